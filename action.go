@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// actionKeyFile holds the key action URLs are signed with inside the data
+// directory. Deleting it invalidates all URLs handed out.
+const actionKeyFile = "action_key"
+
+var errUnknownAction = errors.New("unknown action")
+
+// actionSigner signs action names with a key kept in the data directory,
+// created on first use.
+type actionSigner struct {
+	mutex sync.Mutex
+	key   []byte
+}
+
+// loadKey returns the signing key, creating it if there is none yet.
+func (s *actionSigner) loadKey(dataDir string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.key != nil {
+		return s.key, nil
+	}
+	path := filepath.Join(dataDir, actionKeyFile)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if s.key, err = hex.DecodeString(strings.TrimSpace(string(data))); err != nil {
+			return nil, err
+		}
+		return s.key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := writeFileMode(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	s.key = key
+	return key, nil
+}
+
+func actionMAC(key []byte, name string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)[:16]
+}
+
+// actionToken returns the signed token of the action name for its URL.
+func (p *Proxy) actionToken(name string) (string, error) {
+	key, err := p.actions.loadKey(p.config.dataDir())
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(name)) + "." + enc.EncodeToString(actionMAC(key, name)), nil
+}
+
+// lookupAction verifies a signed token and returns its action.
+func (p *Proxy) lookupAction(token string) (string, ActionConfig, error) {
+	encName, encMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ActionConfig{}, errUnknownAction
+	}
+	enc := base64.RawURLEncoding
+	name, err1 := enc.DecodeString(encName)
+	sum, err2 := enc.DecodeString(encMAC)
+	if err1 != nil || err2 != nil {
+		return "", ActionConfig{}, errUnknownAction
+	}
+	key, err := p.actions.loadKey(p.config.dataDir())
+	if err != nil {
+		return "", ActionConfig{}, err
+	}
+	if !hmac.Equal(sum, actionMAC(key, string(name))) {
+		return "", ActionConfig{}, errUnknownAction
+	}
+	action, ok := p.config.Actions[string(name)]
+	if !ok {
+		return "", ActionConfig{}, errUnknownAction
+	}
+	return string(name), action, nil
+}
+
+// actionInfo is an entry of GET /actions.
+type actionInfo struct {
+	Name   string `json:"name"`
+	Device string `json:"device"`
+	Arg    string `json:"arg"`
+	URL    string `json:"url"`
+}
+
+// registerActions adds GET /action/:token and the admin listing of the
+// action URLs when http_server.allow_get_actions is enabled. The signed
+// URL is the credential, so these commands skip auth.protect_devices.
+func registerActions(router *gin.Engine, proxy *Proxy, auth *authenticator) {
+	if !proxy.config.HTTPServer.AllowGetActions {
+		return
+	}
+	router.GET("/action/:token", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		name, action, err := proxy.lookupAction(c.Param("token"))
+		if errors.Is(err, errUnknownAction) {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		ref := parseNodeKey(proxy.nodeKey(action.Device))
+		source := commandSource{Identity: "action:" + name, Addr: c.ClientIP(), Via: "action"}
+		proxy.scheduled.cancel(ref.key())
+		if err := proxy.sendSwitch(withSource(c.Request.Context(), source), ref, action.Arg); err != nil {
+			gatewayError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"action": name, "device": action.Device, "arg": action.Arg})
+	})
+	router.GET("/actions", auth.require(scopeAdmin), func(c *gin.Context) {
+		list := make([]actionInfo, 0, len(proxy.config.Actions))
+		for name, action := range proxy.config.Actions {
+			token, err := proxy.actionToken(name)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			list = append(list, actionInfo{Name: name, Device: action.Device, Arg: action.Arg, URL: requestBaseURL(c) + "/action/" + token})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		c.JSON(200, list)
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetActions(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "hall"}}
+	config.HTTPServer.AllowGetActions = true
+	config.Actions = map[string]ActionConfig{"hall_on": {Device: "266590/1", Arg: "ON"}}
+	config.Auth.ProtectDevices = true
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	get := func(path string, admin bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if admin {
+			req.Header.Set("Authorization", "Bearer admin-token")
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/actions", true)
+	var list []actionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list) != 1 {
+		t.Fatalf("GET /actions = %d %s", rec.Code, rec.Body)
+	}
+	path := strings.TrimPrefix(list[0].URL, "http://example.com")
+	if !strings.HasPrefix(path, "/action/") {
+		t.Fatalf("action URL = %q", list[0].URL)
+	}
+
+	if rec := get(path, false); rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d, body %s", path, rec.Code, rec.Body)
+	}
+	waitFor(t, time.Second, func() bool { return gw.State("1") == "ON" })
+
+	// A token signed with another key or for another name is rejected.
+	name, _, _ := strings.Cut(strings.TrimPrefix(path, "/action/"), ".")
+	for _, forged := range []string{name + ".AAAAAAAAAAAAAAAAAAAAAA", "aGFsbF9vZmY." + strings.SplitN(path, ".", 2)[1], "garbage"} {
+		if rec := get("/action/"+forged, false); rec.Code != http.StatusNotFound {
+			t.Errorf("forged token %q: status %d, want 404", forged, rec.Code)
+		}
+	}
+
+	// The key survives a restart, so the URLs keep working.
+	again := NewProxy(config)
+	if token, _ := again.actionToken("hall_on"); "/action/"+token != path {
+		t.Errorf("token after restart = %q, want %q", token, path)
+	}
+}
+
+func TestGetActionsDisabled(t *testing.T) {
+	var config Config
+	config.Actions = map[string]ActionConfig{"hall_on": {Device: "1", Arg: "ON"}}
+	proxy := NewProxy(&config)
+	rec := httptest.NewRecorder()
+	newRouter(proxy).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/action/x.y", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /action without allow_get_actions: status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errActuationLimit is returned for commands to a device that reached its
+// max_daily_actuations.
+var errActuationLimit = errors.New("daily actuation limit reached")
+
+// actuationLimitError is errActuationLimit with the time until the counts
+// reset at local midnight.
+type actuationLimitError struct {
+	retryAfter int // seconds
+}
+
+func (e *actuationLimitError) Error() string { return errActuationLimit.Error() }
+func (e *actuationLimitError) Unwrap() error { return errActuationLimit }
+
+// actuationCounter counts the commands to each device per local day.
+type actuationCounter struct {
+	mutex  sync.Mutex
+	day    string         // the date the counts are for
+	counts map[string]int // by node key, refused commands included
+}
+
+// take counts a command to the node key at now and reports whether it is
+// within limit, and whether it is the first one refused today.
+func (a *actuationCounter) take(key string, limit int, now time.Time) (ok, first bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if day := now.Format("2006-01-02"); day != a.day || a.counts == nil {
+		a.day = day
+		a.counts = make(map[string]int)
+	}
+	a.counts[key]++
+	n := a.counts[key]
+	return n <= limit, n == limit+1
+}
+
+// untilMidnight returns the time from now until the counts reset.
+func untilMidnight(now time.Time) time.Duration {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Sub(now)
+}
+
+// checkActuations counts a command to dev and refuses it beyond the
+// device's max_daily_actuations, alerting on the first refusal of the day.
+func (p *Proxy) checkActuations(dev *device, ref nodeRef) error {
+	limit := dev.Config.MaxDailyActuations
+	if limit <= 0 {
+		return nil
+	}
+	now := p.localNow()
+	ok, first := p.actuations.take(ref.key(), limit, now)
+	if ok {
+		return nil
+	}
+	if first {
+		name := dev.EntityID
+		if name == "" {
+			name = "node " + ref.key()
+		}
+		log.Printf("Refusing commands to %s: %d commands today reach max_daily_actuations", name, limit)
+		p.alert(alertActuationLimit, "Konke: "+name+" reached its daily limit",
+			"%s received %d commands today, its max_daily_actuations. Further commands are refused until midnight; check the automations controlling it.", name, limit)
+	}
+	return &actuationLimitError{retryAfter: int(untilMidnight(now).Seconds()) + 1}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActuationCounter(t *testing.T) {
+	var a actuationCounter
+	day := time.Date(2024, 5, 1, 23, 0, 0, 0, time.Local)
+	for i, want := range []struct{ ok, first bool }{{true, false}, {true, false}, {false, true}, {false, false}} {
+		if ok, first := a.take("5", 2, day); ok != want.ok || first != want.first {
+			t.Errorf("command %d: ok, first = %v, %v; want %v, %v", i+1, ok, first, want.ok, want.first)
+		}
+	}
+	if ok, _ := a.take("6", 2, day); !ok {
+		t.Error("another device was limited")
+	}
+	// The counts reset at midnight.
+	if ok, _ := a.take("5", 2, day.Add(2*time.Hour)); !ok {
+		t.Error("command on the next day was refused")
+	}
+	if got := untilMidnight(day); got != time.Hour {
+		t.Errorf("untilMidnight = %s, want 1h", got)
+	}
+}
+
+func TestActuationLimit(t *testing.T) {
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "curtain", MaxDailyActuations: 2}}
+	proxy := startProxy(t, config)
+	sink := &recordingSink{}
+	proxy.sinks = []notificationSink{sink}
+	router := newRouter(proxy)
+
+	command := func(arg string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/curtain/2", strings.NewReader(`{"arg": "`+arg+`"}`)))
+		return rec
+	}
+	for _, arg := range []string{"OPEN", "CLOSE"} {
+		if rec := command(arg); rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", arg, rec.Code)
+		}
+	}
+	rec := command("OPEN")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("command beyond the limit: status %d, Retry-After %q; want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	command("OPEN")
+	waitFor(t, time.Second, func() bool { return len(sink.kinds()) > 0 })
+	time.Sleep(20 * time.Millisecond)
+	if kinds := sink.kinds(); len(kinds) != 1 || kinds[0] != alertActuationLimit {
+		t.Errorf("alerts = %v, want one actuation_limit", kinds)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alerts sent to the notification sinks.
+const (
+	alertGatewayDown     = "gateway_down"
+	alertGatewayUp       = "gateway_up"
+	alertLoginFailed     = "login_failed"
+	alertStuckTransition = "stuck_transition"
+	alertRateAnomaly     = "rate_anomaly"
+	alertActuationLimit  = "actuation_limit"
+	alertHADegraded      = "ha_degraded"
+)
+
+var alertKinds = []string{alertGatewayDown, alertGatewayUp, alertLoginFailed, alertStuckTransition, alertRateAnomaly, alertActuationLimit, alertHADegraded}
+
+// defaultGatewayDownAfter is how long the gateway must stay unreachable
+// before gateway_down is sent, so that short drops go unnoticed.
+const defaultGatewayDownAfter = time.Minute
+
+// alertTimeout bounds the delivery of an alert to one sink.
+const alertTimeout = 30 * time.Second
+
+// telegramAPI is the Telegram Bot API endpoint; tests replace it.
+var telegramAPI = "https://api.telegram.org"
+
+// alert is a notification about the proxy or the gateway.
+type alert struct {
+	Kind    string
+	Title   string
+	Message string
+	Time    time.Time
+}
+
+// notificationSink delivers alerts to a person.
+type notificationSink interface {
+	Name() string
+	Send(ctx context.Context, a alert) error
+}
+
+// gatewayDownAfter returns notifications.gateway_down_after.
+func (c *Config) gatewayDownAfter() time.Duration {
+	if c.Notifications.GatewayDownAfter > 0 {
+		return time.Duration(c.Notifications.GatewayDownAfter) * time.Second
+	}
+	return defaultGatewayDownAfter
+}
+
+// notificationSinks returns the configured sinks.
+func (c *Config) notificationSinks(client *http.Client) []notificationSink {
+	n := &c.Notifications
+	var sinks []notificationSink
+	if n.Telegram.BotToken != "" {
+		sinks = append(sinks, &telegramSink{token: n.Telegram.BotToken, chatID: n.Telegram.ChatID, client: client})
+	}
+	if n.Ntfy.Topic != "" {
+		server := strings.TrimSuffix(n.Ntfy.Server, "/")
+		if server == "" {
+			server = "https://ntfy.sh"
+		}
+		sinks = append(sinks, &ntfySink{server: server, topic: n.Ntfy.Topic, token: n.Ntfy.Token, priority: n.Ntfy.Priority, client: client})
+	}
+	if n.Email.Host != "" {
+		sinks = append(sinks, &emailSink{config: n.Email})
+	}
+	return sinks
+}
+
+// validateNotifications checks the notifications section.
+func (c *Config) validateNotifications(add func(message string, path ...string)) {
+	n := &c.Notifications
+	for i, kind := range n.Alerts {
+		if !contains(alertKinds, kind) {
+			add(fmt.Sprintf("unknown alert %q; use one of %s", kind, strings.Join(alertKinds, ", ")),
+				"notifications", "alerts", strconv.Itoa(i))
+		}
+	}
+	if (n.Telegram.BotToken == "") != (n.Telegram.ChatID == "") {
+		add("telegram needs both bot_token and chat_id", "notifications", "telegram")
+	}
+	if n.Email.Host != "" && (n.Email.From == "" || len(n.Email.To) == 0) {
+		add("email needs from and to", "notifications", "email")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// notifier sends alerts to the configured sinks.
+type notifier struct {
+	mutex    sync.Mutex
+	downAt   time.Time   // when the gateway connection was lost
+	downTime *time.Timer // pending gateway_down alert
+	downSent bool        // gateway_down was sent for the current outage
+}
+
+// alert sends an alert to every sink unless notifications.alerts leaves
+// its kind out. Delivery happens in the background; failures are logged.
+func (p *Proxy) alert(kind, title, format string, args ...interface{}) {
+	if len(p.sinks) == 0 {
+		return
+	}
+	if alerts := p.config.Notifications.Alerts; len(alerts) > 0 && !contains(alerts, kind) {
+		return
+	}
+	p.deliver(alert{Kind: kind, Title: title, Message: fmt.Sprintf(format, args...), Time: time.Now()}, nil)
+}
+
+// deliver sends a to the sinks with the given names, or to all sinks if
+// names is empty.
+func (p *Proxy) deliver(a alert, names []string) {
+	for _, sink := range p.sinks {
+		if len(names) > 0 && !contains(names, sink.Name()) {
+			continue
+		}
+		go func(sink notificationSink) {
+			ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+			defer cancel()
+			if err := sink.Send(ctx, a); err != nil {
+				log.Printf("Failed to send %s alert via %s: %v", a.Kind, sink.Name(), err)
+			}
+		}(sink)
+	}
+}
+
+// gatewayLost schedules the gateway_down alert for a lost connection.
+func (p *Proxy) gatewayLost(cause error) {
+	p.alerts.mutex.Lock()
+	defer p.alerts.mutex.Unlock()
+	if p.alerts.downTime != nil || p.alerts.downSent {
+		return
+	}
+	p.alerts.downAt = p.localNow()
+	p.alerts.downTime = time.AfterFunc(p.config.gatewayDownAfter(), func() {
+		p.alerts.mutex.Lock()
+		p.alerts.downTime = nil
+		p.alerts.downSent = true
+		since := p.alerts.downAt
+		p.alerts.mutex.Unlock()
+		p.alert(alertGatewayDown, "Konke gateway unreachable",
+			"The proxy lost the gateway connection at %s (%v) and has not reconnected.", since.Format("15:04:05"), cause)
+	})
+}
+
+// gatewayRestored cancels a pending gateway_down alert, or sends
+// gateway_up if it went out.
+func (p *Proxy) gatewayRestored() {
+	p.alerts.mutex.Lock()
+	defer p.alerts.mutex.Unlock()
+	if p.alerts.downTime != nil {
+		p.alerts.downTime.Stop()
+		p.alerts.downTime = nil
+	}
+	if p.alerts.downSent {
+		p.alerts.downSent = false
+		p.alert(alertGatewayUp, "Konke gateway reachable again",
+			"The proxy reconnected to the gateway after %s.", time.Since(p.alerts.downAt).Round(time.Second))
+	}
+}
+
+// stopAlerts cancels a pending gateway_down alert when the proxy stops.
+func (p *Proxy) stopAlerts() {
+	p.alerts.mutex.Lock()
+	defer p.alerts.mutex.Unlock()
+	if p.alerts.downTime != nil {
+		p.alerts.downTime.Stop()
+		p.alerts.downTime = nil
+	}
+}
+
+// postJSON posts data as JSON to url and fails on non-2xx answers.
+func postJSON(ctx context.Context, client *http.Client, url string, data interface{}) error {
+	body, _ := json.Marshal(data)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doRequest(client, req)
+}
+
+func doRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// telegramSink sends alerts as messages from a Telegram bot.
+type telegramSink struct {
+	token, chatID string
+	client        *http.Client
+}
+
+func (s *telegramSink) Name() string { return "telegram" }
+
+func (s *telegramSink) Send(ctx context.Context, a alert) error {
+	err := postJSON(ctx, s.client, telegramAPI+"/bot"+s.token+"/sendMessage", map[string]string{
+		"chat_id": s.chatID,
+		"text":    a.Title + "\n" + a.Message,
+	})
+	// The errors of the HTTP client quote the URL, which holds the bot
+	// token.
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s Telegram Bot API: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// ntfySink publishes alerts to an ntfy topic.
+type ntfySink struct {
+	server, topic, token, priority string
+	client                         *http.Client
+}
+
+func (s *ntfySink) Name() string { return "ntfy" }
+
+func (s *ntfySink) Send(ctx context.Context, a alert) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.server+"/"+s.topic, strings.NewReader(a.Message))
+	if err != nil {
+		return err
+	}
+	// Header values must be ASCII; ntfy decodes RFC 2047 encoded words.
+	req.Header.Set("Title", mimeHeader(a.Title))
+	req.Header.Set("Tags", a.Kind)
+	if s.priority != "" {
+		req.Header.Set("Priority", s.priority)
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	return doRequest(s.client, req)
+}
+
+// emailSink mails alerts through an SMTP server.
+type emailSink struct {
+	config EmailConfig
+}
+
+func (s *emailSink) Name() string { return "email" }
+
+func (s *emailSink) Send(ctx context.Context, a alert) error {
+	c := s.config
+	port := c.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if c.Username != "" {
+		auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mimeHeader(a.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", a.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(a.Message + "\r\n")
+
+	// net/smtp has no context support; give up waiting when ctx ends.
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(hostPort(c.Host, port), auth, c.From, c.To, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.New("timed out sending mail")
+	}
+}
+
+// mimeHeader encodes s for a mail or HTTP header if it is not ASCII.
+func mimeHeader(s string) string {
+	return mime.BEncoding.Encode("utf-8", s)
+}
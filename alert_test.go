@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink collects the alerts sent to it.
+type recordingSink struct {
+	mutex  sync.Mutex
+	alerts []alert
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Send(_ context.Context, a alert) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.alerts = append(s.alerts, a)
+	return nil
+}
+
+func (s *recordingSink) kinds() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var kinds []string
+	for _, a := range s.alerts {
+		kinds = append(kinds, a.Kind)
+	}
+	return kinds
+}
+
+func TestAlertSinks(t *testing.T) {
+	var mutex sync.Mutex
+	requests := make(map[string]*http.Request)
+	bodies := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		requests[r.URL.Path], bodies[r.URL.Path] = r, string(body)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+	defer func(api string) { telegramAPI = api }(telegramAPI)
+	telegramAPI = server.URL
+
+	var config Config
+	config.Notifications.Telegram.BotToken = "123:abc"
+	config.Notifications.Telegram.ChatID = "42"
+	config.Notifications.Ntfy.Server = server.URL + "/"
+	config.Notifications.Ntfy.Topic = "konke"
+	config.Notifications.Ntfy.Priority = "high"
+	sinks := config.notificationSinks(server.Client())
+	if len(sinks) != 2 {
+		t.Fatalf("got %d sinks, want telegram and ntfy", len(sinks))
+	}
+
+	a := alert{Kind: alertLoginFailed, Title: "登录失败", Message: "bad password", Time: time.Now()}
+	for _, sink := range sinks {
+		if err := sink.Send(context.Background(), a); err != nil {
+			t.Fatalf("%s: %v", sink.Name(), err)
+		}
+	}
+
+	var telegram map[string]string
+	json.Unmarshal([]byte(bodies["/bot123:abc/sendMessage"]), &telegram)
+	if telegram["chat_id"] != "42" || telegram["text"] != "登录失败\nbad password" {
+		t.Errorf("telegram got %q", bodies["/bot123:abc/sendMessage"])
+	}
+	ntfy := requests["/konke"]
+	if ntfy == nil || bodies["/konke"] != "bad password" || ntfy.Header.Get("Priority") != "high" ||
+		ntfy.Header.Get("Tags") != alertLoginFailed || ntfy.Header.Get("Title") != "=?utf-8?b?55m75b2V5aSx6LSl?=" {
+		t.Errorf("ntfy got %+v with body %q", ntfy, bodies["/konke"])
+	}
+}
+
+func TestTelegramErrorHidesToken(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close() // every request fails to connect
+	defer func(api string) { telegramAPI = api }(telegramAPI)
+	telegramAPI = server.URL
+
+	sink := &telegramSink{token: "123:secret", chatID: "42", client: http.DefaultClient}
+	err := sink.Send(context.Background(), alert{Title: "test"})
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("error %v, want one without the bot token", err)
+	}
+}
+
+func TestAlertFilter(t *testing.T) {
+	proxy := eventProxy()
+	proxy.config.Notifications.Alerts = []string{alertStuckTransition}
+	sink := &recordingSink{}
+	proxy.sinks = []notificationSink{sink}
+
+	proxy.handleMessage(&Message{NodeID: "*", Opcode: "LOGIN", Status: "fail"})
+	dev, _ := proxy.lookupDevice("2")
+	proxy.config.HomeAssistant.Port = 1 // nothing listens there
+	proxy.transitionStuck(&dev, "OPEN")
+
+	waitFor(t, 3*time.Second, func() bool { return len(sink.kinds()) > 0 })
+	time.Sleep(50 * time.Millisecond)
+	if kinds := sink.kinds(); len(kinds) != 1 || kinds[0] != alertStuckTransition {
+		t.Errorf("sent %v, want only %s", kinds, alertStuckTransition)
+	}
+}
+
+func TestGatewayDownAlert(t *testing.T) {
+	proxy := eventProxy()
+	proxy.config.Notifications.GatewayDownAfter = 1
+	sink := &recordingSink{}
+	proxy.sinks = []notificationSink{sink}
+
+	// A connection that comes back in time goes unnoticed.
+	proxy.gatewayLost(errors.New("EOF"))
+	proxy.gatewayRestored()
+
+	proxy.gatewayLost(errors.New("EOF"))
+	proxy.gatewayLost(errors.New("connection refused"))
+	waitFor(t, 3*time.Second, func() bool { return len(sink.kinds()) == 1 })
+	proxy.gatewayRestored()
+	waitFor(t, 3*time.Second, func() bool { return len(sink.kinds()) == 2 })
+
+	if kinds := sink.kinds(); kinds[0] != alertGatewayDown || kinds[1] != alertGatewayUp {
+		t.Errorf("sent %v, want gateway_down and gateway_up", kinds)
+	}
+}
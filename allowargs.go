@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errArgNotAllowed is returned for commands with an argument missing from
+// the allowed_args of the device.
+var errArgNotAllowed = errors.New("argument not allowed")
+
+// allowsArg reports whether the device takes arg as a command. Devices
+// without allowed_args take any.
+func (d DeviceConfig) allowsArg(arg string) bool {
+	if len(d.AllowedArgs) == 0 {
+		return true
+	}
+	for _, allowed := range d.AllowedArgs {
+		if arg == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkArg refuses a command the device does not allow.
+func (p *Proxy) checkArg(dev *device, arg string) error {
+	if dev.Config.allowsArg(arg) {
+		return nil
+	}
+	return fmt.Errorf("%w: %q; %s takes %s", errArgNotAllowed, arg, dev.Ref.key(), strings.Join(dev.Config.AllowedArgs, ", "))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAllowedArgs(t *testing.T) {
+	proxy := eventProxy()
+	proxy.config.Devices.Curtains["2"] = DeviceConfig{Entity: "curtain_two", AllowedArgs: []string{"OPEN", "CLOSE", "STOP"}}
+	proxy.inventory = buildInventory(proxy.config)
+	router := newRouter(proxy)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Refused before the gateway is asked, whether sent now or later.
+	for _, body := range []string{`{"arg":"ON"}`, `{"arg":"ON","delay_ms":1000}`} {
+		rec := post("/curtain/2", body)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "OPEN, CLOSE, STOP") {
+			t.Errorf("POST /curtain/2 %s: %d %s, want 400 listing the allowed arguments", body, rec.Code, rec.Body)
+		}
+	}
+	if rec := post("/curtain/2", `{"arg":"OPEN"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST /curtain/2 OPEN: status %d, want 503 from the disconnected gateway", rec.Code)
+	}
+	if rec := post("/switch/1", `{"arg":"HALF"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST /switch/1 without allowed_args: status %d, want 503", rec.Code)
+	}
+
+	proxy.config.Devices.Curtains["2"] = DeviceConfig{Entity: "curtain_two", AllowedArgs: []string{"OPEN", ""}}
+	found := false
+	for _, err := range proxy.config.validate() {
+		found = found || strings.Join(err.path, ".") == "devices.curtains.2.allowed_args"
+	}
+	if !found {
+		t.Error("empty allowed argument accepted")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults for rate anomaly detection: a node sending more than
+// defaultRateMaxMessages messages within defaultRateWindow is considered
+// to be chattering.
+const (
+	defaultRateMaxMessages = 60
+	defaultRateWindow      = time.Minute
+)
+
+// rateLimit returns the per-node message limit and the window it applies
+// to. A negative rate_anomaly.max_messages disables detection.
+func (c *Config) rateLimit() (int, time.Duration) {
+	max, window := c.RateAnomaly.MaxMessages, defaultRateWindow
+	if max == 0 {
+		max = defaultRateMaxMessages
+	}
+	if c.RateAnomaly.Window > 0 {
+		window = time.Duration(c.RateAnomaly.Window) * time.Second
+	}
+	return max, window
+}
+
+// nodeRate counts the messages of one node in fixed windows.
+type nodeRate struct {
+	windowStart time.Time
+	count       int
+	flagged     bool
+	since       time.Time // when the node was flagged
+	suppressed  int64     // HA updates dropped while flagged
+	anomalies   int64     // times the node was flagged
+}
+
+// rateDetector flags nodes that send messages at an abnormal rate, such as
+// a stuck relay chattering.
+type rateDetector struct {
+	mutex sync.Mutex
+	nodes map[string]*nodeRate
+}
+
+// observe counts one message from the node at key. It reports whether the
+// node became flagged or recovered with this message.
+func (d *rateDetector) observe(key string, now time.Time, max int, window time.Duration) (flagged, recovered bool, count int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.nodes == nil {
+		d.nodes = make(map[string]*nodeRate)
+	}
+	r := d.nodes[key]
+	if r == nil {
+		r = &nodeRate{windowStart: now}
+		d.nodes[key] = r
+	}
+
+	if now.Sub(r.windowStart) >= window {
+		// A node recovers after a window without excess messages.
+		if r.flagged && r.count <= max {
+			r.flagged = false
+			recovered = true
+		}
+		r.windowStart = now
+		r.count = 0
+	}
+	r.count++
+	if !r.flagged && r.count > max {
+		r.flagged = true
+		r.since = now
+		r.anomalies++
+		flagged = true
+	}
+	return flagged, recovered, r.count
+}
+
+// isFlagged reports whether the node at key is currently flagged.
+func (d *rateDetector) isFlagged(key string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	r := d.nodes[key]
+	return r != nil && r.flagged
+}
+
+// countSuppressed records an HA update dropped for the node at key.
+func (d *rateDetector) countSuppressed(key string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if r := d.nodes[key]; r != nil {
+		r.suppressed++
+	}
+}
+
+// rateAnomaly is the JSON representation of a flagged node.
+type rateAnomaly struct {
+	Node       string    `json:"node"`
+	Messages   int       `json:"messages"`
+	Since      time.Time `json:"since"`
+	Suppressed int64     `json:"suppressed_updates"`
+}
+
+// flagged returns the currently flagged nodes, sorted by node key.
+func (d *rateDetector) flagged() []rateAnomaly {
+	d.mutex.Lock()
+	list := []rateAnomaly{}
+	for key, r := range d.nodes {
+		if r.flagged {
+			list = append(list, rateAnomaly{Node: key, Messages: r.count, Since: r.since, Suppressed: r.suppressed})
+		}
+	}
+	d.mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Node < list[j].Node })
+	return list
+}
+
+// writeMetrics writes how often each node was flagged in the Prometheus
+// text format.
+func (d *rateDetector) writeMetrics(w io.Writer) {
+	d.mutex.Lock()
+	counts := make(map[string]int64)
+	for key, r := range d.nodes {
+		if r.anomalies > 0 {
+			counts[key] = r.anomalies
+		}
+	}
+	d.mutex.Unlock()
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(w, "# HELP konke_rate_anomalies_total Times a node was flagged for sending messages at an abnormal rate.")
+	fmt.Fprintln(w, "# TYPE konke_rate_anomalies_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "konke_rate_anomalies_total{node=%q} %d\n", key, counts[key])
+	}
+}
+
+// observeRate feeds a gateway message into the rate detector.
+func (p *Proxy) observeRate(msg *Message) {
+	if msg.NodeID == "" || msg.NodeID == "*" {
+		return
+	}
+	max, window := p.config.rateLimit()
+	if max < 0 {
+		return
+	}
+
+	key := p.messageKey(msg)
+	flagged, recovered, count := p.rates.observe(key, time.Now(), max, window)
+	if flagged {
+		log.Printf("Node %s is sending messages at an abnormal rate (%d within %s)", key, count, window)
+		p.alert(alertRateAnomaly, "Konke: node "+key+" is chattering",
+			"Node %s sent %d messages within %s, which may be a stuck relay.", key, count, window)
+	}
+	if recovered {
+		log.Printf("Node %s message rate is back to normal", key)
+	}
+}
+
+// suppressHA reports whether HA updates for the node at key are dropped
+// because it is flagged, counting the dropped update.
+func (p *Proxy) suppressHA(key string) bool {
+	if !p.config.RateAnomaly.Suppress || !p.rates.isFlagged(key) {
+		return false
+	}
+	p.rates.countSuppressed(key)
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateDetector(t *testing.T) {
+	var d rateDetector
+	start := time.Now()
+
+	for i := 1; i <= 3; i++ {
+		if flagged, _, _ := d.observe("5", start, 3, time.Minute); flagged {
+			t.Fatalf("flagged after %d messages, limit 3", i)
+		}
+	}
+	if flagged, _, count := d.observe("5", start.Add(time.Second), 3, time.Minute); !flagged || count != 4 {
+		t.Fatalf("observe = %v, %d; want flagged after 4 messages", flagged, count)
+	}
+	if !d.isFlagged("5") || d.isFlagged("6") {
+		t.Fatal("wrong nodes flagged")
+	}
+
+	// Still chattering in the next window: stays flagged.
+	for i := 0; i < 5; i++ {
+		d.observe("5", start.Add(time.Minute+time.Second), 3, time.Minute)
+	}
+	if !d.isFlagged("5") {
+		t.Fatal("node recovered while still chattering")
+	}
+
+	// A quiet window clears the flag.
+	d.observe("5", start.Add(2*time.Minute+time.Second), 3, time.Minute)
+	if _, recovered, _ := d.observe("5", start.Add(3*time.Minute+time.Second), 3, time.Minute); !recovered {
+		t.Fatal("node did not recover after a quiet window")
+	}
+	if len(d.flagged()) != 0 {
+		t.Errorf("flagged() = %v, want none", d.flagged())
+	}
+
+	// The metric keeps counting after the node recovered.
+	for i := 0; i < 4; i++ {
+		d.observe("5", start.Add(3*time.Minute+2*time.Second), 3, time.Minute)
+	}
+	var metrics strings.Builder
+	d.writeMetrics(&metrics)
+	if !strings.Contains(metrics.String(), `konke_rate_anomalies_total{node="5"} 2`) || strings.Contains(metrics.String(), `node="6"`) {
+		t.Errorf("metrics = %s, want node 5 flagged twice", metrics.String())
+	}
+}
+
+func TestRateAnomalySuppressesHA(t *testing.T) {
+	var config Config
+	config.RateAnomaly.MaxMessages = 2
+	config.RateAnomaly.Suppress = true
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}}
+	proxy := NewProxy(&config)
+
+	args := []string{"ON", "OFF", "ON"}
+	for _, arg := range args {
+		proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: arg})
+	}
+
+	// The third message trips the detector; its state is still tracked,
+	// but not pushed to HA.
+	if got := proxy.deviceState("1"); got != "ON" {
+		t.Errorf("device state = %q, want ON", got)
+	}
+	proxy.stateMu.RLock()
+	entity := proxy.entity["light_one"]
+	proxy.stateMu.RUnlock()
+	if entity != "off" {
+		t.Errorf("HA state = %q, want the last state before suppression, off", entity)
+	}
+
+	flagged := proxy.rates.flagged()
+	if len(flagged) != 1 || flagged[0].Node != "1" || flagged[0].Suppressed != 1 {
+		t.Errorf("flagged() = %+v, want node 1 with one suppressed update", flagged)
+	}
+}
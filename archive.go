@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Defaults for the message archive.
+const (
+	archiveFile           = "archive.db"
+	defaultArchiveMaxRows = 100000
+	defaultArchiveMaxAge  = 30 * 24 * time.Hour
+	defaultArchiveLimit   = 100
+	maxArchiveLimit       = 1000
+)
+
+// archivePruneInterval is how often old archive rows are deleted.
+var archivePruneInterval = time.Minute
+
+// Message directions in the archive.
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+const archiveSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	time      INTEGER NOT NULL,
+	direction TEXT NOT NULL,
+	zkid      TEXT NOT NULL,
+	node      TEXT NOT NULL,
+	opcode    TEXT NOT NULL,
+	arg       TEXT NOT NULL,
+	status    TEXT NOT NULL,
+	req_id    INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_time ON messages (time);
+CREATE INDEX IF NOT EXISTS messages_opcode ON messages (opcode);
+`
+
+// archiveRecord is one archived message.
+type archiveRecord struct {
+	ID        int64           `json:"id"`
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"direction"`
+	ZKID      string          `json:"zkid,omitempty"`
+	NodeID    string          `json:"node_id"`
+	Opcode    string          `json:"opcode"`
+	Arg       json.RawMessage `json:"arg"`
+	Status    string          `json:"status,omitempty"`
+	ReqID     int64           `json:"req_id,omitempty"`
+}
+
+// archive stores every decoded gateway message in SQLite for protocol
+// research. Messages are written by a background goroutine so that a slow
+// disk never holds up the gateway session; when it falls behind, messages
+// are dropped.
+type archive struct {
+	db      *sql.DB
+	records chan archiveRecord
+	maxRows int
+	maxAge  time.Duration
+	done    chan struct{}
+
+	mutex  sync.RWMutex // guards closed against concurrent record calls
+	closed bool
+}
+
+// openArchive opens the archive database configured in archive.path, by
+// default archive.db in the data directory.
+func openArchive(config *Config) (*archive, error) {
+	path := config.Archive.Path
+	if path == "" {
+		path = filepath.Join(config.dataDir(), archiveFile)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids lock errors.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(archiveSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	a := &archive{
+		db:      db,
+		records: make(chan archiveRecord, 1024),
+		maxRows: config.Archive.MaxRows,
+		maxAge:  time.Duration(config.Archive.MaxAge) * 24 * time.Hour,
+		done:    make(chan struct{}),
+	}
+	if a.maxRows <= 0 {
+		a.maxRows = defaultArchiveMaxRows
+	}
+	if a.maxAge <= 0 {
+		a.maxAge = defaultArchiveMaxAge
+	}
+	go a.run()
+	log.Printf("Archiving gateway messages to %s", path)
+	return a, nil
+}
+
+// record queues msg for archiving.
+func (a *archive) record(direction string, msg *Message) {
+	arg, err := json.Marshal(redactArg(msg.Opcode, msg.Arg))
+	if err != nil {
+		return
+	}
+	rec := archiveRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		ZKID:      msg.ZKID,
+		NodeID:    msg.NodeID,
+		Opcode:    msg.Opcode,
+		Arg:       arg,
+		Status:    msg.Status,
+		ReqID:     msg.ReqID,
+	}
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.records <- rec:
+	default:
+	}
+}
+
+// redactArg hides the gateway password in LOGIN arguments.
+func redactArg(opcode string, arg interface{}) interface{} {
+	if opcode != "LOGIN" {
+		return arg
+	}
+	if m, ok := arg.(map[string]string); ok {
+		redacted := make(map[string]string, len(m))
+		for k, v := range m {
+			redacted[k] = v
+		}
+		redacted["password"] = "***"
+		return redacted
+	}
+	return arg
+}
+
+func (a *archive) run() {
+	defer close(a.done)
+
+	prune := time.NewTicker(archivePruneInterval)
+	defer prune.Stop()
+	for {
+		select {
+		case rec, ok := <-a.records:
+			if !ok {
+				return
+			}
+			_, err := a.db.Exec(`INSERT INTO messages (time, direction, zkid, node, opcode, arg, status, req_id)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				rec.Time.UnixMilli(), rec.Direction, rec.ZKID, rec.NodeID, rec.Opcode, string(rec.Arg), rec.Status, rec.ReqID)
+			if err != nil {
+				log.Printf("Failed to archive message: %v", err)
+			}
+		case <-prune.C:
+			a.prune()
+		}
+	}
+}
+
+// prune enforces the retention limits.
+func (a *archive) prune() {
+	cutoff := time.Now().Add(-a.maxAge).UnixMilli()
+	if _, err := a.db.Exec(`DELETE FROM messages WHERE time < ?`, cutoff); err != nil {
+		log.Printf("Failed to prune archive: %v", err)
+		return
+	}
+	if _, err := a.db.Exec(`DELETE FROM messages WHERE id <= (SELECT MAX(id) FROM messages) - ?`, a.maxRows); err != nil {
+		log.Printf("Failed to prune archive: %v", err)
+	}
+}
+
+// close flushes queued messages and closes the database.
+func (a *archive) close() {
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.records)
+	a.mutex.Unlock()
+
+	<-a.done
+	a.db.Close()
+}
+
+// archiveQuery filters archived messages. Zero fields match everything.
+type archiveQuery struct {
+	Opcode    string
+	NodeID    string
+	ZKID      string
+	Direction string
+	State     string    // argument, ignoring case
+	Nodes     []nodeRef // only these nodes; nil for any node
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	Offset    int
+	Ascending bool // oldest first
+}
+
+// query returns a page of the archived messages matching q, newest first
+// unless q.Ascending is set, and the number of matches.
+func (a *archive) query(q archiveQuery) ([]archiveRecord, int, error) {
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+	if q.Opcode != "" {
+		add("opcode = ?", q.Opcode)
+	}
+	if q.NodeID != "" {
+		add("node = ?", q.NodeID)
+	}
+	if q.ZKID != "" {
+		add("zkid = ?", q.ZKID)
+	}
+	if q.Direction != "" {
+		add("direction = ?", q.Direction)
+	}
+	if q.State != "" {
+		state, _ := json.Marshal(q.State)
+		add("arg = ? COLLATE NOCASE", string(state))
+	}
+	if q.Nodes != nil {
+		nodes := []string{"0"}
+		for _, ref := range q.Nodes {
+			nodes = append(nodes, "(node = ? AND zkid = ?)")
+			args = append(args, ref.NodeID, ref.ZKID)
+		}
+		where = append(where, "("+strings.Join(nodes, " OR ")+")")
+	}
+	if !q.Since.IsZero() {
+		add("time >= ?", q.Since.UnixMilli())
+	}
+	if !q.Until.IsZero() {
+		add("time < ?", q.Until.UnixMilli())
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultArchiveLimit
+	}
+	if q.Limit > maxArchiveLimit {
+		q.Limit = maxArchiveLimit
+	}
+
+	cond := ""
+	if len(where) > 0 {
+		cond = " WHERE " + strings.Join(where, " AND ")
+	}
+	var total int
+	if err := a.db.QueryRow(`SELECT COUNT(*) FROM messages`+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	stmt := `SELECT id, time, direction, zkid, node, opcode, arg, status, req_id FROM messages` + cond
+	if q.Ascending {
+		stmt += " ORDER BY id LIMIT ? OFFSET ?"
+	} else {
+		stmt += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	}
+	args = append(args, q.Limit, q.Offset)
+
+	rows, err := a.db.Query(stmt, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	records := []archiveRecord{}
+	for rows.Next() {
+		var rec archiveRecord
+		var millis int64
+		var arg string
+		if err := rows.Scan(&rec.ID, &millis, &rec.Direction, &rec.ZKID, &rec.NodeID, &rec.Opcode, &arg, &rec.Status, &rec.ReqID); err != nil {
+			return nil, 0, err
+		}
+		rec.Time = time.UnixMilli(millis)
+		rec.Arg = json.RawMessage(arg)
+		records = append(records, rec)
+	}
+	return records, total, rows.Err()
+}
+
+// archiveNodes returns the nodes of the devices that pass filter, for
+// archiveQuery.Nodes. Messages of the primary controller may come with or
+// without its zkid, so its nodes are listed both ways.
+func (p *Proxy) archiveNodes(filter listQuery) []nodeRef {
+	primary := p.config.zkids()[0]
+	nodes := []nodeRef{}
+	for _, d := range p.listDevices() {
+		if !filter.matches(&d) {
+			continue
+		}
+		nodes = append(nodes, nodeRef{ZKID: d.ZKID, NodeID: d.NodeID})
+		if d.ZKID == primary {
+			nodes = append(nodes, nodeRef{NodeID: d.NodeID})
+		}
+	}
+	return nodes
+}
+
+// closeArchive flushes and closes the archive, if open.
+func (p *Proxy) closeArchive() {
+	if p.archive != nil {
+		p.archive.close()
+	}
+}
+
+// archiveMessage records msg if archiving is enabled.
+func (p *Proxy) archiveMessage(direction string, msg *Message) {
+	if p.archive != nil {
+		p.archive.record(direction, msg)
+	}
+}
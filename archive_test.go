@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.Archive.Enabled = true
+	config.Archive.Path = t.TempDir() + "/archive.db"
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}}}
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one", Name: "Hall"}}
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "curtain_two"}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	query := func(path string) []archiveRecord {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, rec.Code)
+		}
+		var records []archiveRecord
+		if err := json.Unmarshal(rec.Body.Bytes(), &records); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return records
+	}
+
+	// The initial state query for node 2 and its reply are archived.
+	waitFor(t, time.Second, func() bool { return len(query("/archive?node=2")) >= 2 })
+
+	logins := query("/archive?opcode=LOGIN&direction=out")
+	if len(logins) != 1 {
+		t.Fatalf("archived %d outgoing LOGIN messages, want 1", len(logins))
+	}
+	var arg map[string]string
+	json.Unmarshal(logins[0].Arg, &arg)
+	if arg["username"] != "admin" || arg["password"] != "***" {
+		t.Errorf("archived LOGIN arg = %v, want the password redacted", arg)
+	}
+
+	if got := query("/archive?limit=1"); len(got) != 1 {
+		t.Errorf("limit=1 returned %d records", len(got))
+	}
+	all := query("/archive")
+	if got := query("/archive?limit=1&offset=1"); len(got) != 1 || got[0].ID != all[1].ID {
+		t.Errorf("offset=1 returned %v, want the second newest record", got)
+	}
+	if got := query("/archive?sort=time"); len(got) != len(all) || got[0].ID != all[len(all)-1].ID {
+		t.Errorf("sort=time did not return the oldest record first")
+	}
+	if got := query("/archive?since=" + time.Now().Add(time.Hour).Format(time.RFC3339)); len(got) != 0 {
+		t.Errorf("future since returned %d records", len(got))
+	}
+
+	// The device filters of the other lists pick the nodes of the
+	// matching devices.
+	if err := proxy.sendMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON", Requester: "HJ_Server"}); err != nil {
+		t.Fatalf("sendMessage: %v", err)
+	}
+	waitFor(t, time.Second, func() bool { return len(query("/archive?state=on")) >= 2 })
+	for path, node := range map[string]string{"/archive?type=curtain": "2", "/archive?q=hall": "1", "/archive?state=on&direction=out": "1"} {
+		got := query(path)
+		if len(got) == 0 {
+			t.Errorf("GET %s returned nothing", path)
+		}
+		for _, r := range got {
+			if r.NodeID != node {
+				t.Errorf("GET %s returned a record of node %q, want only node %s", path, r.NodeID, node)
+				break
+			}
+		}
+	}
+	if got := query("/archive?q=nothing"); len(got) != 0 {
+		t.Errorf("search without matching devices returned %d records", len(got))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/archive", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /archive without token: status %d, want 401", rec.Code)
+	}
+}
+
+func TestArchivePrune(t *testing.T) {
+	var config Config
+	config.Archive.Path = t.TempDir() + "/archive.db"
+	config.Archive.MaxRows = 3
+	a, err := openArchive(&config)
+	if err != nil {
+		t.Fatalf("openArchive: %v", err)
+	}
+	defer a.close()
+
+	for i := 0; i < 5; i++ {
+		a.record(directionIn, &Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	}
+	waitFor(t, time.Second, func() bool {
+		records, _, _ := a.query(archiveQuery{})
+		return len(records) == 5
+	})
+
+	a.prune()
+	records, _, err := a.query(archiveQuery{})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if len(records) != 3 || records[0].ID != 5 {
+		t.Errorf("after pruning: %d records, newest %d; want the 3 newest", len(records), records[0].ID)
+	}
+}
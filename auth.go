@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Token scopes. Admin endpoints act on the gateway itself (firmware,
+// reboot) rather than on individual devices. The devices scope grants
+// access to all device endpoints when auth.protect_devices is set.
+const (
+	scopeAdmin   = "admin"
+	scopeDevices = "devices"
+)
+
+// identityKey is the gin context key holding the authenticated token name.
+const identityKey = "auth.identity"
+
+// authToken is an API token from the auth section of the configuration.
+type authToken struct {
+	Name   string   `yaml:"name"`
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes"`
+	// Tenant limits the token to the devices of a tenant, which it may
+	// read and control without further scopes.
+	Tenant string `yaml:"tenant"`
+}
+
+func (t *authToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator checks bearer tokens against the configured tokens and
+// the guest tokens.
+type authenticator struct {
+	tokens   []authToken
+	guests   *guestTokens
+	protect  bool              // device endpoints require a token
+	primary  string            // zkid of the primary controller
+	tenanted bool              // read endpoints require a token
+	tenants  map[string]string // tenant by node key
+}
+
+func newAuthenticator(config *Config, guests *guestTokens) *authenticator {
+	return &authenticator{
+		tokens:   config.Auth.Tokens,
+		guests:   guests,
+		protect:  config.Auth.ProtectDevices,
+		primary:  config.zkids()[0],
+		tenanted: config.tenantsEnabled(),
+		tenants:  config.deviceTenants(),
+	}
+}
+
+// lookup returns the token matching secret, comparing in constant time.
+func (a *authenticator) lookup(secret string) *authToken {
+	var found *authToken
+	for i := range a.tokens {
+		t := &a.tokens[i]
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(secret)) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+// require returns middleware that only lets through requests carrying a
+// bearer token with the given scope.
+func (a *authenticator) require(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret, ok := bearerToken(c)
+		if !ok {
+			return
+		}
+
+		token := a.lookup(secret)
+		if token == nil {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Invalid token"})
+			return
+		}
+		if !token.hasScope(scope) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "Token lacks the " + scope + " scope"})
+			return
+		}
+
+		c.Set(identityKey, token.Name)
+		c.Next()
+	}
+}
+
+// bearerToken returns the request's bearer token, answering 401 if there
+// is none.
+func bearerToken(c *gin.Context) (string, bool) {
+	secret, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || secret == "" {
+		c.AbortWithStatusJSON(401, gin.H{"error": "Missing bearer token"})
+		return "", false
+	}
+	return secret, true
+}
+
+// requireDevice returns middleware for the device endpoints. With
+// auth.protect_devices set, it only lets through tokens with the admin or
+// devices scope and guest tokens for the addressed device.
+func (a *authenticator) requireDevice(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.protect {
+			c.Next()
+			return
+		}
+		secret, ok := bearerToken(c)
+		if !ok {
+			return
+		}
+
+		identity, status, message := a.deviceAccess(secret, func(has func(key string) bool) bool {
+			// Guest and tenant tokens are limited to endpoints addressing
+			// one device.
+			ref, ok := proxy.resolveNode(c.Param("zkid"), c.Param("id"))
+			return c.Param("id") != "" && (!ok || has(ref.key()))
+		})
+		if status != 0 {
+			c.AbortWithStatusJSON(status, gin.H{"error": message})
+			return
+		}
+		c.Set(identityKey, identity)
+		c.Next()
+	}
+}
+
+// deviceAccess checks a token for access to devices. For guest and tenant
+// tokens, which are limited to some devices, allowed decides given a
+// function telling whether the token has the device with a node key. It
+// returns the token's identity, or the status and message to refuse it
+// with.
+func (a *authenticator) deviceAccess(secret string, allowed func(has func(key string) bool) bool) (identity string, status int, message string) {
+	if token := a.lookup(secret); token != nil {
+		if token.Tenant != "" {
+			if !allowed(func(key string) bool { return a.tenants[key] == token.Tenant }) {
+				return "", 403, "Token does not grant access to this device"
+			}
+			return token.Name, 0, ""
+		}
+		if !token.hasScope(scopeAdmin) && !token.hasScope(scopeDevices) {
+			return "", 403, "Token lacks the " + scopeDevices + " scope"
+		}
+		return token.Name, 0, ""
+	}
+	guest, ok := a.guests.lookup(secret)
+	if !ok {
+		return "", 401, "Invalid token"
+	}
+	if !allowed(func(key string) bool { return guest.allows(key, a.primary) }) {
+		return "", 403, "Token does not grant access to this device"
+	}
+	return "guest:" + guest.Name, 0, ""
+}
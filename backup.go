@@ -0,0 +1,264 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Directories inside a backup archive.
+const (
+	backupConfigDir = "config"
+	backupDataDir   = "data"
+)
+
+// maxBackupFile bounds the size of a single file accepted on restore.
+const maxBackupFile = 64 << 20
+
+// backupManifest describes a backup archive.
+type backupManifest struct {
+	Created time.Time `json:"created"`
+	Profile string    `json:"profile,omitempty"`
+	// ConfigDir is set when the configuration is a conf.d directory.
+	ConfigDir bool `json:"config_dir,omitempty"`
+}
+
+// backupFiles returns the files to back up, keyed by their name in the
+// archive: the configuration and everything in the data directory except
+// the message archive, which can be large and is not needed to run.
+func (p *Proxy) backupFiles() (map[string]string, bool, error) {
+	files := make(map[string]string)
+
+	var dir bool
+	if p.configPath != "" {
+		configFiles, isDir, err := configFiles(p.configPath)
+		if err != nil {
+			return nil, false, err
+		}
+		dir = isDir
+		for _, file := range configFiles {
+			files[path.Join(backupConfigDir, filepath.Base(file))] = file
+		}
+	}
+
+	entries, err := ioutil.ReadDir(p.config.dataDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || strings.HasPrefix(entry.Name(), archiveFile) || isCrashDump(entry.Name()) || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		files[path.Join(backupDataDir, entry.Name())] = filepath.Join(p.config.dataDir(), entry.Name())
+	}
+	return files, dir, nil
+}
+
+// writeBackup writes a gzipped tarball of the proxy's configuration and
+// persisted state to w.
+func (p *Proxy) writeBackup(w io.Writer) error {
+	files, dir, err := p.backupFiles()
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	manifest, _ := json.MarshalIndent(backupManifest{Created: now, Profile: p.config.Profile, ConfigDir: dir}, "", "  ")
+	if err := writeTarFile(tw, "manifest.json", manifest, now); err != nil {
+		return err
+	}
+	for name, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, name, data, now); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// errInvalidBackup is returned for archives that are not proxy backups.
+var errInvalidBackup = errors.New("invalid backup archive")
+
+// readBackup reads a backup archive written by writeBackup. Only flat
+// files below config/ and data/ are accepted.
+func readBackup(r io.Reader) (backupManifest, map[string][]byte, error) {
+	var manifest backupManifest
+	files := make(map[string][]byte)
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return manifest, nil, fmt.Errorf("%w: %v", errInvalidBackup, err)
+	}
+	tr := tar.NewReader(gz)
+	sawManifest := false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, fmt.Errorf("%w: %v", errInvalidBackup, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(tr, maxBackupFile+1))
+		if err != nil {
+			return manifest, nil, fmt.Errorf("%w: %v", errInvalidBackup, err)
+		}
+		if len(data) > maxBackupFile {
+			return manifest, nil, fmt.Errorf("%w: %s is too large", errInvalidBackup, header.Name)
+		}
+
+		if header.Name == "manifest.json" {
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return manifest, nil, fmt.Errorf("%w: %v", errInvalidBackup, err)
+			}
+			sawManifest = true
+			continue
+		}
+		dir, name := path.Split(header.Name)
+		if (dir != backupConfigDir+"/" && dir != backupDataDir+"/") || name == "" || name == "." || name == ".." {
+			return manifest, nil, fmt.Errorf("%w: unexpected entry %s", errInvalidBackup, header.Name)
+		}
+		files[header.Name] = data
+	}
+	if !sawManifest {
+		return manifest, nil, fmt.Errorf("%w: missing manifest.json", errInvalidBackup)
+	}
+	return manifest, files, nil
+}
+
+// restoreBackup replaces the configuration and persisted state with the
+// contents of a backup. Configuration files are validated before anything
+// is written. Calibrations take effect at once; the configuration is
+// picked up on the next start.
+func (p *Proxy) restoreBackup(r io.Reader) ([]configError, error) {
+	manifest, files, err := readBackup(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []configError
+	for name, data := range files {
+		if strings.HasPrefix(name, backupConfigDir+"/") {
+			for _, e := range validateConfig(data) {
+				e.File = name
+				errs = append(errs, e)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs, nil
+	}
+	if data, ok := files[path.Join(backupDataDir, dataVersionFile)]; ok {
+		var stored struct {
+			Version int `json:"version"`
+		}
+		if json.Unmarshal(data, &stored) == nil && stored.Version > dataVersion() {
+			return nil, fmt.Errorf("%w: written by a newer version (data version %d)", errInvalidBackup, stored.Version)
+		}
+	}
+
+	// The state in memory is older than the backup from now on and must
+	// not overwrite it on shutdown.
+	p.restored.Store(true)
+	p.guests.freeze()
+	for name, data := range files {
+		var target string
+		switch {
+		case strings.HasPrefix(name, backupConfigDir+"/"):
+			if p.configPath == "" {
+				continue
+			}
+			if manifest.ConfigDir {
+				if err := os.MkdirAll(p.configPath, 0755); err != nil {
+					return nil, err
+				}
+				target = filepath.Join(p.configPath, path.Base(name))
+			} else {
+				target = p.configPath
+			}
+		default:
+			target = filepath.Join(p.config.dataDir(), path.Base(name))
+		}
+		if err := writeFileMode(target, data, restoreMode(target)); err != nil {
+			return nil, err
+		}
+	}
+	// A backup from an older version is brought up to date before the
+	// running proxy writes to the directory again.
+	if _, ok := files[path.Join(backupDataDir, dataVersionFile)]; !ok {
+		os.Remove(filepath.Join(p.config.dataDir(), dataVersionFile))
+	}
+	if err := migrateData(p.config.dataDir()); err != nil {
+		return nil, err
+	}
+	return nil, p.loadCalibration()
+}
+
+// secretDataFiles are the files in the data directory nobody but the
+// proxy may read.
+var secretDataFiles = map[string]bool{actionKeyFile: true, guestFile: true}
+
+// restoreMode returns the mode a restored file is written with: 0600 for
+// secrets, otherwise that of the file it replaces.
+func restoreMode(target string) os.FileMode {
+	if secretDataFiles[filepath.Base(target)] {
+		return 0600
+	}
+	if info, err := os.Stat(target); err == nil {
+		return info.Mode().Perm()
+	}
+	return 0644
+}
+
+// writeFileAtomic replaces a file by writing a temporary file next to it
+// and renaming it into place.
+func writeFileAtomic(file string, data []byte) error {
+	return writeFileMode(file, data, 0644)
+}
+
+// writeFileMode is writeFileAtomic for a file with the given mode.
+func writeFileMode(file string, data []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	// A leftover temporary file keeps the mode it was created with.
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
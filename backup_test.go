@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.DataDir = t.TempDir()
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}}}
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	original := []byte("gateway:\n  host: 127.0.0.1\n")
+	if err := ioutil.WriteFile(configPath, original, 0640); err != nil {
+		t.Fatal(err)
+	}
+	calibration := []byte(`{"1":{"open":10,"close":12}}`)
+	if err := ioutil.WriteFile(filepath.Join(config.DataDir, calibrationFile), calibration, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(config.DataDir, archiveFile), []byte("not backed up"), 0644)
+
+	proxy := startProxy(t, config)
+	proxy.configPath = configPath
+	router := newRouter(proxy)
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	if err := proxy.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := proxy.guests.mint("before", []string{"1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/backup", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /backup: status %d", rec.Code)
+	}
+	backup := rec.Body.Bytes()
+	_, files, err := readBackup(bytes.NewReader(backup))
+	if err != nil {
+		t.Fatalf("reading backup: %v", err)
+	}
+	if !bytes.Equal(files["config/config.yaml"], original) {
+		t.Errorf("backup config = %q, want %q", files["config/config.yaml"], original)
+	}
+	if !bytes.Equal(files["data/"+calibrationFile], calibration) {
+		t.Errorf("backup calibration = %q, want %q", files["data/"+calibrationFile], calibration)
+	}
+	if _, ok := files["data/"+archiveFile]; ok {
+		t.Error("backup contains the message archive")
+	}
+
+	// Change everything, then restore.
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "OFF"})
+	proxy.guests.mint("after", []string{"1"}, time.Hour)
+	ioutil.WriteFile(configPath, []byte("gateway:\n  host: 10.0.0.1\n"), 0644)
+	os.Remove(filepath.Join(config.DataDir, calibrationFile))
+	proxy.loadCalibration()
+
+	rec = do(http.MethodPost, "/restore", backup)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /restore: status %d: %s", rec.Code, rec.Body)
+	}
+	if got, _ := ioutil.ReadFile(configPath); !bytes.Equal(got, original) {
+		t.Errorf("restored config = %q, want %q", got, original)
+	}
+	for file, want := range map[string]os.FileMode{configPath: 0640, filepath.Join(config.DataDir, guestFile): 0600} {
+		if info, err := os.Stat(file); err != nil {
+			t.Error(err)
+		} else if info.Mode().Perm() != want {
+			t.Errorf("restored %s mode = %v, want %v", filepath.Base(file), info.Mode().Perm(), want)
+		}
+	}
+	proxy.coverMu.Lock()
+	times := proxy.calibration["1"]
+	proxy.coverMu.Unlock()
+	if times.Open != 10 || times.Close != 12 {
+		t.Errorf("restored calibration = %+v, want open 10 close 12", times)
+	}
+
+	// What the proxy saves until the restart would undo the restore.
+	proxy.guests.mint("restored", []string{"1"}, time.Hour)
+	proxy.setMode("")
+	if err := proxy.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{stateFile, guestFile} {
+		if got, _ := ioutil.ReadFile(filepath.Join(config.DataDir, name)); !bytes.Equal(got, files["data/"+name]) {
+			t.Errorf("%s after the restore = %s, want the backup's %s", name, got, files["data/"+name])
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.DataDir, modeFile)); !os.IsNotExist(err) {
+		t.Errorf("mode stored after the restore: %v", err)
+	}
+}
+
+func TestRestoreRejectsInvalidBackups(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.DataDir = t.TempDir()
+	proxy := startProxy(t, config)
+	proxy.configPath = filepath.Join(t.TempDir(), "config.yaml")
+
+	build := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for name, data := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+			tw.Write([]byte(data))
+		}
+		tw.Close()
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	for name, test := range map[string]struct {
+		files   map[string]string
+		invalid bool // whether the archive itself is rejected
+	}{
+		"traversal":      {files: map[string]string{"manifest.json": "{}", "data/../../etc/passwd": "x"}, invalid: true},
+		"nested":         {files: map[string]string{"manifest.json": "{}", "data/sub/file": "x"}, invalid: true},
+		"no manifest":    {files: map[string]string{"data/calibration.json": "{}"}, invalid: true},
+		"newer data":     {files: map[string]string{"manifest.json": "{}", "data/" + dataVersionFile: `{"version":99}`}, invalid: true},
+		"invalid config": {files: map[string]string{"manifest.json": "{}", "config/config.yaml": "gateway:\n  hots: x\n"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			errs, err := proxy.restoreBackup(bytes.NewReader(build(test.files)))
+			if test.invalid {
+				if !errors.Is(err, errInvalidBackup) {
+					t.Errorf("err = %v, want %v", err, errInvalidBackup)
+				}
+				return
+			}
+			if err != nil || len(errs) == 0 {
+				t.Errorf("errs = %v, err = %v, want configuration errors", errs, err)
+			}
+			if _, err := os.Stat(proxy.configPath); !os.IsNotExist(err) {
+				t.Error("invalid configuration was written")
+			}
+		})
+	}
+
+	if _, err := proxy.restoreBackup(strings.NewReader("not a tarball")); err == nil {
+		t.Error("restoring garbage succeeded")
+	}
+}
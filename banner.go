@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// gatewayTarget describes where the proxy connects to, without secrets.
+func (c *Config) gatewayTarget() string {
+	switch c.Gateway.Transport {
+	case "serial":
+		return fmt.Sprintf("serial %s at %d baud", c.Gateway.Serial.Port, c.Gateway.Serial.Baud)
+	case "websocket":
+		if u, err := url.Parse(c.Gateway.WebSocket.URL); err == nil {
+			return "websocket " + u.Redacted()
+		}
+		return "websocket (invalid url)"
+	default:
+		summary := "tcp " + hostPort(c.Gateway.Host, c.Gateway.Port)
+		if n := len(c.Gateway.FallbackHosts); n > 0 {
+			summary += fmt.Sprintf(" (+%d fallback)", n)
+		}
+		return summary
+	}
+}
+
+// subsystems lists the optional features the configuration enables.
+func (c *Config) subsystems() []string {
+	var enabled []string
+	add := func(on bool, name string) {
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+	add(c.HTTPServer.GraphQL, "graphql")
+	add(c.mdnsEnabled(), "mdns")
+	add(c.timeSyncEnabled(), "time_sync")
+	add(c.Archive.Enabled, "archive")
+	add(len(c.Auth.Tokens) > 0, "auth")
+	add(len(c.Modes) > 0, "modes")
+	add(len(c.Extensions) > 0, "extensions")
+	add(len(c.notificationSinks(nil)) > 0, "notifications")
+	add(len(c.Alerts) > 0, "alert_rules")
+	return enabled
+}
+
+// configSummary returns the startup summary of the configuration, one
+// "key: value" line each.
+func (c *Config) configSummary() []string {
+	profile := c.Profile
+	if profile == "" {
+		profile = "(default)"
+	}
+	subsystems := strings.Join(c.subsystems(), ", ")
+	if subsystems == "" {
+		subsystems = "none"
+	}
+	curtains := c.HomeAssistant.CurtainDomain
+	if curtains == "" {
+		curtains = "switch"
+	}
+	return []string{
+		"version: " + currentBuild().String(),
+		"profile: " + profile,
+		"gateway: " + c.gatewayTarget(),
+		"zkids: " + strings.Join(c.zkids(), ", "),
+		fmt.Sprintf("devices: %d lights, %d curtains (as %s entities)", len(c.Devices.Lights), len(c.Devices.Curtains), curtains),
+		"home assistant: " + hostPort(c.HomeAssistant.Host, c.HomeAssistant.Port),
+		"http api: " + hostPort(c.HTTPServer.Host, c.HTTPServer.Port),
+		"data dir: " + c.dataDir(),
+		"subsystems: " + subsystems,
+	}
+}
+
+// configWarnings returns settings that are valid but most likely
+// mistakes.
+func (c *Config) configWarnings() []string {
+	var warnings []string
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	if c.Gateway.HeartbeatInterval <= 0 {
+		warn("gateway.heartbeat_interval is %d: no heartbeats are sent and the gateway may drop the session", c.Gateway.HeartbeatInterval)
+	}
+	if len(c.Devices.Lights) == 0 && len(c.Devices.Curtains) == 0 {
+		warn("no devices are mapped: nothing will be reported to Home Assistant")
+	}
+	if c.Gateway.DeviceCount <= 0 && c.Gateway.StartupQuery.strategy() == queryRange {
+		warn("gateway.device_count is %d: device states are not queried at startup", c.Gateway.DeviceCount)
+	}
+	if c.Gateway.Username == "" || c.Gateway.Password == "" {
+		warn("gateway.username or gateway.password is empty: the gateway will likely reject the login")
+	}
+	if c.HomeAssistant.Token == "" {
+		warn("home_assistant.token is empty: state updates will be rejected")
+	}
+	if c.HomeAssistant.Host == "" {
+		warn("home_assistant.host is empty: state updates go to localhost")
+	}
+
+	// The same entity mapped twice makes the two devices overwrite each
+	// other's state.
+	entities := make(map[string][]string)
+	for kind, mapping := range map[string]map[string]DeviceConfig{"lights": c.Devices.Lights, "curtains": c.Devices.Curtains} {
+		for key, dc := range mapping {
+			if dc.Entity != "" {
+				entities[dc.Entity] = append(entities[dc.Entity], kind+"."+key)
+			}
+		}
+	}
+	var duplicates []string
+	for entity, keys := range entities {
+		if len(keys) > 1 {
+			sort.Strings(keys)
+			duplicates = append(duplicates, fmt.Sprintf("entity %s is mapped by %s", entity, strings.Join(keys, " and ")))
+		}
+	}
+	sort.Strings(duplicates)
+	warnings = append(warnings, duplicates...)
+	return warnings
+}
+
+// logStartupSummary logs the configuration summary and its warnings.
+func logStartupSummary(c *Config) {
+	log.Println("Starting konke-ha-proxy")
+	for _, line := range c.configSummary() {
+		log.Println("  " + line)
+	}
+	for _, warning := range c.configWarnings() {
+		log.Println("Warning: " + warning)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func BenchmarkEncodeFrame(b *testing.B) {
+	msg := &Message{
+		NodeID:    "12",
+		Opcode:    "SWITCH",
+		Arg:       "ON",
+		Requester: "HJ_Server",
+		ReqID:     time.Now().Unix(),
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := encodeFrame(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseMessages(b *testing.B) {
+	var buffer strings.Builder
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(&buffer, `!{"nodeid":"%d","opcode":"SWITCH","arg":"ON","requester":"HJ_Server"}$`, i)
+	}
+	data := buffer.String()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if msgs := parseMessages(data); len(msgs) != 10 {
+			b.Fatalf("parsed %d messages, want 10", len(msgs))
+		}
+	}
+}
+
+func BenchmarkHandleSwitch(b *testing.B) {
+	var config Config
+	p := NewProxy(&config)
+	msgs := []*Message{
+		{NodeID: "1", Opcode: "SWITCH", Arg: "ON"},
+		{NodeID: "1", Opcode: "SWITCH", Arg: "OFF"},
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.handleMessage(msgs[i%len(msgs)])
+	}
+}
+
+// BenchmarkSwitchRoundTrip drives POST /switch/:id through the router and
+// the gateway connection against a fake gateway with simulated devices.
+func BenchmarkSwitchRoundTrip(b *testing.B) {
+	for _, devices := range []int{10, 100} {
+		b.Run(fmt.Sprintf("devices=%d", devices), func(b *testing.B) {
+			gw := startFakeGateway(b, devices, nil)
+			proxy := startProxy(b, testConfig(b, gw, devices))
+			router := newRouter(proxy)
+
+			var next int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := atomic.AddInt64(&next, 1)
+					id := strconv.FormatInt(n%int64(devices)+1, 10)
+					body := `{"arg":"ON"}`
+					if n%2 == 0 {
+						body = `{"arg":"OFF"}`
+					}
+
+					req := httptest.NewRequest(http.MethodPost, "/switch/"+id, strings.NewReader(body))
+					req.Header.Set("Content-Type", "application/json")
+					rec := httptest.NewRecorder()
+					router.ServeHTTP(rec, req)
+					if rec.Code != http.StatusOK {
+						b.Fatalf("status %d", rec.Code)
+					}
+				}
+			})
+			b.StopTimer()
+
+			waitFor(b, 5*time.Second, func() bool {
+				return gw.Frames() >= int64(b.N)
+			})
+		})
+	}
+}
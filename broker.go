@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// subscriberBuffer is how many messages a subscriber may fall behind
+// before it starts losing them.
+const subscriberBuffer = 256
+
+// messageBroker fans the messages read from the gateway out to the
+// features consuming them, so that none of them reads the connection
+// itself. Commands all go the other way through sendMessage. Every
+// subscriber has its own buffer: one that falls behind loses messages,
+// which are counted, instead of stalling the connection for the others.
+type messageBroker struct {
+	mutex sync.RWMutex
+	subs  []*subscription
+}
+
+// subscription receives the gateway messages with its opcodes, or all
+// messages if it has none, on C.
+type subscription struct {
+	name    string
+	opcodes map[string]bool
+	C       chan *Message
+	dropped atomic.Int64
+}
+
+// wants reports whether the subscription receives msg.
+func (s *subscription) wants(msg *Message) bool {
+	return s.opcodes == nil || s.opcodes[msg.Opcode]
+}
+
+// subscribe registers a subscriber for the given opcodes. Subscribing to
+// opcodes claims them: their messages are not reported as unhandled.
+func (b *messageBroker) subscribe(name string, opcodes ...string) *subscription {
+	s := &subscription{name: name, C: make(chan *Message, subscriberBuffer)}
+	if len(opcodes) > 0 {
+		s.opcodes = make(map[string]bool)
+		for _, opcode := range opcodes {
+			s.opcodes[opcode] = true
+		}
+	}
+	b.mutex.Lock()
+	b.subs = append(b.subs, s)
+	b.mutex.Unlock()
+	return s
+}
+
+// unsubscribe removes s and closes its channel.
+func (b *messageBroker) unsubscribe(s *subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			close(s.C)
+			return
+		}
+	}
+}
+
+// claims reports whether a subscriber claimed opcode.
+func (b *messageBroker) claims(opcode string) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, s := range b.subs {
+		if s.opcodes[opcode] {
+			return true
+		}
+	}
+	return false
+}
+
+// publish hands msg to its subscribers without waiting for them and
+// reports whether one of them claimed its opcode.
+func (b *messageBroker) publish(msg *Message) (claimed bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, s := range b.subs {
+		if !s.wants(msg) {
+			continue
+		}
+		claimed = claimed || s.opcodes != nil
+		select {
+		case s.C <- msg:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	return claimed
+}
+
+// writeMetrics writes the messages each subscriber lost in the Prometheus
+// text format.
+func (b *messageBroker) writeMetrics(w io.Writer) {
+	b.mutex.RLock()
+	dropped := make(map[string]int64)
+	for _, s := range b.subs {
+		dropped[s.name] += s.dropped.Load()
+	}
+	b.mutex.RUnlock()
+
+	names := make([]string, 0, len(dropped))
+	for name := range dropped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP konke_broker_dropped_total Gateway messages lost by subscribers that fell behind.")
+	fmt.Fprintln(w, "# TYPE konke_broker_dropped_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "konke_broker_dropped_total{subscriber=%q} %d\n", name, dropped[name])
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBroker(t *testing.T) {
+	var b messageBroker
+	all := b.subscribe("all")
+	ir := b.subscribe("ir", "IR_REPORT")
+
+	if b.publish(&Message{Opcode: "SWITCH"}) {
+		t.Error("SWITCH is claimed by a subscriber without opcodes")
+	}
+	if !b.publish(&Message{Opcode: "IR_REPORT"}) {
+		t.Error("IR_REPORT is not claimed")
+	}
+	if !b.claims("IR_REPORT") || b.claims("SWITCH") {
+		t.Error("claims does not match the subscribed opcodes")
+	}
+
+	if len(all.C) != 2 {
+		t.Errorf("subscriber to all messages got %d, want 2", len(all.C))
+	}
+	if msg := <-ir.C; msg.Opcode != "IR_REPORT" || len(ir.C) != 0 {
+		t.Errorf("IR subscriber got %s and %d more", msg.Opcode, len(ir.C))
+	}
+
+	b.unsubscribe(ir)
+	if _, open := <-ir.C; open {
+		t.Error("channel of removed subscriber is still open")
+	}
+	if b.publish(&Message{Opcode: "IR_REPORT"}) {
+		t.Error("IR_REPORT is claimed after unsubscribing")
+	}
+}
+
+func TestBrokerDropsForSlowSubscriber(t *testing.T) {
+	var b messageBroker
+	slow := b.subscribe("slow")
+	for i := 0; i < subscriberBuffer+5; i++ {
+		b.publish(&Message{Opcode: "SWITCH"})
+	}
+	if len(slow.C) != subscriberBuffer || slow.dropped.Load() != 5 {
+		t.Fatalf("queued %d and dropped %d, want %d and 5", len(slow.C), slow.dropped.Load(), subscriberBuffer)
+	}
+
+	var buf bytes.Buffer
+	b.writeMetrics(&buf)
+	if !strings.Contains(buf.String(), `konke_broker_dropped_total{subscriber="slow"} 5`) {
+		t.Errorf("metrics lack the dropped count:\n%s", buf.String())
+	}
+}
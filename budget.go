@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults of home_assistant.error_budget.
+	defaultDeliveryTarget  = 99.0 // percent of updates delivered
+	defaultDeliveryWindow  = 5 * time.Minute
+	defaultDeliveryRetries = 3
+
+	// deliveryMinUpdates is how many updates a window needs before its
+	// success rate is judged, so that one failure after a quiet spell
+	// does not degrade the bridge.
+	deliveryMinUpdates = 10
+	// deliveryBucket is the resolution of the rolling windows and
+	// deliveryHistory the longest of them.
+	deliveryBucket  = 10 * time.Second
+	deliveryHistory = time.Hour
+)
+
+// haRetryDelay is the wait before the first retry of a failed update
+// while degraded; it doubles with every further retry.
+var haRetryDelay = 2 * time.Second
+
+// ErrorBudgetConfig sets the share of Home Assistant state updates that
+// must be delivered.
+type ErrorBudgetConfig struct {
+	// Target is the share of updates in percent that must be delivered
+	// within Window seconds. Below it the bridge is degraded and failed
+	// updates are retried up to Retries times.
+	Target  float64 `yaml:"target"`
+	Window  int     `yaml:"window"`
+	Retries int     `yaml:"retries"`
+}
+
+func (b ErrorBudgetConfig) target() float64 {
+	if b.Target > 0 {
+		return b.Target
+	}
+	return defaultDeliveryTarget
+}
+
+func (b ErrorBudgetConfig) window() time.Duration {
+	if b.Window > 0 {
+		return time.Duration(b.Window) * time.Second
+	}
+	return defaultDeliveryWindow
+}
+
+func (b ErrorBudgetConfig) retries() int {
+	if b.Retries > 0 {
+		return b.Retries
+	}
+	return defaultDeliveryRetries
+}
+
+// validateErrorBudget checks home_assistant.error_budget.
+func (c *Config) validateErrorBudget(add func(message string, path ...string)) {
+	b := c.HomeAssistant.ErrorBudget
+	at := []string{"home_assistant", "error_budget"}
+	if b.Target < 0 || b.Target > 100 {
+		add("target must be a percentage between 0 and 100", append(at, "target")...)
+	}
+	if b.Window < 0 || time.Duration(b.Window)*time.Second > deliveryHistory {
+		add(fmt.Sprintf("window must be between 0 and %d seconds", int(deliveryHistory.Seconds())), append(at, "window")...)
+	}
+	if b.Retries < 0 {
+		add("retries must not be negative", append(at, "retries")...)
+	}
+}
+
+// deliveryCount counts the updates of one bucket.
+type deliveryCount struct {
+	slot      int64 // start of the bucket in deliveryBucket units
+	delivered int
+	failed    int
+}
+
+// deliveryStats is the success rate of Home Assistant updates as shown by
+// GET /healthz.
+type deliveryStats struct {
+	// Delivered is the share of updates delivered in percent within the
+	// error budget window, and DeliveredHour within the last hour; both are
+	// 100 without updates.
+	Delivered     float64 `json:"delivered"`
+	DeliveredHour float64 `json:"delivered_1h"`
+	Target        float64 `json:"target"`
+	Degraded      bool    `json:"degraded"`
+}
+
+// deliveryBudget tracks the outcomes of Home Assistant state updates over
+// rolling windows.
+type deliveryBudget struct {
+	mutex     sync.Mutex
+	buckets   [deliveryHistory / deliveryBucket]deliveryCount
+	delivered int64 // since start, for the metrics
+	failed    int64
+	degraded  bool
+	entities  map[string]int // update generation by entity ID
+}
+
+// record counts an update and reports whether the bridge became degraded
+// or recovered with it.
+func (b *deliveryBudget) record(ok bool, now time.Time, config ErrorBudgetConfig) (degraded, recovered bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	slot := now.UnixNano() / int64(deliveryBucket)
+	bucket := &b.buckets[slot%int64(len(b.buckets))]
+	if bucket.slot != slot {
+		*bucket = deliveryCount{slot: slot}
+	}
+	if ok {
+		bucket.delivered++
+		b.delivered++
+	} else {
+		bucket.failed++
+		b.failed++
+	}
+
+	rate, total := b.rate(now, config.window())
+	if total < deliveryMinUpdates {
+		return false, false
+	}
+	below := rate < config.target()
+	degraded, recovered = below && !b.degraded, !below && b.degraded
+	b.degraded = below
+	return degraded, recovered
+}
+
+// rate returns the share of updates delivered in percent within window,
+// and their number. The caller holds the mutex.
+func (b *deliveryBudget) rate(now time.Time, window time.Duration) (float64, int) {
+	slot := now.UnixNano() / int64(deliveryBucket)
+	oldest := slot - int64(window/deliveryBucket) + 1
+	var delivered, total int
+	for i := range b.buckets {
+		if bucket := &b.buckets[i]; bucket.slot >= oldest && bucket.slot <= slot {
+			delivered += bucket.delivered
+			total += bucket.delivered + bucket.failed
+		}
+	}
+	if total == 0 {
+		return 100, 0
+	}
+	return 100 * float64(delivered) / float64(total), total
+}
+
+// isDegraded reports whether fewer updates than the target were delivered
+// when last judged.
+func (b *deliveryBudget) isDegraded() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.degraded
+}
+
+// failing reports whether the bridge is degraded, or would be with one
+// more failed update at now.
+func (b *deliveryBudget) failing(now time.Time, config ErrorBudgetConfig) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.degraded {
+		return true
+	}
+	rate, total := b.rate(now, config.window())
+	delivered := rate / 100 * float64(total)
+	return total+1 >= deliveryMinUpdates && 100*delivered/float64(total+1) < config.target()
+}
+
+// stats returns the success rates at now.
+func (b *deliveryBudget) stats(now time.Time, config ErrorBudgetConfig) deliveryStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	window, _ := b.rate(now, config.window())
+	hour, _ := b.rate(now, deliveryHistory)
+	return deliveryStats{Delivered: math.Round(window*10) / 10, DeliveredHour: math.Round(hour*10) / 10, Target: config.target(), Degraded: b.degraded}
+}
+
+// next starts a new update of entityID and returns its generation; a
+// retry is dropped once a newer update has started.
+func (b *deliveryBudget) next(entityID string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.entities == nil {
+		b.entities = make(map[string]int)
+	}
+	b.entities[entityID]++
+	return b.entities[entityID]
+}
+
+// current reports whether gen is the latest update of entityID.
+func (b *deliveryBudget) current(entityID string, gen int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.entities[entityID] == gen
+}
+
+// writeMetrics writes the update counts and the success rates.
+func (b *deliveryBudget) writeMetrics(w io.Writer, config ErrorBudgetConfig) {
+	now := time.Now()
+	b.mutex.Lock()
+	delivered, failed, degraded := b.delivered, b.failed, b.degraded
+	window, _ := b.rate(now, config.window())
+	hour, _ := b.rate(now, deliveryHistory)
+	b.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP konke_ha_updates_total State updates sent to Home Assistant.")
+	fmt.Fprintln(w, "# TYPE konke_ha_updates_total counter")
+	fmt.Fprintf(w, "konke_ha_updates_total{result=\"delivered\"} %d\n", delivered)
+	fmt.Fprintf(w, "konke_ha_updates_total{result=\"failed\"} %d\n", failed)
+	fmt.Fprintln(w, "# HELP konke_ha_delivery_ratio Share of state updates delivered to Home Assistant.")
+	fmt.Fprintln(w, "# TYPE konke_ha_delivery_ratio gauge")
+	fmt.Fprintf(w, "konke_ha_delivery_ratio{window=%q} %g\n", config.window().String(), window/100)
+	fmt.Fprintf(w, "konke_ha_delivery_ratio{window=%q} %g\n", deliveryHistory.String(), hour/100)
+	fmt.Fprintln(w, "# HELP konke_ha_degraded Whether fewer state updates than the error budget target are delivered.")
+	fmt.Fprintln(w, "# TYPE konke_ha_degraded gauge")
+	if degraded {
+		fmt.Fprintln(w, "konke_ha_degraded 1")
+	} else {
+		fmt.Fprintln(w, "konke_ha_degraded 0")
+	}
+}
+
+// recordDelivery counts the outcome of a state update, warning when the
+// success rate falls below the target and when it recovers.
+func (p *Proxy) recordDelivery(ok bool) {
+	config := p.config.HomeAssistant.ErrorBudget
+	degraded, recovered := p.delivery.record(ok, time.Now(), config)
+	if degraded {
+		stats := p.delivery.stats(time.Now(), config)
+		log.Printf("Home Assistant updates failing: %.1f%% delivered in the last %s, below the %g%% target; retrying failed updates",
+			stats.Delivered, config.window(), config.target())
+		p.alert(alertHADegraded, "Konke: Home Assistant updates failing",
+			"Only %.1f%% of the state updates reached Home Assistant in the last %s (target %g%%).",
+			stats.Delivered, config.window(), config.target())
+	}
+	if recovered {
+		log.Printf("Home Assistant updates are delivered again")
+	}
+}
+
+// deliveryFailed handles a failed attempt of an update. While the bridge
+// is degraded, or the failure would degrade it, the update is sent again
+// later, unless a newer update of the entity has started or attempt
+// retries have been made. The failure is counted once, after the last
+// attempt.
+func (p *Proxy) deliveryFailed(entityID, state string, attributes map[string]interface{}, gen, attempt int) {
+	failed := func() {
+		p.rules.countHAFailure(time.Now())
+		p.recordDelivery(false)
+	}
+	config := p.config.HomeAssistant.ErrorBudget
+	if attempt >= config.retries() || !p.delivery.failing(time.Now(), config) {
+		failed()
+		return
+	}
+	time.AfterFunc(haRetryDelay<<attempt, func() {
+		if !p.delivery.current(entityID, gen) {
+			failed()
+			return
+		}
+		p.sendToHomeAssistant(entityID, state, attributes, gen, attempt+1)
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeliveryBudget(t *testing.T) {
+	var b deliveryBudget
+	config := ErrorBudgetConfig{Target: 90, Window: 60}
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 8; i++ {
+		b.record(true, now, config)
+	}
+	// Too few updates to judge.
+	if degraded, _ := b.record(false, now, config); degraded {
+		t.Error("degraded with fewer than the minimum updates")
+	}
+	if degraded, _ := b.record(false, now, config); !degraded {
+		t.Error("8 of 10 delivered did not degrade the bridge")
+	}
+	if degraded, _ := b.record(false, now, config); degraded {
+		t.Error("degradation reported twice")
+	}
+
+	// Two minutes later the failures have left the window but not the
+	// hour.
+	later := now.Add(2 * time.Minute)
+	var recovered bool
+	for i := 0; i < deliveryMinUpdates; i++ {
+		_, r := b.record(true, later, config)
+		recovered = recovered || r
+	}
+	if !recovered || b.isDegraded() {
+		t.Error("bridge did not recover")
+	}
+	stats := b.stats(later, config)
+	if stats.Delivered != 100 || stats.DeliveredHour != 85.7 {
+		t.Errorf("stats = %+v, want 100%% in the window and 85.7%% in the hour", stats)
+	}
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	defer func(d time.Duration) { haRetryDelay = d }(haRetryDelay)
+	haRetryDelay = 5 * time.Millisecond
+
+	var failing atomic.Bool
+	var requests atomic.Int32
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ha.Close()
+	var config Config
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(ha.URL, "http://"))
+	config.HomeAssistant.Host = host
+	config.HomeAssistant.Port, _ = strconv.Atoi(port)
+	config.HomeAssistant.ErrorBudget = ErrorBudgetConfig{Target: 95, Retries: 2}
+	proxy := NewProxy(&config)
+
+	// Failures before the bridge is degraded are not retried.
+	failing.Store(true)
+	for i := 0; i < deliveryMinUpdates-1; i++ {
+		proxy.updateHomeAssistant("switch.light_"+strconv.Itoa(i), "on", nil)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := requests.Load(); n != deliveryMinUpdates-1 {
+		t.Fatalf("%d requests, want no retries yet", n)
+	}
+
+	// The failure that degrades the bridge is retried, and counted once
+	// its retries have failed too.
+	proxy.updateHomeAssistant("switch.light_x", "on", nil)
+	waitFor(t, time.Second, proxy.delivery.isDegraded)
+	rec := httptest.NewRecorder()
+	newRouter(proxy).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"degraded":true`) {
+		t.Errorf("healthz: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	// The last failure is retried twice.
+	waitFor(t, time.Second, func() bool { return requests.Load() == deliveryMinUpdates+2 })
+	time.Sleep(50 * time.Millisecond)
+	if n := requests.Load(); n != deliveryMinUpdates+2 {
+		t.Errorf("%d requests, want 2 retries", n)
+	}
+
+	// A newer update drops the retries of the older one.
+	before := requests.Load()
+	proxy.updateHomeAssistant("switch.light_y", "on", nil)
+	failing.Store(false)
+	proxy.updateHomeAssistant("switch.light_y", "off", nil)
+	time.Sleep(50 * time.Millisecond)
+	if n := requests.Load() - before; n != 2 {
+		t.Errorf("%d requests, want the superseded update not retried", n)
+	}
+
+	var metrics strings.Builder
+	proxy.delivery.writeMetrics(&metrics, config.HomeAssistant.ErrorBudget)
+	if !strings.Contains(metrics.String(), `konke_ha_updates_total{result="delivered"} 1`) ||
+		!strings.Contains(metrics.String(), `konke_ha_updates_total{result="failed"} 11`) ||
+		!strings.Contains(metrics.String(), "konke_ha_degraded 1") {
+		t.Errorf("metrics:\n%s", metrics.String())
+	}
+}
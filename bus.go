@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// Topics published on the event bus. The entity ID is appended, e.g.
+// "state/switch.living_room".
+const (
+	topicState      = "state/"      // a device entity changed state
+	topicAttributes = "attributes/" // only the attributes of a device entity changed
+	topicExternal   = "external/"   // an extension set an entity
+)
+
+// busEvent is a change of a Home Assistant entity.
+type busEvent struct {
+	Topic      string
+	Device     *device // nil for external entities
+	EntityID   string  // full Home Assistant entity ID
+	State      string
+	Attributes map[string]interface{}
+	// Echo is set for state changes caused by the proxy's own commands.
+	// Subscribers that send commands in reaction to changes skip these, or
+	// they would answer their own commands in a loop.
+	Echo bool
+}
+
+// eventBus delivers entity changes to the features reporting them, such
+// as the Home Assistant client and the event feed, so that the code
+// detecting a change does not need to know who is interested in it.
+//
+// Handlers run synchronously in the publisher's goroutine, in the order
+// they subscribed, so every subscriber sees the changes of an entity in
+// order. Handlers doing slow work should hand it off.
+type eventBus struct {
+	mutex sync.RWMutex
+	seq   int
+	subs  []busSubscriber
+}
+
+type busSubscriber struct {
+	id      int
+	pattern string
+	handler func(busEvent)
+}
+
+// subscribe calls handler for events whose topic matches pattern and
+// returns a function that cancels the subscription. Patterns are topics
+// split at "/" where "+" matches one level and a final "#" matches the
+// rest, as in MQTT: "state/#" matches every state change.
+func (b *eventBus) subscribe(pattern string, handler func(busEvent)) (unsubscribe func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.seq++
+	id := b.seq
+	b.subs = append(b.subs, busSubscriber{id: id, pattern: pattern, handler: handler})
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		for i, s := range b.subs {
+			if s.id == id {
+				b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// publish delivers ev to the matching subscribers.
+func (b *eventBus) publish(ev busEvent) {
+	b.mutex.RLock()
+	subs := b.subs
+	b.mutex.RUnlock()
+	for _, s := range subs {
+		if topicMatches(s.pattern, ev.Topic) {
+			s.handler(ev)
+		}
+	}
+}
+
+// topicMatches reports whether topic matches an MQTT-style pattern.
+func topicMatches(pattern, topic string) bool {
+	patterns := strings.Split(pattern, "/")
+	levels := strings.Split(topic, "/")
+	for i, p := range patterns {
+		if p == "#" && i == len(patterns)-1 {
+			return true
+		}
+		if i >= len(levels) || (p != "+" && p != levels[i]) {
+			return false
+		}
+	}
+	return len(patterns) == len(levels)
+}
+
+// subscribeBuiltins connects the proxy's own consumers of entity changes.
+func (p *Proxy) subscribeBuiltins() {
+	p.bus.subscribe(topicState+"#", func(ev busEvent) {
+		p.publishState(ev.Device, ev.State)
+	})
+	p.bus.subscribe("#", func(ev busEvent) {
+		p.reportToHomeAssistant(ev)
+	})
+}
+
+// entityChanged publishes a change of dev's entity.
+func (p *Proxy) entityChanged(topic string, dev *device, state string) {
+	entityID := p.haEntityID(dev)
+	p.bus.publish(busEvent{
+		Topic:      topic + entityID,
+		Device:     dev,
+		EntityID:   entityID,
+		State:      state,
+		Attributes: p.haAttributes(dev),
+		Echo:       topic == topicState && p.origins.origin(dev.Ref.key()).Echo,
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"#", "state/switch.a", true},
+		{"state/#", "state/switch.a", true},
+		{"state/#", "attributes/switch.a", false},
+		{"state/+", "state/switch.a", true},
+		{"+/switch.a", "attributes/switch.a", true},
+		{"state/switch.a", "state/switch.a", true},
+		{"state/switch.a", "state/switch.b", false},
+		{"state", "state/switch.a", false},
+		{"state/+/x", "state/switch.a", false},
+	}
+	for _, tt := range tests {
+		if got := topicMatches(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	proxy := eventProxy()
+	proxy.config.HomeAssistant.Port = 1 // nothing listens there
+
+	var got []busEvent
+	unsubscribe := proxy.bus.subscribe("+/switch.light_one", func(ev busEvent) { got = append(got, ev) })
+
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: map[string]interface{}{"state": "ON", "level": 30.0}})
+	proxy.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "OPEN"})
+	unsubscribe()
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "OFF"})
+
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want 2: %+v", len(got), got)
+	}
+	if got[0].Topic != "state/switch.light_one" || got[0].State != "on" || got[0].Device == nil {
+		t.Errorf("first event = %+v", got[0])
+	}
+	if got[1].Topic != "attributes/switch.light_one" || got[1].Attributes["level"] != 30.0 {
+		t.Errorf("second event = %+v", got[1])
+	}
+
+	// The event feed is a subscriber as well.
+	if events, _, _ := proxy.events.since(0); len(events) != 3 {
+		t.Errorf("event feed has %d events, want 3", len(events))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// calibrationFile holds the measured curtain travel times inside the data
+// directory.
+const calibrationFile = "calibration.json"
+
+// calibrationTimeout bounds how long calibration waits for a curtain to
+// finish one movement.
+var calibrationTimeout = 2 * time.Minute
+
+// errNotCurtain is returned when calibrating a node that is not a mapped
+// curtain.
+var errNotCurtain = errors.New("not a configured curtain")
+
+// travelTimes are the measured full travel times of a curtain, in seconds.
+type travelTimes struct {
+	Open  float64 `json:"open"`
+	Close float64 `json:"close"`
+}
+
+// dataDir returns the directory for persistent state.
+func (c *Config) dataDir() string {
+	if c.DataDir == "" {
+		return "data"
+	}
+	return c.DataDir
+}
+
+// loadCalibration reads the stored curtain calibrations, if any.
+func (p *Proxy) loadCalibration() error {
+	data, err := ioutil.ReadFile(filepath.Join(p.config.dataDir(), calibrationFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	calibration := make(map[string]travelTimes)
+	if err == nil {
+		if err := json.Unmarshal(data, &calibration); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", calibrationFile, err)
+		}
+	}
+	p.coverMu.Lock()
+	defer p.coverMu.Unlock()
+	// Curtains calibrated before the file was first read keep their
+	// fresher measurement.
+	if !p.calibrationLoaded {
+		for key, times := range p.calibration {
+			calibration[key] = times
+		}
+	}
+	p.calibration = calibration
+	p.calibrationLoaded = true
+	return nil
+}
+
+// saveCalibration writes the curtain calibrations to the data directory,
+// replacing the file atomically. Nothing is written after a backup
+// restore, and the stored calibrations are read first if that has not
+// happened yet so they are not lost.
+func (p *Proxy) saveCalibration() error {
+	if p.restored.Load() {
+		return nil
+	}
+	p.coverMu.Lock()
+	loaded := p.calibrationLoaded
+	p.coverMu.Unlock()
+	if !loaded {
+		if err := p.loadCalibration(); err != nil {
+			return err
+		}
+	}
+
+	p.coverMu.Lock()
+	data, err := json.MarshalIndent(p.calibration, "", "  ")
+	p.coverMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(p.config.dataDir(), calibrationFile), data)
+}
+
+// calibrate measures how long a curtain takes to open and close fully by
+// timing the gateway's confirmations. The curtain is closed first, then
+// opened and closed again. The result is stored and used for transition
+// reporting and position estimates from then on.
+func (p *Proxy) calibrate(ctx context.Context, ref nodeRef) (travelTimes, error) {
+	dev, ok := p.lookupDevice(ref.key())
+	if !ok || dev.Kind != kindCurtain {
+		return travelTimes{}, errNotCurtain
+	}
+
+	move := func(arg string) (time.Duration, error) {
+		msg := &Message{
+			NodeID:    ref.NodeID,
+			Opcode:    "SWITCH",
+			Arg:       arg,
+			Requester: "HJ_Server",
+			ZKID:      p.outgoingZKID(ref),
+		}
+		start := time.Now()
+		if _, err := p.requestWithin(ctx, msg, calibrationTimeout); err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	}
+
+	log.Printf("Calibrating curtain %s", ref.key())
+	if _, err := move("CLOSE"); err != nil {
+		return travelTimes{}, err
+	}
+	open, err := move("OPEN")
+	if err != nil {
+		return travelTimes{}, err
+	}
+	close, err := move("CLOSE")
+	if err != nil {
+		return travelTimes{}, err
+	}
+
+	result := travelTimes{Open: open.Seconds(), Close: close.Seconds()}
+	p.coverMu.Lock()
+	if p.calibration == nil {
+		p.calibration = make(map[string]travelTimes)
+	}
+	p.calibration[ref.key()] = result
+	p.motion[ref.key()] = &coverMotion{}
+	p.coverMu.Unlock()
+	log.Printf("Curtain %s opens in %.1fs and closes in %.1fs", ref.key(), result.Open, result.Close)
+
+	if err := p.saveCalibration(); err != nil {
+		log.Printf("Failed to save calibration: %v", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,141 @@
+// Command loadtest drives a running konke-ha-proxy with simulated devices
+// and concurrent HTTP clients and reports throughput and latency.
+//
+// It starts a fake gateway, waits for the proxy to log in to it, then lets
+// the clients hammer POST /switch/:id for the configured duration. Point the
+// proxy's gateway.host/gateway.port at the -gateway address before starting
+// it, and set gateway.device_count to the same value as -devices.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+func main() {
+	gatewayAddr := flag.String("gateway", "127.0.0.1:5000", "listen address of the fake gateway")
+	proxyURL := flag.String("proxy", "http://127.0.0.1:8500", "base URL of the proxy HTTP API")
+	devices := flag.Int("devices", 100, "number of simulated devices (N)")
+	clients := flag.Int("clients", 10, "number of concurrent HTTP clients (M)")
+	duration := flag.Duration("duration", 10*time.Second, "length of the measurement")
+	wait := flag.Duration("wait", 60*time.Second, "how long to wait for the proxy to log in")
+	flag.Parse()
+
+	gw := fakegw.New(*devices)
+	if err := gw.Start(*gatewayAddr); err != nil {
+		log.Fatalf("start fake gateway: %v", err)
+	}
+	defer gw.Close()
+	log.Printf("Fake gateway with %d devices listening on %s", *devices, gw.Addr())
+
+	deadline := time.Now().Add(*wait)
+	for gw.Logins() == 0 {
+		if time.Now().After(deadline) {
+			log.Fatalf("proxy did not log in within %s", *wait)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Printf("Proxy logged in, running %d clients for %s", *clients, *duration)
+
+	framesBefore := gw.Frames()
+	results := run(strings.TrimSuffix(*proxyURL, "/"), *devices, *clients, *duration)
+	results.frames = gw.Frames() - framesBefore
+	results.print(os.Stdout)
+}
+
+type results struct {
+	elapsed   time.Duration
+	latencies []time.Duration
+	errors    int
+	frames    int64
+}
+
+func run(baseURL string, devices, clients int, duration time.Duration) *results {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: clients,
+		},
+	}
+
+	var (
+		mutex sync.Mutex
+		res   results
+		wg    sync.WaitGroup
+	)
+
+	start := time.Now()
+	stop := start.Add(duration)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+
+			rng := rand.New(rand.NewSource(seed))
+			var latencies []time.Duration
+			errors := 0
+
+			for time.Now().Before(stop) {
+				id := rng.Intn(devices) + 1
+				arg := "ON"
+				if rng.Intn(2) == 0 {
+					arg = "OFF"
+				}
+
+				began := time.Now()
+				resp, err := client.Post(
+					fmt.Sprintf("%s/switch/%d", baseURL, id),
+					"application/json",
+					strings.NewReader(fmt.Sprintf(`{"arg":%q}`, arg)),
+				)
+				if err != nil {
+					errors++
+					continue
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					errors++
+					continue
+				}
+				latencies = append(latencies, time.Since(began))
+			}
+
+			mutex.Lock()
+			res.latencies = append(res.latencies, latencies...)
+			res.errors += errors
+			mutex.Unlock()
+		}(int64(i) + 1)
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	return &res
+}
+
+func (r *results) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	idx := int(float64(len(r.latencies)-1) * p)
+	return r.latencies[idx]
+}
+
+func (r *results) print(out *os.File) {
+	ok := len(r.latencies)
+	fmt.Fprintf(out, "requests:   %d ok, %d failed\n", ok, r.errors)
+	fmt.Fprintf(out, "throughput: %.1f req/s\n", float64(ok)/r.elapsed.Seconds())
+	fmt.Fprintf(out, "latency:    p50 %s, p90 %s, p99 %s, max %s\n",
+		r.percentile(0.50), r.percentile(0.90), r.percentile(0.99), r.percentile(1))
+	fmt.Fprintf(out, "gateway:    %d frames received\n", r.frames)
+}
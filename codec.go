@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// encodeFrame serializes a message into the gateway wire format: the JSON
+// body wrapped in a leading '!' and a trailing '$'.
+func encodeFrame(msg *Message) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, 0, len(data)+2)
+	frame = append(frame, '!')
+	frame = append(frame, data...)
+	frame = append(frame, '$')
+	return frame, nil
+}
+
+// parseMessages decodes every complete frame in buffer. Fragments that are
+// not valid JSON are dropped.
+func parseMessages(buffer string) []*Message {
+	var messages []*Message
+	parts := strings.Split(buffer, "$")
+
+	for _, part := range parts {
+		if strings.HasPrefix(part, "!") {
+			jsonStr := strings.TrimPrefix(part, "!")
+			var msg Message
+			if err := json.Unmarshal([]byte(jsonStr), &msg); err == nil {
+				messages = append(messages, &msg)
+			}
+		}
+	}
+
+	return messages
+}
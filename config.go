@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config represents the YAML configuration structure
+type Config struct {
+	// Profile names the configuration when a file or directory holds
+	// several, e.g. one per site.
+	Profile string `yaml:"profile"`
+	// Timezone is the IANA name of the local time zone, such as
+	// Asia/Shanghai; the host's zone is used when empty.
+	Timezone string `yaml:"timezone"`
+
+	Gateway struct {
+		Host              string   `yaml:"host"`
+		Port              int      `yaml:"port"`
+		Username          string   `yaml:"username"`
+		Password          string   `yaml:"password"`
+		ZKID              string   `yaml:"zkid"`
+		ZKIDs             []string `yaml:"zkids"`
+		DeviceCount       int      `yaml:"device_count"`
+		HeartbeatInterval int      `yaml:"heartbeat_interval"`
+		// HeartbeatMin and HeartbeatMax bound an adaptive heartbeat
+		// interval, in seconds; it is fixed unless both are set.
+		HeartbeatMin   int      `yaml:"heartbeat_min"`
+		HeartbeatMax   int      `yaml:"heartbeat_max"`
+		TimeSync       *bool    `yaml:"time_sync"`
+		RequestTimeout int      `yaml:"request_timeout"`
+		CoverConflict  string   `yaml:"cover_conflict"`
+		IgnoreNodes    []string `yaml:"ignore_nodes"`
+		IgnoreOpcodes  []string `yaml:"ignore_opcodes"`
+		Transport      string   `yaml:"transport"`
+		// FallbackHosts are other addresses of the same gateway, tried in
+		// turn when Host cannot be reached; "host" or "host:port".
+		FallbackHosts []string  `yaml:"fallback_hosts"`
+		TCP           TCPConfig `yaml:"tcp"`
+		// StartupQuery picks the nodes queried when a session starts.
+		StartupQuery StartupQueryConfig `yaml:"startup_query"`
+		Serial       struct {
+			Port string `yaml:"port"`
+			Baud int    `yaml:"baud"`
+		} `yaml:"serial"`
+		WebSocket struct {
+			URL                string            `yaml:"url"`
+			Headers            map[string]string `yaml:"headers"`
+			InsecureSkipVerify bool              `yaml:"insecure_skip_verify"`
+		} `yaml:"websocket"`
+	} `yaml:"gateway"`
+	HTTPServer struct {
+		Host string `yaml:"host"`
+		Port int    `yaml:"port"`
+		// PollHold is the longest a GET /poll request waits for a
+		// change, in seconds.
+		PollHold int `yaml:"poll_hold"`
+		// StaleAfter is the age in seconds from which GET /switch/:id and
+		// GET /curtain/:id report a device state as stale.
+		StaleAfter int `yaml:"stale_after"`
+		// StrictNodes refuses commands to nodes that are neither mapped
+		// nor in the gateway's inventory; on unless set to false.
+		StrictNodes *bool `yaml:"strict_nodes"`
+		// GraphQL enables POST /graphql.
+		GraphQL bool `yaml:"graphql"`
+		// AllowGetActions enables the signed GET /action URLs of the
+		// actions.
+		AllowGetActions bool `yaml:"allow_get_actions"`
+		// Admin moves the health, metrics, diagnostics, logs and admin
+		// endpoints to a listener of their own when its port is set.
+		// Both hosts may name a network interface.
+		Admin struct {
+			Host string `yaml:"host"`
+			Port int    `yaml:"port"`
+		} `yaml:"admin"`
+	} `yaml:"http_server"`
+	HomeAssistant struct {
+		Host  string `yaml:"host"`
+		Port  int    `yaml:"port"`
+		Token string `yaml:"token"`
+		// CurtainDomain selects how curtains appear in HA: "switch"
+		// (on/off, for REST switches) or "cover" (cover states).
+		CurtainDomain string `yaml:"curtain_domain"`
+		// StateMap maps gateway arguments to HA states per domain
+		// ("switch" or "cover"), ahead of the built-in mapping.
+		StateMap map[string]map[string]string `yaml:"state_map"`
+		// Proxy is the URL of an HTTP or SOCKS5 proxy for the requests to
+		// HA; the usual proxy environment variables apply when empty.
+		Proxy string `yaml:"proxy"`
+		// WarmUp seeds the device states from HA's current states at
+		// startup.
+		WarmUp bool `yaml:"warm_up"`
+		// ErrorBudget sets the share of state updates that must reach HA.
+		ErrorBudget ErrorBudgetConfig `yaml:"error_budget"`
+		// LoopGuard breaks states bouncing between HA and the gateway.
+		LoopGuard LoopGuardConfig `yaml:"loop_guard"`
+	} `yaml:"home_assistant"`
+	Auth struct {
+		Tokens []authToken `yaml:"tokens"`
+		// ProtectDevices requires a token for the device endpoints: one
+		// with the admin or devices scope, or a guest token for the
+		// device.
+		ProtectDevices bool `yaml:"protect_devices"`
+	} `yaml:"auth"`
+	Devices struct {
+		Curtains map[string]DeviceConfig `yaml:"curtains"`
+		Lights   map[string]DeviceConfig `yaml:"lights"`
+	} `yaml:"devices"`
+	// Modes are named restrictions such as a vacation mode, by name.
+	Modes map[string]ModeConfig `yaml:"modes"`
+	// Interlocks keep devices from being switched on together, by name.
+	Interlocks map[string]InterlockConfig `yaml:"interlocks"`
+	// Actions are commands run by opening their signed URL, by name.
+	Actions map[string]ActionConfig `yaml:"actions"`
+	// Hooks are webhooks for third-party triggers, by name.
+	Hooks map[string]HookConfig `yaml:"hooks"`
+	// Macros are named command sequences for POST /macro and webhooks.
+	Macros      map[string][]CommandStep `yaml:"macros"`
+	RateAnomaly struct {
+		MaxMessages int  `yaml:"max_messages"`
+		Window      int  `yaml:"window"`
+		Suppress    bool `yaml:"suppress"`
+	} `yaml:"rate_anomaly"`
+	Archive struct {
+		Enabled bool   `yaml:"enabled"`
+		Path    string `yaml:"path"`
+		MaxRows int    `yaml:"max_rows"`
+		MaxAge  int    `yaml:"max_age"` // days
+	} `yaml:"archive"`
+	Extensions []ExtensionConfig `yaml:"extensions"`
+	// Notifications sends alerts about the gateway and the devices to
+	// people, through every sink that is configured.
+	Notifications struct {
+		// Alerts lists the alerts to send; all are sent when empty.
+		Alerts []string `yaml:"alerts"`
+		// GatewayDownAfter is how long the gateway must stay unreachable
+		// before gateway_down is sent, in seconds.
+		GatewayDownAfter int `yaml:"gateway_down_after"`
+		Telegram         struct {
+			BotToken string `yaml:"bot_token"`
+			ChatID   string `yaml:"chat_id"`
+		} `yaml:"telegram"`
+		Ntfy struct {
+			Server   string `yaml:"server"` // defaults to https://ntfy.sh
+			Topic    string `yaml:"topic"`
+			Token    string `yaml:"token"`
+			Priority string `yaml:"priority"`
+		} `yaml:"ntfy"`
+		Email EmailConfig `yaml:"email"`
+	} `yaml:"notifications"`
+	// Alerts are rules whose conditions are checked periodically and
+	// alerted through the notification sinks.
+	Alerts []AlertRule `yaml:"alerts"`
+	// DataDir is where the proxy keeps state across restarts, such as
+	// curtain calibrations.
+	DataDir string `yaml:"data_dir"`
+	// DNSRefresh is how long resolved host names are reused, in seconds.
+	DNSRefresh int `yaml:"dns_refresh"`
+	// MDNS controls the advertisement of the HTTP API over mDNS.
+	MDNS struct {
+		Enabled *bool  `yaml:"enabled"`
+		Name    string `yaml:"name"` // service instance name
+	} `yaml:"mdns"`
+	Logging struct {
+		Level string `yaml:"level"`
+		File  string `yaml:"file"`
+		// Buffer is how many log records GET /logs keeps in memory.
+		Buffer int `yaml:"buffer"`
+		// Sampling thins out lines that repeat with gateway traffic.
+		Sampling []LogSampling `yaml:"sampling"`
+	} `yaml:"logging"`
+}
+
+// EmailConfig is the SMTP server and addresses alert mails are sent with.
+type EmailConfig struct {
+	Host     string   `yaml:"host"`
+	Port     int      `yaml:"port"` // defaults to 587
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// ModeConfig is a named set of restrictions, switched on with POST /mode
+// or daily during its quiet hours.
+type ModeConfig struct {
+	// Devices (keyed like the device mapping) and Tags select the devices
+	// the mode covers; it covers all devices when both are empty.
+	Devices []string `yaml:"devices"`
+	Tags    []string `yaml:"tags"`
+	// BlockCommands refuses control commands to the devices, and
+	// SuppressUpdates holds back their state updates to Home Assistant
+	// until the mode ends.
+	BlockCommands   bool `yaml:"block_commands"`
+	SuppressUpdates bool `yaml:"suppress_updates"`
+	// QuietHours, as "22:00-07:00", activates the mode every day within
+	// that window in the proxy's local time.
+	QuietHours string `yaml:"quiet_hours"`
+	// SimulatePresence replays a random share of the recent on/off
+	// history of the switches the mode covers while it is active.
+	SimulatePresence bool `yaml:"simulate_presence"`
+}
+
+// ActionConfig is a predefined command run by opening its signed URL.
+type ActionConfig struct {
+	// Device is keyed like the device mapping.
+	Device string `yaml:"device"`
+	Arg    string `yaml:"arg"`
+}
+
+// HookConfig is a webhook, POST /hooks/<name>, that runs a sequence of
+// commands or a macro.
+type HookConfig struct {
+	// Secret, if set, must come with the request as a bearer token or the
+	// X-Hook-Secret header.
+	Secret   string        `yaml:"secret"`
+	Commands []CommandStep `yaml:"commands"`
+	Macro    string        `yaml:"macro"`
+}
+
+// CommandStep is a command of a macro or webhook, sent DelayMS
+// milliseconds after the previous one.
+type CommandStep struct {
+	// Device is keyed like the device mapping.
+	Device  string `yaml:"device"`
+	Arg     string `yaml:"arg"`
+	DelayMS int    `yaml:"delay_ms"`
+}
+
+// InterlockConfig is a set of devices that must never be on together, such
+// as an exhaust fan and a heater.
+type InterlockConfig struct {
+	// Devices are keyed like the device mapping.
+	Devices []string `yaml:"devices"`
+}
+
+// DeviceConfig maps one gateway node to a Home Assistant entity. In YAML it
+// is either the bare entity ID or a mapping with additional options.
+type DeviceConfig struct {
+	Entity string `yaml:"entity"`
+	// Name overrides the name assigned in the vendor app.
+	Name string `yaml:"name"`
+	// Timeout is how long to wait for the gateway to confirm a command,
+	// in seconds, and Retries how often to resend it when it does not.
+	// Commands are only confirmed when either is set.
+	Timeout float64 `yaml:"timeout"`
+	Retries int     `yaml:"retries"`
+	// TravelTime is how long a curtain takes to open or close fully, in
+	// seconds. When set, the curtain is reported as opening or closing
+	// for that long after a command.
+	TravelTime float64 `yaml:"travel_time"`
+	// StateMap maps gateway arguments to HA states for this device, ahead
+	// of home_assistant.state_map.
+	StateMap map[string]string `yaml:"state_map"`
+	// ConfirmNotify reports every command to the device to Home Assistant
+	// with its source, for devices where accountability matters.
+	ConfirmNotify bool `yaml:"confirm_notify"`
+	// Tags and Meta are free-form labels for the user's own grouping and
+	// automations. They are passed through to the API and to the Home
+	// Assistant attributes unchanged.
+	Tags []string          `yaml:"tags"`
+	Meta map[string]string `yaml:"meta"`
+	// MinReportInterval is the least time between two state updates
+	// sent to Home Assistant, in seconds; a change in between is sent
+	// when it has passed. MinChange is the least change of a numeric
+	// state or attribute that is sent. Both keep fluctuating devices from
+	// bloating the recorder database.
+	MinReportInterval float64 `yaml:"min_report_interval"`
+	MinChange         float64 `yaml:"min_change"`
+	// Precision rounds numeric attributes sent to Home Assistant to so
+	// many decimals, and Smoothing sends the moving average of the last
+	// so many reports instead. The API keeps the raw values.
+	Precision *int `yaml:"precision"`
+	Smoothing int  `yaml:"smoothing"`
+	// PowerAttribute is the attribute reporting the power draw of a
+	// metering socket, in watts. The proxy accumulates it into an energy
+	// sensor for the Home Assistant Energy dashboard, named EnergyEntity
+	// or <entity>_energy.
+	PowerAttribute string `yaml:"power_attribute"`
+	EnergyEntity   string `yaml:"energy_entity"`
+	// PowerInterval is how often the socket reports its power, in
+	// seconds. A reading counts for at most twice that.
+	PowerInterval float64 `yaml:"power_interval"`
+	// MaxDailyActuations limits the commands to the device per day, to
+	// protect motors and relays from runaway automations.
+	MaxDailyActuations int `yaml:"max_daily_actuations"`
+	// Dimmer marks a light that takes its level from 0 to 100 as the
+	// SWITCH argument, which commands can ramp with transition_ms.
+	Dimmer bool `yaml:"dimmer"`
+	// Repeat sends every command to the device several times, for
+	// devices that need a command twice to latch.
+	Repeat RepeatConfig `yaml:"repeat"`
+	// AllowedArgs limits the commands the device takes, such as
+	// [OPEN, CLOSE, STOP] for a curtain motor that misreads ON.
+	AllowedArgs []string `yaml:"allowed_args"`
+	// Tenant assigns the device to a household sharing the gateway; tokens
+	// of that tenant only see and control its devices.
+	Tenant string `yaml:"tenant"`
+}
+
+// UnmarshalYAML accepts both the short `"6": "entity_id"` form and the
+// mapping form.
+func (d *DeviceConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var entity string
+	if err := unmarshal(&entity); err == nil {
+		*d = DeviceConfig{Entity: entity}
+		return nil
+	}
+
+	type plain DeviceConfig
+	return unmarshal((*plain)(d))
+}
+
+// configDocument is one configuration read from a file.
+type configDocument struct {
+	File   string
+	Config Config
+}
+
+// name returns the profile name of the document. Documents without a
+// profile key in a directory are named after their file.
+func (d *configDocument) name(dir bool) string {
+	if d.Config.Profile != "" || !dir {
+		return d.Config.Profile
+	}
+	base := filepath.Base(d.File)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// configFiles returns the files making up the configuration at path: the
+// file itself, or the YAML files of a conf.d style directory.
+func configFiles(path string) ([]string, bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !info.IsDir() {
+		return []string{path}, false, nil
+	}
+
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, _ := filepath.Glob(filepath.Join(path, pattern))
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, true, nil
+}
+
+// readConfigDocuments decodes every YAML document in data.
+func readConfigDocuments(file string, data []byte) ([]configDocument, error) {
+	var docs []configDocument
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		doc := configDocument{File: file}
+		err := decoder.Decode(&doc.Config)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// loadConfig reads the configuration at path, a YAML file or a directory
+// of them, and selects the document for profile. Without a profile, the
+// configuration must consist of a single document.
+func loadConfig(path, profile string) (*Config, error) {
+	files, dir, err := configFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []configDocument
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fileDocs, err := readConfigDocuments(file, data)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, fileDocs...)
+	}
+
+	if profile == "" {
+		if len(docs) == 1 {
+			return &docs[0].Config, nil
+		}
+		if len(docs) == 0 {
+			return nil, fmt.Errorf("%s: no configuration found", path)
+		}
+	}
+	var names []string
+	for i := range docs {
+		name := docs[i].name(dir)
+		if profile != "" && name == profile {
+			config := docs[i].Config
+			config.Profile = name
+			return &config, nil
+		}
+		names = append(names, name)
+	}
+	if profile == "" {
+		return nil, fmt.Errorf("%s holds the profiles %s; select one with -profile", path, strings.Join(names, ", "))
+	}
+	return nil, fmt.Errorf("%s: no profile %q (have %s)", path, profile, strings.Join(names, ", "))
+}
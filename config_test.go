@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestDeviceConfigForms(t *testing.T) {
+	data := `
+devices:
+  lights:
+    "6": "ke_ting_deng_dai"
+    "7":
+      entity: "ke_ting_zhu_deng"
+      name: "客厅主灯"
+      tags: ["downstairs", "night"]
+      meta:
+        circuit: "L2"
+`
+	var config Config
+	if err := yaml.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	if got := config.Devices.Lights["6"]; !reflect.DeepEqual(got, DeviceConfig{Entity: "ke_ting_deng_dai"}) {
+		t.Errorf("short form = %+v", got)
+	}
+	if got := config.Devices.Lights["7"]; !reflect.DeepEqual(got, DeviceConfig{
+		Entity: "ke_ting_zhu_deng",
+		Name:   "客厅主灯",
+		Tags:   []string{"downstairs", "night"},
+		Meta:   map[string]string{"circuit": "L2"},
+	}) {
+		t.Errorf("mapping form = %+v", got)
+	}
+}
+
+func TestLoadConfigProfiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(file, []byte(`profile: home
+gateway:
+  host: "192.168.1.10"
+---
+profile: cabin
+gateway:
+  host: "10.0.0.5"
+`), 0644)
+
+	config, err := loadConfig(file, "cabin")
+	if err != nil {
+		t.Fatalf("loadConfig(cabin): %v", err)
+	}
+	if config.Gateway.Host != "10.0.0.5" {
+		t.Errorf("cabin gateway host = %q", config.Gateway.Host)
+	}
+	if _, err := loadConfig(file, ""); err == nil || !strings.Contains(err.Error(), "home, cabin") {
+		t.Errorf("loadConfig without profile = %v, want an error listing the profiles", err)
+	}
+	if _, err := loadConfig(file, "office"); err == nil {
+		t.Error("loadConfig accepted an unknown profile")
+	}
+}
+
+func TestLoadConfigDirectory(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "home.yaml"), []byte("gateway:\n  host: \"192.168.1.10\"\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cabin.yml"), []byte("gateway:\n  host: \"10.0.0.5\"\n"), 0644)
+
+	config, err := loadConfig(dir, "home")
+	if err != nil {
+		t.Fatalf("loadConfig(home): %v", err)
+	}
+	if config.Gateway.Host != "192.168.1.10" || config.Profile != "home" {
+		t.Errorf("home profile = %q with host %q", config.Profile, config.Gateway.Host)
+	}
+}
+
+func TestLoadConfigSingleDocument(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	ioutil.WriteFile(file, []byte("gateway:\n  host: \"192.168.1.10\"\n"), 0644)
+
+	config, err := loadConfig(file, "")
+	if err != nil || config.Gateway.Host != "192.168.1.10" {
+		t.Errorf("loadConfig = %+v, %v", config, err)
+	}
+}
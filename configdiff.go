@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// secretSettings are settings whose values are not shown in diffs. Proxy
+// URLs may carry credentials.
+var secretSettings = map[string]bool{"password": true, "token": true, "bot_token": true, "headers": true, "secret": true, "proxy": true}
+
+// diffConfig describes the changes from old to new, one line per setting,
+// e.g. "added node 17 as cover.bedroom" or
+// "changed gateway.heartbeat_interval: 30 → 15".
+func diffConfig(old, new *Config) []string {
+	curtains := "switch"
+	if new.coverEntities() {
+		curtains = "cover"
+	}
+	d := configDiff{domains: map[string]string{"lights": "switch", "curtains": curtains}}
+	d.value("", reflect.ValueOf(*old), reflect.ValueOf(*new))
+	return d.changes
+}
+
+type configDiff struct {
+	domains map[string]string // HA domain by device section
+	changes []string
+}
+
+func (d *configDiff) add(format string, args ...interface{}) {
+	d.changes = append(d.changes, fmt.Sprintf(format, args...))
+}
+
+func (d *configDiff) value(path string, a, b reflect.Value) {
+	if reflect.DeepEqual(a.Interface(), b.Interface()) {
+		return
+	}
+	name := path[strings.LastIndex(path, ".")+1:]
+	if secretSettings[name] {
+		d.add("changed %s", path)
+		return
+	}
+
+	switch a.Kind() {
+	case reflect.Ptr:
+		if !a.IsNil() && !b.IsNil() {
+			d.value(path, a.Elem(), b.Elem())
+			return
+		}
+		d.add("changed %s: %s → %s", path, formatSetting(a), formatSetting(b))
+	case reflect.Slice:
+		if !hasSettings(a.Type().Elem()) {
+			d.add("changed %s: %s → %s", path, formatSetting(a), formatSetting(b))
+			return
+		}
+		// Lists of settings, such as the auth tokens, are compared entry by
+		// entry so that their secrets stay masked.
+		for i := 0; i < a.Len() || i < b.Len(); i++ {
+			at := joinPath(path, strconv.Itoa(i))
+			switch {
+			case i >= a.Len():
+				d.add("added %s: %s", at, formatSetting(b.Index(i)))
+			case i >= b.Len():
+				d.add("removed %s", at)
+			default:
+				d.value(at, a.Index(i), b.Index(i))
+			}
+		}
+	case reflect.Struct:
+		t := a.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if name := yamlName(t.Field(i)); name != "" {
+				d.value(joinPath(path, name), a.Field(i), b.Field(i))
+			}
+		}
+	case reflect.Map:
+		d.mapValue(path, a, b)
+	default:
+		d.add("changed %s: %s → %s", path, formatSetting(a), formatSetting(b))
+	}
+}
+
+func (d *configDiff) mapValue(path string, a, b reflect.Value) {
+	keys := make(map[string]reflect.Value)
+	for _, k := range a.MapKeys() {
+		keys[k.String()] = k
+	}
+	for _, k := range b.MapKeys() {
+		keys[k.String()] = k
+	}
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	section := strings.TrimPrefix(path, "devices.")
+	domain, isDevices := d.domains[section]
+	isDevices = isDevices && strings.HasPrefix(path, "devices.")
+	for _, name := range names {
+		k := keys[name]
+		before, after := a.MapIndex(k), b.MapIndex(k)
+		switch {
+		case !before.IsValid() && isDevices:
+			d.add("added node %s as %s.%s", name, domain, after.Interface().(DeviceConfig).Entity)
+		case !after.IsValid() && isDevices:
+			d.add("removed node %s (%s.%s)", name, domain, before.Interface().(DeviceConfig).Entity)
+		case !before.IsValid() && after.Kind() == reflect.Struct:
+			d.add("added %s", joinPath(path, name))
+		case !before.IsValid():
+			d.add("added %s: %s", joinPath(path, name), formatSetting(after))
+		case !after.IsValid():
+			d.add("removed %s", joinPath(path, name))
+		default:
+			d.value(joinPath(path, name), before, after)
+		}
+	}
+}
+
+// hasSettings reports whether values of type t are made of named
+// settings, which may be secrets.
+func hasSettings(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		return hasSettings(t.Elem())
+	case reflect.Struct:
+		return true
+	}
+	return false
+}
+
+// formatSetting formats a setting's value for a diff line, masking the
+// secrets among its settings.
+func formatSetting(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return "unset"
+		}
+		return formatSetting(v.Elem())
+	case reflect.String:
+		return fmt.Sprintf("%q", v.String())
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return "[]"
+		}
+		if hasSettings(v.Type().Elem()) {
+			elems := make([]string, v.Len())
+			for i := range elems {
+				elems[i] = formatSetting(v.Index(i))
+			}
+			return "[" + strings.Join(elems, " ") + "]"
+		}
+	case reflect.Map:
+		if hasSettings(v.Type().Elem()) {
+			keys := make([]string, 0, v.Len())
+			for _, k := range v.MapKeys() {
+				keys = append(keys, k.String()+": "+formatSetting(v.MapIndex(k)))
+			}
+			sort.Strings(keys)
+			return "{" + strings.Join(keys, ", ") + "}"
+		}
+	case reflect.Struct:
+		var fields []string
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := yamlName(t.Field(i))
+			switch {
+			case name == "" || v.Field(i).IsZero():
+			case secretSettings[name]:
+				fields = append(fields, name+": ***")
+			default:
+				fields = append(fields, name+": "+formatSetting(v.Field(i)))
+			}
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
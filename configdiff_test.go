@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	var old Config
+	old.Gateway.HeartbeatInterval = 30
+	old.Gateway.Password = "old-secret"
+	old.Devices.Lights = map[string]DeviceConfig{"6": {Entity: "desk"}, "7": {Entity: "hall"}}
+	old.Devices.Curtains = map[string]DeviceConfig{}
+	old.Modes = map[string]ModeConfig{"night": {QuietHours: "22:00-07:00"}}
+	old.Auth.Tokens = []authToken{{Name: "admin", Token: "old-token", Scopes: []string{scopeAdmin}}}
+	old.Hooks = map[string]HookConfig{"doorbell": {Secret: "ding"}}
+
+	new := old
+	new.Gateway.HeartbeatInterval = 15
+	new.Gateway.Password = "new-secret"
+	new.HomeAssistant.CurtainDomain = "cover"
+	new.Devices.Lights = map[string]DeviceConfig{"6": {Entity: "desk", Tags: []string{"office"}}}
+	new.Devices.Curtains = map[string]DeviceConfig{"17": {Entity: "bedroom"}}
+	new.Modes = map[string]ModeConfig{"vacation": {BlockCommands: true}}
+	new.Auth.Tokens = []authToken{
+		{Name: "admin", Token: "new-token", Scopes: []string{scopeAdmin}},
+		{Name: "phone", Token: "phone-token", Scopes: []string{scopeDevices}},
+	}
+	new.Hooks = map[string]HookConfig{"doorbell": {Secret: "dong"}, "gate": {Secret: "open"}}
+
+	want := []string{
+		`changed gateway.password`,
+		`changed gateway.heartbeat_interval: 30 → 15`,
+		`changed home_assistant.curtain_domain: "" → "cover"`,
+		`changed auth.tokens.0.token`,
+		`added auth.tokens.1: {name: "phone", token: ***, scopes: [devices]}`,
+		`added node 17 as cover.bedroom`,
+		`changed devices.lights.6.tags: [] → [office]`,
+		`removed node 7 (switch.hall)`,
+		`removed modes.night`,
+		`added modes.vacation`,
+		`changed hooks.doorbell.secret`,
+		`added hooks.gate`,
+	}
+	got := diffConfig(&old, &new)
+	for _, line := range got {
+		for _, secret := range []string{"token\"", "ding", "dong", "open"} {
+			if strings.Contains(line, secret) {
+				t.Errorf("diff shows a secret: %s", line)
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffConfig =\n%q\nwant\n%q", got, want)
+	}
+	if got := diffConfig(&old, &old); len(got) != 0 {
+		t.Errorf("diffConfig of equal configs = %q", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the frame corpus")
+
+// decodedFrame is what the proxy makes of one frame of a sample.
+type decodedFrame struct {
+	Message *Message               `json:"message"`
+	State   string                 `json:"state,omitempty"`   // SWITCH state
+	Extra   map[string]interface{} `json:"extra,omitempty"`   // SWITCH extra attributes
+	Nodes   []syncNode             `json:"nodes,omitempty"`   // SYNC_INFO inventory
+	Ignored bool                   `json:"ignored,omitempty"` // SWITCH argument not understood
+}
+
+// decodeFrames decodes a frame sample from testdata/frames. Line breaks
+// are not part of the wire format; they only separate frames for
+// readability.
+func decodeFrames(raw []byte) []decodedFrame {
+	stream := strings.NewReplacer("\r", "", "\n", "").Replace(string(raw))
+	decoded := []decodedFrame{}
+	for _, msg := range parseMessages(stream) {
+		frame := decodedFrame{Message: msg}
+		switch msg.Opcode {
+		case "SWITCH":
+			state, extra, ok := switchArg(msg.Arg)
+			frame.State, frame.Extra, frame.Ignored = state, extra, !ok
+		case "SYNC_INFO":
+			frame.Nodes = parseSyncInfo(msg.Arg)
+			sort.Slice(frame.Nodes, func(i, j int) bool { return lessNodeID(frame.Nodes[i].NodeID, frame.Nodes[j].NodeID) })
+		}
+		decoded = append(decoded, frame)
+	}
+	return decoded
+}
+
+// TestFrameSamples decodes every frame sample under testdata/frames and
+// compares the result with its golden file. Run with -update after adding
+// a sample, then review the generated golden file.
+func TestFrameSamples(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join("testdata", "frames", "*", "*.frames"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) == 0 {
+		t.Fatal("no frame samples in testdata/frames")
+	}
+
+	for _, sample := range samples {
+		name := strings.TrimSuffix(filepath.ToSlash(strings.TrimPrefix(sample, filepath.Join("testdata", "frames")+string(filepath.Separator))), ".frames")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(decodeFrames(raw), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(sample, ".frames") + ".golden.json"
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v; run go test -run TestFrameSamples -update to create it", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decoding differs from %s:\n%s", golden, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Policies for a curtain command that arrives while another one for the
+// same node is still in flight, selected by gateway.cover_conflict.
+const (
+	// conflictForward sends both commands, as if there were no conflict.
+	conflictForward = "forward"
+	// conflictCancel stops waiting for the earlier command's confirmation
+	// and sends the new one.
+	conflictCancel = "cancel"
+	// conflictStop cancels the earlier command like conflictCancel and
+	// sends STOP to the motor before the new command.
+	conflictStop = "stop"
+	// conflictReject refuses the new command.
+	conflictReject = "reject"
+)
+
+var (
+	// errCommandConflict is returned for a command rejected because another
+	// one is in flight.
+	errCommandConflict = errors.New("another command is in flight for this device")
+	// errCommandSuperseded is returned to a command that was cancelled by
+	// a newer one.
+	errCommandSuperseded = errors.New("command superseded by a newer one")
+)
+
+// coverConflict returns the configured curtain conflict policy.
+func (c *Config) coverConflict() string {
+	if c.Gateway.CoverConflict == "" {
+		return conflictForward
+	}
+	return c.Gateway.CoverConflict
+}
+
+// validateCoverConflict reports an unknown gateway.cover_conflict value.
+func (c *Config) validateCoverConflict() error {
+	switch c.coverConflict() {
+	case conflictForward, conflictCancel, conflictStop, conflictReject:
+		return nil
+	}
+	return fmt.Errorf("unknown gateway.cover_conflict %q", c.Gateway.CoverConflict)
+}
+
+// coverCommand is a curtain command that has been sent but not yet
+// confirmed by the gateway.
+type coverCommand struct {
+	arg    string
+	cancel context.CancelCauseFunc
+}
+
+// beginCoverCommand registers arg as the command in flight for ref,
+// applying the conflict policy to any command already in flight. The
+// returned context is cancelled with errCommandSuperseded if a later
+// command cancels this one; endCoverCommand must be called once it is no
+// longer needed.
+func (p *Proxy) beginCoverCommand(ctx context.Context, ref nodeRef, arg string) (context.Context, *coverCommand, error) {
+	key := ref.key()
+	policy := p.config.coverConflict()
+
+	p.coverMu.Lock()
+	prev := p.covers[key]
+	conflict := prev != nil && prev.arg != arg && policy != conflictForward
+	if conflict {
+		if policy == conflictReject {
+			p.coverMu.Unlock()
+			return nil, nil, errCommandConflict
+		}
+		prev.cancel(errCommandSuperseded)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	cmd := &coverCommand{arg: arg, cancel: cancel}
+	p.covers[key] = cmd
+	p.coverMu.Unlock()
+
+	if conflict {
+		log.Printf("%s for node %s supersedes %s", arg, key, prev.arg)
+	}
+	if conflict && policy == conflictStop {
+		err := p.sendMessage(&Message{
+			NodeID:    ref.NodeID,
+			Opcode:    "SWITCH",
+			Arg:       "STOP",
+			Requester: "HJ_Server",
+			ReqID:     p.nextReqID(),
+			ZKID:      p.outgoingZKID(ref),
+		})
+		if err != nil {
+			p.endCoverCommand(key, cmd)
+			return nil, nil, err
+		}
+	}
+	return ctx, cmd, nil
+}
+
+// endCoverCommand releases cmd once it has finished or timed out.
+func (p *Proxy) endCoverCommand(key string, cmd *coverCommand) {
+	p.coverMu.Lock()
+	if p.covers[key] == cmd {
+		delete(p.covers, key)
+	}
+	p.coverMu.Unlock()
+	cmd.cancel(nil)
+}
+
+// settleCoverCommand marks the command in flight for key as done when the
+// gateway reports the state it asked for.
+func (p *Proxy) settleCoverCommand(key, arg string) {
+	p.coverMu.Lock()
+	if cmd := p.covers[key]; cmd != nil && cmd.arg == arg {
+		delete(p.covers, key)
+	}
+	p.coverMu.Unlock()
+}
+
+// coverMotion tracks the estimated position of a curtain with a known
+// travel time.
+type coverMotion struct {
+	from   float64       // position when the last movement started, 0-100
+	dir    float64       // +1 while opening, -1 while closing, 0 when still
+	start  time.Time     // when the last movement started
+	travel time.Duration // full travel time in the direction of movement
+	timer  *time.Timer   // fires when the movement is expected to end
+}
+
+// position returns the estimated position at now.
+func (m *coverMotion) position(now time.Time) float64 {
+	if m.dir == 0 || m.travel <= 0 {
+		return m.from
+	}
+	pos := m.from + m.dir*100*float64(now.Sub(m.start))/float64(m.travel)
+	return math.Max(0, math.Min(100, pos))
+}
+
+// travelTime returns how long the curtain takes to complete arg, preferring
+// a calibrated time over the configured one.
+func (p *Proxy) travelTime(dev *device, arg string) time.Duration {
+	p.coverMu.Lock()
+	learned, ok := p.calibration[dev.Ref.key()]
+	p.coverMu.Unlock()
+	if ok {
+		if arg == "OPEN" {
+			return seconds(learned.Open)
+		}
+		return seconds(learned.Close)
+	}
+	return seconds(dev.Config.TravelTime)
+}
+
+// seconds converts a duration in (fractional) seconds from the
+// configuration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// startTransition reports a curtain pushed as a cover entity as opening or
+// closing once a command for it is sent. Without a travel time the final
+// state follows when the gateway reports it; otherwise it is reported once
+// the curtain is expected to have arrived.
+func (p *Proxy) startTransition(dev *device, arg string) {
+	var moving string
+	var dir float64
+	switch arg {
+	case "OPEN":
+		moving, dir = "opening", 1
+	case "CLOSE":
+		moving, dir = "closing", -1
+	default:
+		p.abortTransition(dev)
+		return
+	}
+	if dev.EntityID != "" && p.config.coverEntities() {
+		p.pushState(dev, moving)
+		p.watchTransition(dev, arg)
+	}
+
+	travel := p.travelTime(dev, arg)
+	if travel <= 0 {
+		return
+	}
+	key := dev.Ref.key()
+	initial, _ := statePosition(p.deviceState(key))
+	target := 50 + dir*50
+	now := time.Now()
+
+	p.coverMu.Lock()
+	defer p.coverMu.Unlock()
+	m := p.motion[key]
+	if m == nil {
+		m = &coverMotion{from: initial}
+		p.motion[key] = m
+	}
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	from := m.position(now)
+	*m = coverMotion{from: from, dir: dir, start: now, travel: travel}
+
+	var timer *time.Timer
+	remaining := time.Duration(math.Abs(target-from) / 100 * float64(travel))
+	timer = time.AfterFunc(remaining, func() {
+		p.coverMu.Lock()
+		done := m.timer == timer
+		if done {
+			*m = coverMotion{from: target}
+		}
+		p.coverMu.Unlock()
+		if done {
+			p.reportCover(key)
+		}
+	})
+	m.timer = timer
+}
+
+// abortTransition ends a curtain's transition early, keeping its estimated
+// position and reporting its last known state again.
+func (p *Proxy) abortTransition(dev *device) {
+	key := dev.Ref.key()
+	p.stopWatch(key)
+	p.coverMu.Lock()
+	if m := p.motion[key]; m != nil && m.timer != nil {
+		m.timer.Stop()
+		*m = coverMotion{from: m.position(time.Now())}
+	}
+	p.coverMu.Unlock()
+	p.reportCover(key)
+}
+
+// travelling reports whether the curtain at key is expected to be moving.
+func (p *Proxy) travelling(key string) bool {
+	p.coverMu.Lock()
+	defer p.coverMu.Unlock()
+	m := p.motion[key]
+	return m != nil && m.timer != nil
+}
+
+// statePosition returns the position implied by a curtain's gateway
+// argument, if any.
+func statePosition(arg string) (float64, bool) {
+	switch arg {
+	case "OPEN", "ON":
+		return 100, true
+	case "CLOSE", "OFF":
+		return 0, true
+	}
+	return 0, false
+}
+
+// coverPosition returns a curtain's position from 0 (closed) to 100
+// (open): estimated from its travel time while it moves, otherwise taken
+// from its last reported state.
+func (p *Proxy) coverPosition(key string) (int, bool) {
+	p.coverMu.Lock()
+	m := p.motion[key]
+	var pos float64
+	if m != nil {
+		pos = m.position(time.Now())
+	}
+	p.coverMu.Unlock()
+	if m == nil {
+		var ok bool
+		if pos, ok = statePosition(p.deviceState(key)); !ok {
+			return 0, false
+		}
+	}
+	return int(math.Round(pos)), true
+}
+
+// reportCover pushes the state matching a curtain's last known gateway
+// argument to Home Assistant.
+func (p *Proxy) reportCover(key string) {
+	dev, ok := p.lookupDevice(key)
+	if !ok || dev.EntityID == "" {
+		return
+	}
+	if state, ok := p.haState(&dev, p.deviceState(key)); ok {
+		p.pushState(&dev, state)
+	}
+}
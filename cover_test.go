@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+// startCoverProxy starts a proxy whose curtain on node 9 is never confirmed
+// by the fake gateway, so its commands stay in flight.
+func startCoverProxy(t *testing.T, policy string) (*Proxy, *gatewayLog) {
+	t.Helper()
+
+	frames := &gatewayLog{}
+	gw := startFakeGateway(t, 2, frames.record)
+	config := testConfig(t, gw, 2)
+	config.Gateway.CoverConflict = policy
+	config.Devices.Curtains = map[string]DeviceConfig{"9": {Entity: "curtain_nine", Timeout: 5}}
+	proxy := startProxy(t, config)
+	waitFor(t, time.Second, func() bool { return gw.Logins() == 1 })
+	return proxy, frames
+}
+
+// openInFlight sends OPEN to node 9 in the background and waits until it
+// is registered as in flight. The returned channel receives its result.
+func openInFlight(t *testing.T, proxy *Proxy) <-chan error {
+	t.Helper()
+
+	result := make(chan error, 1)
+	go func() { result <- proxy.sendSwitch(context.Background(), nodeRef{NodeID: "9"}, "OPEN") }()
+	waitFor(t, time.Second, func() bool {
+		proxy.coverMu.Lock()
+		defer proxy.coverMu.Unlock()
+		return proxy.covers["9"] != nil
+	})
+	return result
+}
+
+func TestCoverConflictReject(t *testing.T) {
+	proxy, frames := startCoverProxy(t, conflictReject)
+	openInFlight(t, proxy)
+
+	err := proxy.sendSwitch(context.Background(), nodeRef{NodeID: "9"}, "CLOSE")
+	if !errors.Is(err, errCommandConflict) {
+		t.Fatalf("sendSwitch(CLOSE) = %v, want %v", err, errCommandConflict)
+	}
+	for _, msg := range frames.find("SWITCH", "9") {
+		if msg.Arg != "OPEN" {
+			t.Errorf("rejected command reached the gateway: %v", msg.Arg)
+		}
+	}
+}
+
+func TestCoverConflictCancelAndStop(t *testing.T) {
+	for _, policy := range []string{conflictCancel, conflictStop} {
+		t.Run(policy, func(t *testing.T) {
+			proxy, frames := startCoverProxy(t, policy)
+			open := openInFlight(t, proxy)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if err := proxy.sendSwitch(ctx, nodeRef{NodeID: "9"}, "CLOSE"); !errors.Is(err, errRequestTimeout) {
+				t.Errorf("sendSwitch(CLOSE) = %v, want %v", err, errRequestTimeout)
+			}
+			select {
+			case err := <-open:
+				if !errors.Is(err, errCommandSuperseded) {
+					t.Errorf("sendSwitch(OPEN) = %v, want %v", err, errCommandSuperseded)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("OPEN was not cancelled")
+			}
+
+			var args []interface{}
+			for _, msg := range frames.find("SWITCH", "9") {
+				args = append(args, msg.Arg)
+			}
+			want := []interface{}{"OPEN", "CLOSE"}
+			if policy == conflictStop {
+				want = []interface{}{"OPEN", "STOP", "CLOSE"}
+			}
+			if len(args) != len(want) {
+				t.Fatalf("gateway received %v, want %v", args, want)
+			}
+			for i := range want {
+				if args[i] != want[i] {
+					t.Fatalf("gateway received %v, want %v", args, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCoverConflictInvalidPolicy(t *testing.T) {
+	var config Config
+	config.Gateway.CoverConflict = "ignore"
+	if err := NewProxy(&config).Start(); err == nil {
+		t.Fatal("Start() accepted an unknown cover_conflict policy")
+	}
+}
+
+func TestCalibrateCurtain(t *testing.T) {
+	// The fake gateway confirms a movement once the simulated motor has
+	// finished it.
+	gw := startFakeGateway(t, 4, func(msg *fakegw.Message) {
+		if msg.Opcode == "SWITCH" && msg.NodeID == "4" {
+			switch msg.Arg {
+			case "OPEN":
+				time.Sleep(120 * time.Millisecond)
+			case "CLOSE":
+				time.Sleep(60 * time.Millisecond)
+			}
+		}
+	})
+	config := testConfig(t, gw, 4)
+	config.DataDir = t.TempDir()
+	config.Devices.Curtains = map[string]DeviceConfig{"4": {Entity: "curtain_four"}}
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}}
+	proxy := startProxy(t, config)
+	waitFor(t, time.Second, func() bool { return gw.Logins() == 1 })
+
+	if _, err := proxy.calibrate(context.Background(), nodeRef{NodeID: "1"}); !errors.Is(err, errNotCurtain) {
+		t.Errorf("calibrate(light) = %v, want %v", err, errNotCurtain)
+	}
+
+	result, err := proxy.calibrate(context.Background(), nodeRef{NodeID: "4"})
+	if err != nil {
+		t.Fatalf("calibrate: %v", err)
+	}
+	if result.Open < 0.12 || result.Open > 1 || result.Close < 0.06 || result.Close > result.Open {
+		t.Errorf("calibrate = %+v, want open ~0.12s and close ~0.06s", result)
+	}
+	if _, err := os.Stat(filepath.Join(config.DataDir, calibrationFile)); err != nil {
+		t.Errorf("calibration not saved: %v", err)
+	}
+	if got := proxy.travelTime(&device{Ref: nodeRef{NodeID: "4"}}, "OPEN"); got != seconds(result.Open) {
+		t.Errorf("travel time after calibration = %s, want %gs", got, result.Open)
+	}
+
+	// A restarted proxy picks the calibration up again.
+	restarted := NewProxy(config)
+	if err := restarted.loadCalibration(); err != nil {
+		t.Fatalf("loadCalibration: %v", err)
+	}
+	if got := restarted.calibration["4"]; got != result {
+		t.Errorf("loaded calibration %+v, want %+v", got, result)
+	}
+}
+
+func TestSaveCalibrationKeepsStored(t *testing.T) {
+	var config Config
+	config.DataDir = t.TempDir()
+	file := filepath.Join(config.DataDir, calibrationFile)
+	if err := os.WriteFile(file, []byte(`{"5": {"open": 10, "close": 12}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A curtain calibrated before the file was read is saved next to the
+	// stored calibrations instead of replacing them.
+	proxy := NewProxy(&config)
+	proxy.coverMu.Lock()
+	proxy.calibration = map[string]travelTimes{"4": {Open: 3, Close: 2}}
+	proxy.coverMu.Unlock()
+	if err := proxy.saveCalibration(); err != nil {
+		t.Fatalf("saveCalibration: %v", err)
+	}
+	restarted := NewProxy(&config)
+	if err := restarted.loadCalibration(); err != nil {
+		t.Fatalf("loadCalibration: %v", err)
+	}
+	if got := restarted.calibration; got["4"] != (travelTimes{Open: 3, Close: 2}) || got["5"] != (travelTimes{Open: 10, Close: 12}) {
+		t.Errorf("saved calibration = %+v, want nodes 4 and 5", got)
+	}
+
+	// Nothing is written once a backup has been restored.
+	restored, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.restored.Store(true)
+	proxy.coverMu.Lock()
+	proxy.calibration["4"] = travelTimes{Open: 30, Close: 20}
+	proxy.coverMu.Unlock()
+	if err := proxy.saveCalibration(); err != nil {
+		t.Fatalf("saveCalibration after restore: %v", err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != string(restored) {
+		t.Errorf("calibration written after restore: %s", data)
+	}
+}
+
+func TestCoverMotionPosition(t *testing.T) {
+	start := time.Now()
+	m := coverMotion{from: 20, dir: 1, start: start, travel: 10 * time.Second}
+
+	for _, tt := range []struct {
+		after time.Duration
+		want  float64
+	}{
+		{0, 20},
+		{5 * time.Second, 70},
+		{8 * time.Second, 100},
+		{time.Minute, 100},
+	} {
+		if got := m.position(start.Add(tt.after)); got != tt.want {
+			t.Errorf("position after %s = %g, want %g", tt.after, got, tt.want)
+		}
+	}
+
+	m.dir = -1
+	if got := m.position(start.Add(time.Second)); got != 10 {
+		t.Errorf("closing position after 1s = %g, want 10", got)
+	}
+}
+
+func TestTransitionWatchdog(t *testing.T) {
+	defer func(grace time.Duration) { stuckGrace = grace }(stuckGrace)
+	stuckGrace = 50 * time.Millisecond
+
+	var config Config
+	config.HomeAssistant.CurtainDomain = "cover"
+	config.Devices.Curtains = map[string]DeviceConfig{
+		"2": {Entity: "curtain_two", TravelTime: 0.05},
+		"3": {Entity: "curtain_three", TravelTime: 0.05},
+		"4": {Entity: "curtain_four", TravelTime: 0.05},
+	}
+	proxy := NewProxy(&config)
+	defer proxy.stopWatches()
+
+	// Curtain 2 reports its final state in time, curtain 4 is stopped
+	// part way, and curtain 3 never reports.
+	for _, key := range []string{"2", "3", "4"} {
+		dev, _ := proxy.lookupDevice(key)
+		proxy.startTransition(&dev, "OPEN")
+	}
+	proxy.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "OPEN"})
+	proxy.handleMessage(&Message{NodeID: "4", Opcode: "SWITCH", Arg: "STOP"})
+
+	entityState := func(entityID string) string {
+		proxy.stateMu.RLock()
+		defer proxy.stateMu.RUnlock()
+		return proxy.entity[entityID]
+	}
+	waitFor(t, time.Second, func() bool { return proxy.watch.stuck.Load() == 1 })
+	time.Sleep(100 * time.Millisecond)
+	if n := proxy.watch.stuck.Load(); n != 1 {
+		t.Errorf("%d stuck transitions, want 1", n)
+	}
+	if got := entityState("curtain_three"); got != "unknown" {
+		t.Errorf("stuck curtain state = %q, want unknown", got)
+	}
+	if got := entityState("curtain_two"); got != "open" {
+		t.Errorf("settled curtain state = %q, want open", got)
+	}
+}
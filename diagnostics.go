@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clockSkewLimit is the difference to Home Assistant's clock from which
+// the clock check warns. The proxy sets the gateway clock from its own.
+const clockSkewLimit = 30 * time.Second
+
+// Results of a diagnostic check.
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// diagnosticCheck is the result of one check of a diagnostics report.
+type diagnosticCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// diagnosticReport is the output of the doctor command and of
+// GET /diagnostics. Secrets from the configuration are masked, so it can be
+// pasted into an issue as is.
+type diagnosticReport struct {
+	Version string            `json:"version"`
+	Time    time.Time         `json:"time"`
+	Config  []string          `json:"config"` // the startup summary
+	Checks  []diagnosticCheck `json:"checks"`
+}
+
+// failed reports whether any check failed.
+func (r *diagnosticReport) failed() bool {
+	for _, check := range r.Checks {
+		if check.Status == checkFail {
+			return true
+		}
+	}
+	return false
+}
+
+// markdown formats the report for a GitHub issue.
+func (r *diagnosticReport) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### konke-ha-proxy diagnostics\n\n%s, %s\n\n", r.Version, r.Time.Format(time.RFC3339))
+	b.WriteString("| Check | Status | Detail |\n| --- | --- | --- |\n")
+	for _, check := range r.Checks {
+		detail := strings.ReplaceAll(strings.ReplaceAll(check.Detail, "|", `\|`), "\n", "<br>")
+		fmt.Fprintf(&b, "| %s | %s | %s |\n", check.Name, check.Status, detail)
+	}
+	b.WriteString("\n```\n")
+	for _, line := range r.Config {
+		b.WriteString(line + "\n")
+	}
+	b.WriteString("```\n")
+	return b.String()
+}
+
+// configSecrets returns the values of the secret settings in c, longest
+// first.
+func configSecrets(c *Config) []string {
+	var secrets []string
+	var walk func(name string, v reflect.Value)
+	walk = func(name string, v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			if !v.IsNil() {
+				walk(name, v.Elem())
+			}
+		case reflect.Struct:
+			t := v.Type()
+			for i := 0; i < t.NumField(); i++ {
+				if field := yamlName(t.Field(i)); field != "" {
+					walk(field, v.Field(i))
+				}
+			}
+		case reflect.Map:
+			for _, k := range v.MapKeys() {
+				walk(name, v.MapIndex(k))
+			}
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				walk(name, v.Index(i))
+			}
+		case reflect.String:
+			if secretSettings[name] && v.String() != "" {
+				secrets = append(secrets, v.String())
+			}
+		}
+	}
+	walk("", reflect.ValueOf(*c))
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	return secrets
+}
+
+// redact masks the secrets in the report.
+func (r *diagnosticReport) redact(secrets []string) {
+	mask := func(s string) string {
+		for _, secret := range secrets {
+			s = strings.ReplaceAll(s, secret, "***")
+		}
+		return s
+	}
+	for i := range r.Config {
+		r.Config[i] = mask(r.Config[i])
+	}
+	for i := range r.Checks {
+		r.Checks[i].Detail = mask(r.Checks[i].Detail)
+	}
+}
+
+// diagnose runs the checks. A standalone run, from the doctor command,
+// connects to the gateway and tries the HTTP port itself; otherwise the
+// state of the running proxy is reported.
+func (p *Proxy) diagnose(ctx context.Context, standalone bool) *diagnosticReport {
+	report := &diagnosticReport{
+		Version: currentBuild().String(),
+		Time:    time.Now(),
+		Config:  p.config.configSummary(),
+	}
+	report.Checks = append(report.Checks, p.checkConfig())
+	if standalone {
+		report.Checks = append(report.Checks, p.probeGateway(ctx)...)
+	} else {
+		report.Checks = append(report.Checks, p.checkSession()...)
+	}
+	report.Checks = append(report.Checks, p.checkHomeAssistant(ctx)...)
+	report.Checks = append(report.Checks, checkPort("http_port", p.config.HTTPServer.Host, p.config.HTTPServer.Port, standalone))
+	if p.config.splitAdmin() {
+		admin := p.config.HTTPServer.Admin
+		report.Checks = append(report.Checks, checkPort("admin_port", admin.Host, admin.Port, standalone))
+	}
+	report.redact(configSecrets(p.config))
+	return report
+}
+
+// checkConfig reports the configuration errors and warnings.
+func (p *Proxy) checkConfig() diagnosticCheck {
+	check := diagnosticCheck{Name: "config", Status: checkOK, Detail: "no issues"}
+	var lines []string
+	for _, fe := range p.config.validate() {
+		lines = append(lines, fe.format())
+	}
+	if len(lines) > 0 {
+		check.Status = checkFail
+	} else if lines = p.config.configWarnings(); len(lines) > 0 {
+		check.Status = checkWarn
+	}
+	if len(lines) > 0 {
+		check.Detail = strings.Join(lines, "\n")
+	}
+	return check
+}
+
+// checkSession reports the gateway session of the running proxy.
+func (p *Proxy) checkSession() []diagnosticCheck {
+	target := p.config.gatewayTarget()
+	if !p.Connected() {
+		return []diagnosticCheck{
+			{Name: "gateway", Status: checkFail, Detail: "not connected to " + target},
+			{Name: "login", Status: checkSkip, Detail: "not connected"},
+		}
+	}
+	checks := []diagnosticCheck{{Name: "gateway", Status: checkOK, Detail: "connected to " + target}}
+	switch {
+	case p.Ready():
+		checks = append(checks, diagnosticCheck{Name: "login", Status: checkOK, Detail: "logged in, session ready"})
+	case p.readiness.accepted():
+		checks = append(checks, diagnosticCheck{Name: "login", Status: checkOK, Detail: "logged in, waiting for the inventory sync"})
+	default:
+		checks = append(checks, diagnosticCheck{Name: "login", Status: checkFail, Detail: "the gateway has not accepted the login"})
+	}
+	return checks
+}
+
+// probeGateway connects to the gateway and logs in to each zk controller,
+// like the query command. Nothing is pushed to Home Assistant.
+func (p *Proxy) probeGateway(ctx context.Context) []diagnosticCheck {
+	p.handlers = map[string]func(*Message){}
+	p.sinks = nil
+
+	target := p.config.gatewayTarget()
+	zkids := p.config.zkids()
+	logins := make([]*pendingRequest, len(zkids))
+	for i, zkid := range zkids {
+		ref, _ := p.resolveNode(zkid, "*")
+		logins[i] = p.pending.add(0, "LOGIN", ref.key())
+		defer p.pending.remove(logins[i])
+	}
+	if err := p.connect(ctx); err != nil {
+		return []diagnosticCheck{
+			{Name: "gateway", Status: checkFail, Detail: fmt.Sprintf("%s: %v", target, err)},
+			{Name: "login", Status: checkSkip, Detail: "not connected"},
+		}
+	}
+	defer p.disconnect()
+	go p.receive()
+
+	login := diagnosticCheck{Name: "login", Status: checkOK}
+	var results []string
+	wait, cancel := context.WithTimeout(ctx, p.config.requestTimeout())
+	defer cancel()
+	for i, req := range logins {
+		select {
+		case reply := <-req.reply:
+			if reply.Status == "success" {
+				results = append(results, fmt.Sprintf("zk controller %s: accepted", zkids[i]))
+				continue
+			}
+			results = append(results, fmt.Sprintf("zk controller %s: rejected (%s)", zkids[i], reply.Status))
+		case <-wait.Done():
+			results = append(results, fmt.Sprintf("zk controller %s: no answer", zkids[i]))
+		}
+		login.Status = checkFail
+	}
+	login.Detail = strings.Join(results, "\n")
+	return []diagnosticCheck{{Name: "gateway", Status: checkOK, Detail: "connected to " + target}, login}
+}
+
+// checkHomeAssistant calls the Home Assistant API with the token and
+// compares the clocks by the Date header of the answer.
+func (p *Proxy) checkHomeAssistant(ctx context.Context) []diagnosticCheck {
+	addr := hostPort(p.config.HomeAssistant.Host, p.config.HomeAssistant.Port)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/api/", nil)
+	req.Header.Set("Authorization", "Bearer "+p.config.HomeAssistant.Token)
+	sent := time.Now()
+	resp, err := p.haClient.Do(req)
+	if err != nil {
+		return []diagnosticCheck{
+			{Name: "home_assistant", Status: checkFail, Detail: fmt.Sprintf("%s not reachable: %v", addr, err)},
+			{Name: "clock", Status: checkSkip, Detail: "Home Assistant not reachable"},
+		}
+	}
+	resp.Body.Close()
+	received := time.Now()
+
+	ha := diagnosticCheck{Name: "home_assistant", Status: checkOK, Detail: addr + ": token accepted"}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		ha.Status, ha.Detail = checkFail, fmt.Sprintf("%s: token rejected (%d)", addr, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		ha.Status, ha.Detail = checkFail, fmt.Sprintf("%s: unexpected status %d", addr, resp.StatusCode)
+	}
+
+	clock := diagnosticCheck{Name: "clock", Status: checkSkip, Detail: "Home Assistant sent no Date header"}
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		// The header has whole seconds; compare with the middle of the call.
+		local := sent.Add(received.Sub(sent) / 2)
+		skew := local.Sub(date).Round(time.Second)
+		clock.Status, clock.Detail = checkOK, fmt.Sprintf("%s off Home Assistant's clock", skew)
+		if skew >= clockSkewLimit || skew <= -clockSkewLimit {
+			clock.Status = checkWarn
+		}
+	}
+	return []diagnosticCheck{ha, clock}
+}
+
+// checkPort reports whether the HTTP port of the check name can be used.
+// The running proxy is serving on it already.
+func checkPort(name, host string, port int, standalone bool) diagnosticCheck {
+	addr, err := listenAddr(host, port)
+	if err != nil {
+		return diagnosticCheck{Name: name, Status: checkFail, Detail: err.Error()}
+	}
+	if !standalone {
+		return diagnosticCheck{Name: name, Status: checkOK, Detail: "serving on " + addr}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return diagnosticCheck{Name: name, Status: checkFail, Detail: fmt.Sprintf("%s is not available: %v", addr, err)}
+	}
+	listener.Close()
+	return diagnosticCheck{Name: name, Status: checkOK, Detail: addr + " is free"}
+}
+
+// diagnosticsHandler serves GET /diagnostics, as JSON or, with
+// ?format=markdown, ready to paste into an issue.
+func diagnosticsHandler(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := proxy.diagnose(c.Request.Context(), false)
+		if c.Query("format") == "markdown" {
+			c.Data(200, "text/markdown; charset=utf-8", []byte(report.markdown()))
+			return
+		}
+		c.JSON(200, report)
+	}
+}
+
+// runDoctorCommand implements the "doctor" subcommand and returns the
+// process exit code.
+func runDoctorCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "config.yaml", "configuration file or directory")
+	profile := flags.String("profile", "", "configuration profile to use")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	timeout := flags.Duration("timeout", 30*time.Second, "give up after this long")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: konke-ha-proxy doctor [-json] [-config file] [-profile name]")
+		return 2
+	}
+	log.SetOutput(io.Discard)
+
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	transport, err := newTransport(config)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	report := NewProxyWithTransport(config, transport).diagnose(ctx, true)
+	if *asJSON {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Fprintln(stdout, string(out))
+	} else {
+		fmt.Fprint(stdout, report.markdown())
+	}
+	if report.failed() {
+		return 1
+	}
+	return 0
+}
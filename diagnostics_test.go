@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// startFakeHomeAssistant serves the API root, accepting token, with a
+// clock off by skew.
+func startFakeHomeAssistant(t *testing.T, token string, skew time.Duration) (string, int) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"message": "API running."}`))
+	}))
+	t.Cleanup(server.Close)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+func checkStatus(report *diagnosticReport, name string) string {
+	for _, check := range report.Checks {
+		if check.Name == name {
+			return check.Status
+		}
+	}
+	return ""
+}
+
+func TestDoctorCommand(t *testing.T) {
+	defer log.SetOutput(io.Discard)
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.Gateway.Password = "gateway-secret"
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "hall"}}
+	config.HomeAssistant.Token = "ha-token"
+	config.HomeAssistant.Host, config.HomeAssistant.Port = startFakeHomeAssistant(t, "ha-token", time.Minute)
+	config.HTTPServer.Host = "127.0.0.1"
+	data, _ := yaml.Marshal(config)
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := runDoctorCommand([]string{"-json", "-config", file}, &stdout, &stderr); code != 0 {
+		t.Fatalf("doctor: exit %d, stdout %s, stderr %q", code, stdout.String(), stderr.String())
+	}
+	var report diagnosticReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatalf("output %q: %v", stdout.String(), err)
+	}
+	want := map[string]string{"config": checkOK, "gateway": checkOK, "login": checkOK, "home_assistant": checkOK, "clock": checkWarn, "http_port": checkOK}
+	for name, status := range want {
+		if got := checkStatus(&report, name); got != status {
+			t.Errorf("check %s: %q, want %q", name, got, status)
+		}
+	}
+
+	// A rejected token fails the report.
+	config.HomeAssistant.Token = "wrong-token"
+	data, _ = yaml.Marshal(config)
+	os.WriteFile(file, data, 0o644)
+	stdout.Reset()
+	if code := runDoctorCommand([]string{"-config", file}, &stdout, &stderr); code != 1 {
+		t.Errorf("doctor with a rejected token: exit %d, want 1", code)
+	}
+	if !strings.Contains(stdout.String(), "| home_assistant | fail |") {
+		t.Errorf("report does not fail the token:\n%s", stdout.String())
+	}
+}
+
+func TestDiagnosticsRedaction(t *testing.T) {
+	var config Config
+	config.Gateway.Password = "gateway-secret"
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token"}}
+	report := diagnosticReport{Checks: []diagnosticCheck{{Name: "x", Detail: "login gateway-secret with admin-token"}}}
+	report.redact(configSecrets(&config))
+	if got := report.Checks[0].Detail; got != "login *** with ***" {
+		t.Errorf("redacted detail = %q", got)
+	}
+}
+
+func TestDiagnosticsEndpoint(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.HomeAssistant.Token = "ha-token"
+	config.HomeAssistant.Host, config.HomeAssistant.Port = startFakeHomeAssistant(t, "ha-token", 0)
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := get("/diagnostics", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d, want 401", rec.Code)
+	}
+	rec := get("/diagnostics", "admin-token")
+	var report diagnosticReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("status %d, body %s: %v", rec.Code, rec.Body, err)
+	}
+	for _, name := range []string{"gateway", "login", "home_assistant", "clock"} {
+		if got := checkStatus(&report, name); got != checkOK {
+			t.Errorf("check %s: %q, want ok", name, got)
+		}
+	}
+	if strings.Contains(rec.Body.String(), "admin-token") {
+		t.Error("report contains an auth token")
+	}
+
+	rec = get("/diagnostics?format=markdown", "admin-token")
+	if !strings.HasPrefix(rec.Body.String(), "### konke-ha-proxy diagnostics") {
+		t.Errorf("markdown report = %q", rec.Body)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// discoverySchema is the revision of the /api/discovery response. Fields
+// are only ever added within a revision.
+const discoverySchema = 1
+
+// discoveryInfo is the handshake a Home Assistant integration reads to
+// configure itself.
+type discoveryInfo struct {
+	Schema       int          `json:"schema"`
+	Proxy        buildInfo    `json:"proxy"`
+	Capabilities []string     `json:"capabilities"`
+	Connected    bool         `json:"connected"`
+	Ready        bool         `json:"ready"` // commands are accepted
+	Devices      []deviceInfo `json:"devices"`
+	// Endpoints are absolute URLs, except for the templates with {zkid}
+	// and {id} placeholders, which are paths.
+	Endpoints discoveryEndpoints `json:"endpoints"`
+	// EventCursor is the sequence number of the latest state change; an
+	// integration that subscribes with it misses nothing after this
+	// response.
+	EventCursor int64 `json:"event_cursor"`
+}
+
+type discoveryEndpoints struct {
+	Events  string `json:"events"`
+	WS      string `json:"ws"`
+	Devices string `json:"devices"`
+	States  string `json:"states"`
+	Switch  string `json:"switch"`
+	Curtain string `json:"curtain"`
+}
+
+// discover returns the handshake for a client reaching the proxy at
+// baseURL, listing the devices view lets through.
+func (p *Proxy) discover(baseURL string, view deviceFilter) discoveryInfo {
+	// The cursor is read first so that changes racing with the device
+	// list are delivered again rather than lost.
+	cursor := p.events.cursor()
+	return discoveryInfo{
+		Schema:       discoverySchema,
+		Proxy:        currentBuild(),
+		Capabilities: p.config.capabilities(),
+		Connected:    p.Connected(),
+		Ready:        p.Ready(),
+		Devices:      view.devices(p.listDevices()),
+		Endpoints: discoveryEndpoints{
+			Events:  baseURL + "/events",
+			WS:      "ws" + strings.TrimPrefix(baseURL, "http") + "/ws",
+			Devices: baseURL + "/devices",
+			States:  baseURL + "/states",
+			Switch:  "/zk/{zkid}/switch/{id}",
+			Curtain: "/zk/{zkid}/curtain/{id}",
+		},
+		EventCursor: cursor,
+	}
+}
+
+// requestBaseURL returns the URL the client used to reach the proxy.
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gin-gonic/gin/render"
+)
+
+// listFormat returns the format renderList writes for the request, "json"
+// or "msgpack", and marks the response as depending on the Accept header.
+// Endpoints that may answer 304 call it first, so that the ETag and the
+// headers of a 304 match the body they stand for.
+func listFormat(c *gin.Context) string {
+	vary := false
+	for _, v := range c.Writer.Header().Values("Vary") {
+		vary = vary || v == "Accept"
+	}
+	if !vary {
+		c.Writer.Header().Add("Vary", "Accept")
+	}
+	switch c.NegotiateFormat(binding.MIMEJSON, binding.MIMEMSGPACK2, binding.MIMEMSGPACK) {
+	case binding.MIMEMSGPACK, binding.MIMEMSGPACK2:
+		return "msgpack"
+	}
+	return "json"
+}
+
+// renderList writes obj as MessagePack for clients that ask for it with
+// Accept: application/msgpack, and as JSON otherwise. It is used by the
+// endpoints returning long lists.
+func renderList(c *gin.Context, code int, obj interface{}) {
+	if listFormat(c) == "msgpack" {
+		c.Render(code, render.MsgPack{Data: obj})
+	} else {
+		c.JSON(code, obj)
+	}
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+	return w
+}}
+
+// gzipResponses compresses responses for clients that accept gzip. Event
+// streams, WebSocket upgrades and bodies that are already compressed are
+// passed through.
+func gzipResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+		c.Header("Vary", "Accept-Encoding")
+		w := &gzipWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		defer w.close()
+		c.Next()
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, enc := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(name) == "gzip" {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipWriter decides on the first write or flush whether to compress, once
+// the handler has set its headers.
+type gzipWriter struct {
+	gin.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	h := w.ResponseWriter.Header()
+	status := w.ResponseWriter.Status()
+	if status == http.StatusNoContent || status == http.StatusNotModified ||
+		h.Get("Content-Encoding") != "" ||
+		strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") ||
+		strings.HasPrefix(h.Get("Content-Type"), "application/gzip") {
+		return
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	w.decide()
+	if w.gz == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	w.ResponseWriter.WriteHeaderNow()
+	return w.gz.Write(data)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush commits the headers, so the encoding is decided first: a stream
+// that flushes before its first line is compressed as announced.
+func (w *gzipWriter) Flush() {
+	w.decide()
+	if w.gz != nil {
+		w.ResponseWriter.WriteHeaderNow()
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// close finishes the compressed body.
+func (w *gzipWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	w.gz.Close()
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ugorji/go/codec"
+)
+
+func TestGzipResponses(t *testing.T) {
+	router := newRouter(eventProxy())
+
+	req := httptest.NewRequest(http.MethodGet, "/devices", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", rec.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devices []deviceInfo
+	if err := json.NewDecoder(gz).Decode(&devices); err != nil || len(devices) != 2 {
+		t.Errorf("decoding gzipped devices: %v, %d devices", err, len(devices))
+	}
+
+	for _, enc := range []string{"", "identity", "gzip;q=0"} {
+		req := httptest.NewRequest(http.MethodGet, "/devices", nil)
+		req.Header.Set("Accept-Encoding", enc)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(rec.Body.String(), "[") {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q, body %.20q", enc, rec.Header().Get("Content-Encoding"), rec.Body.String())
+		}
+	}
+}
+
+func TestMsgpackResponses(t *testing.T) {
+	proxy := eventProxy()
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	server := httptest.NewServer(newRouter(proxy))
+	defer server.Close()
+
+	get := func(path string, v interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		req.Header.Set("Accept", "application/msgpack")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/msgpack") {
+			t.Fatalf("GET %s: Content-Type %q", path, ct)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if err := codec.NewDecoderBytes(body, new(codec.MsgpackHandle)).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+
+	var devices []map[string]interface{}
+	get("/devices", &devices)
+	if len(devices) != 2 || string(devices[0]["entity_id"].([]byte)) != "light_one" {
+		t.Errorf("devices = %v", devices)
+	}
+	var poll struct {
+		Cursor int64                    `codec:"cursor"`
+		Events []map[string]interface{} `codec:"events"`
+	}
+	get("/poll?since=0", &poll)
+	if poll.Cursor != 1 || len(poll.Events) != 1 {
+		t.Errorf("poll = %+v, want one event", poll)
+	}
+}
+
+func TestGzipFlushBeforeWrite(t *testing.T) {
+	router := gin.New()
+	router.Use(gzipResponses())
+	router.GET("/stream", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Status(200)
+		c.Writer.Flush()
+		c.Writer.WriteString("first line\n")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	// The headers as they were sent with the flush.
+	if enc := rec.Result().Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", enc)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(gz); err != nil || string(body) != "first line\n" {
+		t.Errorf("body %q, %v", body, err)
+	}
+}
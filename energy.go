@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// energyFile holds the accumulated energy inside the data directory.
+const energyFile = "energy.json"
+
+// energyPushInterval is the least time between two updates of an energy
+// sensor in Home Assistant.
+var energyPushInterval = time.Minute
+
+// topicEnergy is the event bus topic of energy sensor updates.
+const topicEnergy = "energy/"
+
+// defaultPowerInterval is how often a metering socket is assumed to report
+// its power when power_interval is not set.
+const defaultPowerInterval = 5 * time.Minute
+
+// meters reports whether the device's power draw is accumulated.
+func (d DeviceConfig) meters() bool {
+	return d.PowerAttribute != ""
+}
+
+// powerHold returns how long a power reading of the device counts at
+// most: twice its report interval, so that the time the device was
+// offline or the proxy missed its reports is not filled with the last one.
+func (d DeviceConfig) powerHold() time.Duration {
+	if d.PowerInterval > 0 {
+		return 2 * time.Duration(d.PowerInterval*float64(time.Second))
+	}
+	return 2 * defaultPowerInterval
+}
+
+// energyEntityID returns the Home Assistant sensor the energy of dev is
+// reported as.
+func (d *device) energyEntityID() string {
+	if d.Config.EnergyEntity != "" {
+		return "sensor." + d.Config.EnergyEntity
+	}
+	return "sensor." + d.EntityID + "_energy"
+}
+
+// powerReading is the last power draw reported by a meter.
+type powerReading struct {
+	watts float64
+	at    time.Time
+}
+
+// energyMeter accumulates the energy of metering devices from their power
+// readings. The gateway only reports the instantaneous power, so the
+// energy is integrated locally, holding each reading until the next, for
+// a limited time.
+type energyMeter struct {
+	mutex   sync.Mutex
+	totals  map[string]float64 // kWh by node key
+	last    map[string]powerReading
+	pushed  map[string]time.Time
+	version int64 // bumped on every change
+	saved   int64 // version last saved
+}
+
+// add records a power reading and returns the total energy in kWh. The
+// previous reading counts for at most hold.
+func (m *energyMeter) add(key string, watts float64, now time.Time, hold time.Duration) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.totals == nil {
+		m.totals = make(map[string]float64)
+	}
+	if m.last == nil {
+		m.last = make(map[string]powerReading)
+	}
+	if _, ok := m.totals[key]; !ok {
+		m.totals[key] = 0
+	}
+	if prev, ok := m.last[key]; ok && now.After(prev.at) {
+		m.totals[key] += prev.watts * min(now.Sub(prev.at), hold).Hours() / 1000
+		m.version++
+	}
+	m.last[key] = powerReading{watts: watts, at: now}
+	return m.totals[key]
+}
+
+// total returns the energy accumulated for the node key.
+func (m *energyMeter) total(key string) (float64, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	kwh, ok := m.totals[key]
+	return kwh, ok
+}
+
+// due reports whether the sensor of key is to be updated at now, and
+// records the update if so.
+func (m *energyMeter) due(key string, now time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.pushed == nil {
+		m.pushed = make(map[string]time.Time)
+	}
+	if last, ok := m.pushed[key]; ok && now.Sub(last) < energyPushInterval {
+		return false
+	}
+	m.pushed[key] = now
+	return true
+}
+
+// meterPower accumulates the power reported in extra along with state for
+// a metering device and updates its energy sensor. A socket reported off
+// draws nothing, whether or not the report says so.
+func (p *Proxy) meterPower(dev *device, state string, extra map[string]interface{}, now time.Time) {
+	watts, ok := extra[dev.Config.PowerAttribute].(float64)
+	if state == "OFF" {
+		watts, ok = 0, true
+	}
+	if !ok {
+		return
+	}
+	kwh := p.energy.add(dev.Ref.key(), watts, now, dev.Config.powerHold())
+	if dev.EntityID == "" || p.updatesSuppressed(dev) || !p.energy.due(dev.Ref.key(), now) {
+		return
+	}
+	attributes := map[string]interface{}{
+		"unit_of_measurement": "kWh",
+		"device_class":        "energy",
+		"state_class":         "total_increasing",
+	}
+	if name := dev.displayName(); name != "" {
+		attributes["friendly_name"] = name + " energy"
+	}
+	entityID := dev.energyEntityID()
+	p.bus.publish(busEvent{
+		Topic:      topicEnergy + entityID,
+		Device:     dev,
+		EntityID:   entityID,
+		State:      strconv.FormatFloat(kwh, 'f', 3, 64),
+		Attributes: attributes,
+	})
+}
+
+// loadEnergy reads the energy accumulated by previous runs.
+func (p *Proxy) loadEnergy() error {
+	data, err := ioutil.ReadFile(filepath.Join(p.config.dataDir(), energyFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var totals map[string]float64
+	if err := json.Unmarshal(data, &totals); err != nil {
+		setAsideUnreadable(filepath.Join(p.config.dataDir(), energyFile), err)
+		return nil
+	}
+	p.energy.mutex.Lock()
+	defer p.energy.mutex.Unlock()
+	p.energy.totals = totals
+	return nil
+}
+
+// saveEnergy writes the accumulated energy to the data directory if it
+// changed since it was last saved and no backup was restored into it.
+func (p *Proxy) saveEnergy() error {
+	if p.restored.Load() {
+		return nil
+	}
+	m := &p.energy
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.version == m.saved {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.totals, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(p.config.dataDir(), energyFile), data); err != nil {
+		return err
+	}
+	m.saved = m.version
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEnergyMeter(t *testing.T) {
+	var m energyMeter
+	start := time.Now()
+	m.add("5", 1000, start, time.Hour)
+	m.add("5", 500, start.Add(30*time.Minute), time.Hour) // 1000 W for half an hour
+	kwh := m.add("5", 0, start.Add(90*time.Minute), time.Hour)
+	if math.Abs(kwh-1.0) > 1e-9 {
+		t.Errorf("energy = %v kWh, want 1", kwh)
+	}
+	// Readings out of order add nothing.
+	if kwh := m.add("5", 2000, start, time.Hour); math.Abs(kwh-1.0) > 1e-9 {
+		t.Errorf("energy after a stale reading = %v kWh, want 1", kwh)
+	}
+	// A reading counts for no longer than hold.
+	m.add("6", 1000, start, time.Hour)
+	if kwh := m.add("6", 1000, start.Add(3*time.Hour), time.Hour); math.Abs(kwh-1.0) > 1e-9 {
+		t.Errorf("energy after a gap = %v kWh, want 1", kwh)
+	}
+}
+
+func TestEnergySensor(t *testing.T) {
+	var config Config
+	config.DataDir = t.TempDir()
+	config.HomeAssistant.Port = 1 // nothing listens there
+	config.Devices.Lights = map[string]DeviceConfig{"5": {Entity: "socket", Name: "Kettle", PowerAttribute: "power"}}
+	proxy := NewProxy(&config)
+
+	var sent []busEvent
+	proxy.bus.subscribe(topicEnergy+"#", func(ev busEvent) { sent = append(sent, ev) })
+	dev, _ := proxy.lookupDevice("5")
+	start := time.Now()
+	proxy.meterPower(&dev, "ON", map[string]interface{}{"power": 2000.0}, start)
+	// Switched off, without a reading.
+	proxy.meterPower(&dev, "OFF", nil, start.Add(15*time.Second))
+	proxy.meterPower(&dev, "ON", map[string]interface{}{"power": 0.0}, start.Add(3*time.Minute))
+
+	// The sensor is updated at most once per energyPushInterval.
+	if len(sent) != 2 {
+		t.Fatalf("sent %d energy updates, want 2: %+v", len(sent), sent)
+	}
+	last := sent[1]
+	if last.EntityID != "sensor.socket_energy" || last.State != "0.008" {
+		t.Errorf("energy update = %s %s, want sensor.socket_energy 0.008", last.EntityID, last.State)
+	}
+	if last.Attributes["state_class"] != "total_increasing" || last.Attributes["device_class"] != "energy" || last.Attributes["unit_of_measurement"] != "kWh" {
+		t.Errorf("energy attributes = %v", last.Attributes)
+	}
+
+	// The total survives a restart.
+	if err := proxy.saveEnergy(); err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewProxy(&config)
+	if err := restarted.loadEnergy(); err != nil {
+		t.Fatal(err)
+	}
+	kwh, ok := restarted.energy.total("5")
+	if !ok || math.Abs(kwh-2000.0*15/3600/1000) > 1e-9 {
+		t.Errorf("restored energy = %v, %v", kwh, ok)
+	}
+	if list := restarted.listDevices(); list[0].Energy == nil || *list[0].Energy != kwh {
+		t.Errorf("GET /devices energy = %v, want %v", list[0].Energy, kwh)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stateVersion counts the changes to the state served by the GET state
+// endpoints, so that their ETags only change along with the responses.
+type stateVersion struct {
+	// epoch tells the versions of different runs apart, since every run
+	// counts from zero.
+	epoch string
+	n     atomic.Uint64
+}
+
+func newStateVersion() stateVersion {
+	return stateVersion{epoch: strconv.FormatInt(time.Now().UnixNano(), 36)}
+}
+
+// bump records a change.
+func (v *stateVersion) bump() {
+	v.n.Add(1)
+}
+
+// load returns the current version. It is read before the state, so that
+// a change racing with a response changes the next ETag too.
+func (v *stateVersion) load() uint64 {
+	return v.n.Load()
+}
+
+// etag returns an entity tag for version n. Responses that also depend on
+// values computed on read, such as the position of a moving curtain, pass
+// those as extra.
+func (v *stateVersion) etag(n uint64, extra ...int) string {
+	tag := v.epoch + "-" + strconv.FormatUint(n, 10)
+	if len(extra) > 0 {
+		h := fnv.New32a()
+		for _, x := range extra {
+			h.Write([]byte(strconv.Itoa(x) + ","))
+		}
+		tag += "-" + strconv.FormatUint(uint64(h.Sum32()), 36)
+	}
+	return `W/"` + tag + `"`
+}
+
+// notModified sets the ETag header and answers 304 when the client's
+// If-None-Match already names it.
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+	match := c.GetHeader("If-None-Match")
+	if match == "" {
+		return false
+	}
+	for _, tag := range strings.Split(match, ",") {
+		tag = strings.TrimSpace(tag)
+		// If-None-Match uses the weak comparison.
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			c.Status(304)
+			return true
+		}
+	}
+	return false
+}
+
+// devicesETag returns the entity tag of a device list read at version n
+// and rendered in format, as returned by listFormat.
+func (p *Proxy) devicesETag(n uint64, format string, list []deviceInfo) string {
+	var extra []int
+	for i := range list {
+		if list[i].Position != nil {
+			extra = append(extra, *list[i].Position)
+		}
+		if list[i].Health != nil {
+			extra = append(extra, list[i].Health.Score)
+		}
+	}
+	// The JSON and MessagePack bodies differ, so their tags must too.
+	tag := p.stateTag.etag(n, extra...)
+	if format != "json" {
+		tag = strings.TrimSuffix(tag, `"`) + "-" + format + `"`
+	}
+	return tag
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStateETags(t *testing.T) {
+	proxy := eventProxy()
+	router := newRouter(proxy)
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, path := range []string{"/switch/1", "/curtain/2", "/devices"} {
+		rec := get(path, "")
+		etag := rec.Header().Get("ETag")
+		if rec.Code != http.StatusOK || etag == "" {
+			t.Fatalf("GET %s: status %d, ETag %q", path, rec.Code, etag)
+		}
+		if rec := get(path, etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("GET %s with its ETag: status %d, %d bytes; want an empty 304", path, rec.Code, rec.Body.Len())
+		}
+		if rec := get(path, `"other", `+etag); rec.Code != http.StatusNotModified {
+			t.Errorf("GET %s with a list of ETags: status %d, want 304", path, rec.Code)
+		}
+		if rec := get(path, `W/"stale"`); rec.Code != http.StatusOK {
+			t.Errorf("GET %s with a stale ETag: status %d, want 200", path, rec.Code)
+		}
+	}
+
+	// A state change invalidates the tags. Repeating a state keeps the
+	// tag of the list, but not of the node, whose last_updated moves on.
+	etag := get("/switch/1", "").Header().Get("ETag")
+	devicesTag := get("/devices", "").Header().Get("ETag")
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	if rec := get("/devices", devicesTag); rec.Code != http.StatusNotModified {
+		t.Errorf("GET /devices after a repeated state: status %d, want 304", rec.Code)
+	}
+	if rec := get("/switch/1", etag); rec.Code != http.StatusOK {
+		t.Errorf("GET /switch/1 after a repeated state: status %d, want 200", rec.Code)
+	}
+	etag = get("/switch/1", "").Header().Get("ETag")
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "OFF"})
+	if rec := get("/switch/1", etag); rec.Code != http.StatusOK {
+		t.Errorf("GET /switch/1 after a change: status %d, want 200", rec.Code)
+	}
+}
+
+func TestDevicesETagPerFormat(t *testing.T) {
+	proxy := eventProxy()
+	router := newRouter(proxy)
+	get := func(accept, etag string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/devices", nil)
+		req.Header.Set("Accept", accept)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	jsonTag := get("application/json", "").Header().Get("ETag")
+	packTag := get("application/msgpack", "").Header().Get("ETag")
+	if jsonTag == packTag {
+		t.Errorf("JSON and MessagePack share the ETag %s", jsonTag)
+	}
+	// A cached JSON body is no answer to a MessagePack request.
+	if rec := get("application/msgpack", jsonTag); rec.Code != http.StatusOK {
+		t.Errorf("msgpack with the JSON ETag: status %d, want 200", rec.Code)
+	}
+	rec := get("application/msgpack", packTag)
+	if rec.Code != http.StatusNotModified || rec.Header().Get("Vary") != "Accept" {
+		t.Errorf("msgpack with its ETag: status %d, Vary %q; want 304 varying with Accept", rec.Code, rec.Header().Get("Vary"))
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventHistory is how many state changes are kept for clients catching up.
+const eventHistory = 1000
+
+// eventSeqFile holds, inside the data directory, the highest event
+// sequence number the proxy may have handed out. The events themselves are
+// only saved with the states, so after a crash the numbers handed out
+// since are known from it alone.
+const eventSeqFile = "event_seq"
+
+// eventSeqBlock is how many sequence numbers are reserved in the file at a
+// time.
+const eventSeqBlock = 100
+
+// defaultPollHold is how long GET /poll waits for a change by default.
+const defaultPollHold = 30 * time.Second
+
+// pollHold returns the longest time a long poll is held open.
+func (c *Config) pollHold() time.Duration {
+	if c.HTTPServer.PollHold > 0 {
+		return time.Duration(c.HTTPServer.PollHold) * time.Second
+	}
+	return defaultPollHold
+}
+
+// stateEvent is a change of an entity's state as pushed to Home Assistant.
+type stateEvent struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	ZKID     string    `json:"zkid"`
+	NodeID   string    `json:"node_id"`
+	Type     string    `json:"type"`
+	EntityID string    `json:"entity_id"`
+	State    string    `json:"state"`
+	Position *int      `json:"position,omitempty"`
+	// Source is what caused the change: "gateway" for reports the proxy
+	// did not command, such as a wall switch, or the API of the command.
+	Source string `json:"source,omitempty"`
+	// Echo is set when the change is the result of a command sent by the
+	// proxy rather than news from the gateway.
+	Echo bool `json:"echo,omitempty"`
+}
+
+// eventFeed keeps the recent state changes and wakes up clients waiting
+// for new ones.
+type eventFeed struct {
+	mutex   sync.Mutex
+	seq     int64
+	events  []stateEvent          // the last eventHistory events, oldest first
+	changed chan struct{}         // closed and replaced on every event
+	latest  map[string]stateEvent // the last event of each entity
+	// floor is the cursor this run started from when the previous run
+	// lost changes; clients resuming from below it missed them.
+	floor int64
+	// reserved is the highest sequence number reserve has recorded. It
+	// is called before a number beyond it is handed out.
+	reserved int64
+	reserve  func(seq int64) error
+}
+
+// publish appends ev to the feed, assigning its sequence number.
+func (f *eventFeed) publish(ev stateEvent) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.reserve != nil && f.seq >= f.reserved {
+		if err := f.reserve(f.seq + eventSeqBlock); err != nil {
+			log.Printf("Failed to save the event sequence number: %v", err)
+		}
+		f.reserved = f.seq + eventSeqBlock
+	}
+	f.seq++
+	ev.Seq = f.seq
+	f.events = append(f.events, ev)
+	if f.latest == nil {
+		f.latest = make(map[string]stateEvent)
+	}
+	f.latest[ev.EntityID] = ev
+	if len(f.events) > eventHistory {
+		f.events = f.events[len(f.events)-eventHistory:]
+	}
+	if f.changed != nil {
+		close(f.changed)
+		f.changed = nil
+	}
+}
+
+// since returns the events after cursor and a channel that is closed when
+// the next event is published. complete is false when events after the
+// cursor have already been discarded.
+func (f *eventFeed) since(cursor int64) (events []stateEvent, complete bool, changed <-chan struct{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	complete = cursor >= f.floor
+	if len(f.events) > 0 && f.events[0].Seq > cursor+1 {
+		complete = false
+	}
+	for _, ev := range f.events {
+		if ev.Seq > cursor {
+			events = append(events, ev)
+		}
+	}
+	if f.changed == nil {
+		f.changed = make(chan struct{})
+	}
+	return events, complete, f.changed
+}
+
+// latestStates returns the sequence number of the latest event and the
+// last event of every entity up to it.
+func (f *eventFeed) latestStates() (int64, map[string]stateEvent) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	latest := make(map[string]stateEvent, len(f.latest))
+	for id, ev := range f.latest {
+		latest[id] = ev
+	}
+	return f.seq, latest
+}
+
+// recent returns a copy of the kept events, oldest first.
+func (f *eventFeed) recent() []stateEvent {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]stateEvent(nil), f.events...)
+}
+
+// restore loads the events saved by the previous run into an empty feed,
+// so that sequence numbers continue and clients can resume from their
+// cursors across a restart.
+func (f *eventFeed) restore(events []stateEvent) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.seq > 0 || len(events) == 0 {
+		return
+	}
+	if len(events) > eventHistory {
+		events = events[len(events)-eventHistory:]
+	}
+	f.events = append([]stateEvent(nil), events...)
+	f.seq = events[len(events)-1].Seq
+}
+
+// resume returns where a client resuming from cursor continues, and
+// whether it missed changes: because they are no longer kept, or because
+// the cursor is ahead of the feed, as after a crash that lost the
+// latest events.
+func (f *eventFeed) resume(cursor int64) (int64, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if cursor > f.seq {
+		return f.seq, true
+	}
+	return cursor, cursor < f.floor || len(f.events) > 0 && f.events[0].Seq > cursor+1
+}
+
+// skipTo continues the sequence numbers after seq, the highest the
+// previous run may have handed out. When that is beyond the restored
+// events, the changes after them were lost, and cursors from before are
+// told to resync.
+func (f *eventFeed) skipTo(seq int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if seq > f.seq {
+		f.seq = seq
+		f.floor = seq
+	}
+	f.reserved = f.seq
+}
+
+// loadEventSeq continues the event sequence numbers after those of the
+// previous run and saves them in blocks from now on. It is called after
+// the saved events are restored.
+func (p *Proxy) loadEventSeq() error {
+	file := filepath.Join(p.config.dataDir(), eventSeqFile)
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if seq, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			setAsideUnreadable(file, err)
+		} else {
+			p.events.skipTo(seq)
+		}
+	}
+	p.events.mutex.Lock()
+	p.events.reserve = p.saveEventSeq
+	p.events.mutex.Unlock()
+	return nil
+}
+
+// saveEventSeq records seq as the highest event sequence number handed
+// out, unless a backup was restored into the data directory.
+func (p *Proxy) saveEventSeq(seq int64) error {
+	if p.restored.Load() {
+		return nil
+	}
+	return writeFileAtomic(filepath.Join(p.config.dataDir(), eventSeqFile), []byte(strconv.FormatInt(seq, 10)+"\n"))
+}
+
+// cursor returns the sequence number of the latest event.
+func (f *eventFeed) cursor() int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.seq
+}
+
+// publishState records a state pushed for dev.
+func (p *Proxy) publishState(dev *device, state string) {
+	ev := stateEvent{
+		Time:     p.localNow(),
+		ZKID:     zkidOrPrimary(p, dev.Ref.ZKID),
+		NodeID:   dev.Ref.NodeID,
+		Type:     dev.Kind,
+		EntityID: dev.EntityID,
+		State:    state,
+	}
+	origin := p.origins.origin(dev.Ref.key())
+	ev.Source, ev.Echo = origin.Source, origin.Echo
+	if dev.Kind == kindCurtain {
+		if pos, ok := p.coverPosition(dev.Ref.key()); ok {
+			ev.Position = &pos
+		}
+	}
+	p.events.publish(ev)
+}
+
+// skipEchoes reports whether the client asked with ?echoes=0 not to
+// receive the changes caused by commands the proxy sent.
+func skipEchoes(c *gin.Context) bool {
+	return c.Query("echoes") == "0"
+}
+
+// eventsHandler streams state changes as server-sent events. Clients that
+// reconnect with Last-Event-ID receive the changes they missed, as far as
+// they are still kept.
+func eventsHandler(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		view := viewOf(c)
+		noEchoes := skipEchoes(c)
+		cursor := proxy.events.cursor()
+		reset := false
+		if id := c.GetHeader("Last-Event-ID"); id != "" {
+			if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+				cursor, reset = proxy.events.resume(n)
+			}
+		}
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(200)
+		if reset {
+			fmt.Fprintf(c.Writer, "event: reset\ndata: {\"cursor\":%d}\n\n", cursor)
+		}
+		c.Writer.Flush()
+
+		ctx := c.Request.Context()
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+		for {
+			events, _, changed := proxy.events.since(cursor)
+			for _, ev := range events {
+				cursor = ev.Seq
+				if !view.allows(ev.ZKID, ev.NodeID) || (noEchoes && ev.Echo) {
+					continue
+				}
+				data, _ := json.Marshal(ev)
+				fmt.Fprintf(c.Writer, "id: %d\nevent: state\ndata: %s\n\n", ev.Seq, data)
+			}
+			c.Writer.Flush()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			case <-keepalive.C:
+				fmt.Fprint(c.Writer, ": keepalive\n\n")
+			}
+		}
+	}
+}
+
+// statesSnapshot is the body of GET /states.
+type statesSnapshot struct {
+	// Cursor is the sequence number of the last change the states
+	// include; stream or poll the changes after it.
+	Cursor int64           `json:"cursor"`
+	States []snapshotState `json:"states"`
+}
+
+// snapshotState is the state of a mapped entity in GET /states.
+type snapshotState struct {
+	ZKID     string `json:"zkid"`
+	NodeID   string `json:"node_id"`
+	Type     string `json:"type"`
+	EntityID string `json:"entity_id"`
+	State    string `json:"state"`
+	Position *int   `json:"position,omitempty"`
+	// Seq is the sequence number of the change that set the state, 0 if it
+	// is older than the event feed.
+	Seq int64 `json:"seq"`
+}
+
+// statesSnapshot returns the states of the mapped entities view lets
+// through together with
+// the cursor of the last change they include. States that changed since
+// the proxy started are taken from the event feed with the cursor, so
+// that no change is lost between the snapshot and the events after it.
+func (p *Proxy) statesSnapshot(view deviceFilter) statesSnapshot {
+	cursor, latest := p.events.latestStates()
+	snapshot := statesSnapshot{Cursor: cursor, States: []snapshotState{}}
+	for _, info := range view.devices(p.listDevices()) {
+		if info.EntityID == "" {
+			continue
+		}
+		s := snapshotState{ZKID: info.ZKID, NodeID: info.NodeID, Type: info.Type, EntityID: info.EntityID}
+		if ev, ok := latest[info.EntityID]; ok {
+			s.State, s.Position, s.Seq = ev.State, ev.Position, ev.Seq
+		} else {
+			s.State, s.Position = p.entityState(info.EntityID), info.Position
+		}
+		snapshot.States = append(snapshot.States, s)
+	}
+	return snapshot
+}
+
+// wait returns the events after cursor, waiting up to hold for the next one
+// if there are none yet.
+func (f *eventFeed) wait(ctx context.Context, cursor int64, hold time.Duration) ([]stateEvent, bool) {
+	events, complete, changed := f.since(cursor)
+	if len(events) > 0 || hold <= 0 {
+		return events, complete
+	}
+	timer := time.NewTimer(hold)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-changed:
+	}
+	events, complete, _ = f.since(cursor)
+	return events, complete
+}
+
+// pollResponse is the body of GET /poll.
+type pollResponse struct {
+	// Cursor is the since value for the next poll.
+	Cursor int64        `json:"cursor"`
+	Events []stateEvent `json:"events"`
+	// Reset is set when changes after since were discarded; the client
+	// should reload the full state from /devices.
+	Reset bool `json:"reset,omitempty"`
+}
+
+// pollHandler answers long polls: it returns the state changes after the
+// since cursor, holding the request open until one happens or the hold
+// time passes. Without since it returns the current cursor at once.
+func pollHandler(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		maxHold := proxy.config.pollHold()
+		hold := maxHold
+		if s := c.Query("hold"); s != "" {
+			seconds, err := strconv.Atoi(s)
+			if err != nil || seconds < 0 {
+				c.JSON(400, gin.H{"error": "Invalid hold"})
+				return
+			}
+			if d := time.Duration(seconds) * time.Second; d < maxHold {
+				hold = d
+			}
+		}
+
+		s := c.Query("since")
+		if s == "" {
+			renderList(c, 200, pollResponse{Cursor: proxy.events.cursor(), Events: []stateEvent{}})
+			return
+		}
+		since, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || since < 0 {
+			c.JSON(400, gin.H{"error": "Invalid since"})
+			return
+		}
+		if since > proxy.events.cursor() {
+			// A cursor from changes lost in a crash.
+			renderList(c, 200, pollResponse{Cursor: proxy.events.cursor(), Events: []stateEvent{}, Reset: true})
+			return
+		}
+
+		events, complete := proxy.events.wait(c.Request.Context(), since, hold)
+		resp := pollResponse{Cursor: since, Events: viewOf(c).events(events), Reset: !complete}
+		if skipEchoes(c) {
+			kept := resp.Events[:0:0]
+			for _, ev := range resp.Events {
+				if !ev.Echo {
+					kept = append(kept, ev)
+				}
+			}
+			resp.Events = kept
+		}
+		if resp.Events == nil {
+			resp.Events = []stateEvent{}
+		}
+		if len(events) > 0 {
+			resp.Cursor = events[len(events)-1].Seq
+		}
+		renderList(c, 200, resp)
+	}
+}
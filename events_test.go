@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eventProxy returns a proxy without a gateway mapping light "1" and
+// curtain "2".
+func eventProxy() *Proxy {
+	var config Config
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}}
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "curtain_two"}}
+	return NewProxy(&config)
+}
+
+// readEvent reads the next state event from a server-sent event stream.
+func readEvent(t *testing.T, r *bufio.Reader) stateEvent {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var ev stateEvent
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				t.Fatal(err)
+			}
+			return ev
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	proxy := eventProxy()
+	server := httptest.NewServer(newRouter(proxy))
+	defer server.Close()
+
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	// Only changes after connecting are streamed.
+	proxy.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "OPEN"})
+	ev := readEvent(t, bufio.NewReader(resp.Body))
+	if ev.Seq != 2 || ev.EntityID != "curtain_two" || ev.State != "on" || ev.Type != kindCurtain {
+		t.Errorf("event = %+v, want curtain_two on with seq 2", ev)
+	}
+
+	// Reconnecting with Last-Event-ID replays what was missed.
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	if ev := readEvent(t, bufio.NewReader(resp2.Body)); ev.Seq != 1 || ev.EntityID != "light_one" {
+		t.Errorf("replayed event = %+v, want light_one with seq 1", ev)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	proxy := eventProxy()
+	router := newRouter(proxy)
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/discovery", nil)
+	req.Host = "proxy.local:8080"
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	var info discoveryInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Schema != discoverySchema || info.Proxy.Version == "" || len(info.Capabilities) == 0 {
+		t.Errorf("discovery = %+v", info)
+	}
+	if len(info.Devices) != 2 {
+		t.Errorf("discovered %d devices, want 2", len(info.Devices))
+	}
+	if info.Endpoints.Events != "http://proxy.local:8080/events" {
+		t.Errorf("events endpoint = %q", info.Endpoints.Events)
+	}
+	if info.EventCursor != 1 {
+		t.Errorf("event cursor = %d, want 1", info.EventCursor)
+	}
+}
+
+func TestEventFeedHistory(t *testing.T) {
+	var feed eventFeed
+	for i := 0; i < eventHistory+10; i++ {
+		feed.publish(stateEvent{Time: time.Now()})
+	}
+	if events, complete, _ := feed.since(0); complete || len(events) != eventHistory {
+		t.Errorf("since(0) = %d events, complete %v; want %d, incomplete", len(events), complete, eventHistory)
+	}
+	if events, complete, _ := feed.since(eventHistory + 5); !complete || len(events) != 5 {
+		t.Errorf("since(%d) = %d events, complete %v; want 5, complete", eventHistory+5, len(events), complete)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	proxy := eventProxy()
+	router := newRouter(proxy)
+	poll := func(query string) pollResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/poll"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /poll%s: status %d", query, rec.Code)
+		}
+		var resp pollResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	if resp := poll(""); resp.Cursor != 1 || len(resp.Events) != 0 {
+		t.Errorf("poll without since = %+v, want cursor 1 and no events", resp)
+	}
+	if resp := poll("?since=0"); resp.Cursor != 1 || len(resp.Events) != 1 || resp.Events[0].EntityID != "light_one" {
+		t.Errorf("poll since 0 = %+v, want the light's change", resp)
+	}
+
+	// A poll with nothing new is held until a change arrives.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "OFF"})
+	}()
+	start := time.Now()
+	resp := poll("?since=1&hold=5")
+	if resp.Cursor != 2 || len(resp.Events) != 1 || resp.Events[0].State != "off" {
+		t.Errorf("held poll = %+v, want the light turning off", resp)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("held poll returned after %v", elapsed)
+	}
+
+	// Without a change the hold time runs out.
+	if resp := poll("?since=2&hold=0"); resp.Cursor != 2 || len(resp.Events) != 0 {
+		t.Errorf("expired poll = %+v, want cursor 2 and no events", resp)
+	}
+	// A cursor from a previous run asks the client to resync.
+	if resp := poll("?since=99"); !resp.Reset || resp.Cursor != 2 {
+		t.Errorf("poll with a future cursor = %+v, want a reset to 2", resp)
+	}
+}
+
+func TestStatesSnapshot(t *testing.T) {
+	proxy := eventProxy()
+	proxy.entity["curtain_two"] = "off" // seeded before the feed
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "OFF"})
+
+	rec := httptest.NewRecorder()
+	newRouter(proxy).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/states", nil))
+	var snapshot statesSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Cursor != 2 || len(snapshot.States) != 2 {
+		t.Fatalf("snapshot = %+v, want cursor 2 and two states", snapshot)
+	}
+	if s := snapshot.States[0]; s.EntityID != "light_one" || s.State != "off" || s.Seq != 2 {
+		t.Errorf("light_one = %+v, want off from change 2", s)
+	}
+	if s := snapshot.States[1]; s.EntityID != "curtain_two" || s.State != "off" || s.Seq != 0 {
+		t.Errorf("curtain_two = %+v, want the seeded off", s)
+	}
+
+	// The changes after the cursor complete the snapshot.
+	proxy.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "OPEN"})
+	events, complete, _ := proxy.events.since(snapshot.Cursor)
+	if !complete || len(events) != 1 || events[0].EntityID != "curtain_two" || events[0].State != "on" {
+		t.Errorf("events after the cursor = %+v", events)
+	}
+}
+
+func TestEventReplayAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	proxy := eventProxy()
+	proxy.config.DataDir = dir
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	proxy.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "OPEN"})
+	if err := proxy.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := eventProxy()
+	restarted.config.DataDir = dir
+	if err := restarted.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if cursor := restarted.events.cursor(); cursor != 2 {
+		t.Fatalf("cursor after restart = %d, want 2", cursor)
+	}
+	restarted.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "OFF"})
+	events, complete, _ := restarted.events.since(1)
+	if !complete || len(events) != 2 || events[0].EntityID != "curtain_two" || events[1].Seq != 3 {
+		t.Errorf("events after cursor 1 = %+v", events)
+	}
+
+	// A cursor ahead of the feed, as after a crash lost changes, gets a
+	// reset to the current cursor.
+	server := httptest.NewServer(newRouter(restarted))
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	req.Header.Set("Last-Event-ID", "7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	if line, _ := reader.ReadString('\n'); line != "event: reset\n" {
+		t.Fatalf("first line = %q, want a reset", line)
+	}
+	if line, _ := reader.ReadString('\n'); line != "data: {\"cursor\":3}\n" {
+		t.Errorf("reset data = %q", line)
+	}
+	restarted.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "CLOSE"})
+	if ev := readEvent(t, reader); ev.Seq != 4 {
+		t.Errorf("event after the reset = %+v, want seq 4", ev)
+	}
+}
+
+func TestEventSeqAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	proxy := eventProxy()
+	proxy.config.DataDir = dir
+	if err := proxy.loadEventSeq(); err != nil {
+		t.Fatal(err)
+	}
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	if err := proxy.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	// Changes after the last save are lost in a crash, but the clients
+	// have seen them.
+	proxy.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "OPEN"})
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "OFF"})
+
+	restarted := eventProxy()
+	restarted.config.DataDir = dir
+	if err := restarted.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.loadEventSeq(); err != nil {
+		t.Fatal(err)
+	}
+	restarted.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "CLOSE"})
+	events, complete, _ := restarted.events.since(3)
+	if complete || len(events) != 1 || events[0].Seq != eventSeqBlock+1 {
+		t.Errorf("since(3) = %+v, complete %v; want seq %d and a reset", events, complete, eventSeqBlock+1)
+	}
+	if _, missed := restarted.events.resume(1); !missed {
+		t.Error("a cursor from before the crash resumes without a reset")
+	}
+	if _, complete, _ := restarted.events.since(eventSeqBlock + 1); !complete {
+		t.Error("a cursor of this run is told to reset")
+	}
+
+	// After a clean stop the numbers continue without a gap.
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.DataDir = dir
+	started := NewProxy(config)
+	if err := started.Start(); err != nil {
+		t.Fatal(err)
+	}
+	started.events.publish(stateEvent{EntityID: "light_one"})
+	cursor := started.events.cursor()
+	started.Stop()
+	again := eventProxy()
+	again.config.DataDir = dir
+	if err := again.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := again.loadEventSeq(); err != nil {
+		t.Fatal(err)
+	}
+	if _, missed := again.events.resume(cursor); missed || again.events.cursor() != cursor {
+		t.Errorf("cursor after a clean stop = %d, missed %v; want %d", again.events.cursor(), missed, cursor)
+	}
+}
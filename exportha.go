@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// haSecretName is the secrets.yaml entry the exported snippets take the
+// API token from.
+const haSecretName = "konke_ha_proxy_authorization"
+
+// proxyBaseURL returns the URL Home Assistant reaches the HTTP API at,
+// assuming it runs on the same host when the API listens on all
+// interfaces.
+func (c *Config) proxyBaseURL() string {
+	host := c.HTTPServer.Host
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(c.HTTPServer.Port))
+}
+
+// yamlString quotes s for YAML. JSON strings are valid YAML.
+func yamlString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// gatewayIdentifier returns the prefix of the unique IDs of the devices
+// behind a zk controller.
+func gatewayIdentifier(zkid string) string {
+	return "konke_" + zkid
+}
+
+// devicePath returns the API path of dev, relative to the base URL.
+func (c *Config) devicePath(dev *device) string {
+	path := dev.Kind + "/" + dev.Ref.NodeID
+	if dev.Ref.ZKID != "" {
+		path = "zk/" + dev.Ref.ZKID + "/" + path
+	}
+	return path
+}
+
+// haSnippet returns Home Assistant configuration for the mapped devices
+// that controls them through the proxy's REST endpoints: a rest switch for
+// every light, and for every curtain either a rest switch or, with
+// home_assistant.curtain_domain: cover, a template cover whose commands
+// are rest_command calls. The proxy pushes states to the same entities.
+func (c *Config) haSnippet(baseURL string) string {
+	var devs []*device
+	for _, dev := range buildInventory(c) {
+		if dev.EntityID != "" {
+			devs = append(devs, dev)
+		}
+	}
+	sort.Slice(devs, func(i, j int) bool {
+		if devs[i].Kind != devs[j].Kind {
+			return devs[i].Kind > devs[j].Kind // switches first
+		}
+		if devs[i].Ref.ZKID != devs[j].Ref.ZKID {
+			return devs[i].Ref.ZKID < devs[j].Ref.ZKID
+		}
+		return lessNodeID(devs[i].Ref.NodeID, devs[j].Ref.NodeID)
+	})
+
+	var switches, covers []*device
+	for _, dev := range devs {
+		if dev.Kind == kindCurtain && c.coverEntities() {
+			covers = append(covers, dev)
+		} else {
+			switches = append(switches, dev)
+		}
+	}
+	authorized := c.Auth.ProtectDevices
+
+	var b strings.Builder
+	line := func(indent int, format string, args ...interface{}) {
+		b.WriteString(strings.Repeat("  ", indent))
+		fmt.Fprintf(&b, format, args...)
+		b.WriteByte('\n')
+	}
+	name := func(dev *device) string {
+		if dev.Config.Name != "" {
+			return dev.Config.Name
+		}
+		return dev.EntityID
+	}
+	uniqueID := func(dev *device) string {
+		zkid := dev.Ref.ZKID
+		if zkid == "" {
+			zkid = c.zkids()[0]
+		}
+		return gatewayIdentifier(zkid) + "_" + dev.Ref.NodeID
+	}
+
+	line(0, "# Generated by konke-ha-proxy export-ha-config for %s.", baseURL)
+	if authorized {
+		line(0, "# Add to secrets.yaml: %s: \"Bearer <token with the devices scope>\"", haSecretName)
+	}
+
+	if len(covers) > 0 {
+		line(0, "rest_command:")
+		line(1, "konke_command:")
+		line(2, "url: %s", yamlString(baseURL+"/{{ path }}"))
+		line(2, "method: post")
+		line(2, "content_type: application/json")
+		line(2, "payload: '{\"arg\": \"{{ arg }}\"}'")
+		if authorized {
+			line(2, "headers:")
+			line(3, "Authorization: !secret %s", haSecretName)
+		}
+	}
+
+	if len(switches) > 0 {
+		line(0, "switch:")
+		for _, dev := range switches {
+			on, off, field := "ON", "OFF", "is_active"
+			if dev.Kind == kindCurtain {
+				on, off, field = "OPEN", "CLOSE", "is_open"
+			}
+			line(1, "- platform: rest")
+			line(2, "name: %s", yamlString(name(dev)))
+			line(2, "unique_id: %s", uniqueID(dev))
+			line(2, "resource: %s", yamlString(baseURL+"/"+c.devicePath(dev)))
+			line(2, "body_on: '{\"arg\": \"%s\"}'", on)
+			line(2, "body_off: '{\"arg\": \"%s\"}'", off)
+			line(2, "headers:")
+			line(3, "Content-Type: application/json")
+			if authorized {
+				line(3, "Authorization: !secret %s", haSecretName)
+			}
+			line(2, "is_on_template: \"{{ value_json.%s }}\"", field)
+		}
+	}
+
+	if len(covers) > 0 {
+		line(0, "cover:")
+		line(1, "- platform: template")
+		line(2, "covers:")
+		for _, dev := range covers {
+			line(3, "%s:", dev.EntityID)
+			line(4, "friendly_name: %s", yamlString(name(dev)))
+			line(4, "unique_id: %s", uniqueID(dev))
+			for _, action := range []struct{ name, arg string }{{"open_cover", "OPEN"}, {"close_cover", "CLOSE"}, {"stop_cover", "STOP"}} {
+				line(4, "%s:", action.name)
+				line(5, "service: rest_command.konke_command")
+				line(5, "data:")
+				line(6, "path: %s", c.devicePath(dev))
+				line(6, "arg: %s", action.arg)
+			}
+		}
+	}
+	return b.String()
+}
+
+// runExportHACommand implements the "export-ha-config" subcommand and
+// returns the process exit code.
+func runExportHACommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("export-ha-config", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "config.yaml", "configuration file or directory")
+	profile := flags.String("profile", "", "configuration profile to use")
+	baseURL := flags.String("url", "", "URL Home Assistant reaches the proxy at (default from http_server)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: konke-ha-proxy export-ha-config [-config file] [-profile name] [-url http://host:port]")
+		return 2
+	}
+
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	if *baseURL == "" {
+		*baseURL = config.proxyBaseURL()
+	}
+	fmt.Fprint(stdout, config.haSnippet(strings.TrimSuffix(*baseURL, "/")))
+	return 0
+}
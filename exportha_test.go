@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+func TestHASnippet(t *testing.T) {
+	var config Config
+	config.Gateway.ZKIDs = []string{"266590", "266591"}
+	config.HTTPServer.Port = 8500
+	config.Devices.Lights = map[string]DeviceConfig{
+		"10":       {Entity: "hall"},
+		"6":        {Entity: "ke_ting_deng_dai", Name: "客厅灯带"},
+		"266591/3": {Entity: "porch"},
+		"7":        {}, // not mapped
+	}
+	config.Devices.Curtains = map[string]DeviceConfig{"100": {Entity: "zhu_wo_chuang_lian"}}
+
+	snippet := config.haSnippet(config.proxyBaseURL())
+	var doc map[string]interface{}
+	if err := yaml3.Unmarshal([]byte(snippet), &doc); err != nil {
+		t.Fatalf("snippet is not YAML: %v\n%s", err, snippet)
+	}
+	switches, _ := doc["switch"].([]interface{})
+	if len(switches) != 4 || doc["cover"] != nil || doc["rest_command"] != nil {
+		t.Fatalf("snippet has %d switches and cover %v, want 4 and none:\n%s", len(switches), doc["cover"], snippet)
+	}
+	for i, want := range []string{
+		"http://127.0.0.1:8500/switch/6",
+		"http://127.0.0.1:8500/switch/10",
+		"http://127.0.0.1:8500/zk/266591/switch/3",
+		"http://127.0.0.1:8500/curtain/100",
+	} {
+		if got := switches[i].(map[string]interface{})["resource"]; got != want {
+			t.Errorf("switch %d resource = %v, want %s", i, got, want)
+		}
+	}
+	for _, want := range []string{`name: "客厅灯带"`, "unique_id: konke_266590_6", "unique_id: konke_266591_3", `body_on: '{"arg": "OPEN"}'`, "value_json.is_open"} {
+		if !strings.Contains(snippet, want) {
+			t.Errorf("snippet lacks %q:\n%s", want, snippet)
+		}
+	}
+
+	// Curtains pushed as covers become template covers calling a
+	// rest_command, which sends the token when the device endpoints
+	// require one.
+	config.HomeAssistant.CurtainDomain = "cover"
+	config.Auth.ProtectDevices = true
+	snippet = config.haSnippet("http://proxy.lan:8500")
+	doc = nil
+	if err := yaml3.Unmarshal([]byte(snippet), &doc); err != nil {
+		t.Fatalf("snippet is not YAML: %v\n%s", err, snippet)
+	}
+	if switches, _ := doc["switch"].([]interface{}); len(switches) != 3 {
+		t.Errorf("snippet has %d switches, want 3", len(switches))
+	}
+	for _, want := range []string{
+		`url: "http://proxy.lan:8500/{{ path }}"`,
+		"      zhu_wo_chuang_lian:\n",
+		"service: rest_command.konke_command",
+		"path: curtain/100\n            arg: STOP",
+		"Authorization: !secret " + haSecretName,
+	} {
+		if !strings.Contains(snippet, want) {
+			t.Errorf("snippet lacks %q:\n%s", want, snippet)
+		}
+	}
+}
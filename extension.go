@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExtensionConfig describes an external process that adds support for
+// opcodes and HTTP routes the proxy does not handle itself.
+//
+// Extensions speak newline-delimited JSON over stdin and stdout. The proxy
+// sends
+//
+//	{"type": "message", "message": {...}}   a gateway message with one of the opcodes
+//	{"type": "http", "id": 1, "method": "POST", "path": "/ir/send", "query": "...", "body": ...}
+//
+// and the extension may send
+//
+//	{"type": "send", "message": {...}}      a message for the gateway
+//	{"type": "response", "id": 1, "status": 200, "body": ...}
+//	{"type": "ha_state", "entity_id": "sensor.x", "state": "...", "attributes": {...}}
+//
+// Anything the extension writes to stderr ends up in the proxy's log.
+type ExtensionConfig struct {
+	Name    string   `yaml:"name"`
+	Command []string `yaml:"command"`
+	// Opcodes are forwarded to the extension. Opcodes the proxy handles
+	// itself cannot be taken over.
+	Opcodes []string `yaml:"opcodes"`
+	// Routes are path prefixes whose requests are forwarded to the
+	// extension, e.g. "/ir".
+	Routes []string `yaml:"routes"`
+}
+
+// errExtensionDown is returned for HTTP requests to an extension whose
+// process is not running.
+var errExtensionDown = errors.New("extension is not running")
+
+// extensionEnvelope is one line of the extension protocol.
+type extensionEnvelope struct {
+	Type       string                 `json:"type"`
+	ID         int64                  `json:"id,omitempty"`
+	Message    *Message               `json:"message,omitempty"`
+	Method     string                 `json:"method,omitempty"`
+	Path       string                 `json:"path,omitempty"`
+	Query      string                 `json:"query,omitempty"`
+	Body       json.RawMessage        `json:"body,omitempty"`
+	Status     int                    `json:"status,omitempty"`
+	EntityID   string                 `json:"entity_id,omitempty"`
+	State      string                 `json:"state,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// extension runs one extension process, restarting it when it exits.
+type extension struct {
+	config ExtensionConfig
+	proxy  *Proxy
+	sub    *subscription // the extension's opcodes
+
+	mutex sync.Mutex // guards stdin, seq and calls
+	stdin io.WriteCloser
+	seq   int64
+	calls map[int64]chan extensionEnvelope
+}
+
+// registerExtensions hands the extensions' opcodes to them.
+func (p *Proxy) registerExtensions() error {
+	for _, config := range p.config.Extensions {
+		if config.Name == "" || len(config.Command) == 0 {
+			return errors.New("extensions need a name and a command")
+		}
+		ext := &extension{config: config, proxy: p, calls: make(map[int64]chan extensionEnvelope)}
+		for _, opcode := range config.Opcodes {
+			if _, taken := p.handlers[opcode]; taken || p.broker.claims(opcode) {
+				return fmt.Errorf("extension %s: opcode %s is already handled", config.Name, opcode)
+			}
+		}
+		if len(config.Opcodes) > 0 {
+			ext.sub = p.broker.subscribe("extension:"+config.Name, config.Opcodes...)
+		}
+		p.extensions = append(p.extensions, ext)
+	}
+	return nil
+}
+
+// addExtensionSubsystems adds the subsystems that keep the extension
+// processes running and forward their opcodes to them. Forwarding runs
+// apart from the gateway connection, so a slow extension only delays its
+// own messages.
+func (p *Proxy) addExtensionSubsystems() {
+	for _, ext := range p.extensions {
+		name := "extension " + ext.config.Name
+		p.subsystems.add(name, nil, loop(ext.run))
+		if ext.sub == nil {
+			continue
+		}
+		p.subsystems.add(name+" forwarding", []string{name}, loop(func(ctx context.Context) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg := <-ext.sub.C:
+					ext.forward(msg)
+				}
+			}
+		}))
+	}
+}
+
+// run keeps the extension process running until ctx is cancelled.
+func (e *extension) run(ctx context.Context) {
+	for {
+		if err := e.serve(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Extension %s exited: %v", e.config.Name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// serve runs the process once and dispatches its output until it exits.
+func (e *extension) serve(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, e.config.Command[0], e.config.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Started extension %s", e.config.Name)
+
+	e.mutex.Lock()
+	e.stdin = stdin
+	e.mutex.Unlock()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var env extensionEnvelope
+		if err := json.Unmarshal(scanner.Bytes(), &env); err != nil {
+			log.Printf("Extension %s sent invalid JSON: %v", e.config.Name, err)
+			continue
+		}
+		e.handle(&env)
+	}
+
+	// Fail the requests still waiting for the process.
+	e.mutex.Lock()
+	e.stdin = nil
+	for id, reply := range e.calls {
+		close(reply)
+		delete(e.calls, id)
+	}
+	e.mutex.Unlock()
+	stdin.Close()
+	return cmd.Wait()
+}
+
+// handle processes one line from the extension.
+func (e *extension) handle(env *extensionEnvelope) {
+	switch env.Type {
+	case "send":
+		if env.Message == nil {
+			return
+		}
+		if err := e.proxy.sendMessage(env.Message); err != nil {
+			log.Printf("Extension %s: failed to send message: %v", e.config.Name, err)
+		}
+	case "response":
+		e.mutex.Lock()
+		reply, ok := e.calls[env.ID]
+		delete(e.calls, env.ID)
+		e.mutex.Unlock()
+		if ok {
+			reply <- *env
+		}
+	case "ha_state":
+		if env.EntityID != "" {
+			e.proxy.bus.publish(busEvent{
+				Topic:      topicExternal + env.EntityID,
+				EntityID:   env.EntityID,
+				State:      env.State,
+				Attributes: env.Attributes,
+			})
+		}
+	default:
+		log.Printf("Extension %s sent unknown message type %q", e.config.Name, env.Type)
+	}
+}
+
+// write sends one line to the extension.
+func (e *extension) write(env *extensionEnvelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.stdin == nil {
+		return errExtensionDown
+	}
+	_, err = e.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// forward passes a message with one of the extension's opcodes on.
+func (e *extension) forward(msg *Message) {
+	if err := e.write(&extensionEnvelope{Type: "message", Message: msg}); err != nil {
+		log.Printf("Extension %s: failed to forward %s: %v", e.config.Name, msg.Opcode, err)
+	}
+}
+
+// call forwards an HTTP request and waits for the extension's response.
+func (e *extension) call(ctx context.Context, env *extensionEnvelope, timeout time.Duration) (extensionEnvelope, error) {
+	reply := make(chan extensionEnvelope, 1)
+	e.mutex.Lock()
+	e.seq++
+	env.ID = e.seq
+	e.calls[env.ID] = reply
+	e.mutex.Unlock()
+	defer func() {
+		e.mutex.Lock()
+		delete(e.calls, env.ID)
+		e.mutex.Unlock()
+	}()
+
+	if err := e.write(env); err != nil {
+		return extensionEnvelope{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	select {
+	case resp, ok := <-reply:
+		if !ok {
+			return extensionEnvelope{}, errExtensionDown
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return extensionEnvelope{}, errRequestTimeout
+	}
+}
+
+// coreRouteSegments are the first path segments of the proxy's own
+// routes, which extensions cannot take over.
+var coreRouteSegments = map[string]bool{
+	"action": true, "actions": true, "admin": true, "anomalies": true, "api": true,
+	"archive": true, "backup": true, "curtain": true, "debug": true, "devices": true,
+	"diagnostics": true, "events": true, "gateway": true, "graphql": true, "healthz": true,
+	"history": true, "hooks": true, "logs": true, "macro": true, "metrics": true,
+	"mode": true, "poll": true, "restore": true, "snapshot": true, "states": true,
+	"stats": true, "switch": true, "version": true, "ws": true, "zk": true,
+}
+
+// extensionRoute matches the route prefixes extensions may claim: plain
+// path segments, without the parameters and wildcards of the router.
+var extensionRoute = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+// validateExtensions checks that the extensions can be started and that
+// their route prefixes can be mounted next to the proxy's and each
+// other's routes.
+func (c *Config) validateExtensions(add func(message string, path ...string)) {
+	claimed := map[string]string{} // first segments, by extension
+	for i, ext := range c.Extensions {
+		at := []string{"extensions", strconv.Itoa(i)}
+		if ext.Name == "" || len(ext.Command) == 0 {
+			add("extensions need a name and a command", at...)
+		}
+		for j, prefix := range ext.Routes {
+			path := append(at, "routes", strconv.Itoa(j))
+			if !extensionRoute.MatchString(prefix) {
+				add(fmt.Sprintf("route %q must start with / and name a plain path", prefix), path...)
+				continue
+			}
+			segment := strings.SplitN(prefix[1:], "/", 2)[0]
+			if coreRouteSegments[segment] {
+				add(fmt.Sprintf("route %q clashes with the proxy's /%s endpoints", prefix, segment), path...)
+			} else if other, ok := claimed[segment]; ok {
+				add(fmt.Sprintf("route %q clashes with the routes of extension %s", prefix, other), path...)
+			} else {
+				claimed[segment] = ext.Name
+			}
+		}
+	}
+}
+
+// registerExtensionRoutes forwards the extensions' route prefixes to them.
+// They are protected like the device endpoints, since extensions may
+// control devices.
+func registerExtensionRoutes(router *gin.Engine, proxy *Proxy, auth *authenticator) {
+	for _, ext := range proxy.extensions {
+		handler := extensionHandler(proxy, ext)
+		for _, prefix := range ext.config.Routes {
+			router.Any(prefix, auth.requireDevice(proxy), handler)
+			router.Any(prefix+"/*path", auth.requireDevice(proxy), handler)
+		}
+	}
+}
+
+func extensionHandler(proxy *Proxy, ext *extension) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		// Bodies that are not JSON are passed as a JSON string.
+		if len(body) > 0 && !json.Valid(body) {
+			body, _ = json.Marshal(string(body))
+		}
+
+		resp, err := ext.call(c.Request.Context(), &extensionEnvelope{
+			Type:   "http",
+			Method: c.Request.Method,
+			Path:   c.Request.URL.Path,
+			Query:  c.Request.URL.RawQuery,
+			Body:   body,
+		}, proxy.config.requestTimeout())
+		if err != nil {
+			gatewayError(c, err)
+			return
+		}
+
+		status := resp.Status
+		if status == 0 {
+			status = 200
+		}
+		if len(resp.Body) == 0 {
+			c.Status(status)
+			return
+		}
+		c.Data(status, "application/json; charset=utf-8", resp.Body)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHelperExtension is not a real test: it is the extension process
+// started by TestExtension. It forwards POST /ir/send to the gateway as
+// IR_SEND and acknowledges every IR_REPORT with IR_ACK.
+func TestHelperExtension(t *testing.T) {
+	if os.Getenv("KONKE_TEST_EXTENSION") != "1" {
+		return
+	}
+
+	out := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var env extensionEnvelope
+		if err := json.Unmarshal(scanner.Bytes(), &env); err != nil {
+			continue
+		}
+		switch env.Type {
+		case "message":
+			out.Encode(extensionEnvelope{Type: "send", Message: &Message{NodeID: env.Message.NodeID, Opcode: "IR_ACK", Arg: "*", Requester: "HJ_Server"}})
+		case "http":
+			var body struct {
+				Code string `json:"code"`
+			}
+			json.Unmarshal(env.Body, &body)
+			out.Encode(extensionEnvelope{Type: "send", Message: &Message{NodeID: "5", Opcode: "IR_SEND", Arg: body.Code, Requester: "HJ_Server"}})
+			out.Encode(extensionEnvelope{Type: "response", ID: env.ID, Status: 202, Body: json.RawMessage(`{"sent":true}`)})
+		}
+	}
+	os.Exit(0)
+}
+
+func TestExtension(t *testing.T) {
+	t.Setenv("KONKE_TEST_EXTENSION", "1")
+
+	frames := &gatewayLog{}
+	gw := startFakeGateway(t, 2, frames.record)
+	config := testConfig(t, gw, 2)
+	config.Extensions = []ExtensionConfig{{
+		Name:    "ir",
+		Command: []string{os.Args[0], "-test.run=^TestHelperExtension$"},
+		Opcodes: []string{"IR_REPORT"},
+		Routes:  []string{"/ir"},
+	}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	// HTTP requests under the route prefix go to the extension, which
+	// answers and sends a message to the gateway.
+	var resp *httptest.ResponseRecorder
+	waitFor(t, 5*time.Second, func() bool {
+		req := httptest.NewRequest(http.MethodPost, "/ir/send", strings.NewReader(`{"code":"TV_POWER"}`))
+		resp = httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp.Code != http.StatusServiceUnavailable
+	})
+	if resp.Code != http.StatusAccepted || !strings.Contains(resp.Body.String(), `"sent":true`) {
+		t.Fatalf("POST /ir/send = %d %s, want 202 from the extension", resp.Code, resp.Body.String())
+	}
+	waitFor(t, time.Second, func() bool {
+		sent := frames.find("IR_SEND", "5")
+		return len(sent) == 1 && sent[0].Arg == "TV_POWER"
+	})
+
+	// Messages with the extension's opcodes are forwarded to it.
+	proxy.handleMessage(&Message{NodeID: "5", Opcode: "IR_REPORT", Arg: "TV_POWER"})
+	waitFor(t, time.Second, func() bool { return len(frames.find("IR_ACK", "5")) == 1 })
+	if len(proxy.unhandled.list()) != 0 {
+		t.Errorf("extension opcode reported as unhandled: %+v", proxy.unhandled.list())
+	}
+}
+
+func TestExtensionCannotTakeBuiltinOpcode(t *testing.T) {
+	var config Config
+	config.Extensions = []ExtensionConfig{{Name: "bad", Command: []string{"true"}, Opcodes: []string{"SWITCH"}}}
+	if err := NewProxy(&config).registerExtensions(); err == nil {
+		t.Fatal("registerExtensions accepted a built-in opcode")
+	}
+}
+
+func TestExtensionRoutes(t *testing.T) {
+	var config Config
+	config.Extensions = []ExtensionConfig{
+		{Name: "ir", Command: []string{"true"}, Routes: []string{"/ir", "ir2", "/switch/extra", "/rf/:code"}},
+		{Name: "rf", Command: []string{"true"}, Routes: []string{"/ir/learn", "/rf"}},
+	}
+	var bad []string
+	for _, err := range config.validate() {
+		if len(err.path) == 4 && err.path[0] == "extensions" {
+			bad = append(bad, strings.Join(err.path[1:], "."))
+		}
+	}
+	if want := []string{"0.routes.1", "0.routes.2", "0.routes.3", "1.routes.0"}; strings.Join(bad, " ") != strings.Join(want, " ") {
+		t.Errorf("rejected routes %v, want %v", bad, want)
+	}
+
+	// With devices protected, the routes need a devices token.
+	config.Extensions = []ExtensionConfig{{Name: "ir", Command: []string{"true"}, Routes: []string{"/ir"}}}
+	config.Auth.ProtectDevices = true
+	config.Auth.Tokens = []authToken{{Name: "phone", Token: "phone-token", Scopes: []string{scopeDevices}}}
+	proxy := NewProxy(&config)
+	if err := proxy.registerExtensions(); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(proxy)
+	for token, want := range map[string]int{"": 401, "wrong": 401, "phone-token": 503} {
+		req := httptest.NewRequest(http.MethodPost, "/ir/send", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("token %q: status %d, want %d", token, rec.Code, want)
+		}
+	}
+}
+
+func TestCoreRouteSegments(t *testing.T) {
+	var config Config
+	config.HTTPServer.GraphQL = true
+	config.HTTPServer.AllowGetActions = true
+	for _, route := range newRouter(NewProxy(&config)).Routes() {
+		if segment := strings.SplitN(route.Path[1:], "/", 2)[0]; !coreRouteSegments[segment] {
+			t.Errorf("%s %s is not covered by coreRouteSegments", route.Method, route.Path)
+		}
+	}
+}
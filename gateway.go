@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// errUnknownZKID is returned for zkids that are not configured.
+var errUnknownZKID = errors.New("unknown zkid")
+
+// timeSyncInterval is how often the gateway clock is re-synced while a
+// session is up. Drifted clocks break the gateway's internal schedules.
+var timeSyncInterval = 24 * time.Hour
+
+// timeSyncEnabled reports whether the gateway clock should be synced
+// automatically. It defaults to on.
+func (c *Config) timeSyncEnabled() bool {
+	return c.Gateway.TimeSync == nil || *c.Gateway.TimeSync
+}
+
+// syncTime sets the clock of every configured zk controller to the local
+// time of the configured time zone and returns the time that was sent.
+func (p *Proxy) syncTime() (time.Time, error) {
+	now := p.localNow()
+	for _, zkid := range p.config.zkids() {
+		ref, _ := p.resolveNode(zkid, "*")
+		msg := &Message{
+			NodeID:    "*",
+			Opcode:    "SET_TIME",
+			Requester: "HJ_Server",
+			Arg: map[string]interface{}{
+				"time":      now.Format("2006-01-02 15:04:05"),
+				"timestamp": now.Unix(),
+				"timezone":  now.Format("-07:00"),
+			},
+			ReqID: p.nextReqID(),
+			ZKID:  p.outgoingZKID(ref),
+		}
+		if err := p.sendMessage(msg); err != nil {
+			return now, err
+		}
+	}
+	return now, nil
+}
+
+// syncTimePeriodically syncs the gateway clock at the start of a session
+// and then daily until ctx is cancelled.
+func (p *Proxy) syncTimePeriodically(ctx context.Context) error {
+	if !p.config.timeSyncEnabled() {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(timeSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.syncTime(); err != nil {
+			log.Printf("Error syncing gateway time: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Proxy) handleSetTime(msg *Message) {
+	if msg.Status != "" && msg.Status != "success" {
+		log.Printf("Gateway rejected time sync: %s", msg.Status)
+		return
+	}
+	log.Println("Gateway time synced")
+}
+
+// firmwareRequest sends a firmware opcode to one zk controller and waits
+// for its answer. An empty zkid addresses the primary controller.
+func (p *Proxy) firmwareRequest(ctx context.Context, zkid, opcode string, arg interface{}) (*Message, error) {
+	ref, ok := p.resolveNode(zkid, "*")
+	if !ok {
+		return nil, errUnknownZKID
+	}
+	return p.request(ctx, &Message{
+		NodeID:    "*",
+		Opcode:    opcode,
+		Arg:       arg,
+		Requester: "HJ_Server",
+		ZKID:      p.outgoingZKID(ref),
+	})
+}
+
+// queryFirmware returns the controller's firmware information.
+func (p *Proxy) queryFirmware(ctx context.Context, zkid string) (*Message, error) {
+	return p.firmwareRequest(ctx, zkid, "FW_QUERY", "*")
+}
+
+// triggerUpgrade asks the controller to start a firmware upgrade. arg is
+// passed through to the gateway unchanged.
+func (p *Proxy) triggerUpgrade(ctx context.Context, zkid string, arg interface{}) (*Message, error) {
+	if arg == nil {
+		arg = "*"
+	}
+	return p.firmwareRequest(ctx, zkid, "FW_UPGRADE", arg)
+}
+
+// After a reboot command the gateway usually drops the connection within a
+// few seconds; if it does not, the proxy drops it itself after rebootGrace
+// so that it does not keep writing into a half-dead socket. It then polls
+// every rebootPollInterval for up to rebootTimeout without treating the
+// failed attempts as errors.
+var (
+	rebootGrace        = 5 * time.Second
+	rebootPollInterval = 2 * time.Second
+	rebootTimeout      = 5 * time.Minute
+)
+
+// reboot sends the reboot opcode to a zk controller. The gateway may go
+// away before answering, so a missing reply is not an error.
+func (p *Proxy) reboot(ctx context.Context, zkid string) error {
+	reply, err := p.firmwareRequest(ctx, zkid, "REBOOT", "*")
+	if err != nil && !errors.Is(err, errRequestTimeout) {
+		return err
+	}
+	if reply != nil && reply.Status != "" && reply.Status != "success" {
+		return fmt.Errorf("gateway refused reboot: %s", reply.Status)
+	}
+
+	p.rebootAt.Store(time.Now().UnixNano())
+	log.Printf("Gateway reboot requested (zkid %s)", zkidOrPrimary(p, zkid))
+
+	time.AfterFunc(rebootGrace, func() {
+		if p.rebooting() && p.Connected() {
+			log.Println("Gateway still connected after reboot command, dropping connection")
+			p.transport.Close()
+		}
+	})
+	return nil
+}
+
+// rebooting reports whether a reboot was requested recently enough that
+// connection failures are expected.
+func (p *Proxy) rebooting() bool {
+	at := p.rebootAt.Load()
+	return at != 0 && time.Since(time.Unix(0, at)) < rebootTimeout
+}
+
+// rebootFinished clears the reboot state once the gateway is back and
+// returns how long it was away.
+func (p *Proxy) rebootFinished() (time.Duration, bool) {
+	at := p.rebootAt.Swap(0)
+	if at == 0 {
+		return 0, false
+	}
+	return time.Since(time.Unix(0, at)), true
+}
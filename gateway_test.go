@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncTimePeriodically(t *testing.T) {
+	interval := timeSyncInterval
+	timeSyncInterval = 50 * time.Millisecond
+	t.Cleanup(func() { timeSyncInterval = interval })
+
+	frames := &gatewayLog{}
+	gw := startFakeGateway(t, 1, frames.record)
+	config := testConfig(t, gw, 1)
+	config.Timezone = "Asia/Shanghai"
+	startProxy(t, config)
+
+	// Once after the login, then on every tick.
+	waitFor(t, integrationTimeout, func() bool { return len(frames.find("SET_TIME", "*")) >= 3 })
+	msg := frames.find("SET_TIME", "*")[0]
+	arg, _ := msg.Arg.(map[string]interface{})
+	if arg["timezone"] != "+08:00" || msg.Requester != "HJ_Server" || msg.ReqID == 0 {
+		t.Fatalf("SET_TIME frame = %+v", msg)
+	}
+	sent, err := time.ParseInLocation("2006-01-02 15:04:05", arg["time"].(string), config.location())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(sent); d < 0 || d > time.Minute {
+		t.Errorf("time %s is %s off", arg["time"], d)
+	}
+	if int64(arg["timestamp"].(float64)) != sent.Unix() {
+		t.Errorf("timestamp %v does not match time %s", arg["timestamp"], arg["time"])
+	}
+}
+
+func TestSyncTimeDisabled(t *testing.T) {
+	frames := &gatewayLog{}
+	gw := startFakeGateway(t, 1, frames.record)
+	config := testConfig(t, gw, 1)
+	disabled := false
+	config.Gateway.TimeSync = &disabled
+	proxy := startProxy(t, config)
+
+	// The initial sync has been answered by the time a later request is.
+	if _, err := proxy.queryFirmware(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(frames.find("SET_TIME", "")); got != 0 {
+		t.Errorf("gateway received %d SET_TIME frames with time_sync off", got)
+	}
+}
+
+func TestHandleSetTime(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(io.Discard)
+
+	proxy := eventProxy()
+	proxy.handleSetTime(&Message{Opcode: "SET_TIME", Status: "success"})
+	proxy.handleSetTime(&Message{Opcode: "SET_TIME", Status: "fail"})
+	if got := buf.String(); !strings.Contains(got, "Gateway time synced") || !strings.Contains(got, "Gateway rejected time sync: fail") {
+		t.Errorf("log = %q", got)
+	}
+}
+
+func TestIntegrationSyncTimeRequiresAdmin(t *testing.T) {
+	env := newIntegrationEnv(t)
+
+	for token, want := range map[string]int{"": 401, "user-token": 403, "admin-token": 200} {
+		req, _ := http.NewRequest(http.MethodPost, env.api.URL+"/gateway/sync-time", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /gateway/sync-time: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("token %q: status %d, want %d", token, resp.StatusCode, want)
+		}
+	}
+	// One after the login and one for the admin.
+	waitFor(t, integrationTimeout, func() bool { return len(env.frames.find("SET_TIME", "*")) == 2 })
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+)
+
+// graphqlSchema exposes the device list, the recent state changes and
+// device commands. History is the event feed behind /events and /poll.
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+type Query {
+	proxy: ProxyInfo!
+	devices(type: String, zkid: String, tag: String): [Device!]!
+	device(zkid: String, id: String!): Device
+	history(entityId: String, since: Int, limit: Int): [StateChange!]!
+}
+
+type Mutation {
+	setSwitch(zkid: String, id: String!, on: Boolean!): Device!
+	setCurtain(zkid: String, id: String!, action: CurtainAction!): Device!
+}
+
+enum CurtainAction {
+	OPEN
+	CLOSE
+	STOP
+}
+
+type ProxyInfo {
+	version: String!
+	commit: String
+	connected: Boolean!
+	capabilities: [String!]!
+}
+
+type Device {
+	zkid: String!
+	nodeId: String!
+	type: String!
+	entityId: String!
+	name: String!
+	room: String!
+	state: String!
+	position: Int
+	tags: [String!]!
+	meta: [MetaEntry!]!
+}
+
+type MetaEntry {
+	key: String!
+	value: String!
+}
+
+type StateChange {
+	seq: Int!
+	time: String!
+	zkid: String!
+	nodeId: String!
+	type: String!
+	entityId: String!
+	state: String!
+	position: Int
+	source: String
+	echo: Boolean!
+}
+`
+
+// defaultHistoryLimit is how many state changes history returns by default.
+const defaultHistoryLimit = 100
+
+// registerGraphQL adds POST /graphql when http_server.graphql is enabled.
+// It is protected like the device endpoints, since it can control every
+// device.
+func registerGraphQL(router *gin.Engine, proxy *Proxy, auth *authenticator) {
+	if !proxy.config.HTTPServer.GraphQL {
+		return
+	}
+	schema := graphql.MustParseSchema(graphqlSchema, &graphqlResolver{proxy: proxy}, graphql.UseFieldResolvers())
+	router.POST("/graphql", auth.requireDevice(proxy), func(c *gin.Context) {
+		c.Request = c.Request.WithContext(withSource(c.Request.Context(), requestSource(c, "graphql")))
+	}, gin.WrapH(&relay.Handler{Schema: schema}))
+}
+
+type graphqlResolver struct {
+	proxy *Proxy
+}
+
+type proxyInfoResolver struct {
+	Version      string
+	Commit       *string
+	Connected    bool
+	Capabilities []string
+}
+
+func (r *graphqlResolver) Proxy() *proxyInfoResolver {
+	b := currentBuild()
+	info := &proxyInfoResolver{
+		Version:      b.Version,
+		Connected:    r.proxy.Connected(),
+		Capabilities: r.proxy.config.capabilities(),
+	}
+	if b.Commit != "" {
+		info.Commit = &b.Commit
+	}
+	return info
+}
+
+type deviceResolver struct {
+	info deviceInfo
+}
+
+func (d *deviceResolver) ZKID() string     { return d.info.ZKID }
+func (d *deviceResolver) NodeID() string   { return d.info.NodeID }
+func (d *deviceResolver) Type() string     { return d.info.Type }
+func (d *deviceResolver) EntityID() string { return d.info.EntityID }
+func (d *deviceResolver) Name() string     { return d.info.Name }
+func (d *deviceResolver) Room() string     { return d.info.Room }
+func (d *deviceResolver) State() string    { return d.info.State }
+func (d *deviceResolver) Position() *int32 { return int32Ptr(d.info.Position) }
+func (d *deviceResolver) Tags() []string   { return append([]string{}, d.info.Tags...) }
+
+type metaEntry struct {
+	Key, Value string
+}
+
+// Meta returns the device's meta fields sorted by key.
+func (d *deviceResolver) Meta() []metaEntry {
+	entries := make([]metaEntry, 0, len(d.info.Meta))
+	for k, v := range d.info.Meta {
+		entries = append(entries, metaEntry{Key: k, Value: v})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+func int32Ptr(v *int) *int32 {
+	if v == nil {
+		return nil
+	}
+	n := int32(*v)
+	return &n
+}
+
+func (r *graphqlResolver) Devices(args struct{ Type, Zkid, Tag *string }) []*deviceResolver {
+	var devices []*deviceResolver
+	for _, info := range r.proxy.listDevices() {
+		if args.Type != nil && info.Type != *args.Type {
+			continue
+		}
+		if args.Zkid != nil && info.ZKID != *args.Zkid {
+			continue
+		}
+		if args.Tag != nil && !hasTag(info.Tags, *args.Tag) {
+			continue
+		}
+		devices = append(devices, &deviceResolver{info: info})
+	}
+	return devices
+}
+
+func (r *graphqlResolver) Device(args struct {
+	Zkid *string
+	ID   string
+}) *deviceResolver {
+	return r.findDevice(args.Zkid, args.ID)
+}
+
+// findDevice returns the listed device with the node ID on zkid.
+func (r *graphqlResolver) findDevice(zkid *string, id string) *deviceResolver {
+	want := zkidOrPrimary(r.proxy, stringValue(zkid))
+	for _, info := range r.proxy.listDevices() {
+		if info.ZKID == want && info.NodeID == id {
+			return &deviceResolver{info: info}
+		}
+	}
+	return nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+type stateChangeResolver struct {
+	ev stateEvent
+}
+
+func (s *stateChangeResolver) Seq() int32       { return int32(s.ev.Seq) }
+func (s *stateChangeResolver) Time() string     { return s.ev.Time.Format(time.RFC3339Nano) }
+func (s *stateChangeResolver) ZKID() string     { return s.ev.ZKID }
+func (s *stateChangeResolver) NodeID() string   { return s.ev.NodeID }
+func (s *stateChangeResolver) Type() string     { return s.ev.Type }
+func (s *stateChangeResolver) EntityID() string { return s.ev.EntityID }
+func (s *stateChangeResolver) State() string    { return s.ev.State }
+func (s *stateChangeResolver) Position() *int32 { return int32Ptr(s.ev.Position) }
+func (s *stateChangeResolver) Echo() bool       { return s.ev.Echo }
+func (s *stateChangeResolver) Source() *string {
+	if s.ev.Source == "" {
+		return nil
+	}
+	return &s.ev.Source
+}
+
+// History returns the most recent state changes, newest first.
+func (r *graphqlResolver) History(args struct {
+	EntityId *string
+	Since    *int32
+	Limit    *int32
+}) []*stateChangeResolver {
+	var since int64
+	if args.Since != nil {
+		since = int64(*args.Since)
+	}
+	limit := defaultHistoryLimit
+	if args.Limit != nil && *args.Limit > 0 {
+		limit = int(*args.Limit)
+	}
+
+	events, _, _ := r.proxy.events.since(since)
+	var changes []*stateChangeResolver
+	for i := len(events) - 1; i >= 0 && len(changes) < limit; i-- {
+		if args.EntityId != nil && events[i].EntityID != *args.EntityId {
+			continue
+		}
+		changes = append(changes, &stateChangeResolver{ev: events[i]})
+	}
+	return changes
+}
+
+// errWrongKind is returned by a mutation for a device of the other kind.
+var errWrongKind = errors.New("device is not of the requested type")
+
+// command sends arg to the node and returns its updated device.
+func (r *graphqlResolver) command(ctx context.Context, zkid *string, id, kind, arg string) (*deviceResolver, error) {
+	ref, ok := r.proxy.resolveNode(stringValue(zkid), id)
+	if !ok {
+		return nil, errUnknownZKID
+	}
+	if dev, ok := r.proxy.lookupDevice(ref.key()); ok && dev.Kind != kind {
+		return nil, errWrongKind
+	}
+	if err := r.proxy.checkNode(ref, false); err != nil {
+		return nil, err
+	}
+	r.proxy.scheduled.cancel(ref.key())
+	if err := r.proxy.sendSwitch(ctx, ref, arg); err != nil {
+		return nil, err
+	}
+	if dev := r.findDevice(zkid, id); dev != nil {
+		return dev, nil
+	}
+	// Discovered nodes, and unknown ones with strict_nodes off, can be
+	// switched but are not listed.
+	return &deviceResolver{info: deviceInfo{
+		ZKID:   zkidOrPrimary(r.proxy, ref.ZKID),
+		NodeID: id,
+		Type:   kind,
+		State:  r.proxy.deviceState(ref.key()),
+	}}, nil
+}
+
+func (r *graphqlResolver) SetSwitch(ctx context.Context, args struct {
+	Zkid *string
+	ID   string
+	On   bool
+}) (*deviceResolver, error) {
+	arg := "OFF"
+	if args.On {
+		arg = "ON"
+	}
+	return r.command(ctx, args.Zkid, args.ID, kindSwitch, arg)
+}
+
+func (r *graphqlResolver) SetCurtain(ctx context.Context, args struct {
+	Zkid   *string
+	ID     string
+	Action string
+}) (*deviceResolver, error) {
+	return r.command(ctx, args.Zkid, args.ID, kindCurtain, args.Action)
+}
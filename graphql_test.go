@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGraphQL(t *testing.T) {
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.HTTPServer.GraphQL = true
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one", Name: "Desk"}}
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "curtain_two"}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	query := func(q string) (data map[string]interface{}, errs []interface{}) {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{"query": q})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST /graphql: status %d", rec.Code)
+		}
+		var resp struct {
+			Data   map[string]interface{} `json:"data"`
+			Errors []interface{}          `json:"errors"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Data, resp.Errors
+	}
+
+	data, errs := query(`{ proxy { version connected } devices(type: "switch") { nodeId name entityId } }`)
+	if len(errs) > 0 {
+		t.Fatalf("errors: %v", errs)
+	}
+	devices := data["devices"].([]interface{})
+	if len(devices) != 1 || devices[0].(map[string]interface{})["name"] != "Desk" {
+		t.Errorf("devices = %v, want the desk light", devices)
+	}
+	if data["proxy"].(map[string]interface{})["connected"] != true {
+		t.Errorf("proxy = %v, want connected", data["proxy"])
+	}
+
+	data, errs = query(`mutation { setSwitch(id: "1", on: true) { state } }`)
+	if len(errs) > 0 {
+		t.Fatalf("errors: %v", errs)
+	}
+	if state := data["setSwitch"].(map[string]interface{})["state"]; state != "ON" {
+		t.Errorf("state after setSwitch = %v, want ON", state)
+	}
+
+	// The change is recorded once the gateway reports it.
+	waitFor(t, time.Second, func() bool {
+		data, errs = query(`{ history(entityId: "light_one") { seq entityId state } }`)
+		history := data["history"].([]interface{})
+		return len(errs) == 0 && len(history) > 0 && history[0].(map[string]interface{})["state"] == "on"
+	})
+
+	// Curtain commands are refused for switches.
+	if _, errs := query(`mutation { setCurtain(id: "1", action: OPEN) { state } }`); len(errs) == 0 {
+		t.Error("setCurtain on a switch succeeded")
+	}
+}
+
+func TestGraphQLDisabled(t *testing.T) {
+	router := newRouter(NewProxy(&Config{}))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader([]byte(`{"query":"{ proxy { version } }"}`))))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("POST /graphql without graphql enabled: status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// guestFile holds the guest tokens inside the data directory.
+const guestFile = "guest_tokens.json"
+
+// maxGuestTTL bounds how long a guest token can be valid.
+const maxGuestTTL = 90 * 24 * time.Hour
+
+var (
+	errGuestExists  = errors.New("a guest token with that name exists")
+	errGuestUnknown = errors.New("no such guest token")
+)
+
+// guestToken is a time-limited token minted with POST /admin/tokens that
+// may only control the listed devices. Only a hash of the secret is kept.
+type guestToken struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash,omitempty"`
+	Devices []string  `json:"devices"` // node keys as in the device mapping
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// guestTokens are the guest tokens of a proxy, persisted in the data
+// directory.
+type guestTokens struct {
+	mutex  sync.Mutex
+	file   string
+	tokens []guestToken
+	frozen bool // a backup was restored; the file is left to it
+}
+
+// load reads the stored guest tokens, if any.
+func (g *guestTokens) load(dataDir string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.file = filepath.Join(dataDir, guestFile)
+	data, err := ioutil.ReadFile(g.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &g.tokens); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", guestFile, err)
+	}
+	return nil
+}
+
+// saveLocked drops expired tokens and writes the rest to the data
+// directory.
+func (g *guestTokens) saveLocked(now time.Time) error {
+	live := g.tokens[:0]
+	for _, t := range g.tokens {
+		if now.Before(t.Expires) {
+			live = append(live, t)
+		}
+	}
+	g.tokens = live
+	if g.file == "" || g.frozen {
+		return nil
+	}
+	data, err := json.MarshalIndent(g.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileMode(g.file, data, 0600)
+}
+
+// freeze stops writing the tokens to the data directory.
+func (g *guestTokens) freeze() {
+	g.mutex.Lock()
+	g.frozen = true
+	g.mutex.Unlock()
+}
+
+// mint creates a guest token for devices, valid for ttl, and returns its
+// secret. The secret cannot be retrieved later.
+func (g *guestTokens) mint(name string, devices []string, ttl time.Duration) (guestToken, string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return guestToken{}, "", err
+	}
+	secret := "guest_" + hex.EncodeToString(buf)
+
+	now := time.Now()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, t := range g.tokens {
+		if t.Name == name && now.Before(t.Expires) {
+			return guestToken{}, "", errGuestExists
+		}
+	}
+	token := guestToken{
+		Name:    name,
+		Hash:    hashSecret(secret),
+		Devices: devices,
+		Created: now.UTC().Truncate(time.Second),
+		Expires: now.Add(ttl).UTC().Truncate(time.Second),
+	}
+	g.tokens = append(g.tokens, token)
+	return token, secret, g.saveLocked(now)
+}
+
+// revoke deletes the guest token called name.
+func (g *guestTokens) revoke(name string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i, t := range g.tokens {
+		if t.Name == name {
+			g.tokens = append(g.tokens[:i], g.tokens[i+1:]...)
+			return g.saveLocked(time.Now())
+		}
+	}
+	return errGuestUnknown
+}
+
+// list returns the unexpired guest tokens without their hashes, sorted by
+// expiry.
+func (g *guestTokens) list() []guestToken {
+	now := time.Now()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	list := []guestToken{}
+	for _, t := range g.tokens {
+		if now.Before(t.Expires) {
+			t.Hash = ""
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	return list
+}
+
+// lookup returns the unexpired guest token matching secret.
+func (g *guestTokens) lookup(secret string) (guestToken, bool) {
+	hash := []byte(hashSecret(secret))
+	now := time.Now()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var found guestToken
+	ok := false
+	for _, t := range g.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), hash) == 1 && now.Before(t.Expires) {
+			found, ok = t, true
+		}
+	}
+	return found, ok
+}
+
+// allows reports whether the token may control the node at key, with
+// device keys normalized against the primary zkid.
+func (t *guestToken) allows(key, primary string) bool {
+	for _, k := range t.Devices {
+		ref := parseNodeKey(k)
+		if ref.ZKID == primary {
+			ref.ZKID = ""
+		}
+		if ref.key() == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuestTokens(t *testing.T) {
+	var config Config
+	config.DataDir = t.TempDir()
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}}}
+	config.Auth.ProtectDevices = true
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}, "3": {Entity: "light_three"}}
+	proxy := NewProxy(&config)
+	if err := proxy.guests.load(config.DataDir); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(proxy)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/switch/1", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /switch/1 without a token: status %d, want 401", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/switch/1", "admin-token", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /switch/1 as admin: status %d, want 200", rec.Code)
+	}
+
+	rec := do(http.MethodPost, "/admin/tokens", "admin-token", `{"name": "sitter", "devices": ["1"], "ttl": 3600}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /admin/tokens: status %d: %s", rec.Code, rec.Body)
+	}
+	var minted struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &minted)
+	if minted.Token == "" || time.Until(minted.Expires) < 59*time.Minute {
+		t.Fatalf("minted token = %+v", minted)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/switch/1", http.StatusOK},
+		{http.MethodGet, "/switch/3", http.StatusForbidden},
+		{http.MethodGet, "/gateway/firmware", http.StatusUnauthorized},
+		{http.MethodGet, "/admin/tokens", http.StatusUnauthorized},
+	} {
+		if rec := do(tc.method, tc.path, minted.Token, ""); rec.Code != tc.want {
+			t.Errorf("%s %s with the guest token: status %d, want %d", tc.method, tc.path, rec.Code, tc.want)
+		}
+	}
+
+	if rec := do(http.MethodPost, "/admin/tokens", "admin-token", `{"name": "sitter", "devices": ["3"], "ttl": 60}`); rec.Code != http.StatusConflict {
+		t.Errorf("minting a duplicate name: status %d, want 409", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/admin/tokens", "admin-token", `{"name": "other", "devices": ["9"], "ttl": 60}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("minting for an unmapped node: status %d, want 400", rec.Code)
+	}
+	rec = do(http.MethodGet, "/admin/tokens", "admin-token", "")
+	if body := rec.Body.String(); !strings.Contains(body, `"name":"sitter"`) || strings.Contains(body, "hash") {
+		t.Errorf("GET /admin/tokens = %s, want sitter without its hash", body)
+	}
+
+	// Guest tokens survive a restart.
+	var reloaded guestTokens
+	if err := reloaded.load(config.DataDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.lookup(minted.Token); !ok {
+		t.Error("guest token lost after reloading")
+	}
+
+	if rec := do(http.MethodDelete, "/admin/tokens/sitter", "admin-token", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE /admin/tokens/sitter: status %d, want 204", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/switch/1", minted.Token, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /switch/1 with a revoked token: status %d, want 401", rec.Code)
+	}
+}
+
+func TestGuestTokenExpiry(t *testing.T) {
+	var g guestTokens
+	_, secret, err := g.mint("sitter", []string{"1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.tokens[0].Expires = time.Now().Add(-time.Second)
+	if _, ok := g.lookup(secret); ok {
+		t.Error("expired guest token accepted")
+	}
+	if list := g.list(); len(list) != 0 {
+		t.Errorf("expired guest token listed: %+v", list)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// healthLatencyWeight is the weight of the newest ACK latency in the
+	// moving average.
+	healthLatencyWeight = 0.2
+	// healthCommandWindow is how long a command waits for its ACK before
+	// it no longer counts towards the latency.
+	healthCommandWindow = time.Minute
+)
+
+// deviceHealth is the health of a node as reported by GET /devices.
+type deviceHealth struct {
+	// Score runs from 100 for a device that answers everything at once
+	// down to 0.
+	Score         int     `json:"score"`
+	LatencyMS     float64 `json:"latency_ms"` // moving average of the ACK latency
+	Commands      int     `json:"commands"`   // SWITCH frames sent, retries included
+	Retries       int     `json:"retries"`
+	Queries       int     `json:"queries"`
+	MissedQueries int     `json:"missed_queries"`
+}
+
+// nodeHealth holds the counts of a node since the proxy started.
+type nodeHealth struct {
+	latency       time.Duration
+	acks          int
+	commands      int
+	retries       int
+	queries       int
+	missedQueries int
+}
+
+// healthRequest is a request to a node waiting for its answer.
+type healthRequest struct {
+	key    string
+	opcode string
+	sent   time.Time
+}
+
+// healthTracker collects what the device health scores are computed from.
+type healthTracker struct {
+	mutex       sync.Mutex
+	nodes       map[string]*nodeHealth
+	outstanding map[int64]healthRequest
+}
+
+func (h *healthTracker) node(key string) *nodeHealth {
+	if h.nodes == nil {
+		h.nodes = make(map[string]*nodeHealth)
+	}
+	n, ok := h.nodes[key]
+	if !ok {
+		n = &nodeHealth{}
+		h.nodes[key] = n
+	}
+	return n
+}
+
+// expire drops the requests that have waited too long, counting the
+// queries among them as missed.
+func (h *healthTracker) expire(now time.Time, queryTimeout time.Duration) {
+	for id, req := range h.outstanding {
+		switch {
+		case req.opcode == "QUERY" && now.Sub(req.sent) >= queryTimeout:
+			h.node(req.key).missedQueries++
+		case req.opcode == "SWITCH" && now.Sub(req.sent) >= healthCommandWindow:
+		default:
+			continue
+		}
+		delete(h.outstanding, id)
+	}
+}
+
+// sent records a SWITCH or QUERY request to the node key.
+func (h *healthTracker) sent(reqID int64, key, opcode string, now time.Time, queryTimeout time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.expire(now, queryTimeout)
+	if h.outstanding == nil {
+		h.outstanding = make(map[int64]healthRequest)
+	}
+	h.outstanding[reqID] = healthRequest{key: key, opcode: opcode, sent: now}
+	n := h.node(key)
+	if opcode == "QUERY" {
+		n.queries++
+	} else {
+		n.commands++
+	}
+}
+
+// retried records that a command to the node key is sent again for want
+// of a confirmation.
+func (h *healthTracker) retried(key string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.node(key).retries++
+}
+
+// answered records a reply from the node key. Replies are matched by
+// reqId, or else to the oldest request waiting on the node.
+func (h *healthTracker) answered(reqID int64, key string, now time.Time, queryTimeout time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.expire(now, queryTimeout)
+	req, ok := h.outstanding[reqID]
+	if !ok || reqID == 0 {
+		ok = false
+		for id, r := range h.outstanding {
+			if r.key == key && (!ok || r.sent.Before(req.sent)) {
+				req, reqID, ok = r, id, true
+			}
+		}
+		if !ok {
+			return
+		}
+	}
+	delete(h.outstanding, reqID)
+	n := h.node(req.key)
+	latency := now.Sub(req.sent)
+	if n.acks == 0 {
+		n.latency = latency
+	} else {
+		n.latency += time.Duration(healthLatencyWeight * float64(latency-n.latency))
+	}
+	n.acks++
+}
+
+// health returns the health of the node key, if anything was sent to it.
+// The score takes 40 points for the share of retried commands, 40 for the
+// share of missed queries and 20 for the ACK latency relative to the
+// request timeout.
+func (h *healthTracker) health(key string, now time.Time, queryTimeout time.Duration) (deviceHealth, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.expire(now, queryTimeout)
+	n, ok := h.nodes[key]
+	if !ok {
+		return deviceHealth{}, false
+	}
+	var retryRate, missRate float64
+	if n.commands > 0 {
+		retryRate = math.Min(1, float64(n.retries)/float64(n.commands))
+	}
+	if n.queries > 0 {
+		missRate = float64(n.missedQueries) / float64(n.queries)
+	}
+	latencyFactor := math.Min(1, float64(n.latency)/float64(queryTimeout))
+	score := 100 * (1 - 0.4*retryRate - 0.4*missRate - 0.2*latencyFactor)
+	return deviceHealth{
+		Score:         int(math.Round(score)),
+		LatencyMS:     math.Round(float64(n.latency)/float64(time.Millisecond)*10) / 10,
+		Commands:      n.commands,
+		Retries:       n.retries,
+		Queries:       n.queries,
+		MissedQueries: n.missedQueries,
+	}, true
+}
+
+// recordSent notes a request to a node for its health score.
+func (p *Proxy) recordSent(msg *Message) {
+	if (msg.Opcode != "SWITCH" && msg.Opcode != "QUERY") || msg.NodeID == "" || msg.NodeID == "*" {
+		return
+	}
+	p.health.sent(msg.ReqID, p.messageKey(msg), msg.Opcode, time.Now(), p.config.requestTimeout())
+}
+
+// recordAnswer notes a node's report as the answer to a request waiting
+// on it, if any.
+func (p *Proxy) recordAnswer(msg *Message) {
+	if msg.Opcode != "SWITCH" || msg.NodeID == "" || msg.NodeID == "*" {
+		return
+	}
+	p.health.answered(msg.ReqID, p.messageKey(msg), time.Now(), p.config.requestTimeout())
+}
+
+// deviceHealth returns the health of the node key, if anything was sent
+// to it.
+func (p *Proxy) deviceHealth(key string) (deviceHealth, bool) {
+	return p.health.health(key, time.Now(), p.config.requestTimeout())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthScore(t *testing.T) {
+	var h healthTracker
+	now := time.Now()
+	timeout := 5 * time.Second
+
+	if _, ok := h.health("1", now, timeout); ok {
+		t.Error("health of a node nothing was sent to")
+	}
+
+	// Two queries, one of them answered after a second.
+	h.sent(1, "1", "QUERY", now, timeout)
+	h.sent(2, "1", "QUERY", now, timeout)
+	h.answered(1, "1", now.Add(time.Second), timeout)
+	// A command retried once.
+	h.sent(3, "1", "SWITCH", now, timeout)
+	h.retried("1")
+	h.sent(4, "1", "SWITCH", now, timeout)
+	h.answered(4, "1", now.Add(time.Second), timeout)
+	// Reports without a reqId answer the oldest request to the node.
+	h.sent(5, "2", "SWITCH", now, timeout)
+	h.sent(6, "2", "SWITCH", now.Add(time.Second), timeout)
+	h.answered(0, "2", now.Add(2*time.Second), timeout)
+	if _, ok := h.outstanding[5]; ok {
+		t.Error("the oldest request 5 is still waiting")
+	}
+
+	got, ok := h.health("1", now.Add(timeout), timeout)
+	if !ok {
+		t.Fatal("no health after commands")
+	}
+	want := deviceHealth{Score: 56, LatencyMS: 1000, Commands: 2, Retries: 1, Queries: 2, MissedQueries: 1}
+	if got != want {
+		t.Errorf("health = %+v, want %+v", got, want)
+	}
+}
+
+func TestDeviceHealth(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	proxy := startProxy(t, testConfig(t, gw, 1))
+	router := newRouter(proxy)
+
+	// The initial query of node 1 is answered at once.
+	waitFor(t, time.Second, func() bool {
+		health, ok := proxy.deviceHealth("1")
+		return ok && health.Queries == 1 && health.MissedQueries == 0 && health.LatencyMS < 1000
+	})
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/devices", nil))
+	var devices []deviceInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Health == nil {
+		t.Fatalf("devices = %s, want node 1 with its health", rec.Body)
+	}
+	if score := devices[0].Health.Score; score < 90 {
+		t.Errorf("score = %d, want a healthy node", score)
+	}
+
+	dev, _ := proxy.lookupDevice("1")
+	if _, ok := proxy.haAttributes(&dev)["health"]; !ok {
+		t.Error("no health attribute for Home Assistant")
+	}
+}
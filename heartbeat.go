@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// heartbeatMaxMissed is how many heartbeats in a row may go unanswered
+	// before an adaptive heartbeat gives the session up.
+	heartbeatMaxMissed = 3
+	// heartbeatStableRounds is how many prompt answers in a row lengthen
+	// the interval.
+	heartbeatStableRounds = 5
+	// heartbeatSlowRTT is the round trip below which an answer counts as
+	// prompt however it compares with the average.
+	heartbeatSlowRTT = 500 * time.Millisecond
+	// heartbeatRTTWeight is the weight of the newest round trip in the
+	// moving average.
+	heartbeatRTTWeight = 0.2
+)
+
+// adaptiveHeartbeat reports whether heartbeat_min and heartbeat_max set
+// bounds for an adaptive heartbeat interval.
+func (c *Config) adaptiveHeartbeat() bool {
+	return c.Gateway.HeartbeatMin > 0 && c.Gateway.HeartbeatMax > 0
+}
+
+// validateHeartbeat checks the heartbeat bounds.
+func (c *Config) validateHeartbeat(add func(message string, path ...string)) {
+	g := c.Gateway
+	if g.HeartbeatMin < 0 || g.HeartbeatMax < 0 {
+		add("heartbeat bounds must not be negative", "gateway", "heartbeat_min")
+		return
+	}
+	if (g.HeartbeatMin > 0) != (g.HeartbeatMax > 0) {
+		add("set both heartbeat_min and heartbeat_max for an adaptive heartbeat", "gateway", "heartbeat_min")
+		return
+	}
+	if g.HeartbeatMin > g.HeartbeatMax {
+		add("heartbeat_min is above heartbeat_max", "gateway", "heartbeat_min")
+	}
+	if c.adaptiveHeartbeat() && g.HeartbeatInterval <= 0 {
+		add("an adaptive heartbeat needs a heartbeat_interval to start from", "gateway", "heartbeat_interval")
+	}
+}
+
+// heartbeatStatus is the state of the heartbeat as shown by GET /healthz.
+type heartbeatStatus struct {
+	Adaptive bool    `json:"adaptive"`
+	Interval float64 `json:"interval"` // seconds
+	RTTMS    float64 `json:"rtt_ms"`   // moving average of the answered ones
+	Missed   int     `json:"missed"`   // in a row
+}
+
+// heartbeatAdapter times the heartbeats of a session. With bounds, it
+// halves the interval when a heartbeat goes unanswered, shortens it when
+// an answer is slow against the average round trip, and lengthens it by
+// half after heartbeatStableRounds prompt answers in a row.
+type heartbeatAdapter struct {
+	mutex    sync.Mutex
+	adaptive bool
+	min, max time.Duration
+	interval time.Duration
+	sent     time.Time // of the heartbeat awaiting its answer
+	answered bool
+	seen     bool // the gateway answers heartbeats at all
+	rtt      time.Duration
+	missed   int
+	stable   int
+}
+
+// reset starts a session with the configured interval and bounds.
+func (h *heartbeatAdapter) reset(c *Config) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.adaptive = c.adaptiveHeartbeat()
+	h.interval = time.Duration(c.Gateway.HeartbeatInterval) * time.Second
+	h.min, h.max = 0, 0
+	h.sent, h.answered, h.seen = time.Time{}, false, false
+	h.rtt, h.missed, h.stable = 0, 0, 0
+	if h.adaptive {
+		h.min = time.Duration(c.Gateway.HeartbeatMin) * time.Second
+		h.max = time.Duration(c.Gateway.HeartbeatMax) * time.Second
+		h.interval = h.clamp(h.interval)
+	}
+}
+
+func (h *heartbeatAdapter) clamp(d time.Duration) time.Duration {
+	if d < h.min {
+		return h.min
+	}
+	if d > h.max {
+		return h.max
+	}
+	return d
+}
+
+// next is called when a heartbeat is sent at now. It judges the one before
+// and returns the wait until the following heartbeat, or an error once too
+// many went unanswered.
+func (h *heartbeatAdapter) next(now time.Time) (time.Duration, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// Firmwares that never answer heartbeats keep a fixed interval.
+	if h.adaptive && h.seen && !h.sent.IsZero() {
+		if !h.answered {
+			h.missed++
+			h.stable = 0
+			h.interval = h.clamp(h.interval / 2)
+		}
+	}
+	if h.missed >= heartbeatMaxMissed {
+		return 0, fmt.Errorf("gateway missed %d heartbeats in a row", h.missed)
+	}
+	h.sent, h.answered = now, false
+	return h.interval, nil
+}
+
+// reply records the gateway's answer to a heartbeat.
+func (h *heartbeatAdapter) reply(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.sent.IsZero() || h.answered {
+		return
+	}
+	h.answered, h.missed = true, 0
+	rtt := now.Sub(h.sent)
+	slow := h.seen && rtt > heartbeatSlowRTT && rtt > 2*h.rtt
+	if !h.seen {
+		h.rtt = rtt
+	} else {
+		h.rtt += time.Duration(heartbeatRTTWeight * float64(rtt-h.rtt))
+	}
+	h.seen = true
+	if !h.adaptive {
+		return
+	}
+	if slow {
+		h.stable = 0
+		h.interval = h.clamp(h.interval * 3 / 4)
+		return
+	}
+	if h.stable++; h.stable >= heartbeatStableRounds {
+		h.stable = 0
+		h.interval = h.clamp(h.interval * 3 / 2)
+	}
+}
+
+// status returns the current interval and round trip.
+func (h *heartbeatAdapter) status() heartbeatStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return heartbeatStatus{
+		Adaptive: h.adaptive,
+		Interval: h.interval.Seconds(),
+		RTTMS:    milliseconds(h.rtt),
+		Missed:   h.missed,
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatAdapter(t *testing.T) {
+	config := &Config{}
+	config.Gateway.HeartbeatInterval = 20
+	config.Gateway.HeartbeatMin = 5
+	config.Gateway.HeartbeatMax = 30
+
+	var h heartbeatAdapter
+	h.reset(config)
+	now := time.Unix(0, 0)
+	beat := func(rtt time.Duration, answered bool) time.Duration {
+		t.Helper()
+		wait, err := h.next(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answered {
+			h.reply(now.Add(rtt))
+		}
+		now = now.Add(wait)
+		return wait
+	}
+
+	// Stable answers lengthen the interval up to the maximum.
+	for i := 0; i < heartbeatStableRounds; i++ {
+		beat(50*time.Millisecond, true)
+	}
+	if wait := beat(50*time.Millisecond, true); wait != 30*time.Second {
+		t.Errorf("after %d stable rounds wait = %s, want 30s", heartbeatStableRounds, wait)
+	}
+
+	// A lost heartbeat halves it, down to the minimum.
+	beat(0, false)
+	if wait := beat(0, false); wait != 15*time.Second {
+		t.Errorf("after a loss wait = %s, want 15s", wait)
+	}
+	if wait := beat(50*time.Millisecond, true); wait != 7500*time.Millisecond {
+		t.Errorf("after two losses wait = %s, want 7.5s", wait)
+	}
+	if s := h.status(); s.Missed != 0 {
+		t.Errorf("missed = %d after an answer", s.Missed)
+	}
+
+	// A slow answer shortens it by a quarter.
+	beat(2*time.Second, true)
+	if wait := beat(50*time.Millisecond, true); wait != 5625*time.Millisecond {
+		t.Errorf("after a slow answer wait = %s, want 5.625s", wait)
+	}
+
+	// Too many losses in a row end the session.
+	for i := 0; i < heartbeatMaxMissed; i++ {
+		beat(0, false)
+	}
+	if _, err := h.next(now); err == nil {
+		t.Errorf("no error after %d missed heartbeats", heartbeatMaxMissed)
+	}
+	if s := h.status(); s.Interval != 5 || !s.Adaptive {
+		t.Errorf("status = %+v, want the 5s minimum", s)
+	}
+}
+
+func TestHeartbeatFixed(t *testing.T) {
+	config := &Config{}
+	config.Gateway.HeartbeatInterval = 20
+
+	var h heartbeatAdapter
+	h.reset(config)
+	now := time.Unix(0, 0)
+	for i := 0; i < 2*heartbeatMaxMissed; i++ {
+		wait, err := h.next(now)
+		if err != nil || wait != 20*time.Second {
+			t.Fatalf("heartbeat %d: wait %s, err %v", i, wait, err)
+		}
+		if i == 0 {
+			h.reply(now.Add(time.Second))
+		}
+		now = now.Add(wait)
+	}
+	if s := h.status(); s.Adaptive || s.RTTMS != 1000 {
+		t.Errorf("status = %+v", s)
+	}
+
+	// Without answers, losses are not judged even when adaptive.
+	config.Gateway.HeartbeatMin, config.Gateway.HeartbeatMax = 5, 30
+	h.reset(config)
+	for i := 0; i < 2*heartbeatMaxMissed; i++ {
+		if wait, err := h.next(now); err != nil || wait != 20*time.Second {
+			t.Fatalf("silent gateway, heartbeat %d: wait %s, err %v", i, wait, err)
+		}
+	}
+}
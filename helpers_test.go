@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	log.SetOutput(io.Discard)
+	reconnectDelay = 20 * time.Millisecond
+	rebootGrace = 50 * time.Millisecond
+	rebootPollInterval = 20 * time.Millisecond
+}
+
+// startFakeGateway starts a fake gateway with the given number of nodes and
+// stops it when the test finishes. onMessage, if not nil, observes every
+// frame the gateway receives.
+func startFakeGateway(tb testing.TB, devices int, onMessage func(*fakegw.Message)) *fakegw.Gateway {
+	tb.Helper()
+
+	gw := fakegw.New(devices)
+	gw.OnMessage = onMessage
+	if err := gw.Start("127.0.0.1:0"); err != nil {
+		tb.Fatalf("start fake gateway: %v", err)
+	}
+	tb.Cleanup(func() { gw.Close() })
+	return gw
+}
+
+// newPipeTransport connects the proxy to a fake gateway through an
+// in-memory net.Pipe instead of a socket.
+func newPipeTransport(gw *fakegw.Gateway) GatewayTransport {
+	return &streamTransport{
+		name: "pipe",
+		open: func(context.Context) (io.ReadWriteCloser, error) {
+			client, server := net.Pipe()
+			gw.ServeConn(server)
+			return client, nil
+		},
+	}
+}
+
+// testConfig returns a configuration pointing at the fake gateway.
+func testConfig(tb testing.TB, gw *fakegw.Gateway, devices int) *Config {
+	tb.Helper()
+
+	host, port, err := net.SplitHostPort(gw.Addr())
+	if err != nil {
+		tb.Fatalf("split gateway address: %v", err)
+	}
+
+	var config Config
+	config.Gateway.Host = host
+	config.Gateway.Port, _ = strconv.Atoi(port)
+	config.Gateway.Username = "admin"
+	config.Gateway.Password = "admin"
+	config.Gateway.ZKID = "266590"
+	config.Gateway.DeviceCount = devices
+	config.Gateway.HeartbeatInterval = 20
+	return &config
+}
+
+// startProxy starts a proxy for config, waits until its gateway session is
+// ready and stops it when the test finishes.
+func startProxy(tb testing.TB, config *Config) *Proxy {
+	tb.Helper()
+
+	if config.DataDir == "" {
+		config.DataDir = tb.TempDir()
+	}
+	proxy := NewProxy(config)
+	if err := proxy.Start(); err != nil {
+		tb.Fatalf("start proxy: %v", err)
+	}
+	tb.Cleanup(proxy.Stop)
+	waitFor(tb, 2*time.Second, proxy.Ready)
+	return proxy
+}
+
+// waitFor polls cond until it returns true or the timeout elapses.
+func waitFor(tb testing.TB, timeout time.Duration, cond func() bool) {
+	tb.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("condition not met within %s", timeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hookSecret returns the secret a webhook request carries: the bearer
+// token or the X-Hook-Secret header. It is not accepted as a query
+// parameter, which would end up in access logs.
+func hookSecret(c *gin.Context) string {
+	if s, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return s
+	}
+	return c.GetHeader("X-Hook-Secret")
+}
+
+// hookHandler serves POST /hooks/:name, starting the hook's command
+// sequence or macro and answering 202 at once.
+func hookHandler(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		hook, ok := proxy.config.Hooks[name]
+		if !ok {
+			c.JSON(404, gin.H{"error": "Unknown hook"})
+			return
+		}
+		if hook.Secret != "" && subtle.ConstantTimeCompare([]byte(hookSecret(c)), []byte(hook.Secret)) != 1 {
+			c.JSON(401, gin.H{"error": "Invalid hook secret"})
+			return
+		}
+		steps := hook.Commands
+		if hook.Macro != "" {
+			steps = proxy.config.Macros[hook.Macro]
+		}
+		source := commandSource{Identity: "hook:" + name, Addr: c.ClientIP(), Via: "hook"}
+		if err := proxy.startSequence("Hook "+name, steps, source); err != nil {
+			gatewayError(c, err)
+			return
+		}
+		c.JSON(202, gin.H{"hook": name, "commands": len(steps)})
+	}
+}
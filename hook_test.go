@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "porch"}}
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "gate"}}
+	config.Hooks = map[string]HookConfig{"doorbell": {
+		Secret: "ding",
+		Commands: []CommandStep{
+			{Device: "1", Arg: "ON"},
+			{Device: "266590/2", Arg: "OPEN", DelayMS: 20},
+		},
+	}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	post := func(path, secret string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if secret != "" {
+			req.Header.Set("X-Hook-Secret", secret)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post("/hooks/intercom", "ding"); code != http.StatusNotFound {
+		t.Errorf("unknown hook: status %d, want 404", code)
+	}
+	if code := post("/hooks/doorbell", "dong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong secret: status %d, want 401", code)
+	}
+	if code := post("/hooks/doorbell?secret=ding", ""); code != http.StatusUnauthorized {
+		t.Errorf("secret in the query: status %d, want 401", code)
+	}
+	if code := post("/hooks/doorbell", "ding"); code != http.StatusAccepted {
+		t.Fatalf("hook: status %d, want 202", code)
+	}
+	waitFor(t, time.Second, func() bool { return gw.State("1") == "ON" && gw.State("2") == "OPEN" })
+}
@@ -0,0 +1,28 @@
+package main
+
+// buildIgnoreLists turns gateway.ignore_nodes and gateway.ignore_opcodes
+// into sets. Node entries use the same keys as the device mapping.
+func buildIgnoreLists(config *Config) (nodes, opcodes map[string]bool) {
+	nodes = make(map[string]bool)
+	for _, key := range config.Gateway.IgnoreNodes {
+		ref := parseNodeKey(key)
+		if ref.ZKID == config.zkids()[0] {
+			ref.ZKID = ""
+		}
+		nodes[ref.key()] = true
+	}
+	opcodes = make(map[string]bool)
+	for _, opcode := range config.Gateway.IgnoreOpcodes {
+		opcodes[opcode] = true
+	}
+	return nodes, opcodes
+}
+
+// ignored reports whether msg is dropped on arrival, before it is logged,
+// counted or forwarded anywhere.
+func (p *Proxy) ignored(msg *Message) bool {
+	if p.ignoreOpcodes[msg.Opcode] {
+		return true
+	}
+	return len(p.ignoreNodes) > 0 && p.ignoreNodes[p.messageKey(msg)]
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestIgnoreLists(t *testing.T) {
+	var config Config
+	config.Gateway.ZKID = "266590"
+	config.Gateway.ZKIDs = []string{"266590", "266591"}
+	config.Gateway.IgnoreNodes = []string{"266590/7", "266591/3"}
+	config.Gateway.IgnoreOpcodes = []string{"NOISE"}
+	proxy := NewProxy(&config)
+
+	proxy.handleMessage(&Message{NodeID: "7", Opcode: "SWITCH", Arg: "ON"})
+	proxy.handleMessage(&Message{NodeID: "3", ZKID: "266591", Opcode: "SWITCH", Arg: "ON"})
+	proxy.handleMessage(&Message{NodeID: "3", Opcode: "SWITCH", Arg: "ON"})
+	proxy.handleMessage(&Message{NodeID: "3", Opcode: "NOISE", Arg: "OFF"})
+
+	if got := proxy.deviceState("7"); got != "" {
+		t.Errorf("ignored node 7 has state %q", got)
+	}
+	if got := proxy.deviceState("266591/3"); got != "" {
+		t.Errorf("ignored node 266591/3 has state %q", got)
+	}
+	if got := proxy.deviceState("3"); got != "ON" {
+		t.Errorf("node 3 state = %q, want ON", got)
+	}
+
+	proxy.handleMessage(&Message{NodeID: "*", Opcode: "SYNC_INFO", Arg: []interface{}{
+		map[string]interface{}{"nodeid": "7", "name": "Neighbour repeater"},
+		map[string]interface{}{"nodeid": "8", "name": "Hall"},
+	}})
+	if _, ok := proxy.lookupDevice("7"); ok {
+		t.Error("ignored node 7 was added to the inventory")
+	}
+	if _, ok := proxy.lookupDevice("8"); !ok {
+		t.Error("node 8 missing from the inventory")
+	}
+}
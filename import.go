@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// vendorNode is a device found in a backup exported from the vendor app.
+type vendorNode struct {
+	syncNode
+	ZKID string
+	Kind string // kindSwitch or kindCurtain, empty for other devices
+}
+
+// parseVendorExport extracts the devices from a backup exported from the
+// vendor app. App versions differ in the layout, so the document is walked
+// for objects carrying a node ID: rooms either list their devices or are
+// referenced by room ID from a flat device list, and the zk controller is
+// taken from the nearest object naming one. These layouts have not been
+// checked against a real export; see testdata/import.
+func parseVendorExport(data []byte) ([]vendorNode, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	rooms := make(map[string]string) // room name by room ID
+	var collectRooms func(v interface{})
+	collectRooms = func(v interface{}) {
+		switch v := v.(type) {
+		case []interface{}:
+			for _, item := range v {
+				collectRooms(item)
+			}
+		case map[string]interface{}:
+			if list, ok := v["rooms"].([]interface{}); ok {
+				for _, item := range list {
+					if fields, ok := item.(map[string]interface{}); ok {
+						if id := firstField(fields, "roomId", "id"); id != "" {
+							rooms[id] = firstField(fields, "roomName", "name")
+						}
+					}
+				}
+			}
+			for _, item := range v {
+				collectRooms(item)
+			}
+		}
+	}
+	collectRooms(doc)
+
+	var nodes []vendorNode
+	seen := make(map[nodeRef]bool)
+	var walk func(v interface{}, zkid, room string)
+	walk = func(v interface{}, zkid, room string) {
+		switch v := v.(type) {
+		case []interface{}:
+			for _, item := range v {
+				walk(item, zkid, room)
+			}
+		case map[string]interface{}:
+			if id := firstField(v, "zkid", "zkId", "ccuId"); id != "" {
+				zkid = id
+			}
+			if firstField(v, "nodeid", "nodeId") != "" {
+				node, _ := parseSyncNode("", v)
+				if node.Room == "" {
+					node.Room = rooms[firstField(v, "roomId")]
+				}
+				if node.Room == "" {
+					node.Room = room
+				}
+				ref := nodeRef{ZKID: zkid, NodeID: node.NodeID}
+				if !seen[ref] {
+					seen[ref] = true
+					nodes = append(nodes, vendorNode{syncNode: node, ZKID: zkid, Kind: vendorKind(node)})
+				}
+				return
+			}
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if key != "rooms" {
+					walk(v[key], zkid, room)
+					continue
+				}
+				list, _ := v[key].([]interface{})
+				for _, item := range list {
+					name := room
+					if fields, ok := item.(map[string]interface{}); ok {
+						if n := firstField(fields, "roomName", "name"); n != "" {
+							name = n
+						}
+					}
+					walk(item, zkid, name)
+				}
+			}
+		}
+	}
+	walk(doc, "", "")
+	return nodes, nil
+}
+
+// vendorKind guesses from the model and name whether a device is a curtain
+// or switches like a light. Sensors, scene panels and the like are left out.
+func vendorKind(node syncNode) string {
+	s := strings.ToLower(node.Model + " " + node.Name)
+	has := func(words ...string) bool {
+		for _, w := range words {
+			if strings.Contains(s, w) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("curtain", "blind", "shade", "窗帘", "窗纱"):
+		return kindCurtain
+	case has("light", "lamp", "switch", "socket", "plug", "灯", "开关", "插座"):
+		return kindSwitch
+	}
+	return ""
+}
+
+// entitySlug returns the ASCII letters and digits of s as an entity ID, or
+// "" when s has none, as for most names set in the vendor app.
+func entitySlug(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "_"):
+			b.WriteByte('_')
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+// importSnippet returns the devices: section mapping the lights and
+// curtains among nodes. Nodes on primary, or without a zkid, get plain
+// node keys. Entity IDs come from the device names where these are
+// ASCII and from the kind and node ID otherwise; the vendor name is kept
+// as name and the room as a tag.
+func importSnippet(source string, nodes []vendorNode, primary string) string {
+	for i := range nodes {
+		if nodes[i].ZKID == primary {
+			nodes[i].ZKID = ""
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].ZKID != nodes[j].ZKID {
+			return nodes[i].ZKID < nodes[j].ZKID
+		}
+		return lessNodeID(nodes[i].NodeID, nodes[j].NodeID)
+	})
+
+	var b strings.Builder
+	line := func(indent int, format string, args ...interface{}) {
+		b.WriteString(strings.Repeat("  ", indent))
+		fmt.Fprintf(&b, format, args...)
+		b.WriteByte('\n')
+	}
+
+	var skipped, others []string
+	otherZKIDs := make(map[string]bool)
+	byKind := make(map[string][]vendorNode)
+	for _, node := range nodes {
+		if node.Kind == "" {
+			label := node.NodeID
+			if node.Name != "" || node.Model != "" {
+				label += " (" + strings.TrimSpace(node.Name+" "+node.Model) + ")"
+			}
+			skipped = append(skipped, label)
+			continue
+		}
+		if node.ZKID != "" && !otherZKIDs[node.ZKID] {
+			otherZKIDs[node.ZKID] = true
+			others = append(others, node.ZKID)
+		}
+		byKind[node.Kind] = append(byKind[node.Kind], node)
+	}
+
+	line(0, "# Generated by konke-ha-proxy import from %s.", source)
+	if len(others) > 0 {
+		line(0, "# List these zk controllers in gateway.zkids after %s: %s", primary, strings.Join(others, ", "))
+	}
+	if len(skipped) > 0 {
+		line(0, "# Skipped %d devices that are neither lights nor curtains: %s", len(skipped), strings.Join(skipped, ", "))
+	}
+	line(0, "devices:")
+	used := make(map[string]bool)
+	for _, section := range []struct{ name, kind, prefix string }{
+		{"curtains", kindCurtain, "curtain"},
+		{"lights", kindSwitch, "light"},
+	} {
+		list := byKind[section.kind]
+		if len(list) == 0 {
+			continue
+		}
+		line(1, "%s:", section.name)
+		for _, node := range list {
+			entity := entitySlug(node.Name)
+			if entity == "" {
+				entity = section.prefix + "_" + node.NodeID
+				if node.ZKID != "" {
+					entity = section.prefix + "_" + node.ZKID + "_" + node.NodeID
+				}
+			}
+			for base, n := entity, 2; used[entity]; n++ {
+				entity = fmt.Sprintf("%s_%d", base, n)
+			}
+			used[entity] = true
+
+			line(2, "%s:", yamlString(nodeRef{ZKID: node.ZKID, NodeID: node.NodeID}.key()))
+			line(3, "entity: %s", yamlString(entity))
+			if node.Name != "" {
+				line(3, "name: %s", yamlString(node.Name))
+			}
+			if node.Room != "" {
+				line(3, "tags: [%s]", yamlString(node.Room))
+			}
+		}
+	}
+	return b.String()
+}
+
+// busiestZKID returns the zk controller with the most nodes, which is
+// taken as the primary one when -zkid is not given.
+func busiestZKID(nodes []vendorNode) string {
+	count := make(map[string]int)
+	for _, node := range nodes {
+		if node.ZKID != "" {
+			count[node.ZKID]++
+		}
+	}
+	busiest := ""
+	for zkid, n := range count {
+		if busiest == "" || n > count[busiest] || n == count[busiest] && zkid < busiest {
+			busiest = zkid
+		}
+	}
+	return busiest
+}
+
+// runImportCommand implements the "import" subcommand and returns the
+// process exit code.
+func runImportCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	file := flags.String("file", "", "backup exported from the vendor app")
+	primary := flags.String("zkid", "", "primary zk controller (default the one with the most devices)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" || flags.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: konke-ha-proxy import -file backup.json [-zkid id]")
+		return 2
+	}
+
+	data, err := ioutil.ReadFile(*file)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading backup: %v\n", err)
+		return 1
+	}
+	nodes, err := parseVendorExport(data)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error parsing %s: %v\n", *file, err)
+		return 1
+	}
+	if len(nodes) == 0 {
+		fmt.Fprintf(stderr, "No devices found in %s\n", *file)
+		return 1
+	}
+	if *primary == "" {
+		*primary = busiestZKID(nodes)
+	}
+	fmt.Fprint(stdout, importSnippet(filepath.Base(*file), nodes, *primary))
+	return 0
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestImportCommand(t *testing.T) {
+	// The sample is hand-written, not exported from the vendor app: rooms
+	// listing their devices, and a flat list referencing a room by ID on
+	// a second zk controller.
+	file := filepath.Join("testdata", "import", "synthetic-export.json")
+
+	var stdout, stderr bytes.Buffer
+	if code := runImportCommand([]string{"-file", file}, &stdout, &stderr); code != 0 {
+		t.Fatalf("import: exit %d, stderr %q", code, stderr.String())
+	}
+	var config Config
+	if err := yaml.Unmarshal(stdout.Bytes(), &config); err != nil {
+		t.Fatalf("output is not a config: %v\n%s", err, stdout.String())
+	}
+	want := map[string]DeviceConfig{
+		"7":        {Entity: "light_7", Name: "主灯", Tags: []string{"客厅"}},
+		"10":       {Entity: "desk_lamp", Name: "Desk Lamp", Tags: []string{"Study"}},
+		"266591/3": {Entity: "porch_switch", Name: "Porch switch", Tags: []string{"Study"}},
+		"266591/4": {Entity: "light_266591_4", Name: "开关", Tags: []string{"客厅"}},
+	}
+	if len(config.Devices.Lights) != len(want) {
+		t.Errorf("lights = %+v, want %d", config.Devices.Lights, len(want))
+	}
+	for key, w := range want {
+		got := config.Devices.Lights[key]
+		if got.Entity != w.Entity || got.Name != w.Name || strings.Join(got.Tags, ",") != strings.Join(w.Tags, ",") {
+			t.Errorf("light %s = %+v, want %+v", key, got, w)
+		}
+	}
+	if got := config.Devices.Curtains["2"]; got.Entity != "curtain_2" || got.Name != "客厅窗帘" {
+		t.Errorf("curtain 2 = %+v", got)
+	}
+	for _, want := range []string{"gateway.zkids after 266590: 266591", "Skipped 1 devices", "30 (温湿度 sensor)"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, stdout.String())
+		}
+	}
+
+	// The imported mapping passes validation once the zkids are listed.
+	config.Gateway.ZKIDs = []string{"266590", "266591"}
+	for _, err := range config.validate() {
+		if len(err.path) > 0 && err.path[0] == "devices" {
+			t.Errorf("imported mapping: %v: %s", err.path, err.message)
+		}
+	}
+
+	if code := runImportCommand(nil, &stdout, &stderr); code != 2 {
+		t.Errorf("import without -file: exit %d, want 2", code)
+	}
+}
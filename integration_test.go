@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+const integrationTimeout = 5 * time.Second
+
+// fakeHA is a stub of Home Assistant's REST state API.
+type fakeHA struct {
+	*httptest.Server
+
+	mutex      sync.Mutex
+	states     map[string]string
+	attributes map[string]map[string]interface{}
+	history    map[string][]string
+	calls      map[string][]map[string]interface{} // service calls and events by path
+	updates    int
+	badAuth    int
+}
+
+func startFakeHA(tb testing.TB, token string) *fakeHA {
+	tb.Helper()
+
+	ha := &fakeHA{
+		states:     make(map[string]string),
+		attributes: make(map[string]map[string]interface{}),
+		history:    make(map[string][]string),
+		calls:      make(map[string][]map[string]interface{}),
+	}
+	ha.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ha.mutex.Lock()
+		defer ha.mutex.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			ha.badAuth++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPost && (strings.HasPrefix(r.URL.Path, "/api/services/") || strings.HasPrefix(r.URL.Path, "/api/events/")) {
+			var data map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&data)
+			ha.calls[r.URL.Path] = append(ha.calls[r.URL.Path], data)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/api/states/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var body struct {
+			State      string                 `json:"state"`
+			Attributes map[string]interface{} `json:"attributes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		entityID := strings.TrimPrefix(r.URL.Path, "/api/states/")
+		ha.states[entityID] = body.State
+		ha.history[entityID] = append(ha.history[entityID], body.State)
+		ha.attributes[entityID] = body.Attributes
+		ha.updates++
+		w.WriteHeader(http.StatusOK)
+	}))
+	tb.Cleanup(ha.Close)
+	return ha
+}
+
+func (ha *fakeHA) state(entityID string) string {
+	ha.mutex.Lock()
+	defer ha.mutex.Unlock()
+	return ha.states[entityID]
+}
+
+// statesSince returns the states pushed for an entity, oldest first,
+// after the first n.
+func (ha *fakeHA) statesSince(entityID string, n int) []string {
+	ha.mutex.Lock()
+	defer ha.mutex.Unlock()
+	if n > len(ha.history[entityID]) {
+		return nil
+	}
+	return append([]string(nil), ha.history[entityID][n:]...)
+}
+
+// called returns the bodies posted to a service or event path.
+func (ha *fakeHA) called(path string) []map[string]interface{} {
+	ha.mutex.Lock()
+	defer ha.mutex.Unlock()
+	return append([]map[string]interface{}(nil), ha.calls[path]...)
+}
+
+func (ha *fakeHA) attribute(entityID, name string) interface{} {
+	ha.mutex.Lock()
+	defer ha.mutex.Unlock()
+	return ha.attributes[entityID][name]
+}
+
+// gatewayLog collects the frames received by the fake gateway.
+type gatewayLog struct {
+	mutex    sync.Mutex
+	messages []fakegw.Message
+}
+
+func (l *gatewayLog) record(msg *fakegw.Message) {
+	l.mutex.Lock()
+	l.messages = append(l.messages, *msg)
+	l.mutex.Unlock()
+}
+
+func (l *gatewayLog) find(opcode, nodeID string) []fakegw.Message {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var found []fakegw.Message
+	for _, msg := range l.messages {
+		if msg.Opcode == opcode && (nodeID == "" || msg.NodeID == nodeID) {
+			found = append(found, msg)
+		}
+	}
+	return found
+}
+
+// integrationEnv wires a fake gateway, a stub Home Assistant and the proxy
+// with its HTTP API together.
+type integrationEnv struct {
+	gw     *fakegw.Gateway
+	frames *gatewayLog
+	ha     *fakeHA
+	proxy  *Proxy
+	api    *httptest.Server
+}
+
+func newIntegrationEnv(t *testing.T, configure ...func(*Config)) *integrationEnv {
+	t.Helper()
+
+	env := &integrationEnv{frames: &gatewayLog{}}
+	env.gw = startFakeGateway(t, 4, env.frames.record)
+	env.gw.Report("1", "ON")
+	env.gw.SetName("1", "客厅灯")
+	env.gw.SetName("3", "书房灯")
+	env.gw.SetRoom("1", "客厅")
+	env.ha = startFakeHA(t, "test-token")
+
+	config := testConfig(t, env.gw, 4)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(env.ha.URL, "http://"))
+	config.HomeAssistant.Host = host
+	config.HomeAssistant.Port, _ = strconv.Atoi(port)
+	config.HomeAssistant.Token = "test-token"
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}, "3": {
+		Entity: "light_three",
+		Name:   "Reading Lamp",
+		Tags:   []string{"night"},
+		Meta:   map[string]string{"circuit": "L2"},
+		// Commands to node 3 are reported to HA.
+		ConfirmNotify: true,
+	}}
+	config.Devices.Curtains = map[string]DeviceConfig{
+		"2": {Entity: "curtain_two", Timeout: 2},
+		// Node 9 does not exist on the gateway, so commands are never
+		// confirmed.
+		"9": {Entity: "curtain_nine", Timeout: 0.1, Retries: 2},
+	}
+	config.Auth.Tokens = []authToken{
+		{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}},
+		{Name: "user", Token: "user-token"},
+	}
+	for _, f := range configure {
+		f(config)
+	}
+
+	env.proxy = startProxy(t, config)
+	env.api = httptest.NewServer(newRouter(env.proxy))
+	t.Cleanup(env.api.Close)
+	return env
+}
+
+func (env *integrationEnv) post(t *testing.T, path, body string) map[string]interface{} {
+	t.Helper()
+
+	resp, err := http.Post(env.api.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST %s: status %d", path, resp.StatusCode)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("POST %s: decode response: %v", path, err)
+	}
+	return result
+}
+
+func (env *integrationEnv) get(t *testing.T, path string) map[string]interface{} {
+	t.Helper()
+
+	resp, err := http.Get(env.api.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("GET %s: decode response: %v", path, err)
+	}
+	return result
+}
+
+func TestIntegrationLogin(t *testing.T) {
+	env := newIntegrationEnv(t)
+
+	waitFor(t, integrationTimeout, func() bool { return env.gw.Logins() == 1 })
+
+	logins := env.frames.find("LOGIN", "*")
+	if len(logins) != 1 {
+		t.Fatalf("got %d LOGIN frames, want 1", len(logins))
+	}
+	arg, _ := logins[0].Arg.(map[string]interface{})
+	if arg["username"] != "admin" || arg["password"] != "admin" || arg["zkid"] != "266590" {
+		t.Errorf("unexpected LOGIN arguments: %v", arg)
+	}
+}
+
+func TestIntegrationResync(t *testing.T) {
+	env := newIntegrationEnv(t)
+
+	for i := 1; i <= 4; i++ {
+		id := strconv.Itoa(i)
+		waitFor(t, integrationTimeout, func() bool { return len(env.frames.find("QUERY", id)) == 1 })
+	}
+
+	// The gateway's answers to the initial queries are forwarded to HA
+	// for every mapped device.
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_one") == "on" })
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.curtain_two") == "off" })
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_three") == "off" })
+
+	if got := env.get(t, "/switch/1")["is_active"]; got != true {
+		t.Errorf("GET /switch/1 is_active = %v, want true", got)
+	}
+}
+
+func TestIntegrationStateReportUpdatesHA(t *testing.T) {
+	env := newIntegrationEnv(t)
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_three") == "off" })
+
+	env.gw.Report("3", "ON")
+
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_three") == "on" })
+	if got := env.get(t, "/switch/3")["is_active"]; got != true {
+		t.Errorf("GET /switch/3 is_active = %v, want true", got)
+	}
+
+	env.ha.mutex.Lock()
+	badAuth := env.ha.badAuth
+	env.ha.mutex.Unlock()
+	if badAuth != 0 {
+		t.Errorf("%d HA requests without the configured token", badAuth)
+	}
+}
+
+func TestIntegrationSwitchCommand(t *testing.T) {
+	env := newIntegrationEnv(t)
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_three") == "off" })
+
+	if got := env.post(t, "/switch/3", `{"arg":"ON"}`)["is_active"]; got != true {
+		t.Errorf("POST /switch/3 is_active = %v, want true", got)
+	}
+
+	// The command reaches the gateway as a SWITCH frame ...
+	waitFor(t, integrationTimeout, func() bool {
+		for _, msg := range env.frames.find("SWITCH", "3") {
+			if msg.Arg == "ON" && msg.ReqID != 0 {
+				return true
+			}
+		}
+		return false
+	})
+	// ... whose acknowledgement is reflected back into HA.
+	if got := env.gw.State("3"); got != "ON" {
+		t.Errorf("gateway state of node 3 = %q, want ON", got)
+	}
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_three") == "on" })
+	if got := env.get(t, "/switch/3")["is_active"]; got != true {
+		t.Errorf("GET /switch/3 is_active = %v, want true", got)
+	}
+}
+
+func TestIntegrationCurtainCommand(t *testing.T) {
+	env := newIntegrationEnv(t)
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.curtain_two") == "off" })
+
+	if got := env.post(t, "/curtain/2", `{"arg":"OPEN"}`)["is_open"]; got != true {
+		t.Errorf("POST /curtain/2 is_open = %v, want true", got)
+	}
+
+	waitFor(t, integrationTimeout, func() bool { return env.gw.State("2") == "OPEN" })
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.curtain_two") == "on" })
+	if got := env.get(t, "/curtain/2")["is_open"]; got != true {
+		t.Errorf("GET /curtain/2 is_open = %v, want true", got)
+	}
+}
+
+// coverDomain pushes the curtains of an integration environment to the
+// cover domain and adds curtain 4 with a travel time.
+func coverDomain(config *Config) {
+	config.HomeAssistant.CurtainDomain = "cover"
+	config.Devices.Curtains["4"] = DeviceConfig{Entity: "curtain_four", TravelTime: 0.3}
+}
+
+func TestIntegrationCoverTransitions(t *testing.T) {
+	env := newIntegrationEnv(t, coverDomain)
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("cover.curtain_two") == "closed" })
+
+	env.post(t, "/curtain/2", `{"arg":"OPEN"}`)
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("cover.curtain_two") == "open" })
+	if got := env.ha.statesSince("cover.curtain_two", 1); len(got) != 2 || got[0] != "opening" {
+		t.Errorf("cover.curtain_two went through %v, want [opening open]", got)
+	}
+	if got := env.ha.state("switch.curtain_two"); got != "" {
+		t.Errorf("curtain also pushed as a switch: %q", got)
+	}
+}
+
+func TestCurtainAsSwitchByDefault(t *testing.T) {
+	ha := startFakeHA(t, "test-token")
+	var config Config
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(ha.URL, "http://"))
+	config.HomeAssistant.Host = host
+	config.HomeAssistant.Port, _ = strconv.Atoi(port)
+	config.HomeAssistant.Token = "test-token"
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "curtain_two"}}
+	proxy := NewProxy(&config)
+
+	proxy.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "OPEN"})
+	if got := ha.state("switch.curtain_two"); got != "on" {
+		t.Errorf("switch.curtain_two = %q, want on", got)
+	}
+	if got := ha.state("cover.curtain_two"); got != "" {
+		t.Errorf("curtain pushed as a cover by default: %q", got)
+	}
+}
+
+func TestIntegrationCurtainTravelTime(t *testing.T) {
+	env := newIntegrationEnv(t, coverDomain)
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("cover.curtain_four") == "closed" })
+
+	start := time.Now()
+	env.post(t, "/curtain/4", `{"arg":"OPEN"}`)
+	// The gateway acknowledges at once, but the curtain is reported as
+	// moving until its travel time has passed.
+	waitFor(t, integrationTimeout, func() bool { return env.gw.State("4") == "OPEN" })
+	if got := env.ha.state("cover.curtain_four"); got != "opening" {
+		t.Errorf("state during travel = %q, want opening", got)
+	}
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("cover.curtain_four") == "open" })
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("curtain reported open after %s, before its travel time", elapsed)
+	}
+}
+
+func TestIntegrationCommandRetries(t *testing.T) {
+	env := newIntegrationEnv(t)
+	waitFor(t, integrationTimeout, func() bool { return env.gw.Logins() == 1 })
+
+	resp, err := http.Post(env.api.URL+"/curtain/9", "application/json", strings.NewReader(`{"arg":"OPEN"}`))
+	if err != nil {
+		t.Fatalf("POST /curtain/9: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("POST /curtain/9: status %d, want 504", resp.StatusCode)
+	}
+
+	// One attempt plus two retries, each with its own reqId.
+	frames := env.frames.find("SWITCH", "9")
+	if len(frames) != 3 {
+		t.Fatalf("gateway received %d SWITCH frames for node 9, want 3", len(frames))
+	}
+	if frames[0].ReqID == frames[1].ReqID || frames[1].ReqID == frames[2].ReqID {
+		t.Errorf("retries reused reqIds: %d, %d, %d", frames[0].ReqID, frames[1].ReqID, frames[2].ReqID)
+	}
+	if got := env.get(t, "/curtain/9")["is_open"]; got != false {
+		t.Errorf("unconfirmed command changed state: is_open = %v", got)
+	}
+
+	// The curtain is reported as stuck.
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.curtain_nine") == "unknown" })
+	if events := env.ha.called("/api/events/konke_stuck_transition"); len(events) != 1 || events[0]["command"] != "OPEN" {
+		t.Errorf("stuck transition events = %v", events)
+	}
+	metrics, _ := http.Get(env.api.URL + "/metrics")
+	body, _ := io.ReadAll(metrics.Body)
+	metrics.Body.Close()
+	if !strings.Contains(string(body), "konke_stuck_transitions_total 1\n") {
+		t.Errorf("metrics do not count the stuck transition:\n%s", body)
+	}
+}
+
+func TestIntegrationReconnect(t *testing.T) {
+	env := newIntegrationEnv(t)
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_three") == "off" })
+
+	// Restart the gateway on the same address with node 3 switched on
+	// while the proxy was away.
+	addr := env.gw.Addr()
+	env.gw.Close()
+	frames := &gatewayLog{}
+	gw := fakegw.New(4)
+	gw.OnMessage = frames.record
+	gw.Report("3", "ON")
+	if err := gw.Start(addr); err != nil {
+		t.Fatalf("restart fake gateway: %v", err)
+	}
+	t.Cleanup(func() { gw.Close() })
+
+	waitFor(t, integrationTimeout, func() bool { return gw.Logins() == 1 })
+	waitFor(t, integrationTimeout, func() bool { return len(frames.find("QUERY", "3")) == 1 })
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_three") == "on" })
+	if !env.proxy.Connected() {
+		t.Error("proxy not connected after gateway restart")
+	}
+}
+
+func TestIntegrationFirmwareRequiresAdmin(t *testing.T) {
+	env := newIntegrationEnv(t)
+
+	for token, want := range map[string]int{"": 401, "wrong": 401, "user-token": 403, "admin-token": 200} {
+		req, _ := http.NewRequest(http.MethodGet, env.api.URL+"/gateway/firmware", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /gateway/firmware: %v", err)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Errorf("token %q: status %d, want %d", token, resp.StatusCode, want)
+		}
+		if want == 200 {
+			firmware, _ := body["firmware"].(map[string]interface{})
+			if firmware["version"] != "1.0.0" || body["zkid"] != "266590" {
+				t.Errorf("unexpected firmware response: %v", body)
+			}
+		}
+	}
+	if got := len(env.frames.find("FW_QUERY", "*")); got != 1 {
+		t.Errorf("gateway received %d FW_QUERY frames, want 1", got)
+	}
+}
+
+func TestIntegrationRebootReconnects(t *testing.T) {
+	env := newIntegrationEnv(t)
+	waitFor(t, integrationTimeout, func() bool { return env.gw.Logins() == 1 })
+
+	req, _ := http.NewRequest(http.MethodPost, env.api.URL+"/gateway/reboot", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /gateway/reboot: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST /gateway/reboot: status %d, want 202", resp.StatusCode)
+	}
+
+	// The fake gateway keeps the socket open, so the proxy drops it
+	// itself, logs in again and resyncs.
+	waitFor(t, integrationTimeout, func() bool { return env.gw.Logins() == 2 })
+	waitFor(t, integrationTimeout, func() bool { return len(env.frames.find("QUERY", "1")) == 2 })
+	waitFor(t, integrationTimeout, func() bool { return !env.proxy.rebooting() })
+}
+
+func TestIntegrationFriendlyNames(t *testing.T) {
+	env := newIntegrationEnv(t)
+
+	// Names assigned in the vendor app are used unless overridden.
+	waitFor(t, integrationTimeout, func() bool { return env.ha.attribute("switch.light_one", "friendly_name") == "客厅灯" })
+	waitFor(t, integrationTimeout, func() bool {
+		return env.ha.attribute("switch.light_three", "friendly_name") == "Reading Lamp"
+	})
+
+	if got := env.ha.attribute("switch.light_one", "suggested_area"); got != "客厅" {
+		t.Errorf("suggested_area = %v, want 客厅", got)
+	}
+	if tags, meta := env.ha.attribute("switch.light_three", "tags"), env.ha.attribute("switch.light_three", "meta"); fmt.Sprint(tags, meta) != "[night] map[circuit:L2]" {
+		t.Errorf("tags = %v, meta = %v; want the configured ones", tags, meta)
+	}
+
+	// Renaming a device in the app is pushed on the next sync.
+	env.gw.SetName("1", "餐厅灯")
+	env.proxy.requestSyncInfo()
+	waitFor(t, integrationTimeout, func() bool { return env.ha.attribute("switch.light_one", "friendly_name") == "餐厅灯" })
+	if got := env.ha.state("switch.light_one"); got != "on" {
+		t.Errorf("rename changed state to %q", got)
+	}
+}
+
+func TestIntegrationConfirmNotify(t *testing.T) {
+	env := newIntegrationEnv(t)
+	waitFor(t, integrationTimeout, func() bool { return env.gw.Logins() == 1 })
+
+	env.post(t, "/switch/3", `{"arg": "ON"}`)
+	waitFor(t, integrationTimeout, func() bool { return len(env.ha.called("/api/events/konke_command")) == 1 })
+
+	event := env.ha.called("/api/events/konke_command")[0]
+	if event["entity_id"] != "switch.light_three" || event["command"] != "ON" || event["via"] != "rest" || event["addr"] != "127.0.0.1" {
+		t.Errorf("konke_command event = %v", event)
+	}
+	notes := env.ha.called("/api/services/persistent_notification/create")
+	if len(notes) != 1 || !strings.Contains(notes[0]["message"].(string), "Reading Lamp was sent ON by anonymous from 127.0.0.1 via rest") {
+		t.Errorf("notifications = %v", notes)
+	}
+
+	// Devices without confirm_notify are not reported.
+	env.post(t, "/switch/1", `{"arg": "OFF"}`)
+	time.Sleep(100 * time.Millisecond)
+	if n := len(env.ha.called("/api/events/konke_command")); n != 1 {
+		t.Errorf("%d konke_command events, want 1", n)
+	}
+}
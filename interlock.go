@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errInterlock is returned for commands that would switch on a device
+// while another device of one of its interlocks is on.
+var errInterlock = errors.New("refused by interlock")
+
+// isOn reports whether arg switches dev on, or opens it.
+func (p *Proxy) isOn(dev *device, arg string) bool {
+	state, _ := p.haState(dev, arg)
+	return state == "on" || state == "open"
+}
+
+// interlockGuard makes checking the interlocks and sending a command
+// that switches a node on one step. Such commands count as on from the
+// check until they are finished, so that concurrent commands to other
+// devices of an interlock do not both pass.
+type interlockGuard struct {
+	mutex   sync.Mutex
+	pending map[string]int // commands switching a node on, by node key
+}
+
+// checkInterlocks refuses a command that would switch on the node while
+// another device sharing an interlock with it is on, as last reported or
+// commanded. STOP always passes. Unless it refuses the command, it returns
+// a function to call once the command is finished.
+func (p *Proxy) checkInterlocks(dev *device, ref nodeRef, arg string) (release func(), err error) {
+	if len(p.config.Interlocks) == 0 || arg == "STOP" || !p.isOn(dev, arg) {
+		return func() {}, nil
+	}
+	g := &p.interlocks
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for name, interlock := range p.config.Interlocks {
+		keys := make([]string, 0, len(interlock.Devices))
+		for _, key := range interlock.Devices {
+			if key = p.nodeKey(key); key != ref.key() {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == len(interlock.Devices) {
+			continue
+		}
+		for _, key := range keys {
+			other, _ := p.lookupDevice(key)
+			if g.pending[key] == 0 && !p.isOn(&other, p.deviceState(key)) {
+				continue
+			}
+			blocker := "node " + key
+			if other.EntityID != "" {
+				blocker = p.haEntityID(&other)
+			}
+			return nil, fmt.Errorf("%w %q: %s is on", errInterlock, name, blocker)
+		}
+	}
+
+	key := ref.key()
+	if g.pending == nil {
+		g.pending = make(map[string]int)
+	}
+	g.pending[key]++
+	return func() {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		if g.pending[key]--; g.pending[key] == 0 {
+			delete(g.pending, key)
+		}
+	}, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+func TestInterlock(t *testing.T) {
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "fan"}, "2": {Entity: "heater"}}
+	config.Interlocks = map[string]InterlockConfig{"fan_heater": {Devices: []string{"1", "266590/2"}}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	command := func(node, arg string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/switch/"+node, strings.NewReader(`{"arg": "`+arg+`"}`)))
+		return rec
+	}
+
+	proxy.setDeviceState("2", "ON")
+	rec := command("1", "ON")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "switch.heater is on") {
+		t.Errorf("ON while the heater is on: status %d, body %s; want 409 naming the heater", rec.Code, rec.Body)
+	}
+	if rec := command("1", "OFF"); rec.Code != http.StatusOK {
+		t.Errorf("OFF while the heater is on: status %d, want 200", rec.Code)
+	}
+
+	proxy.setDeviceState("2", "OFF")
+	if rec := command("1", "ON"); rec.Code != http.StatusOK {
+		t.Errorf("ON while the heater is off: status %d, want 200", rec.Code)
+	}
+}
+
+func TestInterlockCommandInFlight(t *testing.T) {
+	sent := make(chan struct{})
+	confirm := make(chan struct{})
+	gw := startFakeGateway(t, 2, func(msg *fakegw.Message) {
+		if msg.Opcode == "SWITCH" && msg.NodeID == "1" && msg.Arg == "ON" {
+			close(sent)
+			<-confirm // the gateway confirms only when the test lets it
+		}
+	})
+	config := testConfig(t, gw, 2)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "fan", Timeout: 5}, "2": {Entity: "heater"}}
+	config.Interlocks = map[string]InterlockConfig{"fan_heater": {Devices: []string{"1", "2"}}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	command := func(node, arg string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/switch/"+node, strings.NewReader(`{"arg": "`+arg+`"}`)))
+		return rec
+	}
+
+	fan := make(chan int)
+	go func() { fan <- command("1", "ON").Code }()
+	select {
+	case <-sent:
+	case <-time.After(integrationTimeout):
+		t.Fatal("the gateway did not receive the fan command")
+	}
+	if rec := command("2", "ON"); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "switch.fan is on") {
+		t.Errorf("ON while the fan command is in flight: status %d, body %s; want 409 naming the fan", rec.Code, rec.Body)
+	}
+	close(confirm)
+	if code := <-fan; code != http.StatusOK {
+		t.Errorf("fan command: status %d, want 200", code)
+	}
+	if rec := command("2", "ON"); rec.Code != http.StatusConflict {
+		t.Errorf("ON once the fan is confirmed on: status %d, want 409", rec.Code)
+	}
+}
+
+func TestInterlockValidation(t *testing.T) {
+	var config Config
+	config.Gateway.Host = "192.168.1.10"
+	config.Gateway.ZKID = "266590"
+	config.Interlocks = map[string]InterlockConfig{
+		"single":  {Devices: []string{"7"}},
+		"unknown": {Devices: []string{"7", "999/8"}},
+	}
+	errs := config.validate()
+	if len(errs) != 2 {
+		t.Fatalf("errors = %v, want 2", errs)
+	}
+}
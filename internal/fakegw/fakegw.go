@@ -0,0 +1,279 @@
+// Package fakegw implements an in-process stand-in for a Konke gateway. It
+// speaks the same "!{json}$" framing as the real control unit, answers
+// LOGIN, CCU_HB, QUERY and SWITCH requests for a fixed number of simulated
+// nodes, and can push unsolicited state reports to connected clients.
+package fakegw
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Message mirrors the gateway message layout used by the proxy.
+type Message struct {
+	NodeID    string      `json:"nodeid"`
+	Opcode    string      `json:"opcode"`
+	Arg       interface{} `json:"arg"`
+	Requester string      `json:"requester"`
+	ReqID     int64       `json:"reqId,omitempty"`
+	Status    string      `json:"status,omitempty"`
+}
+
+// Gateway is a fake gateway listening on a TCP socket.
+type Gateway struct {
+	devices int
+
+	listener net.Listener
+	mutex    sync.Mutex
+	states   map[string]string
+	names    map[string]string
+	rooms    map[string]string
+	clients  map[net.Conn]*sync.Mutex
+	wg       sync.WaitGroup
+
+	frames int64
+	logins int64
+
+	// OnMessage, when set, is called for every frame received from a
+	// client. It must be set before Start.
+	OnMessage func(*Message)
+}
+
+// New returns a gateway simulating nodes 1..devices, all initially OFF.
+func New(devices int) *Gateway {
+	g := &Gateway{
+		devices: devices,
+		states:  make(map[string]string),
+		names:   make(map[string]string),
+		rooms:   make(map[string]string),
+		clients: make(map[net.Conn]*sync.Mutex),
+	}
+	for i := 1; i <= devices; i++ {
+		g.states[strconv.Itoa(i)] = "OFF"
+	}
+	return g
+}
+
+// Start begins accepting connections on addr, e.g. "127.0.0.1:0".
+func (g *Gateway) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	g.listener = listener
+
+	g.wg.Add(1)
+	go g.accept()
+	return nil
+}
+
+// Addr returns the address the gateway is listening on.
+func (g *Gateway) Addr() string {
+	return g.listener.Addr().String()
+}
+
+// ServeConn serves a single client connection, such as one end of a
+// net.Pipe, without going through the listener.
+func (g *Gateway) ServeConn(conn net.Conn) {
+	g.mutex.Lock()
+	g.clients[conn] = &sync.Mutex{}
+	g.mutex.Unlock()
+
+	g.wg.Add(1)
+	go g.serve(conn)
+}
+
+// Close stops the listener and drops all client connections.
+func (g *Gateway) Close() error {
+	var err error
+	if g.listener != nil {
+		err = g.listener.Close()
+	}
+
+	g.mutex.Lock()
+	for conn := range g.clients {
+		conn.Close()
+	}
+	g.mutex.Unlock()
+
+	g.wg.Wait()
+	return err
+}
+
+// Frames returns the number of frames received from clients so far.
+func (g *Gateway) Frames() int64 {
+	return atomic.LoadInt64(&g.frames)
+}
+
+// Logins returns the number of LOGIN requests received so far.
+func (g *Gateway) Logins() int64 {
+	return atomic.LoadInt64(&g.logins)
+}
+
+// State returns the simulated state of a node.
+func (g *Gateway) State(nodeID string) string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.states[nodeID]
+}
+
+// SetName sets the name reported for a node in SYNC_INFO responses, as if
+// it had been assigned in the vendor app.
+func (g *Gateway) SetName(nodeID, name string) {
+	g.mutex.Lock()
+	g.names[nodeID] = name
+	g.mutex.Unlock()
+}
+
+// SetRoom sets the room reported for a node in SYNC_INFO responses.
+func (g *Gateway) SetRoom(nodeID, room string) {
+	g.mutex.Lock()
+	g.rooms[nodeID] = room
+	g.mutex.Unlock()
+}
+
+// Report changes a node's state as if it had been switched locally and
+// pushes the resulting SWITCH report to every connected client.
+func (g *Gateway) Report(nodeID, arg string) {
+	g.mutex.Lock()
+	g.states[nodeID] = arg
+	g.mutex.Unlock()
+
+	g.broadcast(&Message{
+		NodeID:    nodeID,
+		Opcode:    "SWITCH",
+		Arg:       arg,
+		Requester: "HJ_Server",
+	})
+}
+
+func (g *Gateway) accept() {
+	defer g.wg.Done()
+
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			return
+		}
+		g.ServeConn(conn)
+	}
+}
+
+func (g *Gateway) serve(conn net.Conn) {
+	defer g.wg.Done()
+	defer func() {
+		g.mutex.Lock()
+		delete(g.clients, conn)
+		g.mutex.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := reader.ReadString('$')
+		if err != nil {
+			return
+		}
+
+		body := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(data), "!"), "$")
+		var msg Message
+		if err := json.Unmarshal([]byte(body), &msg); err != nil {
+			continue
+		}
+		atomic.AddInt64(&g.frames, 1)
+
+		if g.OnMessage != nil {
+			g.OnMessage(&msg)
+		}
+		if reply := g.reply(&msg); reply != nil {
+			g.send(conn, reply)
+		}
+	}
+}
+
+func (g *Gateway) reply(msg *Message) *Message {
+	switch msg.Opcode {
+	case "LOGIN":
+		atomic.AddInt64(&g.logins, 1)
+		return &Message{NodeID: "*", Opcode: "LOGIN", Arg: "*", Requester: "HJ_Server", Status: "success"}
+	case "CCU_HB":
+		return &Message{NodeID: "*", Opcode: "CCU_HB", Arg: "*", Requester: "HJ_Server"}
+	case "SYNC_INFO":
+		g.mutex.Lock()
+		nodes := make([]map[string]string, 0, g.devices)
+		for i := 1; i <= g.devices; i++ {
+			id := strconv.Itoa(i)
+			nodes = append(nodes, map[string]string{"nodeid": id, "name": g.names[id], "room": g.rooms[id]})
+		}
+		g.mutex.Unlock()
+		return &Message{NodeID: "*", Opcode: "SYNC_INFO", Arg: map[string]interface{}{"nodes": nodes}, Requester: "HJ_Server", ReqID: msg.ReqID}
+	case "FW_QUERY":
+		return &Message{NodeID: "*", Opcode: "FW_QUERY", Arg: map[string]string{"version": "1.0.0"}, Requester: "HJ_Server", ReqID: msg.ReqID, Status: "success"}
+	case "FW_UPGRADE":
+		return &Message{NodeID: "*", Opcode: "FW_UPGRADE", Arg: "*", Requester: "HJ_Server", ReqID: msg.ReqID, Status: "success"}
+	case "REBOOT":
+		return &Message{NodeID: "*", Opcode: "REBOOT", Arg: "*", Requester: "HJ_Server", ReqID: msg.ReqID, Status: "success"}
+	case "SET_TIME":
+		return &Message{NodeID: "*", Opcode: "SET_TIME", Arg: "*", Requester: "HJ_Server", ReqID: msg.ReqID, Status: "success"}
+	case "QUERY":
+		g.mutex.Lock()
+		state, ok := g.states[msg.NodeID]
+		g.mutex.Unlock()
+		if !ok {
+			return nil
+		}
+		return &Message{NodeID: msg.NodeID, Opcode: "SWITCH", Arg: state, Requester: "HJ_Server", ReqID: msg.ReqID}
+	case "SWITCH":
+		arg, ok := msg.Arg.(string)
+		if !ok {
+			return nil
+		}
+		g.mutex.Lock()
+		_, known := g.states[msg.NodeID]
+		if known {
+			g.states[msg.NodeID] = arg
+		}
+		g.mutex.Unlock()
+		if !known {
+			return nil
+		}
+		return &Message{NodeID: msg.NodeID, Opcode: "SWITCH", Arg: arg, Requester: "HJ_Server", ReqID: msg.ReqID}
+	}
+	return nil
+}
+
+func (g *Gateway) broadcast(msg *Message) {
+	g.mutex.Lock()
+	conns := make([]net.Conn, 0, len(g.clients))
+	for conn := range g.clients {
+		conns = append(conns, conn)
+	}
+	g.mutex.Unlock()
+
+	for _, conn := range conns {
+		g.send(conn, msg)
+	}
+}
+
+func (g *Gateway) send(conn net.Conn, msg *Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	g.mutex.Lock()
+	lock := g.clients[conn]
+	g.mutex.Unlock()
+	if lock == nil {
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	conn.Write([]byte("!" + string(data) + "$"))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Device kinds, named after the HTTP endpoints that control them.
+const (
+	kindSwitch  = "switch"
+	kindCurtain = "curtain"
+)
+
+// nodeRef identifies a node behind one of the zk controllers reachable
+// through the gateway. An empty ZKID refers to the primary controller, so
+// single-controller installations keep using bare node IDs everywhere.
+type nodeRef struct {
+	ZKID   string
+	NodeID string
+}
+
+// key returns the map key used for the node in the proxy's state:
+// "12" on the primary controller, "266591/12" on any other.
+func (r nodeRef) key() string {
+	if r.ZKID == "" {
+		return r.NodeID
+	}
+	return r.ZKID + "/" + r.NodeID
+}
+
+// parseNodeKey is the inverse of nodeRef.key, used for device keys in the
+// configuration.
+func parseNodeKey(key string) nodeRef {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return nodeRef{ZKID: key[:i], NodeID: key[i+1:]}
+	}
+	return nodeRef{NodeID: key}
+}
+
+// zkids returns the configured zk controller IDs, primary first.
+func (c *Config) zkids() []string {
+	if len(c.Gateway.ZKIDs) > 0 {
+		return c.Gateway.ZKIDs
+	}
+	return []string{c.Gateway.ZKID}
+}
+
+// device is a gateway node known to the proxy, either mapped to a Home
+// Assistant entity in the configuration or discovered through SYNC_INFO.
+type device struct {
+	Ref      nodeRef
+	Kind     string
+	EntityID string
+
+	// Config holds the per-device options from the configuration.
+	Config DeviceConfig
+	// GatewayName is the name assigned in the vendor app, as reported by
+	// SYNC_INFO.
+	GatewayName string
+	// Room is the room or zone the node is assigned to in the vendor app.
+	Room string
+}
+
+// displayName returns the name to show in Home Assistant, preferring the
+// configured override.
+func (d *device) displayName() string {
+	if d.Config.Name != "" {
+		return d.Config.Name
+	}
+	return d.GatewayName
+}
+
+// buildInventory collects the devices mapped in the configuration, keyed
+// by node key.
+func buildInventory(config *Config) map[string]*device {
+	inventory := make(map[string]*device)
+	add := func(kind string, mapping map[string]DeviceConfig) {
+		for key, dc := range mapping {
+			ref := parseNodeKey(key)
+			if ref.ZKID == config.zkids()[0] {
+				ref.ZKID = ""
+			}
+			inventory[ref.key()] = &device{Ref: ref, Kind: kind, EntityID: dc.Entity, Config: dc}
+		}
+	}
+	add(kindCurtain, config.Devices.Curtains)
+	add(kindSwitch, config.Devices.Lights)
+	return inventory
+}
+
+// errUnknownNode is returned for commands to a node that is neither mapped
+// nor listed in the gateway's inventory.
+var errUnknownNode = errors.New("unknown node")
+
+// strictNodes reports whether commands to unknown nodes are refused.
+func (c *Config) strictNodes() bool {
+	return c.HTTPServer.StrictNodes == nil || *c.HTTPServer.StrictNodes
+}
+
+// checkNode returns errUnknownNode for a node that is neither in the
+// configuration nor in the inventory discovered through SYNC_INFO, unless
+// http_server.strict_nodes is off or the client forces the command.
+func (p *Proxy) checkNode(ref nodeRef, force bool) error {
+	if force || !p.config.strictNodes() {
+		return nil
+	}
+	if _, ok := p.lookupDevice(ref.key()); !ok {
+		return errUnknownNode
+	}
+	return nil
+}
+
+// lookupDevice returns a copy of the inventory entry for a node key.
+func (p *Proxy) lookupDevice(key string) (device, bool) {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+
+	dev, ok := p.inventory[key]
+	if !ok {
+		return device{}, false
+	}
+	return *dev, true
+}
+
+// isMapped reports whether the node is mapped to a Home Assistant entity.
+func (p *Proxy) isMapped(ref nodeRef) bool {
+	dev, ok := p.lookupDevice(ref.key())
+	return ok && dev.EntityID != ""
+}
+
+// resolveNode maps a zkid and node ID from an HTTP path or a gateway
+// message to a nodeRef. It reports false for zkids that are not
+// configured.
+func (p *Proxy) resolveNode(zkid, nodeID string) (nodeRef, bool) {
+	zkids := p.config.zkids()
+	if zkid == "" || zkid == zkids[0] {
+		return nodeRef{NodeID: nodeID}, true
+	}
+	for _, id := range zkids[1:] {
+		if id == zkid {
+			return nodeRef{ZKID: zkid, NodeID: nodeID}, true
+		}
+	}
+	return nodeRef{}, false
+}
+
+// zkidOrPrimary returns zkid, or the primary controller's zkid if empty.
+func zkidOrPrimary(p *Proxy, zkid string) string {
+	if zkid == "" {
+		return p.config.zkids()[0]
+	}
+	return zkid
+}
+
+// outgoingZKID returns the zkid to put on messages for ref. It is omitted
+// entirely when only one controller is configured.
+func (p *Proxy) outgoingZKID(ref nodeRef) string {
+	zkids := p.config.zkids()
+	if len(zkids) < 2 {
+		return ""
+	}
+	if ref.ZKID == "" {
+		return zkids[0]
+	}
+	return ref.ZKID
+}
+
+// deviceInfo is the JSON representation of a device in the inventory.
+type deviceInfo struct {
+	ZKID       string                 `json:"zkid"`
+	NodeID     string                 `json:"node_id"`
+	Type       string                 `json:"type"`
+	EntityID   string                 `json:"entity_id"`
+	Name       string                 `json:"name"`
+	Room       string                 `json:"room"`
+	State      string                 `json:"state"`
+	Position   *int                   `json:"position,omitempty"`
+	Energy     *float64               `json:"energy,omitempty"` // kWh accumulated by metering devices
+	Health     *deviceHealth          `json:"health,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"` // extra fields of structured SWITCH arguments
+	Tags       []string               `json:"tags,omitempty"`
+	Meta       map[string]string      `json:"meta,omitempty"`
+}
+
+// listDevices returns the inventory sorted by zkid and node ID.
+func (p *Proxy) listDevices() []deviceInfo {
+	p.stateMu.RLock()
+	list := make([]deviceInfo, 0, len(p.inventory))
+	for key, dev := range p.inventory {
+		list = append(list, deviceInfo{
+			ZKID:       zkidOrPrimary(p, dev.Ref.ZKID),
+			NodeID:     dev.Ref.NodeID,
+			Type:       dev.Kind,
+			EntityID:   dev.EntityID,
+			Name:       dev.displayName(),
+			Room:       dev.Room,
+			State:      p.devices[key],
+			Tags:       dev.Config.Tags,
+			Attributes: p.extra[key],
+			Meta:       dev.Config.Meta,
+		})
+	}
+	p.stateMu.RUnlock()
+
+	for i := range list {
+		ref, _ := p.resolveNode(list[i].ZKID, list[i].NodeID)
+		if kwh, ok := p.energy.total(ref.key()); ok {
+			list[i].Energy = &kwh
+		}
+		if health, ok := p.deviceHealth(ref.key()); ok {
+			list[i].Health = &health
+		}
+		if list[i].Type != kindCurtain {
+			continue
+		}
+		if pos, ok := p.coverPosition(ref.key()); ok {
+			list[i].Position = &pos
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ZKID != list[j].ZKID {
+			return list[i].ZKID < list[j].ZKID
+		}
+		return lessNodeID(list[i].NodeID, list[j].NodeID)
+	})
+	return list
+}
+
+// lessNodeID orders numeric node IDs numerically and anything else
+// lexically.
+func lessNodeID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
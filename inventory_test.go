@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMultiZKIDRouting(t *testing.T) {
+	var config Config
+	config.Gateway.ZKIDs = []string{"100", "200"}
+	config.Devices.Lights = map[string]DeviceConfig{"7": {Entity: "primary_light"}, "200/7": {Entity: "second_light"}, "100/8": {Entity: "also_primary"}}
+	proxy := NewProxy(&config)
+
+	if _, ok := proxy.resolveNode("300", "7"); ok {
+		t.Error("resolveNode accepted an unconfigured zkid")
+	}
+	ref, _ := proxy.resolveNode("100", "8")
+	if ref.key() != "8" || proxy.inventory["8"] == nil {
+		t.Errorf("primary zkid not normalized: key %q", ref.key())
+	}
+	if got := proxy.outgoingZKID(ref); got != "100" {
+		t.Errorf("outgoingZKID(primary) = %q, want 100", got)
+	}
+
+	proxy.handleMessage(&Message{NodeID: "7", Opcode: "SWITCH", Arg: "ON", ZKID: "200"})
+	proxy.handleMessage(&Message{NodeID: "7", Opcode: "SWITCH", Arg: "OFF"})
+
+	devices := proxy.listDevices()
+	if len(devices) != 3 {
+		t.Fatalf("got %d devices, want 3", len(devices))
+	}
+	want := []deviceInfo{
+		{ZKID: "100", NodeID: "7", Type: kindSwitch, EntityID: "primary_light", State: "OFF"},
+		{ZKID: "100", NodeID: "8", Type: kindSwitch, EntityID: "also_primary"},
+		{ZKID: "200", NodeID: "7", Type: kindSwitch, EntityID: "second_light", State: "ON"},
+	}
+	for i := range want {
+		if !reflect.DeepEqual(devices[i], want[i]) {
+			t.Errorf("device %d = %+v, want %+v", i, devices[i], want[i])
+		}
+	}
+}
+
+func TestStrictNodes(t *testing.T) {
+	proxy := eventProxy()
+	router := newRouter(proxy)
+	post := func(path string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"arg":"ON"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Known nodes get as far as the gateway, which is not connected.
+	proxy.handleMessage(&Message{NodeID: "*", Opcode: "SYNC_INFO", Arg: []interface{}{
+		map[string]interface{}{"nodeid": "40", "name": "Attic"},
+	}})
+	for _, path := range []string{"/switch/1", "/switch/40", "/switch/abc123?force=1"} {
+		if code := post(path); code != http.StatusServiceUnavailable {
+			t.Errorf("POST %s: status %d, want 503", path, code)
+		}
+	}
+	if code := post("/switch/abc123"); code != http.StatusNotFound {
+		t.Errorf("POST /switch/abc123: status %d, want 404", code)
+	}
+	auth := newAuthenticator(proxy.config, &proxy.guests)
+	if resp := proxy.wsCommand(context.Background(), auth, "", commandSource{}, wsRequest{Type: "command", NodeID: "abc123", Arg: "ON"}); resp.Status != http.StatusNotFound {
+		t.Errorf("ws command to an unknown node: status %d, want 404", resp.Status)
+	}
+
+	off := false
+	proxy.config.HTTPServer.StrictNodes = &off
+	if code := post("/switch/abc123"); code != http.StatusServiceUnavailable {
+		t.Errorf("POST /switch/abc123 with strict_nodes off: status %d, want 503", code)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// subsystemGateway is the subsystem keeping the gateway connection.
+const subsystemGateway = "gateway connection"
+
+// States of a subsystem.
+const (
+	subsystemWaiting    = "waiting" // for its dependencies to run
+	subsystemRunning    = "running"
+	subsystemRestarting = "restarting"
+	subsystemStopped    = "stopped"
+	subsystemDisabled   = "disabled" // at runtime, through the admin API
+)
+
+var (
+	errUnknownSubsystem  = errors.New("unknown subsystem")
+	errDependencyOff     = errors.New("a dependency is disabled")
+	errSubsystemsStopped = errors.New("subsystems are not running")
+)
+
+var (
+	// A subsystem that fails is restarted after restartBackoffMin,
+	// doubling with every failure in a row up to restartBackoffMax. A run
+	// that lasted restartBackoffMax starts the count over.
+	restartBackoffMin = time.Second
+	restartBackoffMax = time.Minute
+)
+
+// subsystem is a long-running part of the proxy, such as the gateway
+// connection or an extension.
+type subsystem struct {
+	name string
+	deps []string
+	run  func(ctx context.Context) error
+	done chan struct{}
+
+	// Guarded by the manager's mutex.
+	cancel    context.CancelFunc
+	disabled  bool
+	state     string
+	since     time.Time
+	restarts  int
+	lastError string
+}
+
+// subsystemStatus is the state of a subsystem as listed by GET /healthz.
+type subsystemStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	DependsOn []string  `json:"depends_on,omitempty"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// subsystemManager starts the subsystems in the order of their
+// dependencies, restarts those that fail with a backoff, and stops them in
+// the reverse order.
+type subsystemManager struct {
+	mutex   sync.Mutex
+	list    []*subsystem  // in start order once started
+	changed chan struct{} // closed on every state change
+	started bool
+	ctx     context.Context
+	protect func(name string, fn func() error) error
+}
+
+// add registers a subsystem that runs until ctx is cancelled. run returns
+// an error when it fails; it is started again then. deps name the
+// subsystems that must be running before it starts.
+func (m *subsystemManager) add(name string, deps []string, run func(ctx context.Context) error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.list = append(m.list, &subsystem{name: name, deps: deps, run: run, state: subsystemStopped})
+}
+
+// loop adapts a loop that only ends with its context to a subsystem.
+func loop(fn func(ctx context.Context)) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		fn(ctx)
+		return nil
+	}
+}
+
+// order sorts the subsystems so that each comes after its dependencies.
+func (m *subsystemManager) order() error {
+	byName := make(map[string]*subsystem, len(m.list))
+	for _, s := range m.list {
+		byName[s.name] = s
+	}
+	var sorted []*subsystem
+	visited := make(map[string]int) // 1 while visiting, 2 when done
+	var visit func(s *subsystem) error
+	visit = func(s *subsystem) error {
+		switch visited[s.name] {
+		case 1:
+			return fmt.Errorf("subsystem %s depends on itself", s.name)
+		case 2:
+			return nil
+		}
+		visited[s.name] = 1
+		for _, dep := range s.deps {
+			d, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("subsystem %s depends on unknown subsystem %s", s.name, dep)
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		visited[s.name] = 2
+		sorted = append(sorted, s)
+		return nil
+	}
+	for _, s := range m.list {
+		if err := visit(s); err != nil {
+			return err
+		}
+	}
+	m.list = sorted
+	return nil
+}
+
+// start starts the subsystems. protect runs each, turning its panics into
+// errors.
+func (m *subsystemManager) start(ctx context.Context, protect func(name string, fn func() error) error) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.order(); err != nil {
+		return err
+	}
+	m.changed = make(chan struct{})
+	m.started = true
+	m.ctx, m.protect = ctx, protect
+	for _, s := range m.list {
+		m.launch(s)
+	}
+	return nil
+}
+
+// launch starts s in the background. The caller holds the mutex.
+func (m *subsystemManager) launch(s *subsystem) {
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(m.ctx)
+	s.done = make(chan struct{})
+	m.setState(s, subsystemWaiting)
+	go m.supervise(ctx, s, s.done)
+}
+
+func (m *subsystemManager) lookup(name string) *subsystem {
+	for _, s := range m.list {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// disable stops the subsystem name and the ones depending on it, and
+// returns the names of those it stopped. They stay stopped until enabled
+// again.
+func (m *subsystemManager) disable(name string) ([]string, error) {
+	m.mutex.Lock()
+	if !m.started {
+		m.mutex.Unlock()
+		return nil, errSubsystemsStopped
+	}
+	if m.lookup(name) == nil {
+		m.mutex.Unlock()
+		return nil, errUnknownSubsystem
+	}
+	// The list is in dependency order, so one pass finds the dependents
+	// of the dependents too.
+	affected := map[string]bool{name: true}
+	var stopping []*subsystem
+	var done []chan struct{}
+	for _, s := range m.list {
+		for _, dep := range s.deps {
+			if affected[dep] {
+				affected[s.name] = true
+			}
+		}
+		if affected[s.name] && !s.disabled {
+			s.disabled = true
+			s.cancel()
+			stopping = append(stopping, s)
+			done = append(done, s.done)
+		}
+	}
+	m.mutex.Unlock()
+
+	names := []string{}
+	for i := len(stopping) - 1; i >= 0; i-- {
+		s := stopping[i]
+		<-done[i]
+		m.mutex.Lock()
+		if s.disabled {
+			m.setState(s, subsystemDisabled)
+		}
+		m.mutex.Unlock()
+		log.Printf("Subsystem %s disabled", s.name)
+		names = append(names, s.name)
+	}
+	return names, nil
+}
+
+// enable starts a disabled subsystem again. Its dependencies must be
+// enabled.
+func (m *subsystemManager) enable(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.started {
+		return errSubsystemsStopped
+	}
+	s := m.lookup(name)
+	if s == nil {
+		return errUnknownSubsystem
+	}
+	if !s.disabled {
+		return nil
+	}
+	for _, dep := range s.deps {
+		if m.lookup(dep).disabled {
+			return fmt.Errorf("%w: %s", errDependencyOff, dep)
+		}
+	}
+	s.disabled = false
+	m.launch(s)
+	log.Printf("Subsystem %s enabled", s.name)
+	return nil
+}
+
+// running reports whether the subsystem name is running.
+func (m *subsystemManager) running(name string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.lookup(name)
+	return s != nil && s.state == subsystemRunning
+}
+
+// setState changes the state of s. The caller holds the mutex.
+func (m *subsystemManager) setState(s *subsystem, state string) {
+	s.state = state
+	s.since = time.Now()
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// waitDeps waits until the dependencies of s are running.
+func (m *subsystemManager) waitDeps(ctx context.Context, s *subsystem) bool {
+	for {
+		m.mutex.Lock()
+		ready := true
+		for _, dep := range s.deps {
+			for _, d := range m.list {
+				if d.name == dep && d.state != subsystemRunning {
+					ready = false
+				}
+			}
+		}
+		changed := m.changed
+		m.mutex.Unlock()
+		if ready {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// supervise runs s until ctx is cancelled or it returns without an error.
+func (m *subsystemManager) supervise(ctx context.Context, s *subsystem, done chan struct{}) {
+	defer close(done)
+	defer func() {
+		m.mutex.Lock()
+		if s.done == done { // not enabled again in the meantime
+			m.setState(s, subsystemStopped)
+		}
+		m.mutex.Unlock()
+	}()
+
+	failures := 0
+	for {
+		if !m.waitDeps(ctx, s) {
+			return
+		}
+		m.mutex.Lock()
+		m.setState(s, subsystemRunning)
+		m.mutex.Unlock()
+
+		started := time.Now()
+		err := m.protect(s.name, func() error { return s.run(ctx) })
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) >= restartBackoffMax {
+			failures = 0
+		}
+		failures++
+		backoff := restartBackoffMin << (failures - 1)
+		if backoff > restartBackoffMax || backoff <= 0 {
+			backoff = restartBackoffMax
+		}
+		log.Printf("Subsystem %s failed (%v), restarting in %s", s.name, err, backoff)
+		m.mutex.Lock()
+		s.restarts++
+		s.lastError = err.Error()
+		m.setState(s, subsystemRestarting)
+		m.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		m.mutex.Lock()
+		m.setState(s, subsystemWaiting)
+		m.mutex.Unlock()
+	}
+}
+
+// stop stops the subsystems in the reverse start order, each after the
+// ones depending on it.
+func (m *subsystemManager) stop() {
+	m.mutex.Lock()
+	list := m.list
+	started := m.started
+	m.started = false
+	m.mutex.Unlock()
+	if !started {
+		return
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		m.mutex.Lock()
+		s := list[i]
+		s.cancel()
+		done := s.done
+		m.mutex.Unlock()
+		<-done
+	}
+}
+
+// status returns the states of the subsystems in start order.
+func (m *subsystemManager) status() []subsystemStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := make([]subsystemStatus, 0, len(m.list))
+	for _, s := range m.list {
+		list = append(list, subsystemStatus{
+			Name:      s.name,
+			State:     s.state,
+			Since:     s.since,
+			DependsOn: s.deps,
+			Restarts:  s.restarts,
+			LastError: s.lastError,
+		})
+	}
+	return list
+}
+
+// healthzHandler serves GET /healthz: the states of the subsystems, of
+// the gateway session and of the updates to Home Assistant. It answers 503
+// while a subsystem is restarting after a failure or the updates miss
+// their error budget.
+func healthzHandler(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subsystems := proxy.subsystems.status()
+		delivery := proxy.delivery.stats(time.Now(), proxy.config.HomeAssistant.ErrorBudget)
+		status, code := "ok", 200
+		for _, s := range subsystems {
+			if s.State == subsystemRestarting {
+				status, code = "degraded", 503
+			}
+		}
+		if delivery.Degraded {
+			status, code = "degraded", 503
+		}
+		c.JSON(code, gin.H{
+			"status":         status,
+			"gateway":        gin.H{"connected": proxy.Connected(), "ready": proxy.Ready(), "heartbeat": proxy.heartbeat.status()},
+			"home_assistant": delivery,
+			"subsystems":     subsystems,
+		})
+	}
+}
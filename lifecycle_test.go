@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSubsystemManager(t *testing.T) {
+	defer func(min time.Duration) { restartBackoffMin = min }(restartBackoffMin)
+	restartBackoffMin = 10 * time.Millisecond
+
+	var mutex sync.Mutex
+	var events []string
+	record := func(event string) {
+		mutex.Lock()
+		events = append(events, event)
+		mutex.Unlock()
+	}
+	var failures atomic.Int32
+	var m subsystemManager
+	// Added before its dependency, started after it.
+	m.add("b", []string{"a"}, loop(func(ctx context.Context) {
+		record("start b")
+		<-ctx.Done()
+		record("stop b")
+	}))
+	m.add("a", nil, func(ctx context.Context) error {
+		if failures.Add(1) == 1 {
+			return errors.New("flaky")
+		}
+		record("start a")
+		<-ctx.Done()
+		record("stop a")
+		return nil
+	})
+	protect := func(name string, fn func() error) error { return fn() }
+	if err := m.start(context.Background(), protect); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, time.Second, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(events) == 2
+	})
+	status := m.status()
+	if status[0].Name != "a" || status[0].Restarts != 1 || status[0].LastError != "flaky" || status[0].State != subsystemRunning {
+		t.Errorf("status of a = %+v, want running after one restart", status[0])
+	}
+	m.stop()
+	want := []string{"start a", "start b", "stop b", "stop a"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+	if state := m.status()[1].State; state != subsystemStopped {
+		t.Errorf("state of b after stop = %q", state)
+	}
+
+	var bad subsystemManager
+	bad.add("x", []string{"missing"}, loop(func(ctx context.Context) {}))
+	if err := bad.start(context.Background(), protect); err == nil || !strings.Contains(err.Error(), "unknown subsystem") {
+		t.Errorf("unknown dependency: %v", err)
+	}
+	var cycle subsystemManager
+	cycle.add("x", []string{"y"}, loop(func(ctx context.Context) {}))
+	cycle.add("y", []string{"x"}, loop(func(ctx context.Context) {}))
+	if err := cycle.start(context.Background(), protect); err == nil {
+		t.Error("dependency cycle accepted")
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	proxy := startProxy(t, testConfig(t, gw, 1))
+	router := newRouter(proxy)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Status     string            `json:"status"`
+		Subsystems []subsystemStatus `json:"subsystems"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "ok" || len(body.Subsystems) == 0 || body.Subsystems[0].Name != subsystemGateway || body.Subsystems[0].State != subsystemRunning {
+		t.Errorf("healthz = %s", rec.Body)
+	}
+}
+
+func TestToggleSubsystems(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}}}
+	config.Alerts = []AlertRule{{Name: "flapping", Condition: conditionReconnects, Threshold: 5, Window: 60}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+	waitFor(t, time.Second, func() bool { return proxy.subsystems.running(subsystemWebSocket) })
+
+	toggle := func(name string, enabled bool) *httptest.ResponseRecorder {
+		body := `{"enabled":false}`
+		if enabled {
+			body = `{"enabled":true}`
+		}
+		req := httptest.NewRequest(http.MethodPost, "/admin/subsystems/"+url.PathEscape(name), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := toggle(subsystemWebSocket, false); rec.Code != http.StatusOK {
+		t.Fatalf("disable: status %d, body %s", rec.Code, rec.Body)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ws while disabled: status %d", rec.Code)
+	}
+	if rec := toggle(subsystemWebSocket, true); rec.Code != http.StatusOK {
+		t.Fatalf("enable: status %d, body %s", rec.Code, rec.Body)
+	}
+	waitFor(t, time.Second, func() bool { return proxy.subsystems.running(subsystemWebSocket) })
+
+	// Disabling the gateway connection takes its dependents along.
+	rec = toggle(subsystemGateway, false)
+	var body struct {
+		Disabled []string `json:"disabled"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Disabled) < 2 || body.Disabled[len(body.Disabled)-1] != subsystemGateway {
+		t.Errorf("disabled = %v, want the dependents before the gateway connection", body.Disabled)
+	}
+	if rec := toggle("alert rules", true); rec.Code != http.StatusConflict {
+		t.Errorf("enabling a dependent of a disabled subsystem: status %d", rec.Code)
+	}
+	if rec := toggle("nope", false); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown subsystem: status %d", rec.Code)
+	}
+	if rec := toggle(subsystemGateway, true); rec.Code != http.StatusOK {
+		t.Fatalf("enable gateway: status %d, body %s", rec.Code, rec.Body)
+	}
+	waitFor(t, 2*time.Second, func() bool { return proxy.Ready() })
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// splitAdmin reports whether the admin endpoints have a listener of their
+// own.
+func (c *Config) splitAdmin() bool {
+	return c.HTTPServer.Admin.Port > 0
+}
+
+// listenAddr returns the address to listen on for a configured host and
+// port. The host may also name a network interface, such as tailscale0 or
+// wg0, to listen on its address; an IPv4 address is preferred.
+func listenAddr(host string, port int) (string, error) {
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		return hostPort(host, port), nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("interface %s: %v", host, err)
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			return hostPort(ip4.String(), port), nil
+		}
+		if found == nil {
+			found = ipnet.IP
+		}
+	}
+	if found == nil {
+		return "", fmt.Errorf("interface %s has no address", host)
+	}
+	return hostPort(found.String(), port), nil
+}
+
+// listen opens a listener on a configured host and port.
+func listen(host string, port int) (net.Listener, error) {
+	addr, err := listenAddr(host, port)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen("tcp", addr)
+}
+
+// validateAdminListener checks http_server.admin.
+func (c *Config) validateAdminListener(add func(message string, path ...string)) {
+	admin := c.HTTPServer.Admin
+	switch {
+	case admin.Port < 0 || admin.Port > 65535:
+		add("port must be between 1 and 65535", "http_server", "admin", "port")
+	case admin.Port > 0 && admin.Port == c.HTTPServer.Port && admin.Host == c.HTTPServer.Host:
+		add("the admin listener needs another host or port than the control API", "http_server", "admin", "port")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminListener(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.HTTPServer.Port = 8500
+	config.HTTPServer.Admin.Host = "127.0.0.1"
+	config.HTTPServer.Admin.Port = 8501
+	proxy := startProxy(t, config)
+	control, admin := newRouter(proxy), newAdminRouter(proxy)
+
+	get := func(router http.Handler, target string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Code
+	}
+	for _, target := range []string{"/healthz", "/metrics"} {
+		if code := get(control, target); code != http.StatusNotFound {
+			t.Errorf("control API %s: status %d, want 404", target, code)
+		}
+		if code := get(admin, target); code != http.StatusOK {
+			t.Errorf("admin listener %s: status %d", target, code)
+		}
+	}
+	if code := get(control, "/switch/1"); code != http.StatusOK {
+		t.Errorf("control API /switch/1: status %d", code)
+	}
+	if code := get(admin, "/switch/1"); code != http.StatusNotFound {
+		t.Errorf("admin listener /switch/1: status %d, want 404", code)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	if addr, err := listenAddr("192.168.1.2", 8500); err != nil || addr != "192.168.1.2:8500" {
+		t.Errorf("address: %q, %v", addr, err)
+	}
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addr, err := listenAddr(iface.Name, 8500)
+		if err != nil || !strings.HasPrefix(addr, "127.") {
+			t.Errorf("interface %s: %q, %v", iface.Name, addr, err)
+		}
+		return
+	}
+	t.Skip("no loopback interface")
+}
+
+func TestValidateAdminListener(t *testing.T) {
+	for _, test := range []struct {
+		host string
+		port int
+		ok   bool
+	}{
+		{"127.0.0.1", 8501, true},
+		{"", 8500, false}, // the control API's
+		{"127.0.0.1", 70000, false},
+		{"127.0.0.1", 0, true}, // disabled
+		{"", 0, true},
+	} {
+		var config Config
+		config.HTTPServer.Port = 8500
+		config.HTTPServer.Admin.Host = test.host
+		config.HTTPServer.Admin.Port = test.port
+		var errs []string
+		config.validateAdminListener(func(message string, path ...string) {
+			errs = append(errs, message)
+		})
+		if ok := len(errs) == 0; ok != test.ok {
+			t.Errorf("admin %s:%d: errors %v", test.host, test.port, errs)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits of paginated list endpoints.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listQuery holds the filtering, sorting and pagination parameters shared
+// by the list endpoints.
+type listQuery struct {
+	Type   string
+	State  string
+	Tag    string
+	Q      string // case-insensitive substring of the name, entity or room
+	Sort   string // field name, optionally prefixed with "-" for descending
+	Limit  int    // 0 returns everything
+	Offset int
+}
+
+// parseListQuery reads the list parameters of c, accepting sort on the
+// given fields. Unpaginated endpoints keep returning everything unless
+// limit is set.
+func parseListQuery(c *gin.Context, sortFields ...string) (listQuery, error) {
+	q := listQuery{
+		Type:  c.Query("type"),
+		State: c.Query("state"),
+		Tag:   c.Query("tag"),
+		Q:     strings.ToLower(c.Query("q")),
+		Sort:  c.Query("sort"),
+	}
+	var err error
+	if s := c.Query("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit")
+		}
+		if q.Limit > maxListLimit {
+			q.Limit = maxListLimit
+		}
+	}
+	if s := c.Query("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return q, fmt.Errorf("invalid offset")
+		}
+	}
+	if q.Sort != "" {
+		field := strings.TrimPrefix(q.Sort, "-")
+		valid := false
+		for _, f := range sortFields {
+			valid = valid || f == field
+		}
+		if !valid {
+			return q, fmt.Errorf("cannot sort by %q; use one of %s", field, strings.Join(sortFields, ", "))
+		}
+	}
+	return q, nil
+}
+
+// descending reports whether the sort is in descending order.
+func (q listQuery) descending() bool {
+	return strings.HasPrefix(q.Sort, "-")
+}
+
+// sortField returns the field to sort on, or def.
+func (q listQuery) sortField(def string) string {
+	if q.Sort == "" {
+		return def
+	}
+	return strings.TrimPrefix(q.Sort, "-")
+}
+
+// page returns the bounds of the requested page within n items.
+func (q listQuery) page(n int) (start, end int) {
+	start = q.Offset
+	if start > n {
+		start = n
+	}
+	end = n
+	if q.Limit > 0 && start+q.Limit < n {
+		end = start + q.Limit
+	}
+	return start, end
+}
+
+// setTotal reports the number of matches before pagination, so that list
+// bodies can stay plain arrays.
+func setTotal(c *gin.Context, total int) {
+	c.Header("X-Total-Count", strconv.Itoa(total))
+}
+
+// matches reports whether a device passes the filters.
+func (q listQuery) matches(d *deviceInfo) bool {
+	if q.Type != "" && d.Type != q.Type {
+		return false
+	}
+	if q.State != "" && !strings.EqualFold(d.State, q.State) {
+		return false
+	}
+	if q.Tag != "" && !hasTag(d.Tags, q.Tag) {
+		return false
+	}
+	if q.Q != "" {
+		text := strings.ToLower(d.Name + "\x00" + d.EntityID + "\x00" + d.Room)
+		if !strings.Contains(text, q.Q) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTag reports whether tags contain tag, ignoring case.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceSortFields are the fields GET /devices can sort on.
+var deviceSortFields = []string{"node_id", "name", "room", "type", "state", "entity_id"}
+
+// filterDevices applies q to a device list ordered by node.
+func filterDevices(list []deviceInfo, q listQuery) ([]deviceInfo, int) {
+	matched := list[:0:0]
+	for i := range list {
+		if q.matches(&list[i]) {
+			matched = append(matched, list[i])
+		}
+	}
+
+	key := func(d *deviceInfo) string {
+		switch q.sortField("node_id") {
+		case "name":
+			return strings.ToLower(d.Name)
+		case "room":
+			return strings.ToLower(d.Room)
+		case "type":
+			return d.Type
+		case "state":
+			return d.State
+		case "entity_id":
+			return d.EntityID
+		}
+		return ""
+	}
+	// The list is already in node order, which breaks ties.
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := key(&matched[i]), key(&matched[j])
+		if q.descending() {
+			return a > b
+		}
+		return a < b
+	})
+	if q.descending() && q.sortField("node_id") == "node_id" {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+
+	start, end := q.page(len(matched))
+	return matched[start:end], len(matched)
+}
+
+// historySortFields are the fields GET /history can sort on.
+var historySortFields = []string{"seq", "time"}
+
+// filterHistory applies q to state changes in the order they happened,
+// returning the newest first unless sorted by ascending seq or time.
+func filterHistory(events []stateEvent, q listQuery, entityID string) ([]stateEvent, int) {
+	matched := []stateEvent{}
+	for _, ev := range events {
+		d := deviceInfo{Type: ev.Type, State: ev.State, EntityID: ev.EntityID}
+		if !q.matches(&d) || (entityID != "" && ev.EntityID != entityID) {
+			continue
+		}
+		matched = append(matched, ev)
+	}
+	if q.Sort == "" || q.descending() {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+	start, end := q.page(len(matched))
+	return matched[start:end], len(matched)
+}
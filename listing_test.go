@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListDevicesQuery(t *testing.T) {
+	var config Config
+	config.Devices.Lights = map[string]DeviceConfig{
+		"1": {Entity: "light_desk", Name: "Desk"},
+		"2": {Entity: "light_hall", Name: "Hall", Tags: []string{"Night"}, Meta: map[string]string{"floor": "1"}},
+		"3": {Entity: "light_bed", Name: "Bedside"},
+	}
+	config.Devices.Curtains = map[string]DeviceConfig{"4": {Entity: "curtain_study", Name: "Blinds"}}
+	proxy := NewProxy(&config)
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	router := newRouter(proxy)
+
+	list := func(query string) ([]string, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/devices"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /devices%s: status %d", query, rec.Code)
+		}
+		var devices []deviceInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &devices); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, d := range devices {
+			ids = append(ids, d.NodeID)
+		}
+		return ids, rec.Header().Get("X-Total-Count")
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  string
+		total string
+	}{
+		{"", "[1 2 3 4]", "4"},
+		{"?type=curtain", "[4]", "1"},
+		{"?state=on", "[1]", "1"},
+		{"?q=study", "[4]", "1"},
+		{"?q=BED", "[3]", "1"},
+		{"?tag=night", "[2]", "1"},
+		{"?sort=name", "[3 4 1 2]", "4"},
+		{"?sort=-name", "[2 1 4 3]", "4"},
+		{"?sort=-node_id&limit=2", "[4 3]", "4"},
+		{"?limit=2&offset=1", "[2 3]", "4"},
+		{"?offset=10", "[]", "4"},
+	} {
+		ids, total := list(tc.query)
+		if got := fmtIDs(ids); got != tc.want || total != tc.total {
+			t.Errorf("GET /devices%s = %s (total %s), want %s (total %s)", tc.query, got, total, tc.want, tc.total)
+		}
+	}
+
+	for _, query := range []string{"?sort=position", "?limit=x", "?offset=-1"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/devices"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /devices%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func fmtIDs(ids []string) string {
+	s := "["
+	for i, id := range ids {
+		if i > 0 {
+			s += " "
+		}
+		s += id
+	}
+	return s + "]"
+}
+
+func TestHistory(t *testing.T) {
+	proxy := eventProxy()
+	router := newRouter(proxy)
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	proxy.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "OPEN"})
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "OFF"})
+
+	history := func(query string) ([]stateEvent, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/history"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /history%s: status %d", query, rec.Code)
+		}
+		var events []stateEvent
+		if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+			t.Fatal(err)
+		}
+		return events, rec.Header().Get("X-Total-Count")
+	}
+
+	if events, total := history(""); len(events) != 3 || events[0].Seq != 3 || total != "3" {
+		t.Errorf("history = %+v (total %s), want 3 changes newest first", events, total)
+	}
+	if events, _ := history("?sort=seq&limit=1"); len(events) != 1 || events[0].Seq != 1 {
+		t.Errorf("oldest change = %+v, want seq 1", events)
+	}
+	if events, total := history("?entity_id=light_one&offset=1"); len(events) != 1 || events[0].State != "on" || total != "2" {
+		t.Errorf("light history from offset 1 = %+v (total %s), want its first change", events, total)
+	}
+	if events, _ := history("?type=curtain"); len(events) != 1 || events[0].EntityID != "curtain_two" {
+		t.Errorf("curtain history = %+v", events)
+	}
+	if events, _ := history("?since=2"); len(events) != 1 || events[0].Seq != 3 {
+		t.Errorf("history since 2 = %+v, want seq 3", events)
+	}
+}
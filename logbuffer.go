@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultLogBuffer is how many log records are kept in memory when
+	// logging.buffer is not set.
+	defaultLogBuffer = 1000
+	// defaultLogLimit is how many records GET /logs returns without limit.
+	defaultLogLimit = 100
+)
+
+// logLevels are the log levels from the lowest.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// logRecord is a log line as returned by GET /logs.
+type logRecord struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// logRing keeps the newest log records. It is written to by the log
+// package alongside the console.
+type logRing struct {
+	mutex   sync.Mutex
+	records []logRecord // a ring once full
+	next    int         // index of the oldest record once full
+	size    int
+}
+
+// recentLogs holds the process's newest log records.
+var recentLogs = &logRing{size: defaultLogBuffer}
+
+// resize sets how many records are kept, dropping the oldest if there are
+// more.
+func (r *logRing) resize(size int) {
+	if size <= 0 {
+		size = defaultLogBuffer
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	records := r.ordered()
+	if len(records) > size {
+		records = records[len(records)-size:]
+	}
+	r.records, r.next, r.size = records, 0, size
+}
+
+// tee returns a writer that writes to w and keeps the records.
+func (r *logRing) tee(w io.Writer) io.Writer {
+	return io.MultiWriter(w, r)
+}
+
+// Write adds a record. The log package writes each record in one call.
+func (r *logRing) Write(p []byte) (int, error) {
+	now := time.Now()
+	message := strings.TrimSuffix(string(p), "\n")
+	// Drop the date and time the standard log flags prefix.
+	if len(message) > 20 {
+		if _, err := time.ParseInLocation("2006/01/02 15:04:05", message[:19], time.Local); err == nil {
+			message = message[20:]
+		}
+	}
+	r.add(logRecord{Time: now, Level: logLevel(message), Message: message})
+	return len(p), nil
+}
+
+func (r *logRing) add(record logRecord) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.records) < r.size {
+		r.records = append(r.records, record)
+		return
+	}
+	r.records[r.next] = record
+	r.next = (r.next + 1) % r.size
+}
+
+// ordered returns the records from the oldest. The caller holds the mutex.
+func (r *logRing) ordered() []logRecord {
+	records := make([]logRecord, 0, len(r.records))
+	records = append(records, r.records[r.next:]...)
+	return append(records, r.records[:r.next]...)
+}
+
+// list returns the newest records at level or above, at most limit, from
+// the oldest.
+func (r *logRing) list(level string, limit int) []logRecord {
+	min := levelRank(level)
+	r.mutex.Lock()
+	records := r.ordered()
+	r.mutex.Unlock()
+	list := []logRecord{}
+	for i := len(records) - 1; i >= 0 && len(list) < limit; i-- {
+		if levelRank(records[i].Level) >= min {
+			list = append(list, records[i])
+		}
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list
+}
+
+func levelRank(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return 0
+}
+
+// logLevel tells the level of a log line. The proxy logs plain lines, so
+// the level is taken from their wording: errors and panics are errors,
+// failures and refusals warnings and anything else info.
+func logLevel(message string) string {
+	switch {
+	case strings.HasPrefix(message, "Error"), strings.HasPrefix(message, "Panic"):
+		return "error"
+	}
+	lower := strings.ToLower(message)
+	for _, word := range []string{"fail", "giving up", "rejected", "refusing", "no confirmation", "unsupported", "ignoring"} {
+		if strings.Contains(lower, word) {
+			return "warn"
+		}
+	}
+	return "info"
+}
+
+// logsHandler serves GET /logs: the newest records kept in memory,
+// optionally from a level up.
+func logsHandler(ring *logRing) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		level := c.DefaultQuery("level", "debug")
+		if !contains(logLevels, level) {
+			c.JSON(400, gin.H{"error": "level must be one of debug, info, warn, error"})
+			return
+		}
+		limit := defaultLogLimit
+		if s := c.Query("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				c.JSON(400, gin.H{"error": "limit must be a positive number"})
+				return
+			}
+			limit = n
+		}
+		c.JSON(200, ring.list(level, limit))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogRing(t *testing.T) {
+	ring := &logRing{size: 3}
+	logger := log.New(ring, "", log.LstdFlags)
+	logger.Printf("Connected to gateway")
+	logger.Printf("Failed to update HA: timeout")
+	logger.Printf("Error syncing: EOF")
+	logger.Printf("Login successful")
+
+	all := ring.list("debug", 10)
+	if len(all) != 3 || all[0].Message != "Failed to update HA: timeout" || all[2].Message != "Login successful" {
+		t.Fatalf("records = %+v, want the newest three from the oldest", all)
+	}
+	if all[0].Level != "warn" || all[1].Level != "error" || all[2].Level != "info" {
+		t.Errorf("levels = %s %s %s", all[0].Level, all[1].Level, all[2].Level)
+	}
+	if warn := ring.list("warn", 10); len(warn) != 2 {
+		t.Errorf("warn and above = %+v", warn)
+	}
+	if last := ring.list("debug", 1); len(last) != 1 || last[0].Message != "Login successful" {
+		t.Errorf("limit 1 = %+v, want the newest", last)
+	}
+
+	ring.resize(2)
+	if all := ring.list("debug", 10); len(all) != 2 || all[0].Message != "Error syncing: EOF" {
+		t.Errorf("after shrinking = %+v", all)
+	}
+}
+
+func TestLogsEndpoint(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	log.SetOutput(recentLogs.tee(io.Discard))
+	defer log.SetOutput(io.Discard)
+	log.Printf("Failed to reach the logs test")
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := get("/logs?level=warn&limit=1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	var records []logRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Message != "Failed to reach the logs test" || records[0].Level != "warn" {
+		t.Errorf("records = %+v", records)
+	}
+	if rec := get("/logs?level=loud"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown level: status %d", rec.Code)
+	}
+	if rec := get("/logs?limit=0"); rec.Code != http.StatusBadRequest {
+		t.Errorf("limit 0: status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/logs", nil))
+	if rec.Code == http.StatusOK {
+		t.Error("logs served without a token")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Log events that repeat with gateway traffic and can be sampled.
+const (
+	logHeartbeat = "heartbeat" // heartbeat replies
+	logHAUpdate  = "ha_update" // successful state updates to Home Assistant
+	logUnhandled = "unhandled" // messages no handler takes
+)
+
+var logEvents = []string{logHeartbeat, logHAUpdate, logUnhandled}
+
+// logSummaryInterval is how often summarized events are logged.
+var logSummaryInterval = time.Minute
+
+// LogSampling thins out the log lines of one event.
+type LogSampling struct {
+	Event string `yaml:"event"` // heartbeat, ha_update or unhandled
+	// Every logs only the first of every so many lines.
+	Every int `yaml:"every"`
+	// Summarize replaces the lines with a count once a minute.
+	Summarize bool `yaml:"summarize"`
+}
+
+// validateLogSampling checks logging.sampling.
+func (c *Config) validateLogSampling(add func(message string, path ...string)) {
+	events := make(map[string]bool)
+	for i, rule := range c.Logging.Sampling {
+		at := []string{"logging", "sampling", strconv.Itoa(i)}
+		if !contains(logEvents, rule.Event) {
+			add(fmt.Sprintf("unknown event %q; use one of heartbeat, ha_update, unhandled", rule.Event), append(at, "event")...)
+		} else if events[rule.Event] {
+			add(fmt.Sprintf("event %s is sampled twice", rule.Event), append(at, "event")...)
+		}
+		events[rule.Event] = true
+		if (rule.Every > 0) == rule.Summarize || rule.Every < 0 {
+			add("set either a positive every or summarize", at...)
+		}
+	}
+}
+
+// logSampler writes the log lines of sampled events.
+type logSampler struct {
+	mutex  sync.Mutex
+	rules  map[string]LogSampling
+	counts map[string]int    // lines since the last logged one or summary
+	last   map[string]string // last summarized line
+}
+
+// setRules configures the sampling of each event.
+func (s *logSampler) setRules(rules []LogSampling) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rules = make(map[string]LogSampling)
+	for _, rule := range rules {
+		s.rules[rule.Event] = rule
+	}
+	s.counts = make(map[string]int)
+	s.last = make(map[string]string)
+}
+
+// summarizing reports whether any event is summarized.
+func (s *logSampler) summarizing() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, rule := range s.rules {
+		if rule.Summarize {
+			return true
+		}
+	}
+	return false
+}
+
+// printf logs a line of event, subject to its sampling rule.
+func (s *logSampler) printf(event, format string, args ...interface{}) {
+	s.mutex.Lock()
+	rule, ok := s.rules[event]
+	if !ok {
+		s.mutex.Unlock()
+		log.Printf(format, args...)
+		return
+	}
+	n := s.counts[event]
+	s.counts[event] = n + 1
+	if rule.Summarize {
+		s.last[event] = fmt.Sprintf(format, args...)
+		s.mutex.Unlock()
+		return
+	}
+	s.mutex.Unlock()
+	if n%rule.Every == 0 {
+		log.Printf(format, args...)
+	}
+}
+
+// summarize logs and resets the counts of the summarized events.
+func (s *logSampler) summarize(interval time.Duration) {
+	s.mutex.Lock()
+	var lines []string
+	for event, rule := range s.rules {
+		if n := s.counts[event]; rule.Summarize && n > 0 {
+			lines = append(lines, fmt.Sprintf("%s: %d lines in the last %s, last: %s", event, n, interval, s.last[event]))
+			s.counts[event] = 0
+		}
+	}
+	s.mutex.Unlock()
+	sort.Strings(lines)
+	for _, line := range lines {
+		log.Println(line)
+	}
+}
+
+// summarizeLogs logs the summarized events periodically until ctx is
+// cancelled.
+func (p *Proxy) summarizeLogs(ctx context.Context) {
+	ticker := time.NewTicker(logSummaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.logs.summarize(logSummaryInterval)
+			return
+		case <-ticker.C:
+			p.logs.summarize(logSummaryInterval)
+		}
+	}
+}
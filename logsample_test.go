@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(io.Discard)
+
+	var s logSampler
+	s.setRules([]LogSampling{{Event: logHAUpdate, Every: 3}, {Event: logHeartbeat, Summarize: true}})
+	for i := 1; i <= 7; i++ {
+		s.printf(logHAUpdate, "update %d", i)
+		s.printf(logHeartbeat, "heartbeat %d", i)
+		s.printf(logUnhandled, "unhandled %d", i)
+	}
+	out := buf.String()
+	for i := 1; i <= 7; i++ {
+		logged := strings.Contains(out, "update "+string(rune('0'+i))+"\n")
+		if want := i%3 == 1; logged != want {
+			t.Errorf("update %d logged = %v, want %v", i, logged, want)
+		}
+	}
+	if strings.Contains(out, "heartbeat") {
+		t.Errorf("summarized heartbeats were logged:\n%s", out)
+	}
+	if strings.Count(out, "unhandled") != 7 {
+		t.Errorf("unsampled lines were dropped:\n%s", out)
+	}
+
+	buf.Reset()
+	s.summarize(time.Minute)
+	if got := buf.String(); !strings.Contains(got, "heartbeat: 7 lines in the last 1m0s, last: heartbeat 7") {
+		t.Errorf("summary = %q", got)
+	}
+	buf.Reset()
+	s.summarize(time.Minute)
+	if buf.Len() != 0 {
+		t.Errorf("empty summary logged %q", buf.String())
+	}
+}
+
+func TestValidateLogSampling(t *testing.T) {
+	errs := validateConfig([]byte(`gateway:
+  host: "192.168.1.10"
+logging:
+  sampling:
+    - event: heartbeat
+      every: 10
+      summarize: true
+    - event: chatter
+      every: 2
+    - event: ha_update
+    - event: ha_update
+      every: 5
+`))
+	want := map[string]bool{
+		"logging.sampling.0":       true,
+		"logging.sampling.1.event": true,
+		"logging.sampling.2":       true,
+		"logging.sampling.3.event": true,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("validateConfig = %+v, want %d errors", errs, len(want))
+	}
+	for _, e := range errs {
+		if !want[e.Path] {
+			t.Errorf("unexpected error %+v", e)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errSyncLoop is returned for commands to a node whose state is bouncing
+// between Home Assistant and the gateway.
+var errSyncLoop = errors.New("state is looping between Home Assistant and the gateway")
+
+// Defaults for home_assistant.loop_guard.
+const (
+	defaultLoopWindow   = 2 * time.Second
+	defaultLoopSuppress = 30 * time.Second
+)
+
+// LoopGuardConfig breaks loops where a state change pushed to HA comes
+// straight back as a command reversing it. Bounces is how many such
+// commands in a row, each within Window milliseconds of the change it
+// reverses, make a loop; commands to the node are then refused for
+// Suppress seconds. 0 bounces, the default, turns the guard off: an
+// automation blinking a light looks just like a loop.
+type LoopGuardConfig struct {
+	Bounces  int `yaml:"bounces"`
+	Window   int `yaml:"window_ms"`
+	Suppress int `yaml:"suppress"`
+}
+
+func (g LoopGuardConfig) window() time.Duration {
+	if g.Window > 0 {
+		return time.Duration(g.Window) * time.Millisecond
+	}
+	return defaultLoopWindow
+}
+
+func (g LoopGuardConfig) suppress() time.Duration {
+	if g.Suppress > 0 {
+		return time.Duration(g.Suppress) * time.Second
+	}
+	return defaultLoopSuppress
+}
+
+// validateLoopGuard checks home_assistant.loop_guard.
+func (c *Config) validateLoopGuard(add func(message string, path ...string)) {
+	g := c.HomeAssistant.LoopGuard
+	at := []string{"home_assistant", "loop_guard"}
+	if g.Bounces < 0 {
+		add("bounces must not be negative", append(at, "bounces")...)
+	}
+	if g.Window < 0 {
+		add("window_ms must not be negative", append(at, "window_ms")...)
+	}
+	if g.Suppress < 0 {
+		add("suppress must not be negative", append(at, "suppress")...)
+	}
+}
+
+// loopNode is what the loop guard knows about one node.
+type loopNode struct {
+	state   string      // the last reported state
+	changed time.Time   // when it last changed
+	origin  stateOrigin // what changed it
+	bounces int         // commands in a row that reversed a fresh change
+	until   time.Time   // commands are refused before this while looping
+}
+
+// loopGuard spots states bouncing between HA and the gateway.
+type loopGuard struct {
+	mutex  sync.Mutex
+	nodes  map[string]*loopNode // by node key
+	broken atomic.Int64         // loops broken since the start
+}
+
+func (l *loopGuard) node(key string) *loopNode {
+	if l.nodes == nil {
+		l.nodes = make(map[string]*loopNode)
+	}
+	n, ok := l.nodes[key]
+	if !ok {
+		n = &loopNode{}
+		l.nodes[key] = n
+	}
+	return n
+}
+
+// reported records a report of state from the node key at now, changed
+// by origin.
+func (l *loopGuard) reported(key, state string, origin stateOrigin, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if n := l.node(key); n.state != state {
+		n.state, n.changed, n.origin = state, now, origin
+	}
+}
+
+// command counts a command of arg to the node key at now and reports
+// whether it may be sent, and whether it is the one that broke a loop.
+// In a loop every change is the echo of the command before it, so only
+// commands reversing such an echo are bounces. A command for the fresh
+// state itself is HA echoing the change pushed to it, which neither
+// counts nor ends a loop.
+func (l *loopGuard) command(key, arg string, now time.Time, config LoopGuardConfig) (ok, broke bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	n := l.node(key)
+	if now.Before(n.until) {
+		return false, false
+	}
+	if n.state == "" || now.Sub(n.changed) > config.window() {
+		n.bounces = 0
+		return true, false
+	}
+	if arg == n.state {
+		return true, false
+	}
+	if !n.origin.Echo {
+		n.bounces = 0
+		return true, false
+	}
+	n.bounces++
+	if n.bounces < config.Bounces {
+		return true, false
+	}
+	n.bounces = 0
+	n.until = now.Add(config.suppress())
+	l.broken.Add(1)
+	return false, true
+}
+
+// checkLoop refuses a command of arg to dev while its state bounces
+// between HA and the gateway, warning when it breaks a loop.
+func (p *Proxy) checkLoop(dev *device, ref nodeRef, arg string) error {
+	config := p.config.HomeAssistant.LoopGuard
+	if config.Bounces <= 0 {
+		return nil
+	}
+	ok, broke := p.loops.command(ref.key(), arg, time.Now(), config)
+	if ok {
+		return nil
+	}
+	if broke {
+		name := dev.EntityID
+		if name == "" {
+			name = "node " + ref.key()
+		}
+		log.Printf("Warning: %s bounced %d times between Home Assistant and the gateway (last changed by %s); refusing commands to it for %s",
+			name, config.Bounces, p.origins.origin(ref.key()).Source, config.suppress())
+	}
+	return fmt.Errorf("%w for node %s", errSyncLoop, ref.key())
+}
+
+// writeMetrics writes the loops the guard broke in the Prometheus text
+// format.
+func (l *loopGuard) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP konke_sync_loops_broken_total States caught bouncing between Home Assistant and the gateway.")
+	fmt.Fprintln(w, "# TYPE konke_sync_loops_broken_total counter")
+	fmt.Fprintf(w, "konke_sync_loops_broken_total %d\n", l.broken.Load())
+}
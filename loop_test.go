@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoopGuard(t *testing.T) {
+	var l loopGuard
+	config := LoopGuardConfig{Bounces: 3, Window: 1000, Suppress: 10}
+	echo := stateOrigin{Source: "rest", Echo: true}
+	now := time.Unix(0, 0)
+	bounce := func(state, arg string) (bool, bool) {
+		l.reported("1", state, echo, now)
+		now = now.Add(200 * time.Millisecond)
+		return l.command("1", arg, now, config)
+	}
+
+	// Commands asking for the reported state, or coming after the window,
+	// are not bounces.
+	l.reported("1", "ON", echo, now)
+	if ok, _ := l.command("1", "ON", now, config); !ok {
+		t.Fatal("command for the current state refused")
+	}
+	now = now.Add(2 * time.Second)
+	if ok, _ := l.command("1", "OFF", now, config); !ok {
+		t.Fatal("command long after the change refused")
+	}
+
+	if ok, _ := bounce("OFF", "ON"); !ok {
+		t.Fatal("first bounce refused")
+	}
+	if ok, _ := bounce("ON", "OFF"); !ok {
+		t.Fatal("second bounce refused")
+	}
+	// HA repeating the state pushed to it does not end the loop.
+	if ok, _ := l.command("1", "ON", now, config); !ok {
+		t.Fatal("echo of the pushed state refused")
+	}
+	if ok, broke := bounce("OFF", "ON"); ok || !broke {
+		t.Fatalf("third bounce = %v, %v; want the loop broken", ok, broke)
+	}
+	if ok, broke := l.command("1", "ON", now.Add(time.Second), config); ok || broke {
+		t.Errorf("command while suppressed = %v, %v; want refused", ok, broke)
+	}
+	now = now.Add(11 * time.Second)
+	if ok, _ := l.command("1", "ON", now, config); !ok {
+		t.Error("command after the suppression refused")
+	}
+	if ok, _ := l.command("2", "OFF", now, config); !ok {
+		t.Error("command to another node refused")
+	}
+
+	// Reversing changes made at the device is not a loop.
+	for i := 0; i < 5; i++ {
+		state, arg := "ON", "OFF"
+		if i%2 == 1 {
+			state, arg = arg, state
+		}
+		l.reported("3", state, stateOrigin{Source: originGateway}, now)
+		if ok, _ := l.command("3", arg, now.Add(100*time.Millisecond), config); !ok {
+			t.Fatalf("command reversing switch %d at the device refused", i)
+		}
+		now = now.Add(200 * time.Millisecond)
+	}
+
+	var metrics bytes.Buffer
+	l.writeMetrics(&metrics)
+	if !strings.Contains(metrics.String(), "konke_sync_loops_broken_total 1\n") {
+		t.Errorf("metrics = %s", metrics.String())
+	}
+}
+
+func TestCheckLoop(t *testing.T) {
+	proxy := eventProxy()
+	dev, _ := proxy.lookupDevice("1")
+	echo := stateOrigin{Source: "rest", Echo: true}
+
+	// Off by default, so that automations may blink a light.
+	for i := 0; i < 5; i++ {
+		proxy.loops.reported("1", "ON", echo, time.Now())
+		if err := proxy.checkLoop(&dev, dev.Ref, "OFF"); err != nil {
+			t.Fatalf("guard off: %v", err)
+		}
+		proxy.loops.reported("1", "OFF", echo, time.Now())
+	}
+
+	proxy.config.HomeAssistant.LoopGuard.Bounces = 4
+	var err error
+	for i := 0; i < 4 && err == nil; i++ {
+		state, arg := "ON", "OFF"
+		if i%2 == 1 {
+			state, arg = arg, state
+		}
+		proxy.loops.reported("1", state, echo, time.Now())
+		err = proxy.checkLoop(&dev, dev.Ref, arg)
+		if i < 3 && err != nil {
+			t.Fatalf("bounce %d: %v", i+1, err)
+		}
+	}
+	if !errors.Is(err, errSyncLoop) || gatewayStatus(err) != 409 {
+		t.Errorf("last bounce: %v", err)
+	}
+
+	proxy.config.HomeAssistant.LoopGuard = LoopGuardConfig{Bounces: -1, Window: -1, Suppress: -1}
+	if errs := proxy.config.validate(); len(errs) < 3 {
+		t.Errorf("negative loop guard settings accepted: %v", errs)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errStopping is returned for sequences started while the proxy stops.
+var errStopping = errors.New("the proxy is stopping")
+
+// sequenceRunner runs the command sequences of macros and webhooks in the
+// background, until the proxy stops.
+type sequenceRunner struct {
+	mutex   sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// start runs fn in the background, unless the proxy has stopped.
+func (h *sequenceRunner) start(fn func(ctx context.Context)) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.stopped {
+		return false
+	}
+	if h.ctx == nil {
+		h.ctx, h.cancel = context.WithCancel(context.Background())
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		fn(h.ctx)
+	}()
+	return true
+}
+
+// stop cancels the running sequences and waits for them.
+func (h *sequenceRunner) stop() {
+	h.mutex.Lock()
+	h.stopped = true
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.mutex.Unlock()
+	h.wg.Wait()
+}
+
+// runSequence sends commands one after the other, each after its delay,
+// stopping at the first that fails. name labels the sequence in the log.
+func (p *Proxy) runSequence(ctx context.Context, name string, steps []CommandStep, source commandSource) {
+	ctx = withSource(ctx, source)
+	for i, step := range steps {
+		if step.DelayMS > 0 {
+			timer := time.NewTimer(time.Duration(step.DelayMS) * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		ref := parseNodeKey(p.nodeKey(step.Device))
+		p.scheduled.cancel(ref.key())
+		if err := p.sendSwitch(ctx, ref, step.Arg); err != nil {
+			log.Printf("%s: command %d (%s to node %s) failed, skipping the rest: %v", name, i+1, step.Arg, ref.key(), err)
+			return
+		}
+	}
+}
+
+// startSequence runs steps in the background.
+func (p *Proxy) startSequence(name string, steps []CommandStep, source commandSource) error {
+	if !p.Ready() {
+		return p.notReady()
+	}
+	// A sequence that panics is dropped; it is not run again.
+	run := func(ctx context.Context) {
+		p.protect(name, func() error {
+			p.runSequence(ctx, name, steps, source)
+			return nil
+		})
+	}
+	if !p.sequences.start(run) {
+		return errStopping
+	}
+	return nil
+}
+
+// macroHandler serves POST /macro/:name like a webhook. With delay_ms in
+// the body the macro is scheduled instead, replacing an earlier scheduled
+// run of it.
+func macroHandler(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		steps, ok := proxy.config.Macros[name]
+		if !ok {
+			c.JSON(404, gin.H{"error": "Unknown macro"})
+			return
+		}
+		var data struct {
+			DelayMS int64 `json:"delay_ms"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.BindJSON(&data); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+		}
+		source := requestSource(c, "macro")
+		if data.DelayMS != 0 {
+			// Checked before the conversion to a duration, which overflows.
+			if data.DelayMS > maxScheduleMS {
+				c.JSON(400, gin.H{"error": errLongDelay.Error()})
+				return
+			}
+			at, err := proxy.scheduleMacro(withSource(c.Request.Context(), source), name, time.Duration(data.DelayMS)*time.Millisecond)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(202, gin.H{"macro": name, "commands": len(steps), "scheduled": true, "at": at})
+			return
+		}
+		// A run now replaces one that was scheduled.
+		proxy.scheduled.cancel(macroJobKey(name))
+		if err := proxy.startSequence("Macro "+name, steps, source); err != nil {
+			gatewayError(c, err)
+			return
+		}
+		c.JSON(202, gin.H{"macro": name, "commands": len(steps)})
+	}
+}
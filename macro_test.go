@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMacros(t *testing.T) {
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "bedroom"}}
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "bedroom_curtain"}}
+	config.Macros = map[string][]CommandStep{"goodnight": {
+		{Device: "2", Arg: "CLOSE"},
+		{Device: "1", Arg: "OFF", DelayMS: 20},
+	}}
+	config.Hooks = map[string]HookConfig{"bedside_button": {Macro: "goodnight"}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	post := func(path string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		return rec.Code
+	}
+
+	if code := post("/macro/party"); code != http.StatusNotFound {
+		t.Errorf("unknown macro: status %d, want 404", code)
+	}
+	proxy.setDeviceState("1", "ON")
+	if code := post("/macro/goodnight"); code != http.StatusAccepted {
+		t.Fatalf("macro: status %d, want 202", code)
+	}
+	waitFor(t, time.Second, func() bool { return gw.State("2") == "CLOSE" && gw.State("1") == "OFF" })
+
+	// Hooks can run a macro.
+	proxy.sendSwitch(context.Background(), nodeRef{NodeID: "2"}, "OPEN")
+	waitFor(t, time.Second, func() bool { return gw.State("2") == "OPEN" })
+	if code := post("/hooks/bedside_button"); code != http.StatusAccepted {
+		t.Fatalf("hook: status %d, want 202", code)
+	}
+	waitFor(t, time.Second, func() bool { return gw.State("2") == "CLOSE" })
+}
+
+func TestScheduledMacro(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "bedroom"}}
+	config.Macros = map[string][]CommandStep{"goodnight": {{Device: "1", Arg: "OFF"}}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/macro/goodnight", strings.NewReader(body)))
+		return rec
+	}
+
+	proxy.setDeviceState("1", "ON")
+	gw.Report("1", "ON")
+	rec := post(`{"delay_ms": 100}`)
+	if rec.Code != http.StatusAccepted || !strings.Contains(rec.Body.String(), `"scheduled":true`) {
+		t.Fatalf("scheduled macro: status %d, body %s", rec.Code, rec.Body)
+	}
+	if gw.State("1") != "ON" {
+		t.Error("scheduled macro ran at once")
+	}
+	waitFor(t, time.Second, func() bool { return gw.State("1") == "OFF" })
+
+	if rec := post(`{"delay_ms": -1}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("negative delay: status %d, want 400", rec.Code)
+	}
+	if rec := post(`{"delay_ms": 100000000000}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("delay beyond a day: status %d, want 400", rec.Code)
+	}
+}
+
+func TestMacroFromAlertRule(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "siren"}}
+	config.Macros = map[string][]CommandStep{"alarm": {{Device: "1", Arg: "ON"}}}
+	config.Alerts = []AlertRule{{Name: "ha down", Condition: conditionHAFailures, Threshold: 1, Window: 60, Macro: "alarm"}}
+	proxy := startProxy(t, config)
+
+	now := time.Now()
+	proxy.rules.countHAFailure(now)
+	proxy.rules.countHAFailure(now)
+	proxy.checkAlertRules(now)
+	waitFor(t, time.Second, func() bool { return gw.State("1") == "ON" })
+
+	config.Alerts[0].Macro = "missing"
+	config.Notifications.Ntfy.Topic = "konke"
+	var paths []string
+	config.validateAlertRules(func(message string, path ...string) {
+		paths = append(paths, strings.Join(path, "."))
+	})
+	if len(paths) != 1 || paths[0] != "alerts.0.macro" {
+		t.Errorf("errors at %v, want alerts.0.macro", paths)
+	}
+}
+
+func TestMacroValidation(t *testing.T) {
+	var config Config
+	config.Gateway.Host = "192.168.1.10"
+	config.Macros = map[string][]CommandStep{"empty": nil, "bad": {{Device: "1", DelayMS: -1}}}
+	config.Hooks = map[string]HookConfig{"button": {Macro: "missing"}}
+	if errs := config.validate(); len(errs) != 4 {
+		t.Errorf("errors = %v, want 4", errs)
+	}
+}
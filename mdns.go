@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Names advertised over mDNS.
+const (
+	mdnsService      = "_konke-ha-proxy._tcp.local."
+	mdnsServiceIndex = "_services._dns-sd._udp.local."
+	mdnsTTL          = 120
+)
+
+// mdnsEnabled reports whether the HTTP API is advertised over mDNS. It
+// defaults to on.
+func (c *Config) mdnsEnabled() bool {
+	return c.MDNS.Enabled == nil || *c.MDNS.Enabled
+}
+
+// capabilities lists the optional API features enabled by the
+// configuration, for clients discovering the proxy.
+func (c *Config) capabilities() []string {
+	caps := []string{"switch", "curtain", "calibrate", "backup"}
+	if c.coverEntities() {
+		caps = append(caps, "cover")
+	}
+	if c.Archive.Enabled {
+		caps = append(caps, "archive")
+	}
+	if len(c.Extensions) > 0 {
+		caps = append(caps, "extensions")
+	}
+	return caps
+}
+
+// mdnsAdvertiser answers mDNS queries for the proxy's HTTP API, which is
+// published as a DNS-SD service so that companion tools can find it.
+type mdnsAdvertiser struct {
+	conn     *net.UDPConn
+	group    *net.UDPAddr
+	service  dnsmessage.Name
+	index    dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	txt      []string
+	ips      []net.IP
+}
+
+// newMDNSAdvertiser describes the API listening on port. Addresses are
+// taken from the host's interfaces unless http_server.host names one.
+func newMDNSAdvertiser(conn *net.UDPConn, config *Config, port int) (*mdnsAdvertiser, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+	name := config.MDNS.Name
+	if name == "" {
+		name = "konke-ha-proxy-" + hostname
+	}
+	name = strings.ReplaceAll(name, ".", "-")
+
+	a := &mdnsAdvertiser{
+		conn:  conn,
+		group: mdnsAddr,
+		port:  uint16(port),
+		txt: []string{
+			"version=" + version,
+			"api=1",
+			"path=/",
+			"caps=" + strings.Join(config.capabilities(), ","),
+		},
+	}
+	if len(config.Auth.Tokens) > 0 {
+		a.txt = append(a.txt, "auth=bearer")
+	}
+	if a.service, err = dnsmessage.NewName(mdnsService); err != nil {
+		return nil, err
+	}
+	if a.index, err = dnsmessage.NewName(mdnsServiceIndex); err != nil {
+		return nil, err
+	}
+	if a.instance, err = dnsmessage.NewName(name + "." + mdnsService); err != nil {
+		return nil, err
+	}
+	if a.host, err = dnsmessage.NewName(hostname + ".local."); err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(strings.Trim(config.HTTPServer.Host, "[]")); ip != nil && !ip.IsUnspecified() {
+		a.ips = []net.IP{ip}
+	} else {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				a.ips = append(a.ips, ipNet.IP)
+			}
+		}
+	}
+	return a, nil
+}
+
+// records returns the service's resource records with the given TTL.
+func (a *mdnsAdvertiser) records(ttl uint32) []dnsmessage.Resource {
+	header := func(name dnsmessage.Name, typ dnsmessage.Type, flush bool) dnsmessage.ResourceHeader {
+		class := dnsmessage.ClassINET
+		if flush {
+			// The cache-flush bit marks records only this host owns.
+			class |= 1 << 15
+		}
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: ttl}
+	}
+
+	records := []dnsmessage.Resource{
+		{Header: header(a.service, dnsmessage.TypePTR, false), Body: &dnsmessage.PTRResource{PTR: a.instance}},
+		{Header: header(a.index, dnsmessage.TypePTR, false), Body: &dnsmessage.PTRResource{PTR: a.service}},
+		{Header: header(a.instance, dnsmessage.TypeSRV, true), Body: &dnsmessage.SRVResource{Target: a.host, Port: a.port}},
+		{Header: header(a.instance, dnsmessage.TypeTXT, true), Body: &dnsmessage.TXTResource{TXT: a.txt}},
+	}
+	for _, ip := range a.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			var body dnsmessage.AResource
+			copy(body.A[:], ip4)
+			records = append(records, dnsmessage.Resource{Header: header(a.host, dnsmessage.TypeA, true), Body: &body})
+		} else {
+			var body dnsmessage.AAAAResource
+			copy(body.AAAA[:], ip.To16())
+			records = append(records, dnsmessage.Resource{Header: header(a.host, dnsmessage.TypeAAAA, true), Body: &body})
+		}
+	}
+	return records
+}
+
+// answers returns the records answering q, if it is about the service.
+func (a *mdnsAdvertiser) answers(q dnsmessage.Question, ttl uint32) []dnsmessage.Resource {
+	var answers []dnsmessage.Resource
+	for _, rec := range a.records(ttl) {
+		if !strings.EqualFold(rec.Header.Name.String(), q.Name.String()) {
+			continue
+		}
+		if q.Type == dnsmessage.TypeALL || q.Type == rec.Header.Type {
+			answers = append(answers, rec)
+		}
+	}
+	return answers
+}
+
+// send writes a response with the given answers to addr.
+func (a *mdnsAdvertiser) send(header dnsmessage.Header, questions []dnsmessage.Question, answers []dnsmessage.Resource, addr *net.UDPAddr) {
+	header.Response = true
+	header.Authoritative = true
+	msg := dnsmessage.Message{Header: header, Questions: questions, Answers: answers}
+	packet, err := msg.Pack()
+	if err != nil {
+		log.Printf("mDNS: failed to pack response: %v", err)
+		return
+	}
+	a.conn.WriteToUDP(packet, addr)
+}
+
+// announce multicasts all records; a zero TTL withdraws them.
+func (a *mdnsAdvertiser) announce(ttl uint32) {
+	a.send(dnsmessage.Header{}, nil, a.records(ttl), a.group)
+}
+
+// serve answers queries until the connection is closed.
+func (a *mdnsAdvertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || query.Response {
+			continue
+		}
+
+		var answers []dnsmessage.Resource
+		unicast := false
+		for _, q := range query.Questions {
+			// The top bit of the class asks for a unicast response.
+			if q.Class&(1<<15) != 0 {
+				unicast = true
+			}
+			answers = append(answers, a.answers(q, mdnsTTL)...)
+		}
+		if len(answers) == 0 {
+			continue
+		}
+		if from.Port != a.group.Port {
+			// One-shot queries from ordinary resolvers get a
+			// conventional DNS response (RFC 6762 section 6.7).
+			a.send(dnsmessage.Header{ID: query.ID}, query.Questions, answers, from)
+		} else if unicast {
+			a.send(dnsmessage.Header{}, nil, answers, from)
+		} else {
+			a.send(dnsmessage.Header{}, nil, answers, a.group)
+		}
+	}
+}
+
+// advertise publishes the HTTP API listening on port over mDNS until ctx
+// is cancelled, then withdraws it.
+func advertise(ctx context.Context, config *Config, port int) {
+	if !config.mdnsEnabled() {
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		log.Printf("mDNS advertisement disabled: %v", err)
+		return
+	}
+	a, err := newMDNSAdvertiser(conn, config, port)
+	if err != nil {
+		conn.Close()
+		log.Printf("mDNS advertisement disabled: %v", err)
+		return
+	}
+	log.Printf("Advertising %s over mDNS", a.instance)
+
+	go a.serve()
+	// Announce twice, a second apart, as RFC 6762 section 8.3 asks.
+	a.announce(mdnsTTL)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		a.announce(mdnsTTL)
+		<-ctx.Done()
+	}
+	a.announce(0)
+	conn.Close()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMDNSAdvertiser(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	saved := mdnsAddr
+	mdnsAddr = conn.LocalAddr().(*net.UDPAddr)
+	defer func() { mdnsAddr = saved }()
+
+	config := &Config{}
+	config.HTTPServer.Host = "192.168.1.5"
+	config.MDNS.Name = "living.room"
+	config.Archive.Enabled = true
+	a, err := newMDNSAdvertiser(conn, config, 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.serve()
+
+	// Browse for the service as a one-shot resolver would.
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	service := dnsmessage.MustNewName(mdnsService)
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42},
+		Questions: []dnsmessage.Question{{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	packet, _ := query.Pack()
+	client.WriteToUDP(packet, mdnsAddr)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 9000)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no response: %v", err)
+	}
+	var reply dnsmessage.Message
+	if err := reply.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ID != 42 || len(reply.Answers) != 1 {
+		t.Fatalf("reply = %+v, want one answer to query 42", reply)
+	}
+	ptr, ok := reply.Answers[0].Body.(*dnsmessage.PTRResource)
+	if !ok || ptr.PTR.String() != "living-room."+mdnsService {
+		t.Errorf("PTR answer = %v, want living-room.%s", reply.Answers[0].Body, mdnsService)
+	}
+
+	// The instance resolves to the port and carries version and
+	// capabilities.
+	var srv *dnsmessage.SRVResource
+	var txt *dnsmessage.TXTResource
+	for _, rec := range a.answers(dnsmessage.Question{Name: ptr.PTR, Type: dnsmessage.TypeALL}, mdnsTTL) {
+		switch body := rec.Body.(type) {
+		case *dnsmessage.SRVResource:
+			srv = body
+		case *dnsmessage.TXTResource:
+			txt = body
+		}
+	}
+	if srv == nil || srv.Port != 8080 {
+		t.Errorf("SRV = %v, want port 8080", srv)
+	}
+	if txt == nil || !strings.Contains(strings.Join(txt.TXT, " "), "version="+version) ||
+		!strings.Contains(strings.Join(txt.TXT, " "), "archive") {
+		t.Errorf("TXT = %v, want the version and the archive capability", txt)
+	}
+
+	// The host name resolves to the configured address.
+	hostname, _ := os.Hostname()
+	addrs, err := mdnsLookup(context.Background(), strings.SplitN(hostname, ".", 2)[0]+".local")
+	if err != nil || len(addrs) != 1 || addrs[0] != "192.168.1.5" {
+		t.Errorf("host lookup = %v, %v, want [192.168.1.5]", addrs, err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dataVersionFile records the schema version of the files in the data
+// directory.
+const dataVersionFile = "data_version.json"
+
+// dataMigration brings the data directory from version To-1 to To.
+type dataMigration struct {
+	To          int
+	Description string
+	Migrate     func(dir string) error
+}
+
+// dataMigrations are the migrations in order. Add one whenever the format
+// of a file in the data directory changes incompatibly. Version 1 is the
+// format from before versioning, so the first migration only records it.
+var dataMigrations = []dataMigration{
+	{To: 1, Description: "record the data schema version", Migrate: func(string) error { return nil }},
+}
+
+// dataVersion returns the schema version of the persisted data this build
+// writes.
+func dataVersion() int {
+	return dataMigrations[len(dataMigrations)-1].To
+}
+
+// storedDataVersion returns the version recorded in dir: 0 for data from
+// before versioning, and the current version for an empty or missing directory.
+func storedDataVersion(dir string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, dataVersionFile))
+	if err == nil {
+		var stored struct {
+			Version int `json:"version"`
+		}
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return 0, fmt.Errorf("failed to parse %s: %v", dataVersionFile, err)
+		}
+		return stored.Version, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			return 0, nil
+		}
+	}
+	return dataVersion(), nil
+}
+
+// migrateData brings the data directory to the current data version
+// before anything is loaded from it. The files are copied to
+// pre-migration-v<N> first, so a failed migration loses nothing. Data written by a newer build is
+// refused rather than misread or overwritten.
+func migrateData(dir string) error {
+	version, err := storedDataVersion(dir)
+	if err != nil {
+		return err
+	}
+	current := dataVersion()
+	if version > current {
+		return fmt.Errorf("%s was written by a newer version (data version %d, this build reads up to %d); upgrade the proxy or restore a backup", dir, version, current)
+	}
+	if version < current {
+		backup := filepath.Join(dir, fmt.Sprintf("pre-migration-v%d", version))
+		if err := copyDataFiles(dir, backup); err != nil {
+			return fmt.Errorf("failed to back up %s before migrating: %v", dir, err)
+		}
+		for _, m := range dataMigrations {
+			if m.To <= version {
+				continue
+			}
+			if err := m.Migrate(dir); err != nil {
+				return fmt.Errorf("failed to migrate %s to data version %d (%s): %v; the previous files are in %s", dir, m.To, m.Description, err, backup)
+			}
+			log.Printf("Migrated %s to data version %d: %s", dir, m.To, m.Description)
+		}
+	}
+	data, _ := json.Marshal(map[string]int{"version": current})
+	return writeFileAtomic(filepath.Join(dir, dataVersionFile), data)
+}
+
+// copyDataFiles copies the regular files of dir, except the message
+// archive, to backup.
+func copyDataFiles(dir, backup string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || strings.HasPrefix(entry.Name(), archiveFile) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := writeFileMode(filepath.Join(backup, entry.Name()), data, entry.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setAsideUnreadable renames a data file that cannot be parsed, so that it
+// is not overwritten by the next save and can be recovered by hand.
+func setAsideUnreadable(file string, err error) {
+	aside := file + ".unreadable"
+	if renameErr := os.Rename(file, aside); renameErr != nil {
+		log.Printf("Ignoring unreadable %s: %v", filepath.Base(file), err)
+		return
+	}
+	log.Printf("Ignoring unreadable %s, moved to %s: %v", filepath.Base(file), filepath.Base(aside), err)
+}
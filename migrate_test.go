@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateData(t *testing.T) {
+	saved := dataMigrations
+	defer func() { dataMigrations = saved }()
+	var ran []int
+	dataMigrations = append(append([]dataMigration(nil), saved...), dataMigration{
+		To:          2,
+		Description: "rename mode.json",
+		Migrate: func(dir string) error {
+			ran = append(ran, 2)
+			return os.Rename(filepath.Join(dir, modeFile), filepath.Join(dir, "mode2.json"))
+		},
+	})
+
+	// A new data directory starts at the current version.
+	fresh := filepath.Join(t.TempDir(), "data")
+	if err := migrateData(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := storedDataVersion(fresh); v != 2 || len(ran) != 0 {
+		t.Errorf("fresh directory: version %d, migrations %v", v, ran)
+	}
+
+	// Data from before versioning runs every migration after a copy.
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, modeFile), []byte(`{"mode":"away"}`), 0644)
+	if err := migrateData(dir); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := storedDataVersion(dir); v != 2 || len(ran) != 1 {
+		t.Errorf("legacy directory: version %d, migrations %v", v, ran)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "mode2.json")); err != nil {
+		t.Error("migration did not run:", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "pre-migration-v0", modeFile)); err != nil || string(data) != `{"mode":"away"}` {
+		t.Errorf("pre-migration copy = %q, %v", data, err)
+	}
+
+	// Migrated data is left alone on the next start.
+	if err := migrateData(dir); err != nil || len(ran) != 1 {
+		t.Errorf("second start: migrations %v, err %v", ran, err)
+	}
+
+	// A failing migration keeps the version, so it is retried.
+	failing := t.TempDir()
+	ioutil.WriteFile(filepath.Join(failing, stateFile), []byte(`{}`), 0644)
+	if err := migrateData(failing); err == nil || !strings.Contains(err.Error(), "pre-migration-v0") {
+		t.Errorf("failed migration: err = %v", err)
+	}
+	if v, _ := storedDataVersion(failing); v != 0 {
+		t.Errorf("after a failed migration version = %d, want 0", v)
+	}
+
+	// Data from a newer build is refused.
+	dataMigrations = saved
+	if err := migrateData(dir); err == nil || !strings.Contains(err.Error(), "newer version") {
+		t.Errorf("newer data: err = %v", err)
+	}
+}
+
+func TestSetAsideUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	proxy := eventProxy()
+	proxy.config.DataDir = dir
+	file := filepath.Join(dir, stateFile)
+	ioutil.WriteFile(file, []byte("{truncated"), 0644)
+	if err := proxy.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unreadable %s still in place: %v", stateFile, err)
+	}
+	if data, err := ioutil.ReadFile(file + ".unreadable"); err != nil || string(data) != "{truncated" {
+		t.Errorf("set aside = %q, %v", data, err)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modeFile holds the mode set with POST /mode inside the data directory.
+const modeFile = "mode.json"
+
+// modeCheckInterval is how often the proxy checks whether quiet hours
+// began or ended.
+var modeCheckInterval = time.Minute
+
+// errModeBlocked is returned for commands to a device an active mode
+// blocks.
+var errModeBlocked = errors.New("blocked by the active mode")
+
+// errUnknownMode is returned when setting a mode that is not configured.
+var errUnknownMode = errors.New("unknown mode")
+
+// quietHours is a daily time window. It wraps around midnight when the
+// end is before the start.
+type quietHours struct {
+	start, end int // minutes since midnight
+}
+
+// parseQuietHours parses "HH:MM-HH:MM".
+func parseQuietHours(s string) (quietHours, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return quietHours{}, fmt.Errorf("quiet hours %q are not in the form HH:MM-HH:MM", s)
+	}
+	var q quietHours
+	for _, part := range []struct {
+		text string
+		out  *int
+	}{{from, &q.start}, {to, &q.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part.text))
+		if err != nil {
+			return quietHours{}, fmt.Errorf("quiet hours %q are not in the form HH:MM-HH:MM", s)
+		}
+		*part.out = t.Hour()*60 + t.Minute()
+	}
+	return q, nil
+}
+
+// contains reports whether t falls within the window.
+func (q quietHours) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// modeState is the mode set through the API and the modes active at the
+// last check.
+type modeState struct {
+	mutex  sync.Mutex
+	manual string
+	active []string
+}
+
+// activeModes returns the modes in effect at now: the one set through the
+// API and those within their quiet hours, sorted by name.
+func (p *Proxy) activeModes(now time.Time) []string {
+	p.modes.mutex.Lock()
+	manual := p.modes.manual
+	p.modes.mutex.Unlock()
+
+	var active []string
+	for name, mode := range p.config.Modes {
+		if name == manual {
+			active = append(active, name)
+			continue
+		}
+		if mode.QuietHours == "" {
+			continue
+		}
+		if q, err := parseQuietHours(mode.QuietHours); err == nil && q.contains(now) {
+			active = append(active, name)
+		}
+	}
+	sort.Strings(active)
+	return active
+}
+
+// modeApplies reports whether mode covers dev.
+func (p *Proxy) modeApplies(mode ModeConfig, dev *device) bool {
+	return p.selects(mode.Devices, mode.Tags, dev)
+}
+
+// nodeKey returns the node key of a device listed by a key like those of
+// the device mapping, where the primary zkid may be spelled out.
+func (p *Proxy) nodeKey(key string) string {
+	ref := parseNodeKey(key)
+	if ref.ZKID == p.config.zkids()[0] {
+		ref.ZKID = ""
+	}
+	return ref.key()
+}
+
+// selects reports whether dev is among the devices (keyed like the device
+// mapping) or has one of the tags. Both empty select every device.
+func (p *Proxy) selects(devices, tags []string, dev *device) bool {
+	if len(devices) == 0 && len(tags) == 0 {
+		return true
+	}
+	for _, key := range devices {
+		if p.nodeKey(key) == dev.Ref.key() {
+			return true
+		}
+	}
+	for _, tag := range tags {
+		if hasTag(dev.Config.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// restricting returns the first active mode that has the restriction
+// selected by want and covers dev, or "".
+func (p *Proxy) restricting(dev *device, want func(ModeConfig) bool) string {
+	if len(p.config.Modes) == 0 {
+		return ""
+	}
+	for _, name := range p.activeModes(p.localNow()) {
+		mode := p.config.Modes[name]
+		if want(mode) && p.modeApplies(mode, dev) {
+			return name
+		}
+	}
+	return ""
+}
+
+// commandsBlocked returns the mode that blocks commands to dev, or "".
+func (p *Proxy) commandsBlocked(dev *device) string {
+	return p.restricting(dev, func(m ModeConfig) bool { return m.BlockCommands })
+}
+
+// updatesSuppressed reports whether an active mode holds back HA updates
+// for dev.
+func (p *Proxy) updatesSuppressed(dev *device) bool {
+	return p.restricting(dev, func(m ModeConfig) bool { return m.SuppressUpdates }) != ""
+}
+
+// setMode activates the configured mode name, or clears the mode set
+// through the API when name is empty, and stores the choice in the data
+// directory.
+func (p *Proxy) setMode(name string) error {
+	if _, ok := p.config.Modes[name]; name != "" && !ok {
+		return fmt.Errorf("%w %q", errUnknownMode, name)
+	}
+	p.modes.mutex.Lock()
+	p.modes.manual = name
+	p.modes.mutex.Unlock()
+	log.Printf("Mode set to %q", name)
+
+	var err error
+	if !p.restored.Load() {
+		data, _ := json.Marshal(map[string]string{"mode": name})
+		err = writeFileAtomic(filepath.Join(p.config.dataDir(), modeFile), data)
+	}
+	p.checkModes()
+	p.checkPresence(p.localNow())
+	return err
+}
+
+// modeInfo is the body of GET and POST /mode.
+type modeInfo struct {
+	Mode   string   `json:"mode"`   // set through the API
+	Active []string `json:"active"` // including modes within quiet hours
+	Modes  []string `json:"modes"`  // configured
+}
+
+func (p *Proxy) modeStatus() modeInfo {
+	p.modes.mutex.Lock()
+	info := modeInfo{Mode: p.modes.manual, Modes: []string{}}
+	p.modes.mutex.Unlock()
+	info.Active = p.activeModes(p.localNow())
+	if info.Active == nil {
+		info.Active = []string{}
+	}
+	for name := range p.config.Modes {
+		info.Modes = append(info.Modes, name)
+	}
+	sort.Strings(info.Modes)
+	return info
+}
+
+// visibleModes narrows info to the modes covering a device view lets
+// through, so that a tenant only learns of the modes of its household.
+func (p *Proxy) visibleModes(info modeInfo, view deviceFilter) modeInfo {
+	if view == nil {
+		return info
+	}
+	covers := func(name string) bool {
+		mode, ok := p.config.Modes[name]
+		if !ok {
+			return false
+		}
+		p.stateMu.RLock()
+		defer p.stateMu.RUnlock()
+		for _, dev := range p.inventory {
+			if view.allows(dev.Ref.ZKID, dev.Ref.NodeID) && p.modeApplies(mode, dev) {
+				return true
+			}
+		}
+		return false
+	}
+	visible := func(names []string) []string {
+		kept := []string{}
+		for _, name := range names {
+			if covers(name) {
+				kept = append(kept, name)
+			}
+		}
+		return kept
+	}
+	info.Active, info.Modes = visible(info.Active), visible(info.Modes)
+	if !covers(info.Mode) {
+		info.Mode = ""
+	}
+	return info
+}
+
+// loadMode restores the mode set through the API before a restart. Modes
+// removed from the configuration since are dropped.
+func (p *Proxy) loadMode() error {
+	data, err := ioutil.ReadFile(filepath.Join(p.config.dataDir(), modeFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stored struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", modeFile, err)
+	}
+	if _, ok := p.config.Modes[stored.Mode]; !ok {
+		stored.Mode = ""
+	}
+	p.modes.mutex.Lock()
+	p.modes.manual = stored.Mode
+	p.modes.mutex.Unlock()
+
+	active := p.activeModes(p.localNow())
+	p.modes.mutex.Lock()
+	p.modes.active = active
+	p.modes.mutex.Unlock()
+	return nil
+}
+
+// checkModes reports the current state of every mapped device to Home
+// Assistant when the active modes changed, so that updates held back
+// while a mode was active are caught up.
+func (p *Proxy) checkModes() {
+	active := p.activeModes(p.localNow())
+	p.modes.mutex.Lock()
+	changed := strings.Join(active, ",") != strings.Join(p.modes.active, ",")
+	p.modes.active = active
+	p.modes.mutex.Unlock()
+	if !changed {
+		return
+	}
+	log.Printf("Active modes: %v", active)
+
+	p.stateMu.RLock()
+	keys := make([]string, 0, len(p.inventory))
+	for key, dev := range p.inventory {
+		if dev.EntityID != "" {
+			keys = append(keys, key)
+		}
+	}
+	p.stateMu.RUnlock()
+	for _, key := range keys {
+		dev, _ := p.lookupDevice(key)
+		if dev.Kind == kindCurtain && p.travelling(key) {
+			continue
+		}
+		if state, ok := p.haState(&dev, p.deviceState(key)); ok {
+			p.pushState(&dev, state)
+		}
+	}
+}
+
+// watchModes catches up on HA updates when quiet hours end.
+func (p *Proxy) watchModes(ctx context.Context) {
+	ticker := time.NewTicker(modeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkModes()
+			p.checkPresence(p.localNow())
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("15:04", clock)
+		return t
+	}
+	for _, tc := range []struct {
+		hours string
+		clock string
+		want  bool
+	}{
+		{"22:00-07:00", "23:30", true},
+		{"22:00-07:00", "06:59", true},
+		{"22:00-07:00", "07:00", false},
+		{"22:00-07:00", "12:00", false},
+		{"09:00-17:30", "17:29", true},
+		{"09:00-17:30", "08:59", false},
+	} {
+		q, err := parseQuietHours(tc.hours)
+		if err != nil {
+			t.Fatalf("parseQuietHours(%q): %v", tc.hours, err)
+		}
+		if got := q.contains(at(tc.clock)); got != tc.want {
+			t.Errorf("%s contains %s = %v, want %v", tc.hours, tc.clock, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"22:00", "25:00-07:00", "night"} {
+		if _, err := parseQuietHours(bad); err == nil {
+			t.Errorf("parseQuietHours(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestModes(t *testing.T) {
+	newProxy := func(dataDir string) *Proxy {
+		var config Config
+		config.DataDir = dataDir
+		config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one", Tags: []string{"guest"}}}
+		config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "curtain_two"}}
+		config.Modes = map[string]ModeConfig{
+			"vacation": {Tags: []string{"guest"}, BlockCommands: true, SuppressUpdates: true},
+		}
+		return NewProxy(&config)
+	}
+	dir := t.TempDir()
+	proxy := newProxy(dir)
+	router := newRouter(proxy)
+
+	if err := proxy.setMode("party"); !errors.Is(err, errUnknownMode) {
+		t.Errorf("setMode(party) = %v, want errUnknownMode", err)
+	}
+	if err := proxy.setMode("vacation"); err != nil {
+		t.Fatalf("setMode(vacation): %v", err)
+	}
+
+	// Updates for covered devices are held back; others pass.
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	proxy.handleMessage(&Message{NodeID: "2", Opcode: "SWITCH", Arg: "OPEN"})
+	if events, _, _ := proxy.events.since(0); len(events) != 1 || events[0].EntityID != "curtain_two" {
+		t.Errorf("events during vacation = %+v, want only the curtain", events)
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/switch/1", strings.NewReader(`{"arg": "OFF"}`)))
+	if rec.Code != http.StatusLocked {
+		t.Errorf("POST /switch/1 during vacation: status %d, want 423", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/mode", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `"mode":"vacation"`) || !strings.Contains(body, `"active":["vacation"]`) {
+		t.Errorf("GET /mode = %s", body)
+	}
+
+	// The mode survives a restart.
+	restarted := newProxy(dir)
+	if err := restarted.loadMode(); err != nil {
+		t.Fatalf("loadMode: %v", err)
+	}
+	if status := restarted.modeStatus(); status.Mode != "vacation" {
+		t.Errorf("mode after restart = %q, want vacation", status.Mode)
+	}
+
+	// Ending the mode catches up on the held back state.
+	if err := proxy.setMode(""); err != nil {
+		t.Fatalf("clearing the mode: %v", err)
+	}
+	if events, _, _ := proxy.events.since(1); len(events) != 1 || events[0].EntityID != "light_one" || events[0].State != "on" {
+		t.Errorf("events after vacation = %+v, want the light's state", events)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// commandEvent is the Home Assistant event type fired for commands to
+// devices with confirm_notify.
+const commandEvent = "konke_command"
+
+// commandSource identifies who sent a command.
+type commandSource struct {
+	Identity string `json:"identity"` // token name, empty for anonymous requests
+	Addr     string `json:"addr"`     // client address
+	Via      string `json:"via"`      // API the command came through
+}
+
+func (s commandSource) String() string {
+	who := s.Identity
+	if who == "" {
+		who = "anonymous"
+	}
+	return fmt.Sprintf("%s from %s via %s", who, s.Addr, s.Via)
+}
+
+type commandSourceKey struct{}
+
+// withSource returns a context carrying the source of the commands sent
+// with it.
+func withSource(ctx context.Context, source commandSource) context.Context {
+	return context.WithValue(ctx, commandSourceKey{}, source)
+}
+
+// sourceOf returns the command source stored in ctx.
+func sourceOf(ctx context.Context) commandSource {
+	source, ok := ctx.Value(commandSourceKey{}).(commandSource)
+	if !ok {
+		return commandSource{Via: "internal"}
+	}
+	return source
+}
+
+// requestSource returns the source of commands sent by a request.
+func requestSource(c *gin.Context, via string) commandSource {
+	return commandSource{Identity: c.GetString(identityKey), Addr: c.ClientIP(), Via: via}
+}
+
+// notifyCommand tells Home Assistant that a command was executed on a
+// device with confirm_notify, as a persistent notification and as a
+// konke_command event automations can trigger on.
+func (p *Proxy) notifyCommand(dev *device, arg string, source commandSource) {
+	name := dev.displayName()
+	if name == "" {
+		name = dev.EntityID
+	}
+	now := p.localNow()
+
+	notification := map[string]string{
+		"notification_id": "konke_command_" + dev.EntityID,
+		"title":           "Konke: " + name,
+		"message":         fmt.Sprintf("%s was sent %s by %s at %s.", name, arg, source, now.Format("2006-01-02 15:04:05")),
+	}
+	if err := p.postHomeAssistant("/api/services/persistent_notification/create", notification); err != nil {
+		log.Printf("Failed to notify Home Assistant of the command to %s: %v", dev.EntityID, err)
+	}
+
+	event := map[string]interface{}{
+		"entity_id": p.haEntityID(dev),
+		"zkid":      zkidOrPrimary(p, dev.Ref.ZKID),
+		"node_id":   dev.Ref.NodeID,
+		"command":   arg,
+		"identity":  source.Identity,
+		"addr":      source.Addr,
+		"via":       source.Via,
+		"time":      now.Format(time.RFC3339),
+	}
+	if err := p.postHomeAssistant("/api/events/"+commandEvent, event); err != nil {
+		log.Printf("Failed to fire %s for %s: %v", commandEvent, dev.EntityID, err)
+	}
+}
+
+// postHomeAssistant posts data as JSON to a Home Assistant API path.
+func (p *Proxy) postHomeAssistant(path string, data interface{}) error {
+	url := fmt.Sprintf("http://%s%s",
+		hostPort(p.config.HomeAssistant.Host, p.config.HomeAssistant.Port), path)
+	jsonData, _ := json.Marshal(data)
+
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+p.config.HomeAssistant.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.haClient.Do(req)
+	if err != nil {
+		p.rules.countHAFailure(time.Now())
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		p.rules.countHAFailure(time.Now())
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
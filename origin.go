@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// originGateway is the origin of a state change the proxy did not command,
+// such as a wall switch or the vendor app.
+const originGateway = "gateway"
+
+// originWatchdog is the origin of the unknown state of a stuck transition.
+const originWatchdog = "watchdog"
+
+// viaSchedule is the source of delayed and ramped commands when they are
+// sent.
+const viaSchedule = "schedule"
+
+// viaAlert is the source of the commands of macros run by alert rules.
+const viaAlert = "alert"
+
+// stateOrigin is what caused the current state of a node. Echo is set when
+// the state is the result of a command the proxy sent, so that consumers
+// reacting to changes can tell their own commands coming back.
+type stateOrigin struct {
+	Source string
+	Echo   bool
+}
+
+// commandedArg is a command sent to a node, waiting for the gateway to
+// report the state it asked for.
+type commandedArg struct {
+	arg      string
+	via      string
+	deadline time.Time
+}
+
+// stateOrigins attributes state changes to what caused them: the API a
+// command came through when the gateway reports the commanded state in
+// time, and the gateway itself otherwise.
+type stateOrigins struct {
+	mutex     sync.Mutex
+	commanded map[string]commandedArg // by node key
+	current   map[string]stateOrigin  // by node key
+}
+
+// command records that arg was sent to the node key through via, and
+// that a report of it until the deadline is its result.
+func (o *stateOrigins) command(key, arg, via string, deadline time.Time) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.commanded == nil {
+		o.commanded = make(map[string]commandedArg)
+	}
+	o.commanded[key] = commandedArg{arg: arg, via: via, deadline: deadline}
+}
+
+// reported attributes a report of arg from the node key at now and
+// returns its origin: an echo of the command that asked for arg, or a
+// change from the gateway.
+func (o *stateOrigins) reported(key, arg string, now time.Time) stateOrigin {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	origin := stateOrigin{Source: originGateway}
+	if c, ok := o.commanded[key]; ok {
+		if c.arg == arg && !now.After(c.deadline) {
+			origin = stateOrigin{Source: c.via, Echo: true}
+		} else if now.After(c.deadline) {
+			delete(o.commanded, key)
+		}
+	}
+	o.setLocked(key, origin)
+	return origin
+}
+
+// set records the origin of a state the proxy sets itself.
+func (o *stateOrigins) set(key string, origin stateOrigin) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.setLocked(key, origin)
+}
+
+func (o *stateOrigins) setLocked(key string, origin stateOrigin) {
+	if o.current == nil {
+		o.current = make(map[string]stateOrigin)
+	}
+	o.current[key] = origin
+}
+
+// origin returns the origin of the current state of the node key, with
+// an empty Source if it was not reported since the proxy started.
+func (o *stateOrigins) origin(key string) stateOrigin {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.current[key]
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateOrigins(t *testing.T) {
+	var o stateOrigins
+	now := time.Unix(0, 0)
+	gateway := stateOrigin{Source: originGateway}
+	if got := o.reported("1", "ON", now); got != gateway {
+		t.Errorf("uncommanded report from %+v", got)
+	}
+
+	o.command("1", "OFF", "rest", now.Add(time.Second))
+	if got := o.reported("1", "ON", now); got != gateway {
+		t.Errorf("report of another state from %+v", got)
+	}
+	echo := stateOrigin{Source: "rest", Echo: true}
+	if got := o.reported("1", "OFF", now.Add(500*time.Millisecond)); got != echo || o.origin("1") != echo {
+		t.Errorf("commanded report from %+v", got)
+	}
+	if got := o.reported("1", "OFF", now.Add(2*time.Second)); got != gateway {
+		t.Errorf("late report from %+v", got)
+	}
+}
+
+func TestIntegrationStateOrigin(t *testing.T) {
+	env := newIntegrationEnv(t)
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_three") == "off" })
+	last := func() stateEvent {
+		events := env.proxy.events.recent()
+		return events[len(events)-1]
+	}
+
+	env.post(t, "/switch/3", `{"arg":"ON"}`)
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_three") == "on" })
+	if got := env.ha.attribute("switch.light_three", "changed_by"); got != "rest" {
+		t.Errorf("changed_by = %v after a REST command, want rest", got)
+	}
+	if got := last(); got.Source != "rest" || !got.Echo {
+		t.Errorf("event after a REST command = %+v, want an echo from rest", got)
+	}
+
+	// A wall switch shows up as a report nobody commanded.
+	env.gw.Report("3", "OFF")
+	waitFor(t, integrationTimeout, func() bool { return env.ha.state("switch.light_three") == "off" })
+	if got := env.ha.attribute("switch.light_three", "changed_by"); got != originGateway {
+		t.Errorf("changed_by = %v after a wall switch, want gateway", got)
+	}
+	if got := last(); got.Source != originGateway || got.Echo {
+		t.Errorf("event after a wall switch = %+v, want a change from the gateway", got)
+	}
+
+	// Clients reacting to changes can leave out the echoes of commands.
+	poll := env.get(t, "/poll?since=0&echoes=0")
+	events, _ := poll["events"].([]interface{})
+	for _, ev := range events {
+		if ev.(map[string]interface{})["echo"] == true {
+			t.Errorf("echo in /poll?echoes=0: %v", ev)
+		}
+	}
+	if len(events) == 0 {
+		t.Error("/poll?echoes=0 dropped the wall switch change")
+	}
+}
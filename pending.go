@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRequestTimeout bounds how long the proxy waits for the gateway
+// to answer a request when gateway.request_timeout is not set.
+const defaultRequestTimeout = 5 * time.Second
+
+// errRequestTimeout is returned when the gateway does not answer in time.
+var errRequestTimeout = errors.New("timed out waiting for gateway response")
+
+// errStateMismatch is returned when the gateway answers a command with
+// another state than the one commanded.
+var errStateMismatch = errors.New("gateway reported another state than commanded")
+
+// requestTimeout returns the configured gateway request timeout.
+func (c *Config) requestTimeout() time.Duration {
+	if c.Gateway.RequestTimeout > 0 {
+		return time.Duration(c.Gateway.RequestTimeout) * time.Second
+	}
+	return defaultRequestTimeout
+}
+
+// confirmed reports whether commands for the device wait for the gateway
+// to confirm them.
+func (d DeviceConfig) confirmed() bool {
+	return d.Timeout > 0 || d.Retries > 0
+}
+
+// timeout returns how long to wait for each attempt of a confirmed command,
+// falling back to the gateway request timeout.
+func (d DeviceConfig) timeout(c *Config) time.Duration {
+	if d.Timeout > 0 {
+		return time.Duration(d.Timeout * float64(time.Second))
+	}
+	return c.requestTimeout()
+}
+
+// pendingRequest is a request waiting for its reply.
+type pendingRequest struct {
+	reqID  int64
+	opcode string
+	node   string
+	reply  chan *Message
+}
+
+// pendingRequests matches gateway replies to the requests waiting for
+// them. Replies are matched by reqId; replies without a known reqId go to
+// the oldest waiter for the same opcode and node.
+type pendingRequests struct {
+	mutex   sync.Mutex
+	waiters []*pendingRequest
+}
+
+func (r *pendingRequests) add(reqID int64, opcode, node string) *pendingRequest {
+	req := &pendingRequest{reqID: reqID, opcode: opcode, node: node, reply: make(chan *Message, 1)}
+	r.mutex.Lock()
+	r.waiters = append(r.waiters, req)
+	r.mutex.Unlock()
+	return req
+}
+
+func (r *pendingRequests) remove(req *pendingRequest) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, w := range r.waiters {
+		if w == req {
+			r.waiters = append(r.waiters[:i], r.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// resolve hands msg, which concerns the given node key, to the request it
+// answers, if any.
+func (r *pendingRequests) resolve(msg *Message, node string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	match := -1
+	for i, w := range r.waiters {
+		if msg.ReqID != 0 && w.reqID == msg.ReqID {
+			match = i
+			break
+		}
+		if match < 0 && w.opcode == msg.Opcode && w.node == node {
+			match = i
+		}
+	}
+	if match < 0 {
+		return false
+	}
+
+	req := r.waiters[match]
+	r.waiters = append(r.waiters[:match], r.waiters[match+1:]...)
+	req.reply <- msg
+	return true
+}
+
+// confirms reports whether reply, the answer to the SWITCH command msg,
+// reports the state that was commanded. Without a request ID a report
+// from another source can answer the command, and it need not.
+func confirms(msg, reply *Message) bool {
+	want, _, _ := switchArg(msg.Arg)
+	got, _, ok := switchArg(reply.Arg)
+	return ok && strings.EqualFold(got, want)
+}
+
+// nextReqID returns a request ID unique within this process.
+func (p *Proxy) nextReqID() int64 {
+	return atomic.AddInt64(&p.reqSeq, 1)
+}
+
+// messageKey returns the node key a message refers to.
+func (p *Proxy) messageKey(msg *Message) string {
+	ref, _ := p.resolveNode(msg.ZKID, msg.NodeID)
+	return ref.key()
+}
+
+// request sends msg to the gateway and waits for the matching reply, up to
+// the configured request timeout.
+func (p *Proxy) request(ctx context.Context, msg *Message) (*Message, error) {
+	return p.requestWithin(ctx, msg, p.config.requestTimeout())
+}
+
+// requestWithin is like request with an explicit timeout.
+func (p *Proxy) requestWithin(ctx context.Context, msg *Message, timeout time.Duration) (*Message, error) {
+	msg.ReqID = p.nextReqID()
+	req := p.pending.add(msg.ReqID, msg.Opcode, p.messageKey(msg))
+	defer p.pending.remove(req)
+
+	if err := p.sendMessage(msg); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	select {
+	case reply := <-req.reply:
+		if msg.trace != nil {
+			msg.trace.confirmed(time.Now())
+		}
+		return reply, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errRequestTimeout
+		}
+		return nil, context.Cause(ctx)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// viaPresence is the source of the commands of the presence simulation.
+// They pass modes that block commands.
+const viaPresence = "presence"
+
+var (
+	// presenceShare is the share of the on periods in the history that
+	// the presence simulation replays.
+	presenceShare = 0.6
+	// presenceJitter shifts the replayed on periods by up to this much
+	// either way, and presenceStretch changes their length by up to this
+	// share.
+	presenceJitter  = 15 * time.Minute
+	presenceStretch = 0.2
+	// presencePlan is how far ahead the simulation is planned.
+	presencePlan = 24 * time.Hour
+)
+
+// onPeriod is a time a switch was on.
+type onPeriod struct {
+	start    time.Time
+	duration time.Duration
+}
+
+// presenceState is the presence simulation currently running.
+type presenceState struct {
+	mutex   sync.Mutex
+	running bool
+	until   time.Time              // when the plan runs out
+	planned map[string]*commandJob // by node key
+	lit     map[string]bool        // node keys the simulation last switched on
+}
+
+// onPeriods returns the on periods in the history of each node key that
+// keep reports true for, as far as they ended.
+func (p *Proxy) onPeriods(events []stateEvent, keep func(dev *device) bool) map[string][]onPeriod {
+	periods := make(map[string][]onPeriod)
+	since := make(map[string]time.Time)
+	for _, ev := range events {
+		ref, ok := p.resolveNode(ev.ZKID, ev.NodeID)
+		if !ok {
+			continue
+		}
+		key := ref.key()
+		dev, ok := p.lookupDevice(key)
+		if !ok || dev.Kind == kindCurtain || !keep(&dev) {
+			continue
+		}
+		start, on := since[key]
+		switch {
+		case ev.State == "on" && !on:
+			since[key] = ev.Time
+		case ev.State == "off" && on:
+			periods[key] = append(periods[key], onPeriod{start: start, duration: ev.Time.Sub(start)})
+			delete(since, key)
+		}
+	}
+	return periods
+}
+
+// planPresence picks a random share of the on periods and moves each to
+// the next time its time of day comes after now, shifted and stretched at
+// random. It returns the ON and OFF commands of each node as scheduler
+// steps.
+func planPresence(periods map[string][]onPeriod, now time.Time, rng *rand.Rand) map[string][]scheduledStep {
+	plan := make(map[string][]scheduledStep)
+	for key, list := range periods {
+		var next []onPeriod
+		for _, period := range list {
+			if rng.Float64() >= presenceShare {
+				continue
+			}
+			y, m, d := now.Date()
+			h, min, s := period.start.In(now.Location()).Clock()
+			start := time.Date(y, m, d, h, min, s, 0, now.Location())
+			start = start.Add(time.Duration((rng.Float64()*2 - 1) * float64(presenceJitter)))
+			for start.Before(now) {
+				start = start.Add(24 * time.Hour)
+			}
+			if start.Sub(now) >= presencePlan {
+				continue
+			}
+			duration := time.Duration(float64(period.duration) * (1 + (rng.Float64()*2-1)*presenceStretch))
+			next = append(next, onPeriod{start: start, duration: duration})
+		}
+		sort.Slice(next, func(i, j int) bool { return next[i].start.Before(next[j].start) })
+
+		var steps []scheduledStep
+		at := now
+		for _, period := range next {
+			if period.start.Before(at) {
+				// Overlaps the previous period.
+				continue
+			}
+			end := period.start.Add(period.duration)
+			steps = append(steps,
+				scheduledStep{after: period.start.Sub(at), arg: "ON"},
+				scheduledStep{after: period.duration, arg: "OFF"})
+			at = end
+		}
+		if len(steps) > 0 {
+			plan[key] = steps
+		}
+	}
+	return plan
+}
+
+// presenceCovers reports whether an active mode simulating presence
+// covers dev.
+func (p *Proxy) presenceCovers(active []string, dev *device) bool {
+	for _, name := range active {
+		if mode := p.config.Modes[name]; mode.SimulatePresence && p.modeApplies(mode, dev) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPresence starts the presence simulation when a mode simulating
+// presence becomes active, plans the next day when the plan runs out, and
+// ends it, switching off what it left on, when no such mode is active.
+func (p *Proxy) checkPresence(now time.Time) {
+	var active []string
+	for _, name := range p.activeModes(now) {
+		if p.config.Modes[name].SimulatePresence {
+			active = append(active, name)
+		}
+	}
+
+	s := &p.presence
+	s.mutex.Lock()
+	if len(active) == 0 {
+		if !s.running {
+			s.mutex.Unlock()
+			return
+		}
+		planned, lit := s.planned, s.lit
+		s.running, s.planned, s.lit = false, nil, nil
+		s.mutex.Unlock()
+		log.Printf("Presence simulation ended")
+		p.endPresence(planned, lit)
+		return
+	}
+	if s.running && now.Before(s.until) {
+		s.mutex.Unlock()
+		return
+	}
+	s.running = true
+	s.until = now.Add(presencePlan)
+	if s.lit == nil {
+		s.lit = make(map[string]bool)
+	}
+	s.mutex.Unlock()
+
+	events, _, _ := p.events.since(0)
+	periods := p.onPeriods(events, func(dev *device) bool { return dev.EntityID != "" && p.presenceCovers(active, dev) })
+	plan := planPresence(periods, now, rand.New(rand.NewSource(now.UnixNano())))
+	if len(plan) == 0 {
+		log.Printf("Presence simulation for mode %v: no on/off history of the covered switches to replay", active)
+	}
+
+	until := now.Add(presencePlan)
+	if len(plan) == 0 {
+		// Try again once the history has grown.
+		until = now.Add(time.Hour)
+	}
+	source := commandSource{Via: viaPresence}
+	planned := make(map[string]*commandJob, len(plan))
+	count := 0
+	for key, steps := range plan {
+		key := key
+		count += len(steps) / 2
+		ref := parseNodeKey(key)
+		planned[key] = p.scheduled.start(key, steps, func(arg string) error {
+			err := p.sendSwitch(withSource(context.Background(), source), ref, arg)
+			if err != nil {
+				log.Printf("Presence simulation failed to send %s to node %s: %v", arg, key, err)
+				return err
+			}
+			s.mutex.Lock()
+			if s.lit != nil {
+				s.lit[key] = arg == "ON"
+			}
+			s.mutex.Unlock()
+			return nil
+		})
+	}
+	s.mutex.Lock()
+	s.until = until
+	s.planned = planned
+	s.mutex.Unlock()
+	if count > 0 {
+		log.Printf("Presence simulation for mode %v: replaying %d on periods of %d switches until %s", active, count, len(planned), until.Format(time.RFC3339))
+	}
+}
+
+// endPresence drops the planned commands and switches off what the
+// simulation left on.
+func (p *Proxy) endPresence(planned map[string]*commandJob, lit map[string]bool) {
+	for key, job := range planned {
+		p.scheduled.cancelJob(key, job)
+	}
+	ctx := withSource(context.Background(), commandSource{Via: viaPresence})
+	for key, on := range lit {
+		if !on {
+			continue
+		}
+		if err := p.sendSwitch(ctx, parseNodeKey(key), "OFF"); err != nil {
+			log.Printf("Presence simulation failed to switch off node %s: %v", key, err)
+		}
+	}
+}
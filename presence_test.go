@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanPresence(t *testing.T) {
+	defer func(share float64, jitter time.Duration, stretch float64) {
+		presenceShare, presenceJitter, presenceStretch = share, jitter, stretch
+	}(presenceShare, presenceJitter, presenceStretch)
+	presenceShare, presenceJitter, presenceStretch = 1, 0, 0
+
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+	periods := map[string][]onPeriod{"1": {
+		{start: day.Add(19 * time.Hour), duration: time.Hour},
+		{start: day.Add(21*time.Hour + 30*time.Minute), duration: 30 * time.Minute},
+	}}
+	rng := rand.New(rand.NewSource(1))
+
+	plan := planPresence(periods, day.Add(50*time.Hour), rng) // 2 May, 02:00
+	want := []scheduledStep{
+		{after: 17 * time.Hour, arg: "ON"}, {after: time.Hour, arg: "OFF"},
+		{after: 90 * time.Minute, arg: "ON"}, {after: 30 * time.Minute, arg: "OFF"},
+	}
+	if !reflect.DeepEqual(plan["1"], want) {
+		t.Errorf("plan at 02:00 = %+v, want %+v", plan["1"], want)
+	}
+
+	// Periods whose time has passed today come tomorrow.
+	plan = planPresence(periods, day.Add(44*time.Hour), rng) // 2 May, 20:00
+	want = []scheduledStep{
+		{after: 90 * time.Minute, arg: "ON"}, {after: 30 * time.Minute, arg: "OFF"},
+		{after: 21 * time.Hour, arg: "ON"}, {after: time.Hour, arg: "OFF"},
+	}
+	if !reflect.DeepEqual(plan["1"], want) {
+		t.Errorf("plan at 20:00 = %+v, want %+v", plan["1"], want)
+	}
+}
+
+func TestPresenceSimulation(t *testing.T) {
+	defer func(share float64) { presenceShare = share }(presenceShare)
+	presenceShare = 1
+
+	var config Config
+	config.DataDir = t.TempDir()
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}}
+	config.Modes = map[string]ModeConfig{"vacation": {SimulatePresence: true, BlockCommands: true}}
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}}}
+	proxy := NewProxy(&config)
+	defer proxy.scheduled.stop()
+	router := newRouter(proxy)
+
+	now := time.Now()
+	proxy.events.publish(stateEvent{Time: now.Add(-25 * time.Hour), NodeID: "1", EntityID: "light_one", State: "on"})
+	proxy.events.publish(stateEvent{Time: now.Add(-23 * time.Hour), NodeID: "1", EntityID: "light_one", State: "off"})
+
+	post := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	toggle := func() modeInfo {
+		rec := post("/mode/vacation")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST /mode/vacation: status %d", rec.Code)
+		}
+		return proxy.modeStatus()
+	}
+
+	if status := toggle(); status.Mode != "vacation" {
+		t.Fatalf("mode = %q after the first toggle, want vacation", status.Mode)
+	}
+	proxy.scheduled.mutex.Lock()
+	planned := proxy.scheduled.jobs["1"] != nil
+	proxy.scheduled.mutex.Unlock()
+	if !planned {
+		t.Error("no commands planned for the light")
+	}
+
+	// The simulation passes the mode's command block.
+	ctx := withSource(context.Background(), commandSource{Via: viaPresence})
+	if err := proxy.sendSwitch(ctx, nodeRef{NodeID: "1"}, "ON"); errors.Is(err, errModeBlocked) {
+		t.Errorf("simulated command was blocked: %v", err)
+	}
+	if err := proxy.sendSwitch(context.Background(), nodeRef{NodeID: "1"}, "ON"); !errors.Is(err, errModeBlocked) {
+		t.Errorf("command during vacation = %v, want errModeBlocked", err)
+	}
+
+	if status := toggle(); status.Mode != "" {
+		t.Fatalf("mode = %q after the second toggle, want none", status.Mode)
+	}
+	proxy.scheduled.mutex.Lock()
+	planned = proxy.scheduled.jobs["1"] != nil
+	proxy.scheduled.mutex.Unlock()
+	if planned {
+		t.Error("planned commands kept after the simulation ended")
+	}
+
+	if rec := post("/mode/party"); rec.Code != http.StatusNotFound {
+		t.Errorf("POST /mode/party: status %d, want 404", rec.Code)
+	}
+}
@@ -2,269 +2,541 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	
+	"log"
 	"net"
 	"net/http"
-	"strconv"
-	"strings"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/gin-gonic/gin"
-	"gopkg.in/yaml.v2"
 )
 
-// Config represents the YAML configuration structure
-type Config struct {
-	Gateway struct {
-		Host             string `yaml:"host"`
-		Port             int    `yaml:"port"`
-		Username         string `yaml:"username"`
-		Password         string `yaml:"password"`
-		ZKID            string `yaml:"zkid"`
-		DeviceCount     int    `yaml:"device_count"`
-		HeartbeatInterval int    `yaml:"heartbeat_interval"`
-	} `yaml:"gateway"`
-	HTTPServer struct {
-		Host string `yaml:"host"`
-		Port int    `yaml:"port"`
-	} `yaml:"http_server"`
-	HomeAssistant struct {
-		Host  string `yaml:"host"`
-		Port  int    `yaml:"port"`
-		Token string `yaml:"token"`
-	} `yaml:"home_assistant"`
-	Devices struct {
-		Curtains map[string]string `yaml:"curtains"`
-		Lights   map[string]string `yaml:"lights"`
-	} `yaml:"devices"`
-	Logging struct {
-		Level string `yaml:"level"`
-		File  string `yaml:"file"`
-	} `yaml:"logging"`
-}
-
 // Message represents a gateway message
 type Message struct {
 	NodeID    string      `json:"nodeid"`
 	Opcode    string      `json:"opcode"`
 	Arg       interface{} `json:"arg"`
 	Requester string      `json:"requester"`
-	ReqID     int64      `json:"reqId,omitempty"`
+	ReqID     int64       `json:"reqId,omitempty"`
+	ZKID      string      `json:"zkid,omitempty"`
 	Status    string      `json:"status,omitempty"`
+
+	trace *commandTrace // of the command sent, if traced
 }
 
+// reconnectDelay is how long the proxy waits between connection attempts
+// after losing the gateway.
+var reconnectDelay = 10 * time.Second
+
+// errNotConnected is returned when a message is sent while the gateway
+// connection is down.
+var errNotConnected = errors.New("not connected to gateway")
+
 // Proxy represents the main proxy structure
 type Proxy struct {
 	config     *Config
-	conn       net.Conn
+	configPath string // file or directory the config was loaded from
+	transport  GatewayTransport
 	devices    map[string]string
+	updated    map[string]time.Time // when the state of a node was last reported
 	entity     map[string]string
-	mutex      sync.Mutex
-	connected  bool
-	handlers   map[string]func(*Message)
+	extra      map[string]map[string]interface{} // extra SWITCH fields by node key
+	mutex      sync.Mutex                        // serializes writes to the transport
+	stateMu    sync.RWMutex                      // guards devices, updated, entity, extra and inventory
+	inventory  map[string]*device
+	pending    pendingRequests
+	rates      rateDetector
+	unhandled  unhandledOpcodes
+	events     eventFeed
+	origins    stateOrigins  // what caused the current state of each node
+	bus        eventBus      // entity changes for HA, the event feed and other consumers
+	broker     messageBroker // gateway messages for consumers other than handlers
+	modes      modeState
+	guests     guestTokens
+	watch      transitionWatch
+	extensions []*extension
+	sinks      []notificationSink
+	alerts     notifier
+	rules      ruleState
+	readiness  readiness
+	logs       logSampler
+	reports    reportThrottle // updates of throttled devices to HA
+	samples    sensorSamples  // recent numeric attributes of smoothed devices
+	energy     energyMeter    // energy accumulated by metering devices
+	actuations actuationCounter
+	loops      loopGuard
+	interlocks interlockGuard   // commands switching nodes of interlocks on
+	scheduled  commandScheduler // delayed commands and dimming transitions
+	scenes     sceneStore       // snapshots taken with POST /snapshot
+	presence   presenceState
+	actions    actionSigner   // signs the URLs of GET /action
+	sequences  sequenceRunner // command sequences of macros and webhooks
+	repeats    commandRepeats // repeated commands in flight
+	health     healthTracker  // what the device health scores are computed from
+	wsGate     wsGate         // open while the websocket stream subsystem runs
+	delivery   deliveryBudget // outcomes of the state updates to Home Assistant
+	traces     commandTraces  // commands traced with ?trace=1
+	heartbeat  heartbeatAdapter
+	archive    *archive // nil unless archive.enabled
+	tap        frameTap // raw gateway traffic for GET /debug/tap
+	haClient   *http.Client
+	reqSeq     int64
+	stateTag   stateVersion
+	rebootAt   atomic.Int64 // unix nanoseconds of the last reboot command
+	connected  atomic.Bool
+	// restored is set once a backup was restored; the data directory is
+	// left to it until the restart.
+	restored atomic.Bool
+	handlers map[string]func(*Message)
+
+	ignoreNodes   map[string]bool // node keys whose messages are dropped
+	ignoreOpcodes map[string]bool // opcodes whose messages are dropped
+
+	coverMu           sync.Mutex               // guards covers, motion and calibration
+	covers            map[string]*coverCommand // curtain commands in flight by node key
+	motion            map[string]*coverMotion  // estimated curtain positions
+	calibration       map[string]travelTimes   // calibrated curtain travel times
+	calibrationLoaded bool                     // calibration file has been read
+
+	cancel     context.CancelFunc
+	subsystems subsystemManager
 }
 
-// NewProxy creates a new proxy instance
+// NewProxy creates a new proxy instance using the transport selected in
+// the configuration.
 func NewProxy(config *Config) *Proxy {
+	return NewProxyWithTransport(config, nil)
+}
+
+// NewProxyWithTransport creates a new proxy instance that talks to the
+// gateway over transport. A nil transport selects the configured one when
+// the proxy starts.
+func NewProxyWithTransport(config *Config, transport GatewayTransport) *Proxy {
 	p := &Proxy{
 		config:    config,
+		transport: transport,
 		devices:   make(map[string]string),
+		updated:   make(map[string]time.Time),
 		entity:    make(map[string]string),
-		connected: false,
+		extra:     make(map[string]map[string]interface{}),
+		inventory: buildInventory(config),
+		covers:    make(map[string]*coverCommand),
+		motion:    make(map[string]*coverMotion),
+		reqSeq:    time.Now().UnixMilli(),
+		stateTag:  newStateVersion(),
 	}
+	dial := newResolver(config.dnsRefresh()).dial
+	haTransport := http.DefaultTransport.(*http.Transport).Clone()
+	haTransport.DialContext = dial
+	haTransport.Proxy = config.haProxy()
+	p.haClient = &http.Client{Transport: haTransport}
+	// The notification sinks are on the internet and only take the proxy
+	// from the environment.
+	sinkTransport := http.DefaultTransport.(*http.Transport).Clone()
+	sinkTransport.DialContext = dial
+	p.sinks = config.notificationSinks(&http.Client{Transport: sinkTransport})
+	p.ignoreNodes, p.ignoreOpcodes = buildIgnoreLists(config)
+	p.logs.setRules(config.Logging.Sampling)
+
+	p.subscribeBuiltins()
 
 	p.handlers = map[string]func(*Message){
 		"CCU_HB":    p.handleHeartbeat,
 		"SYNC_INFO": p.handleSync,
 		"SWITCH":    p.handleSwitch,
 		"LOGIN":     p.handleLogin,
+		"SET_TIME":  p.handleSetTime,
 	}
 
 	return p
 }
 
-func (p *Proxy) connect() error {
-	addr := fmt.Sprintf("%s:%d", p.config.Gateway.Host, p.config.Gateway.Port)
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
+func (p *Proxy) connect(ctx context.Context) error {
+	if err := p.transport.Dial(ctx); err != nil {
 		return fmt.Errorf("failed to connect to gateway: %v", err)
 	}
 
-	p.conn = conn
-	p.connected = true
-	fmt.Println("Connected to gateway at %s", addr)
-	return p.login()
+	p.readiness.reset()
+	p.connected.Store(true)
+	log.Printf("Connected to gateway at %v", p.transport)
+
+	if err := p.login(); err != nil {
+		p.disconnect()
+		return err
+	}
+	return nil
+}
+
+// Connected reports whether the proxy currently has a gateway session.
+func (p *Proxy) Connected() bool {
+	return p.connected.Load()
 }
 
+// disconnect closes the current gateway connection, if any.
+func (p *Proxy) disconnect() {
+	p.connected.Store(false)
+	p.readiness.reset()
+	p.transport.Close()
+}
+
+// login sends one LOGIN per configured zk controller.
 func (p *Proxy) login() error {
-	loginMsg := Message{
-		NodeID:    "*",
-		Opcode:    "LOGIN",
-		Requester: "HJ_Server",
-		Arg: map[string]string{
-			"username": p.config.Gateway.Username,
-			"password": p.config.Gateway.Password,
-			"zkid":     p.config.Gateway.ZKID,
-			"seq":      "",
-			"device":   "",
-			"version":  "",
-		},
+	for _, zkid := range p.config.zkids() {
+		loginMsg := Message{
+			NodeID:    "*",
+			Opcode:    "LOGIN",
+			Requester: "HJ_Server",
+			Arg: map[string]string{
+				"username": p.config.Gateway.Username,
+				"password": p.config.Gateway.Password,
+				"zkid":     zkid,
+				"seq":      "",
+				"device":   "",
+				"version":  "",
+			},
+		}
+		if err := p.sendMessage(&loginMsg); err != nil {
+			return err
+		}
 	}
-	return p.sendMessage(&loginMsg)
+	return nil
 }
 
 func (p *Proxy) sendMessage(msg *Message) error {
+	queued := time.Now()
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	locked := time.Now()
 
-	data, err := json.Marshal(msg)
+	if !p.connected.Load() {
+		return errNotConnected
+	}
+
+	frame, err := encodeFrame(msg)
 	if err != nil {
 		return err
 	}
 
-	message := fmt.Sprintf("!%s$", string(data))
-	_, err = p.conn.Write([]byte(message))
-	return err
+	if err := p.transport.Send(frame); err != nil {
+		return err
+	}
+	p.tap.record(directionOut, tapData(msg, frame))
+	p.archiveMessage(directionOut, msg)
+	p.recordSent(msg)
+	if msg.trace != nil {
+		msg.trace.sending(queued, locked)
+	}
+	return nil
 }
 
-func (p *Proxy) receive() {
-	reader := bufio.NewReader(p.conn)
-	buffer := ""
-
-	for p.connected {
-		data, err := reader.ReadString('$')
+// receive dispatches incoming messages until the transport fails.
+func (p *Proxy) receive() error {
+	for {
+		data, err := p.transport.Receive()
 		if err != nil {
-			fmt.Println("Error reading from connection: %v", err)
-			p.handleDisconnect()
-			return
+			return err
 		}
+		p.tap.record(directionIn, data)
 
-		buffer += data
-		messages := p.parseMessages(buffer)
-		buffer = ""
-
-		for _, msg := range messages {
+		for _, msg := range parseMessages(string(data)) {
 			p.handleMessage(msg)
 		}
 	}
 }
 
-func (p *Proxy) parseMessages(buffer string) []*Message {
-	var messages []*Message
-	parts := strings.Split(buffer, "$")
-
-	for _, part := range parts {
-		if strings.HasPrefix(part, "!") {
-			jsonStr := strings.TrimPrefix(part, "!")
-			var msg Message
-			if err := json.Unmarshal([]byte(jsonStr), &msg); err == nil {
-				messages = append(messages, &msg)
-			}
-		}
-	}
-
-	return messages
-}
-
 func (p *Proxy) handleMessage(msg *Message) {
-	if handler, ok := p.handlers[msg.Opcode]; ok {
+	if p.ignored(msg) {
+		return
+	}
+	p.archiveMessage(directionIn, msg)
+	p.recordAnswer(msg)
+	if p.repeatEcho(msg) {
+		// A waiting command may still take it as its confirmation.
+		p.pending.resolve(msg, p.messageKey(msg))
+		return
+	}
+	p.observeRate(msg)
+	if msg.NodeID != "" && msg.NodeID != "*" {
+		p.rules.nodeSeen(p.messageKey(msg), time.Now())
+	}
+	claimed := p.broker.publish(msg)
+	handler, handled := p.handlers[msg.Opcode]
+	if handled {
 		handler(msg)
-	} else {
-		fmt.Println("Unhandled message: %v", msg)
+	}
+	// Waiting commands are resolved once the handler has recorded the
+	// state they brought, so that checks after them see it.
+	resolved := p.pending.resolve(msg, p.messageKey(msg))
+	if !handled && !resolved && !claimed {
+		p.logs.printf(logUnhandled, "Unhandled message: %v", msg)
+		p.unhandled.record(msg)
 	}
 }
 
 func (p *Proxy) handleHeartbeat(_ *Message) {
-	fmt.Println("收到心跳响应")
-}
-
-func (p *Proxy) handleSync(msg *Message) {
-	fmt.Println("Received sync response: %v", msg)
+	p.heartbeat.reply(time.Now())
+	p.logs.printf(logHeartbeat, "收到心跳响应")
 }
 
 func (p *Proxy) handleSwitch(msg *Message) {
-	nodeID := msg.NodeID
-	arg, ok := msg.Arg.(string)
+	ref, ok := p.resolveNode(msg.ZKID, msg.NodeID)
+	if !ok {
+		return
+	}
+	arg, extra, ok := switchArg(msg.Arg)
 	if !ok {
+		log.Printf("Unsupported SWITCH argument: %v", msg)
 		return
 	}
 
-	p.devices[nodeID] = arg
-	var state string
+	p.setDeviceState(ref.key(), arg)
+	origin := p.origins.reported(ref.key(), arg, time.Now())
+	p.loops.reported(ref.key(), arg, origin, time.Now())
+	extraChanged := p.setExtraAttributes(ref.key(), extra)
+	p.settleCoverCommand(ref.key(), arg)
+	p.settleTransition(ref.key())
+
+	dev, ok := p.lookupDevice(ref.key())
+	if ok && p.samples.observe(ref.key(), dev.Config.Smoothing, extra) {
+		extraChanged = true
+	}
+	if ok && dev.Config.meters() {
+		p.meterPower(&dev, arg, extra, time.Now())
+	}
+	if !ok || dev.EntityID == "" || p.suppressHA(ref.key()) {
+		return
+	}
+	// A curtain with a travel time reports its final state when that
+	// has elapsed, not when the gateway acknowledges the command.
+	if dev.Kind == kindCurtain && p.travelling(ref.key()) {
+		return
+	}
+	if state, ok := p.haState(&dev, arg); ok {
+		if extraChanged && !p.updatesSuppressed(&dev) && p.entityState(dev.EntityID) == state {
+			// Only the attributes changed.
+			p.entityChanged(topicAttributes, &dev, state)
+			return
+		}
+		p.pushState(&dev, state)
+	}
+}
+
+// coverEntities reports whether curtains are pushed to HA as cover
+// entities rather than switches.
+func (c *Config) coverEntities() bool {
+	return c.HomeAssistant.CurtainDomain == "cover"
+}
+
+// haDomain returns the Home Assistant domain a device of the given kind is
+// pushed to.
+func (p *Proxy) haDomain(kind string) string {
+	if kind == kindCurtain && p.config.coverEntities() {
+		return "cover"
+	}
+	return "switch"
+}
+
+// mappedState returns the HA state configured for a gateway argument of
+// dev in its state_map or in home_assistant.state_map.
+func (p *Proxy) mappedState(dev *device, arg string) (string, bool) {
+	if state, ok := dev.Config.StateMap[arg]; ok {
+		return state, true
+	}
+	state, ok := p.config.HomeAssistant.StateMap[p.haDomain(dev.Kind)][arg]
+	return state, ok
+}
+
+// haState maps a gateway argument to the Home Assistant state of dev: the
+// configured mapping if there is one, otherwise cover states for curtains
+// pushed as covers and on/off for everything else.
+func (p *Proxy) haState(dev *device, arg string) (string, bool) {
+	if state, ok := p.mappedState(dev, arg); ok {
+		return state, true
+	}
+	if p.haDomain(dev.Kind) == "cover" {
+		switch arg {
+		case "OPEN", "ON", "STOP":
+			// A curtain stopped part way counts as open in HA.
+			return "open", true
+		case "CLOSE", "OFF":
+			return "closed", true
+		}
+		return "", false
+	}
 
 	switch arg {
 	case "ON", "OPEN":
-		state = "on"
+		return "on", true
 	case "OFF", "CLOSE":
-		state = "off"
-	default:
-		return
+		return "off", true
 	}
+	return "", false
+}
 
-	// Get entity ID from config
-	var entityID string
-	if _, ok := p.config.Devices.Curtains[nodeID]; ok {
-		entityID = p.config.Devices.Curtains[nodeID]
-	} else if _, ok := p.config.Devices.Lights[nodeID]; ok {
-		entityID = p.config.Devices.Lights[nodeID]
-	}
+// haEntityID returns the Home Assistant entity ID for a mapped device.
+func (p *Proxy) haEntityID(dev *device) string {
+	return p.haDomain(dev.Kind) + "." + dev.EntityID
+}
 
-	if entityID == "" {
+// pushState publishes state to Home Assistant and the other subscribers
+// of the event bus unless it is already the entity's current state.
+func (p *Proxy) pushState(dev *device, state string) {
+	if p.updatesSuppressed(dev) {
 		return
 	}
-
-	lastState := p.entity[entityID]
-	if lastState == state {
+	if !p.setEntityState(dev.EntityID, state) {
 		return
 	}
+	p.entityChanged(topicState, dev, state)
+}
 
+// haAttributes returns the Home Assistant attributes for a device. HA
+// replaces all attributes on every state update, so they are always sent
+// in full.
+func (p *Proxy) haAttributes(dev *device) map[string]interface{} {
+	attributes := make(map[string]interface{})
+	for k, v := range p.extraAttributes(dev.Ref.key()) {
+		if x, ok := v.(float64); ok && dev.Config.processesNumbers() {
+			v = p.samples.value(dev.Ref.key(), k, x, dev.Config)
+		}
+		attributes[k] = v
+	}
+	if name := dev.displayName(); name != "" {
+		attributes["friendly_name"] = name
+	}
+	if dev.Room != "" {
+		attributes["suggested_area"] = dev.Room
+	}
+	if dev.Kind == kindCurtain {
+		if pos, ok := p.coverPosition(dev.Ref.key()); ok {
+			attributes["current_position"] = pos
+		}
+	}
+	if len(dev.Config.Tags) > 0 {
+		attributes["tags"] = dev.Config.Tags
+	}
+	if len(dev.Config.Meta) > 0 {
+		attributes["meta"] = dev.Config.Meta
+	}
+	if health, ok := p.deviceHealth(dev.Ref.key()); ok {
+		attributes["health"] = health.Score
+	}
+	if origin := p.origins.origin(dev.Ref.key()); origin.Source != "" {
+		attributes["changed_by"] = origin.Source
+	}
+	return attributes
+}
+
+// setEntityState records the HA state last pushed for an entity and
+// reports whether it differs from the previous one.
+func (p *Proxy) setEntityState(entityID, state string) bool {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	if p.entity[entityID] == state {
+		return false
+	}
 	p.entity[entityID] = state
-	p.updateHomeAssistant(fmt.Sprintf("switch.%s", entityID), state)
+	return true
+}
+
+// entityState returns the HA state last pushed for an entity.
+func (p *Proxy) entityState(entityID string) string {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	return p.entity[entityID]
+}
+
+// setDeviceState records the last known gateway argument for a node key.
+func (p *Proxy) setDeviceState(key, arg string) {
+	p.stateMu.Lock()
+	p.updated[key] = time.Now()
+	if p.devices[key] != arg {
+		p.devices[key] = arg
+		p.stateTag.bump()
+	}
+	p.stateMu.Unlock()
 }
 
-func (p *Proxy) updateHomeAssistant(entityID, state string) {
-	url := fmt.Sprintf("http://%s:%d/api/states/%s",
-		p.config.HomeAssistant.Host,
-		p.config.HomeAssistant.Port,
+// deviceState returns the last known gateway argument for a node key.
+func (p *Proxy) deviceState(key string) string {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	return p.devices[key]
+}
+
+func (p *Proxy) updateHomeAssistant(entityID, state string, attributes map[string]interface{}) {
+	p.sendToHomeAssistant(entityID, state, attributes, p.delivery.next(entityID), 0)
+}
+
+// sendToHomeAssistant makes attempt number attempt to send an update of
+// generation gen.
+func (p *Proxy) sendToHomeAssistant(entityID, state string, attributes map[string]interface{}, gen, attempt int) {
+	if attempt == 0 {
+		start := time.Now()
+		defer func() { p.traces.pushed(entityID, time.Since(start)) }()
+	}
+	url := fmt.Sprintf("http://%s/api/states/%s",
+		hostPort(p.config.HomeAssistant.Host, p.config.HomeAssistant.Port),
 		entityID)
 
-	data := map[string]string{"state": state}
+	data := map[string]interface{}{"state": state}
+	if len(attributes) > 0 {
+		data["attributes"] = attributes
+	}
 	jsonData, _ := json.Marshal(data)
 
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
 	req.Header.Set("Authorization", "Bearer "+p.config.HomeAssistant.Token)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := p.haClient.Do(req)
 	if err != nil {
-		fmt.Println("Error updating Home Assistant: %v", err)
+		log.Printf("Error updating Home Assistant: %v", err)
+		p.deliveryFailed(entityID, state, attributes, gen, attempt)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
-		fmt.Println("Successfully updated entity %s to state %s", entityID, state)
+		p.logs.printf(logHAUpdate, "Successfully updated entity %s to state %s", entityID, state)
+		p.recordDelivery(true)
 	} else {
-		fmt.Println("Failed to update Home Assistant: %d", resp.StatusCode)
+		log.Printf("Failed to update Home Assistant: %d", resp.StatusCode)
+		p.deliveryFailed(entityID, state, attributes, gen, attempt)
 	}
 }
 
 func (p *Proxy) handleLogin(msg *Message) {
+	zkid := msg.ZKID
+	if zkid == "" {
+		zkid = p.config.zkids()[0]
+	}
 	if msg.Status == "success" {
-		fmt.Println("Login successful")
+		log.Printf("Login successful (zkid %s)", zkid)
+		p.readiness.loginAccepted(p.config.requestTimeout())
 	} else {
-		fmt.Println("Login failed")
+		log.Printf("Login failed (zkid %s)", zkid)
+		p.alert(alertLoginFailed, "Konke gateway login failed",
+			"The gateway rejected the login for zk controller %s (%s). Check gateway.username and gateway.password.", zkid, msg.Status)
 	}
 }
 
-func (p *Proxy) sendHeartbeat() {
+// sendHeartbeats keeps the gateway session alive until ctx is cancelled or
+// a heartbeat cannot be sent. A non-positive interval disables heartbeats.
+func (p *Proxy) sendHeartbeats(ctx context.Context) error {
+	p.heartbeat.reset(p.config)
+	if p.config.Gateway.HeartbeatInterval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
 	heartbeatMsg := &Message{
 		NodeID:    "*",
 		Opcode:    "CCU_HB",
@@ -272,159 +544,439 @@ func (p *Proxy) sendHeartbeat() {
 		Requester: "HJ_Server",
 	}
 
-	for p.connected {
+	for {
+		wait, err := p.heartbeat.next(time.Now())
+		if err != nil {
+			return err
+		}
 		if err := p.sendMessage(heartbeatMsg); err != nil {
-			fmt.Println("Error sending heartbeat: %v", err)
-			p.handleDisconnect()
-			return
+			return fmt.Errorf("error sending heartbeat: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
 		}
-		time.Sleep(time.Duration(p.config.Gateway.HeartbeatInterval) * time.Second)
 	}
 }
 
-func (p *Proxy) handleDisconnect() {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-
-	if !p.connected {
-		return
+// serve runs one gateway session: it starts the receive, heartbeat and
+// time sync loops, resyncs device state and returns once either loop fails or ctx is
+// cancelled. The transport is closed on return.
+func (p *Proxy) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 3)
+
+	// A panic in one of the loops ends the session like a failure, and
+	// run reconnects.
+	go func() { errc <- p.protect("gateway receive loop", p.receive) }()
+	go func() {
+		errc <- p.protect("heartbeats", func() error { return p.sendHeartbeats(ctx) })
+	}()
+	p.requestSyncInfo()
+	go p.queryStartup(ctx)
+	go func() {
+		errc <- p.protect("time sync", func() error { return p.syncTimePeriodically(ctx) })
+	}()
+
+	var err error
+	pending := cap(errc)
+	select {
+	case err = <-errc:
+		pending--
+	case <-ctx.Done():
 	}
 
-	p.connected = false
-	if p.conn != nil {
-		p.conn.Close()
+	cancel()
+	p.disconnect()
+	for ; pending > 0; pending-- {
+		if e := <-errc; err == nil {
+			err = e
+		}
 	}
-
-	fmt.Println("Disconnected from gateway, attempting to reconnect...")
-	time.Sleep(10 * time.Second)
-	p.reconnect()
+	return err
 }
 
-func (p *Proxy) reconnect() {
-	for !p.connected {
-		if err := p.connect(); err != nil {
-			fmt.Println("Reconnection failed: %v", err)
-			time.Sleep(10 * time.Second)
-			continue
+// run serves the gateway connection and reconnects whenever it is lost,
+// until ctx is cancelled.
+func (p *Proxy) run(ctx context.Context) {
+
+	for {
+		err := p.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if p.rebooting() {
+			log.Println("Gateway is rebooting, waiting for it to come back...")
+		} else {
+			log.Printf("Disconnected from gateway (%v), attempting to reconnect...", err)
+			p.gatewayLost(err)
+		}
+
+		for {
+			delay := reconnectDelay
+			if p.rebooting() {
+				delay = rebootPollInterval
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			if err = p.connect(ctx); err == nil {
+				break
+			}
+			if !p.rebooting() {
+				log.Printf("Reconnection failed: %v", err)
+			}
 		}
-		go p.receive()
-		go p.sendHeartbeat()
-		p.initState()
-		break
-	}
-}
 
-func (p *Proxy) initState() {
-	for i := 1; i <= p.config.Gateway.DeviceCount; i++ {
-		p.queryNodeID(strconv.Itoa(i))
+		p.gatewayRestored()
+		p.rules.countReconnect(time.Now())
+		if away, ok := p.rebootFinished(); ok {
+			log.Printf("Gateway is back after reboot (%s)", away.Round(time.Second))
+		}
 	}
 }
 
-func (p *Proxy) queryNodeID(nodeID string) {
+func (p *Proxy) queryNode(ref nodeRef) {
 	msg := &Message{
-		NodeID:    nodeID,
+		NodeID:    ref.NodeID,
 		Opcode:    "QUERY",
 		Arg:       "*",
 		Requester: "HJ_Server",
-		ReqID:     time.Now().Unix(),
+		ReqID:     p.nextReqID(),
+		ZKID:      p.outgoingZKID(ref),
 	}
 	p.sendMessage(msg)
 }
 
+// sendSwitch sends a SWITCH command for ref. Commands for devices with a
+// timeout or retry policy wait for the gateway's confirmation and are
+// resent if it does not arrive; all others are fire-and-forget and record
+// arg as the node's state right away, even if sending fails. Curtain
+// commands are subject to the gateway.cover_conflict policy.
+func (p *Proxy) sendSwitch(ctx context.Context, ref nodeRef, arg string) (err error) {
+	newMessage := func() *Message {
+		return &Message{
+			NodeID:    ref.NodeID,
+			Opcode:    "SWITCH",
+			Arg:       arg,
+			Requester: "HJ_Server",
+			ZKID:      p.outgoingZKID(ref),
+		}
+	}
+
+	dev, _ := p.lookupDevice(ref.key())
+	if err := p.checkArg(&dev, arg); err != nil {
+		return err
+	}
+	if mode := p.commandsBlocked(&dev); mode != "" && sourceOf(ctx).Via != viaPresence {
+		return fmt.Errorf("%w %q", errModeBlocked, mode)
+	}
+	if !p.Ready() {
+		return p.notReady()
+	}
+	release, err := p.checkInterlocks(&dev, ref, arg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := p.checkLoop(&dev, ref, arg); err != nil {
+		return err
+	}
+	if err := p.checkActuations(&dev, ref); err != nil {
+		return err
+	}
+	if dev.Config.ConfirmNotify {
+		source := sourceOf(ctx)
+		defer func() {
+			if err == nil {
+				go p.notifyCommand(&dev, arg, source)
+			}
+		}()
+	}
+	var cmd *coverCommand
+	if dev.Kind == kindCurtain {
+		if ctx, cmd, err = p.beginCoverCommand(ctx, ref, arg); err != nil {
+			return err
+		}
+		// The curtain is reported opening or closing at once.
+		p.origins.set(ref.key(), stateOrigin{Source: sourceOf(ctx).Via, Echo: true})
+		p.startTransition(&dev, arg)
+	}
+	// The report of the new state is the command's as long as retries
+	// may bring it.
+	window := dev.Config.timeout(p.config) * time.Duration(dev.Config.Retries+1)
+	p.origins.command(ref.key(), arg, sourceOf(ctx).Via, time.Now().Add(window))
+	// The repeats of the last command must not follow this one, also
+	// while it waits for its confirmation or when it is never confirmed.
+	p.repeats.cancel(ref.key())
+
+	trace := traceOf(ctx)
+	if !dev.Config.confirmed() {
+		msg := newMessage()
+		msg.ReqID = p.nextReqID()
+		msg.trace = trace
+		if err := p.sendMessage(msg); err != nil {
+			log.Printf("Failed to send %s to node %s: %v", arg, ref.key(), err)
+		}
+		p.setDeviceState(ref.key(), arg)
+		p.repeatCommand(&dev, ref, arg, newMessage, false)
+		if cmd != nil {
+			// Unconfirmed commands stay in flight until the gateway
+			// reports the new state or the request timeout passes.
+			time.AfterFunc(dev.Config.timeout(p.config), func() { p.endCoverCommand(ref.key(), cmd) })
+		}
+		return nil
+	}
+	if cmd != nil {
+		defer p.endCoverCommand(ref.key(), cmd)
+	}
+
+	timeout := dev.Config.timeout(p.config)
+	for attempt := 0; attempt <= dev.Config.Retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("No confirmation for %s from node %s, retrying (%d/%d)", arg, ref.key(), attempt, dev.Config.Retries)
+			p.health.retried(ref.key())
+		}
+		msg := newMessage()
+		msg.trace = trace
+		var reply *Message
+		reply, err = p.requestWithin(ctx, msg, timeout)
+		if err == nil && !confirms(msg, reply) {
+			log.Printf("Node %s reported %v after %s", ref.key(), reply.Arg, arg)
+			err = errStateMismatch
+		}
+		if !errors.Is(err, errRequestTimeout) && !errors.Is(err, errStateMismatch) {
+			break
+		}
+	}
+	if err == nil {
+		p.repeatCommand(&dev, ref, arg, newMessage, true)
+	}
+	if err != nil && cmd != nil && !errors.Is(err, errCommandSuperseded) {
+		p.abortTransition(&dev)
+	}
+	if errors.Is(err, errRequestTimeout) || errors.Is(err, errStateMismatch) {
+		p.transitionStuck(&dev, arg)
+	}
+	return err
+}
+
+// Start connects to the gateway and keeps the connection alive in the
+// background until Stop is called.
 func (p *Proxy) Start() error {
-	if err := p.connect(); err != nil {
+	if err := p.config.validateCoverConflict(); err != nil {
+		return err
+	}
+	if err := migrateData(p.config.dataDir()); err != nil {
+		return err
+	}
+	if err := p.loadCalibration(); err != nil {
+		return err
+	}
+	if err := p.loadMode(); err != nil {
+		return err
+	}
+	if err := p.guests.load(p.config.dataDir()); err != nil {
+		return err
+	}
+	if err := p.loadState(); err != nil {
+		return err
+	}
+	if err := p.loadEventSeq(); err != nil {
+		return err
+	}
+	if err := p.loadEnergy(); err != nil {
 		return err
 	}
+	if err := p.registerExtensions(); err != nil {
+		return err
+	}
+	if p.transport == nil {
+		transport, err := newTransport(p.config)
+		if err != nil {
+			return err
+		}
+		p.transport = transport
+	}
+	if p.config.Archive.Enabled {
+		archive, err := openArchive(p.config)
+		if err != nil {
+			return fmt.Errorf("failed to open message archive: %v", err)
+		}
+		p.archive = archive
+	}
 
-	go p.receive()
-	go p.sendHeartbeat()
-	p.initState()
+	ctx, cancel := context.WithCancel(context.Background())
+	if p.config.HomeAssistant.WarmUp {
+		p.warmUp(ctx)
+	}
+	if err := p.connect(ctx); err != nil {
+		cancel()
+		p.closeArchive()
+		return err
+	}
+
+	p.cancel = cancel
+	p.subsystems.add(subsystemGateway, nil, loop(p.run))
+	p.subsystems.add("state saving", nil, loop(p.saveStatePeriodically))
+	p.subsystems.add(subsystemWebSocket, nil, loop(p.wsGate.serve))
+	p.addExtensionSubsystems()
+	if len(p.config.Modes) > 0 {
+		p.subsystems.add("mode watch", []string{subsystemGateway}, loop(p.watchModes))
+	}
+	if len(p.config.Alerts) > 0 {
+		p.rules.start(time.Now(), p.config.Alerts)
+		p.subsystems.add("alert rules", []string{subsystemGateway}, loop(p.watchAlertRules))
+	}
+	if p.logs.summarizing() {
+		p.subsystems.add("log summaries", nil, loop(p.summarizeLogs))
+	}
+	if err := p.subsystems.start(ctx, p.protect); err != nil {
+		cancel()
+		p.disconnect()
+		p.closeArchive()
+		return err
+	}
 
 	return nil
 }
 
-func main() {
-	// Read configuration
-	configData, err := ioutil.ReadFile("config.yaml")
-	if err != nil {
-		fmt.Println("Error reading config file: %v", err)
+// Stop closes the gateway connection and waits for background goroutines
+// to exit.
+func (p *Proxy) Stop() {
+	if p.cancel == nil {
+		return
 	}
-
-	var config Config
-	if err := yaml.Unmarshal(configData, &config); err != nil {
-		fmt.Println("Error parsing config file: %v", err)
+	p.scheduled.stop()
+	p.sequences.stop()
+	p.subsystems.stop()
+	p.cancel()
+	p.disconnect()
+	// Once all events are saved, the next run needs not skip sequence
+	// numbers.
+	if err := p.saveState(); err != nil {
+		log.Printf("Failed to save device states: %v", err)
+	} else if err := p.saveEventSeq(p.events.cursor()); err != nil {
+		log.Printf("Failed to save the event sequence number: %v", err)
+	}
+	if err := p.saveEnergy(); err != nil {
+		log.Printf("Failed to save accumulated energy: %v", err)
 	}
+	p.stopWatches()
+	p.stopAlerts()
+	p.reports.stop()
+	p.closeArchive()
+}
 
-	// Initialize proxy
-	proxy := NewProxy(&config)
-	if err := proxy.Start(); err != nil {
-		fmt.Println("Error starting proxy: %v", err)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "update" {
+		os.Exit(runUpdateCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(runQueryCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctorCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export-ha-config" {
+		os.Exit(runExportHACommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImportCommand(os.Args[2:], os.Stdout, os.Stderr))
 	}
 
-	// Initialize Gin router
-	router := gin.Default()
+	log.SetOutput(recentLogs.tee(os.Stderr))
+	configPath := flag.String("config", "config.yaml", "configuration file or directory")
+	profile := flag.String("profile", "", "configuration profile to use")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
 
-	// Switch endpoints
-	router.POST("/switch/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		var data struct {
-			Arg string `json:"arg"`
-		}
-		if err := c.BindJSON(&data); err != nil {
-			c.JSON(400, gin.H{"error": "Invalid request"})
-			return
-		}
+	if *showVersion {
+		fmt.Println(currentBuild())
+		return
+	}
+	log.Printf("konke-ha-proxy %s", currentBuild())
 
-		msg := &Message{
-			NodeID:    id,
-			Opcode:    "SWITCH",
-			Arg:       data.Arg,
-			Requester: "HJ_Server",
-			ReqID:     time.Now().Unix(),
-		}
-		proxy.sendMessage(msg)
-		proxy.devices[id] = data.Arg
-		c.JSON(200, gin.H{"is_active": data.Arg == "ON"})
-	})
-
-	router.GET("/switch/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		state := proxy.devices[id]
-		c.JSON(200, gin.H{"is_active": state == "ON"})
-	})
-
-	// Curtain endpoints
-	router.POST("/curtain/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		var data struct {
-			Arg string `json:"arg"`
-		}
-		if err := c.BindJSON(&data); err != nil {
-			c.JSON(400, gin.H{"error": "Invalid request"})
-			return
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	// Settings such as tenant tokens without protect_devices would leave
+	// devices open, so the proxy does not start with an invalid config.
+	if errs := config.validate(); len(errs) > 0 {
+		for _, fe := range errs {
+			log.Printf("Invalid config: %s", fe.format())
 		}
+		log.Fatalf("Error loading config: %d problems; run konke-ha-proxy config validate for details", len(errs))
+	}
+	recentLogs.resize(config.Logging.Buffer)
+	logStartupSummary(config)
 
-		msg := &Message{
-			NodeID:    id,
-			Opcode:    "SWITCH",
-			Arg:       data.Arg,
-			Requester: "HJ_Server",
-			ReqID:     time.Now().Unix(),
+	// A process started by an upgrade takes over the listener and state
+	// of the one it replaces.
+	inherited, err := inheritHandoff()
+	if err != nil {
+		log.Fatalf("Error taking over from the previous process: %v", err)
+	}
+
+	// Initialize proxy
+	proxy := NewProxy(config)
+	proxy.configPath = *configPath
+	if inherited != nil {
+		proxy.restoreSnapshot(inherited.snapshot)
+	}
+	if err := proxy.Start(); err != nil {
+		if inherited != nil {
+			// The previous process keeps running.
+			log.Fatalf("Error starting proxy: %v", err)
 		}
-		proxy.sendMessage(msg)
-		proxy.devices[id] = data.Arg
-		c.JSON(200, gin.H{"is_open": data.Arg == "OPEN"})
-	})
+		log.Printf("Error starting proxy: %v", err)
+	}
 
-	router.GET("/curtain/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		state := proxy.devices[id]
-		c.JSON(200, gin.H{"is_open": state == "OPEN"})
-	})
+	router := newRouter(proxy)
 
 	// Start HTTP server
-	addr := fmt.Sprintf("%s:%d", config.HTTPServer.Host, config.HTTPServer.Port)
-	if err := router.Run(addr); err != nil {
-		fmt.Println("Error starting HTTP server: %v", err)
+	var listener, adminListener net.Listener
+	if inherited != nil {
+		listener, adminListener = inherited.listener, inherited.admin
+		if adminListener != nil && !config.splitAdmin() {
+			adminListener.Close()
+			adminListener = nil
+		}
+	} else if listener, err = listen(config.HTTPServer.Host, config.HTTPServer.Port); err != nil {
+		log.Fatalf("Error starting HTTP server: %v", err)
 	}
-}
\ No newline at end of file
+	if config.splitAdmin() && adminListener == nil {
+		if adminListener, err = listen(config.HTTPServer.Admin.Host, config.HTTPServer.Admin.Port); err != nil {
+			log.Fatalf("Error starting the admin HTTP server: %v", err)
+		}
+	}
+	if inherited != nil {
+		inherited.signalReady()
+		log.Printf("Took over HTTP server on %v", listener.Addr())
+	}
+	servers := []*http.Server{{Handler: router}}
+	listeners := []net.Listener{listener}
+	if adminListener != nil {
+		log.Printf("Serving the admin endpoints on %v", adminListener.Addr())
+		servers = append(servers, &http.Server{Handler: newAdminRouter(proxy)})
+		listeners = append(listeners, adminListener)
+	}
+	// The advertisements are not withdrawn on exit, so that it stays valid
+	// when a new process takes over in an upgrade.
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		go advertise(context.Background(), config, addr.Port)
+		go registerWithSupervisor(context.Background(), config, addr.Port)
+	}
+	if err := serveUpgradable(servers, listeners, proxy); err != nil {
+		log.Printf("Error starting HTTP server: %v", err)
+	}
+}
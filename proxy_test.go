@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+// TestConcurrentStateAccess exercises the gateway message handlers and the
+// HTTP handlers at the same time; run with -race to check the shared state.
+func TestConcurrentStateAccess(t *testing.T) {
+	var config Config
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}}
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "curtain_two"}}
+	proxy := NewProxy(&config)
+	router := newRouter(proxy)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				proxy.handleMessage(&Message{NodeID: strconv.Itoa(j%3 + 1), Opcode: "SWITCH", Arg: "ON"})
+				proxy.handleMessage(&Message{NodeID: strconv.Itoa(j%3 + 1), Opcode: "SWITCH", Arg: "OFF"})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				req := httptest.NewRequest(http.MethodPost, "/switch/1", strings.NewReader(`{"arg":"ON"}`))
+				req.Header.Set("Content-Type", "application/json")
+				router.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/curtain/2", nil))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSendMessageWithoutConnection(t *testing.T) {
+	var config Config
+	proxy := NewProxy(&config)
+
+	if err := proxy.sendMessage(&Message{NodeID: "1", Opcode: "QUERY"}); err != errNotConnected {
+		t.Fatalf("sendMessage() = %v, want %v", err, errNotConnected)
+	}
+}
+
+func TestInMemoryTransport(t *testing.T) {
+	gw := fakegw.New(2)
+	t.Cleanup(func() { gw.Close() })
+	gw.Report("2", "ON")
+
+	var config Config
+	config.Gateway.DeviceCount = 2
+	config.DataDir = t.TempDir()
+	proxy := NewProxyWithTransport(&config, newPipeTransport(gw))
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+
+	waitFor(t, time.Second, func() bool { return proxy.deviceState("2") == "ON" })
+	if gw.Logins() != 1 {
+		t.Errorf("got %d logins, want 1", gw.Logins())
+	}
+
+	router := newRouter(proxy)
+	req := httptest.NewRequest(http.MethodPost, "/switch/1", strings.NewReader(`{"arg":"ON"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	waitFor(t, time.Second, func() bool { return gw.State("1") == "ON" })
+}
+
+func TestStateMap(t *testing.T) {
+	var config Config
+	config.HomeAssistant.CurtainDomain = "cover"
+	config.HomeAssistant.StateMap = map[string]map[string]string{
+		"switch": {"1": "on", "0": "off"},
+		"cover":  {"OPENING": "opening", "STOPPED": "open"},
+	}
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}}
+	config.Devices.Curtains = map[string]DeviceConfig{
+		"2": {Entity: "curtain_two"},
+		"3": {Entity: "curtain_three", StateMap: map[string]string{"STOPPED": "closed"}},
+	}
+	proxy := NewProxy(&config)
+
+	for _, tc := range []struct {
+		key, arg, want string
+	}{
+		{"1", "1", "on"},
+		{"1", "ON", "on"}, // built-in mapping
+		{"2", "OPENING", "opening"},
+		{"2", "STOPPED", "open"},
+		{"3", "STOPPED", "closed"}, // device mapping first
+		{"3", "CLOSE", "closed"},
+	} {
+		dev, _ := proxy.lookupDevice(tc.key)
+		if got, ok := proxy.haState(&dev, tc.arg); !ok || got != tc.want {
+			t.Errorf("haState(%s, %s) = %q, %v; want %q", tc.key, tc.arg, got, ok, tc.want)
+		}
+	}
+	if _, ok := proxy.haState(&device{Kind: kindSwitch}, "2"); ok {
+		t.Error("unmapped argument 2 has a state")
+	}
+
+	// Mapped arguments also count for the state endpoints.
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "1"})
+	rec := httptest.NewRecorder()
+	newRouter(proxy).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/switch/1", nil))
+	if !strings.Contains(rec.Body.String(), `"is_active":true`) {
+		t.Errorf("GET /switch/1 = %s, want active", rec.Body)
+	}
+}
+
+func TestCommandAnsweredWithOtherState(t *testing.T) {
+	var mutex sync.Mutex
+	var attempts int
+	gw := startFakeGateway(t, 1, func(msg *fakegw.Message) {
+		if msg.Opcode == "SWITCH" && msg.Arg == "ON" {
+			// The gateway answers the command, but the node stays off.
+			mutex.Lock()
+			attempts++
+			mutex.Unlock()
+			msg.Arg = "OFF"
+		}
+	})
+	config := testConfig(t, gw, 1)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one", Timeout: 1, Retries: 1}}
+	proxy := startProxy(t, config)
+
+	rec := httptest.NewRecorder()
+	newRouter(proxy).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/switch/1", strings.NewReader(`{"arg": "ON"}`)))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status %d, body %s; want 502", rec.Code, rec.Body)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if attempts != 2 {
+		t.Errorf("gateway received %d commands, want one attempt and one retry", attempts)
+	}
+	if state := proxy.deviceState("1"); state != "OFF" {
+		t.Errorf("state = %q, want OFF as reported", state)
+	}
+}
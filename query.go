@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// queryResult is the decoded state of a node printed by the "query"
+// subcommand.
+type queryResult struct {
+	ZKID       string                 `json:"zkid"`
+	NodeID     string                 `json:"node_id"`
+	State      string                 `json:"state"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Arg        interface{}            `json:"arg"` // the argument as sent by the gateway
+	// The mapping of the node in the configuration, if any.
+	Type     string `json:"type,omitempty"`
+	EntityID string `json:"entity_id,omitempty"`
+	HAState  string `json:"ha_state,omitempty"`
+}
+
+// queryNodeOnce connects to the gateway, logs in, queries one node and
+// disconnects. Nothing is pushed to Home Assistant.
+func queryNodeOnce(ctx context.Context, p *Proxy, ref nodeRef) (*queryResult, error) {
+	// Replies are only matched to the waiting requests; the proxy's own
+	// handlers would push states and raise alerts.
+	p.handlers = map[string]func(*Message){}
+	p.sinks = nil
+
+	login := p.pending.add(0, "LOGIN", nodeRef{ZKID: ref.ZKID, NodeID: "*"}.key())
+	defer p.pending.remove(login)
+	if err := p.connect(ctx); err != nil {
+		return nil, err
+	}
+	defer p.disconnect()
+	go p.receive()
+
+	timeout := time.NewTimer(p.config.requestTimeout())
+	defer timeout.Stop()
+	select {
+	case reply := <-login.reply:
+		if reply.Status != "success" {
+			return nil, fmt.Errorf("gateway rejected the login for zk controller %s (%s)", zkidOrPrimary(p, ref.ZKID), reply.Status)
+		}
+	case <-timeout.C:
+		return nil, fmt.Errorf("no login reply from zk controller %s", zkidOrPrimary(p, ref.ZKID))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	reply, err := p.request(ctx, &Message{
+		NodeID:    ref.NodeID,
+		Opcode:    "QUERY",
+		Arg:       "*",
+		Requester: "HJ_Server",
+		ZKID:      p.outgoingZKID(ref),
+	})
+	if errors.Is(err, errRequestTimeout) {
+		return nil, fmt.Errorf("node %s did not answer; check the node ID", ref.key())
+	}
+	if err != nil {
+		return nil, err
+	}
+	state, extra, ok := switchArg(reply.Arg)
+	if !ok {
+		return nil, fmt.Errorf("node %s answered with an unsupported argument: %v", ref.key(), reply.Arg)
+	}
+
+	result := &queryResult{
+		ZKID:       zkidOrPrimary(p, ref.ZKID),
+		NodeID:     ref.NodeID,
+		State:      state,
+		Attributes: extra,
+		Arg:        reply.Arg,
+	}
+	if dev, ok := p.lookupDevice(ref.key()); ok {
+		result.Type = dev.Kind
+		result.EntityID = dev.EntityID
+		result.HAState, _ = p.haState(&dev, state)
+	}
+	return result, nil
+}
+
+// runQueryCommand implements the "query" subcommand and returns the
+// process exit code.
+func runQueryCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "config.yaml", "configuration file or directory")
+	profile := flags.String("profile", "", "configuration profile to use")
+	node := flags.String("node", "", "node ID to query")
+	zkid := flags.String("zkid", "", "zk controller of the node (default the primary one)")
+	timeout := flags.Duration("timeout", 30*time.Second, "give up after this long")
+	verbose := flags.Bool("v", false, "log the gateway session to stderr")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *node == "" || flags.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: konke-ha-proxy query -node ID [-zkid ZKID] [-config file] [-profile name]")
+		return 2
+	}
+	if *verbose {
+		log.SetOutput(stderr)
+	} else {
+		log.SetOutput(io.Discard)
+	}
+
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	transport, err := newTransport(config)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	p := NewProxyWithTransport(config, transport)
+	ref, ok := p.resolveNode(*zkid, *node)
+	if !ok {
+		fmt.Fprintf(stderr, "zk controller %s is not configured\n", *zkid)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	result, err := queryNodeOnce(ctx, p, ref)
+	if err != nil {
+		fmt.Fprintf(stderr, "Query failed: %v\n", err)
+		return 1
+	}
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Fprintln(stdout, string(out))
+	return 0
+}
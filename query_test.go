@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeQueryConfig writes a configuration for the query command pointing
+// at addr and returns its path.
+func writeQueryConfig(t *testing.T, addr string) string {
+	t.Helper()
+	host, port, _ := strings.Cut(addr, ":")
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	data := fmt.Sprintf(`gateway:
+  host: %s
+  port: %s
+  username: admin
+  password: admin
+  zkid: "266590"
+  request_timeout: 1
+devices:
+  lights:
+    "2":
+      entity: hall
+`, host, port)
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestQueryCommand(t *testing.T) {
+	defer log.SetOutput(io.Discard)
+	gw := startFakeGateway(t, 3, nil)
+	gw.Report("2", "ON")
+	file := writeQueryConfig(t, gw.Addr())
+
+	var stdout, stderr bytes.Buffer
+	if code := runQueryCommand([]string{"-config", file, "-node", "2"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("query: exit %d, stderr %q", code, stderr.String())
+	}
+	var got queryResult
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		t.Fatalf("output %q: %v", stdout.String(), err)
+	}
+	want := queryResult{ZKID: "266590", NodeID: "2", State: "ON", Arg: "ON", Type: kindSwitch, EntityID: "hall", HAState: "on"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("query printed %+v, want %+v", got, want)
+	}
+
+	// An unknown node does not answer.
+	stdout.Reset()
+	stderr.Reset()
+	if code := runQueryCommand([]string{"-config", file, "-node", "9"}, &stdout, &stderr); code != 1 {
+		t.Errorf("query of unknown node: exit %d, want 1", code)
+	}
+	if !strings.Contains(stderr.String(), "node 9 did not answer") {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+
+	if code := runQueryCommand([]string{"-config", file}, &stdout, &stderr); code != 2 {
+		t.Errorf("query without -node: exit %d, want 2", code)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stateFile holds the last known device states inside the data directory.
+const stateFile = "state.json"
+
+// stateSaveInterval is how often changed device states are saved.
+var stateSaveInterval = time.Minute
+
+// errNotReady is returned for commands while the gateway session is not
+// ready: not connected, not logged in or still syncing.
+var errNotReady = errors.New("gateway session is not ready")
+
+// notReadyError is errNotReady with the time after which the client
+// should retry.
+type notReadyError struct {
+	retryAfter int // seconds
+}
+
+func (e *notReadyError) Error() string { return errNotReady.Error() }
+func (e *notReadyError) Unwrap() error { return errNotReady }
+
+// readiness tracks whether the gateway session can take commands. A
+// session becomes ready once the gateway accepted the login and answered
+// the inventory sync, or the request timeout passed without an answer, as
+// some firmwares do not answer SYNC_INFO.
+type readiness struct {
+	mutex    sync.Mutex
+	loggedIn bool
+	synced   bool
+	timer    *time.Timer
+	ready    atomic.Bool
+	// syncedc is closed once the sync of the session completed or timed
+	// out.
+	syncedc chan struct{}
+}
+
+// reset marks a new session as not ready.
+func (r *readiness) reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.loggedIn, r.synced = false, false
+	r.syncedc = make(chan struct{})
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.ready.Store(false)
+}
+
+// loginAccepted records a successful login and gives the sync until
+// timeout to complete.
+func (r *readiness) loginAccepted(timeout time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.loggedIn {
+		return
+	}
+	r.loggedIn = true
+	if !r.synced {
+		r.timer = time.AfterFunc(timeout, r.syncDone)
+	}
+	r.update()
+}
+
+// syncDone records that the initial sync completed or timed out.
+func (r *readiness) syncDone() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.synced && r.syncedc != nil {
+		close(r.syncedc)
+	}
+	r.synced = true
+	r.update()
+}
+
+// syncWait returns a channel closed once the sync of the current session
+// completed or timed out.
+func (r *readiness) syncWait() <-chan struct{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.syncedc
+}
+
+// accepted reports whether the gateway accepted the login of the session.
+func (r *readiness) accepted() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.loggedIn
+}
+
+func (r *readiness) update() {
+	ready := r.loggedIn && r.synced
+	if ready && r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	if ready && !r.ready.Load() {
+		log.Println("Gateway session is ready")
+	}
+	r.ready.Store(ready)
+}
+
+// Ready reports whether the gateway session takes commands.
+func (p *Proxy) Ready() bool {
+	return p.connected.Load() && p.readiness.ready.Load()
+}
+
+// notReady returns the error for commands refused while the session is
+// not ready, with a hint when to retry.
+func (p *Proxy) notReady() error {
+	return &notReadyError{retryAfter: p.retryAfter()}
+}
+
+// retryAfter returns how many seconds a refused client should wait.
+func (p *Proxy) retryAfter() int {
+	wait := reconnectDelay
+	if p.rebooting() {
+		wait = rebootPollInterval
+	}
+	if p.connected.Load() {
+		wait = p.config.requestTimeout()
+	}
+	return int(math.Max(1, math.Ceil(wait.Seconds())))
+}
+
+// requireReady refuses requests while the gateway session is not ready.
+func requireReady(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !proxy.Ready() {
+			gatewayError(c, proxy.notReady())
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// loadState reads the device states saved by the previous run, so that
+// read endpoints answer before the gateway reports, and the recent state
+// changes, so that event cursors stay valid. States handed over
+// by an upgrade take precedence. The states pushed to Home Assistant are
+// not restored: after a restart they are all pushed again, unless
+// home_assistant.warm_up seeds them from HA.
+func (p *Proxy) loadState() error {
+	data, err := ioutil.ReadFile(filepath.Join(p.config.dataDir(), stateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved proxySnapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		setAsideUnreadable(filepath.Join(p.config.dataDir(), stateFile), err)
+		return nil
+	}
+
+	p.events.restore(saved.Events)
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	if len(p.devices) > 0 {
+		return nil
+	}
+	for k, v := range saved.Devices {
+		p.devices[k] = v
+	}
+	for k, v := range saved.Updated {
+		p.updated[k] = v
+	}
+	return nil
+}
+
+// saveState writes the device states to the data directory, unless a
+// backup was restored into it.
+func (p *Proxy) saveState() error {
+	if p.restored.Load() {
+		return nil
+	}
+	saved := p.snapshot()
+	saved.Entity = nil
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(p.config.dataDir(), stateFile), data)
+}
+
+// saveStatePeriodically saves the device states, the recent state changes
+// and the accumulated energy when they changed, until ctx is cancelled.
+func (p *Proxy) saveStatePeriodically(ctx context.Context) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	saved, savedCursor := p.stateTag.load(), p.events.cursor()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.saveEnergy(); err != nil {
+			log.Printf("Failed to save accumulated energy: %v", err)
+		}
+		if n, cursor := p.stateTag.load(), p.events.cursor(); n != saved || cursor != savedCursor {
+			if err := p.saveState(); err != nil {
+				log.Printf("Failed to save device states: %v", err)
+				continue
+			}
+			saved, savedCursor = n, cursor
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	var r readiness
+	r.loginAccepted(time.Hour)
+	if r.ready.Load() {
+		t.Fatal("ready before the sync")
+	}
+	r.syncDone()
+	if !r.ready.Load() {
+		t.Fatal("not ready after login and sync")
+	}
+
+	// Without an answer to SYNC_INFO the session is ready after the
+	// timeout.
+	r.reset()
+	r.loginAccepted(10 * time.Millisecond)
+	waitFor(t, time.Second, r.ready.Load)
+
+	r.reset()
+	if r.ready.Load() {
+		t.Error("ready after reset")
+	}
+}
+
+func TestNotReady(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, stateFile), []byte(`{"devices": {"1": "ON"}}`), 0644)
+
+	var config Config
+	config.DataDir = dir
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}}
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}}}
+	proxy := NewProxy(&config)
+	if err := proxy.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(proxy)
+
+	// Commands are refused with a hint when to retry.
+	for _, path := range []string{"/switch/1", "/gateway/sync-time"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"arg": "OFF"}`))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		router.ServeHTTP(rec, req)
+		var body struct {
+			RetryAfter int `json:"retry_after"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" || body.RetryAfter < 1 {
+			t.Errorf("POST %s: status %d, Retry-After %q, body %s", path, rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+		}
+	}
+	if proxy.deviceState("1") != "ON" {
+		t.Error("a refused command changed the recorded state")
+	}
+
+	// Reads serve the saved state.
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/switch/1", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"is_active":true`) {
+		t.Errorf("GET /switch/1 = %d %s, want the saved state", rec.Code, rec.Body)
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	var config Config
+	config.DataDir = t.TempDir()
+	proxy := NewProxy(&config)
+	proxy.setDeviceState("3", "OPEN")
+	proxy.setEntityState("curtain_three", "open")
+	if err := proxy.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewProxy(&config)
+	if err := restored.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if restored.deviceState("3") != "OPEN" {
+		t.Errorf("restored state %q, want OPEN", restored.deviceState("3"))
+	}
+	if restored.entityState("curtain_three") != "" {
+		t.Error("the state pushed to Home Assistant was restored")
+	}
+}
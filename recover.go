@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// crashDumpPrefix starts the names of the state dumps written on a
+	// panic inside the data directory.
+	crashDumpPrefix = "crash-"
+	// crashDumpKeep is how many dumps are kept; older ones are removed.
+	crashDumpKeep = 10
+)
+
+// errPanic is returned for a goroutine that panicked.
+var errPanic = errors.New("panic")
+
+// panicCount counts the panics recovered since the process started.
+var panicCount atomic.Int64
+
+// crashDump is written to the data directory when a goroutine panics.
+type crashDump struct {
+	Time      time.Time         `json:"time"`
+	Version   string            `json:"version"`
+	Subsystem string            `json:"subsystem"`
+	Panic     string            `json:"panic"`
+	Stack     string            `json:"stack"`
+	Connected bool              `json:"connected"`
+	Ready     bool              `json:"ready"`
+	Devices   map[string]string `json:"devices"` // gateway arguments by node key
+	Entities  map[string]string `json:"entities"`
+	Pending   []pendingInfo     `json:"pending"`   // requests waiting for a reply
+	Scheduled []string          `json:"scheduled"` // node keys with a delayed command or transition
+}
+
+// pendingInfo describes a request waiting for its reply.
+type pendingInfo struct {
+	ReqID  int64  `json:"req_id"`
+	Opcode string `json:"opcode"`
+	Node   string `json:"node"`
+}
+
+// list returns the waiting requests.
+func (r *pendingRequests) list() []pendingInfo {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	list := make([]pendingInfo, 0, len(r.waiters))
+	for _, w := range r.waiters {
+		list = append(list, pendingInfo{ReqID: w.reqID, Opcode: w.opcode, Node: w.node})
+	}
+	return list
+}
+
+// keys returns the node keys with a job.
+func (s *commandScheduler) keys() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]string, 0, len(s.jobs))
+	for key := range s.jobs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// protect runs fn, turning a panic into an error. The panic is logged with
+// its stack trace and the proxy's state is dumped to the data directory.
+func (p *Proxy) protect(name string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = p.crashed(name, r, debug.Stack())
+		}
+	}()
+	return fn()
+}
+
+// crashed records a panic of the subsystem name.
+func (p *Proxy) crashed(name string, r interface{}, stack []byte) error {
+	panicCount.Add(1)
+	log.Printf("Panic in %s: %v\n%s", name, r, stack)
+	if path, err := p.dumpCrash(name, r, stack); err != nil {
+		log.Printf("Failed to write the crash dump: %v", err)
+	} else {
+		log.Printf("Wrote the state at the panic to %s", path)
+	}
+	return fmt.Errorf("%w in %s: %v", errPanic, name, r)
+}
+
+// dumpCrash writes the state at a panic to a new file in the data
+// directory and removes the oldest dumps beyond crashDumpKeep.
+func (p *Proxy) dumpCrash(name string, r interface{}, stack []byte) (string, error) {
+	now := time.Now()
+	snapshot := p.snapshot()
+	dump := crashDump{
+		Time:      now,
+		Version:   currentBuild().String(),
+		Subsystem: name,
+		Panic:     fmt.Sprint(r),
+		Stack:     string(stack),
+		Connected: p.Connected(),
+		Ready:     p.Ready(),
+		Devices:   snapshot.Devices,
+		Entities:  snapshot.Entity,
+		Pending:   p.pending.list(),
+		Scheduled: p.scheduled.keys(),
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	dir := p.config.dataDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, crashDumpPrefix+now.Format("20060102-150405.000")+".json")
+	if err := writeFileAtomic(path, data); err != nil {
+		return "", err
+	}
+
+	dumps, _ := filepath.Glob(filepath.Join(dir, crashDumpPrefix+"*.json"))
+	sort.Strings(dumps)
+	for len(dumps) > crashDumpKeep {
+		os.Remove(dumps[0])
+		dumps = dumps[1:]
+	}
+	return path, nil
+}
+
+// writePanicMetrics writes the count of recovered panics.
+func writePanicMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP konke_panics_total Panics recovered in background goroutines.")
+	fmt.Fprintln(w, "# TYPE konke_panics_total counter")
+	fmt.Fprintf(w, "konke_panics_total %d\n", panicCount.Load())
+}
+
+// isCrashDump reports whether name is a crash dump file.
+func isCrashDump(name string) bool {
+	return strings.HasPrefix(name, crashDumpPrefix) && strings.HasSuffix(name, ".json")
+}
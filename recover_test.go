@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCrashDump(t *testing.T) {
+	config := &Config{DataDir: t.TempDir()}
+	config.Gateway.ZKID = "266590"
+	p := NewProxy(config)
+	p.devices["1"] = "ON"
+
+	err := p.protect("test loop", func() error { panic("boom") })
+	if !errors.Is(err, errPanic) {
+		t.Fatalf("protect returned %v, want a panic error", err)
+	}
+
+	dumps, _ := filepath.Glob(filepath.Join(config.DataDir, crashDumpPrefix+"*.json"))
+	if len(dumps) != 1 {
+		t.Fatalf("crash dumps = %v, want one", dumps)
+	}
+	data, err := os.ReadFile(dumps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump crashDump
+	if err := json.Unmarshal(data, &dump); err != nil {
+		t.Fatal(err)
+	}
+	if dump.Subsystem != "test loop" || dump.Panic != "boom" || dump.Stack == "" || dump.Devices["1"] != "ON" {
+		t.Errorf("crash dump = %+v", dump)
+	}
+}
+
+func TestReceivePanicReconnects(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.DataDir = t.TempDir()
+	proxy := NewProxy(config)
+	handleSwitch := proxy.handlers["SWITCH"]
+	proxy.handlers["SWITCH"] = func(msg *Message) {
+		if msg.Arg == "BOOM" {
+			panic("bad report")
+		}
+		handleSwitch(msg)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(proxy.Stop)
+	waitFor(t, 2*time.Second, proxy.Ready)
+
+	gw.Report("1", "BOOM")
+	// The session ends and the proxy logs in again.
+	waitFor(t, 2*time.Second, func() bool { return gw.Logins() >= 2 && proxy.Ready() })
+	gw.Report("1", "ON")
+	waitFor(t, time.Second, func() bool { return proxy.deviceState("1") == "ON" })
+}
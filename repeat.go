@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultRepeatInterval is the gap between the sends of a repeated command
+// when repeat.interval is not set.
+const defaultRepeatInterval = 500 * time.Millisecond
+
+// RepeatConfig sends every command to a device several times, for devices
+// that only latch a command when it comes twice.
+type RepeatConfig struct {
+	// Count is how often each command is sent in all, Interval the gap
+	// between the sends in milliseconds.
+	Count    int `yaml:"count"`
+	Interval int `yaml:"interval"`
+}
+
+func (r RepeatConfig) interval() time.Duration {
+	if r.Interval > 0 {
+		return time.Duration(r.Interval) * time.Millisecond
+	}
+	return defaultRepeatInterval
+}
+
+// repeatWindow is the time after a repeated command during which the
+// gateway's reports of the node are expected to come in several times.
+type repeatWindow struct {
+	gen      int
+	arg      string
+	until    time.Time
+	reported bool // the first report of arg has come in
+}
+
+// commandRepeats tracks the repeated commands in flight by node key.
+type commandRepeats struct {
+	mutex sync.Mutex
+	gen   int
+	nodes map[string]repeatWindow
+}
+
+// start opens the window of a repeated command for key, superseding the
+// repeats of an earlier command, and returns its generation. reported is
+// whether the first report of arg has come in already.
+func (r *commandRepeats) start(key, arg string, until time.Time, reported bool) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.nodes == nil {
+		r.nodes = make(map[string]repeatWindow)
+	}
+	r.gen++
+	r.nodes[key] = repeatWindow{gen: r.gen, arg: arg, until: until, reported: reported}
+	return r.gen
+}
+
+// current reports whether gen is still the latest repeated command of key.
+func (r *commandRepeats) current(key string, gen int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.nodes[key].gen == gen
+}
+
+// cancel drops the repeats of key's last command that are not sent yet,
+// and the window in which its reports are taken for echoes.
+func (r *commandRepeats) cancel(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.nodes, key)
+}
+
+// echo reports whether a report of arg for key repeats the first report
+// of a repeated command.
+func (r *commandRepeats) echo(key, arg string, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	w, ok := r.nodes[key]
+	if !ok {
+		return false
+	}
+	if !now.Before(w.until) {
+		delete(r.nodes, key)
+		return false
+	}
+	if arg != w.arg {
+		return false
+	}
+	if !w.reported {
+		w.reported = true
+		r.nodes[key] = w
+		return false
+	}
+	return true
+}
+
+// repeatCommand sends the rest of a command's repeats in the background.
+// Each is fire-and-forget; a newer command to the node drops those not
+// sent yet. confirmed is whether the gateway has confirmed the first send.
+func (p *Proxy) repeatCommand(dev *device, ref nodeRef, arg string, newMessage func() *Message, confirmed bool) {
+	repeat := dev.Config.Repeat
+	if repeat.Count < 2 {
+		return
+	}
+	key := ref.key()
+	interval := repeat.interval()
+	last := time.Duration(repeat.Count-1) * interval
+	gen := p.repeats.start(key, arg, time.Now().Add(last+dev.Config.timeout(p.config)), confirmed)
+	for i := 1; i < repeat.Count; i++ {
+		time.AfterFunc(time.Duration(i)*interval, func() {
+			if !p.repeats.current(key, gen) {
+				return
+			}
+			msg := newMessage()
+			msg.ReqID = p.nextReqID()
+			if err := p.sendMessage(msg); err != nil {
+				log.Printf("Failed to repeat %s to node %s: %v", arg, key, err)
+			}
+		})
+	}
+}
+
+// repeatEcho reports whether msg is a report of a repeated command after
+// the first one. Those are dropped before they reach the rate detector and
+// the state handlers.
+func (p *Proxy) repeatEcho(msg *Message) bool {
+	if msg.Opcode != "SWITCH" || msg.NodeID == "" || msg.NodeID == "*" {
+		return false
+	}
+	arg, _, ok := switchArg(msg.Arg)
+	return ok && p.repeats.echo(p.messageKey(msg), arg, time.Now())
+}
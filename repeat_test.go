@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+func TestRepeatEcho(t *testing.T) {
+	var r commandRepeats
+	now := time.Now()
+	r.start("1", "ON", now.Add(time.Second), false)
+	if r.echo("1", "ON", now) {
+		t.Error("first report taken for an echo")
+	}
+	if !r.echo("1", "ON", now) {
+		t.Error("second report not taken for an echo")
+	}
+	if r.echo("1", "OFF", now) {
+		t.Error("report of another state taken for an echo")
+	}
+	if r.echo("2", "ON", now) {
+		t.Error("report of another node taken for an echo")
+	}
+	if r.echo("1", "ON", now.Add(time.Second)) {
+		t.Error("report after the window taken for an echo")
+	}
+
+	// After a confirmed command the first report has come in already.
+	r.start("1", "OFF", now.Add(time.Second), true)
+	if !r.echo("1", "OFF", now) {
+		t.Error("report after a confirmed command not taken for an echo")
+	}
+}
+
+func TestRepeatedCommands(t *testing.T) {
+	var mutex sync.Mutex
+	var sent []time.Time
+	gw := startFakeGateway(t, 2, func(msg *fakegw.Message) {
+		if msg.Opcode == "SWITCH" {
+			mutex.Lock()
+			sent = append(sent, time.Now())
+			mutex.Unlock()
+		}
+	})
+	received := func() []time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]time.Time(nil), sent...)
+	}
+	config := testConfig(t, gw, 2)
+	config.Devices.Lights = map[string]DeviceConfig{
+		"1": {Entity: "lamp", Repeat: RepeatConfig{Count: 3, Interval: 50}},
+		"2": {Entity: "fan"},
+	}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/switch/1", strings.NewReader(`{"arg": "ON"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("command: status %d", rec.Code)
+	}
+	waitFor(t, time.Second, func() bool { return len(received()) == 3 })
+	got := received()
+	if gap := got[2].Sub(got[0]); gap < 100*time.Millisecond {
+		t.Errorf("repeats sent within %s, want 2 intervals of 50ms", gap)
+	}
+	if state := gw.State("1"); state != "ON" {
+		t.Errorf("gateway state = %q, want ON", state)
+	}
+
+	// Devices without repeat get each command once.
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/switch/2", strings.NewReader(`{"arg": "ON"}`)))
+	time.Sleep(100 * time.Millisecond)
+	if n := len(received()); n != 4 {
+		t.Errorf("%d SWITCH frames, want 4", n)
+	}
+}
+
+func TestRepeatsCancelledBeforeNextCommand(t *testing.T) {
+	var mutex sync.Mutex
+	var args []string
+	gw := startFakeGateway(t, 1, func(msg *fakegw.Message) {
+		if msg.Opcode != "SWITCH" {
+			return
+		}
+		mutex.Lock()
+		args = append(args, msg.Arg.(string))
+		mutex.Unlock()
+		if msg.Arg == "OFF" {
+			time.Sleep(250 * time.Millisecond) // a slow confirmation
+		}
+	})
+	received := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), args...)
+	}
+	config := testConfig(t, gw, 1)
+	config.Devices.Lights = map[string]DeviceConfig{
+		"1": {Entity: "lamp", Timeout: 1, Repeat: RepeatConfig{Count: 3, Interval: 100}},
+	}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	for _, arg := range []string{"ON", "OFF"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/switch/1", strings.NewReader(`{"arg": "`+arg+`"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", arg, rec.Code)
+		}
+	}
+	waitFor(t, time.Second, func() bool { return len(received()) >= 4 })
+	time.Sleep(300 * time.Millisecond)
+	if got := strings.Join(received(), " "); got != "ON OFF OFF OFF" {
+		t.Errorf("SWITCH frames = %s, want the ON repeats dropped", got)
+	}
+}
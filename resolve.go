@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultDNSRefresh is how long resolved addresses are reused.
+const defaultDNSRefresh = 5 * time.Minute
+
+// mdnsTimeout bounds an mDNS query when the caller sets no deadline.
+const mdnsTimeout = 2 * time.Second
+
+// mdnsAddr is the IPv4 mDNS multicast group.
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// dnsRefresh returns how long resolved gateway and Home Assistant
+// addresses are cached; after that they are looked up again so that
+// address changes are picked up. A negative dns_refresh disables caching.
+func (c *Config) dnsRefresh() time.Duration {
+	switch {
+	case c.DNSRefresh < 0:
+		return 0
+	case c.DNSRefresh == 0:
+		return defaultDNSRefresh
+	}
+	return time.Duration(c.DNSRefresh) * time.Second
+}
+
+// haProxy returns how the requests to Home Assistant find their proxy:
+// home_assistant.proxy if set, else HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+func (c *Config) haProxy() func(*http.Request) (*url.URL, error) {
+	if c.HomeAssistant.Proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	u, err := parseProxyURL(c.HomeAssistant.Proxy)
+	if err != nil {
+		return func(*http.Request) (*url.URL, error) { return nil, err }
+	}
+	return http.ProxyURL(u)
+}
+
+// parseProxyURL parses an http, https or socks5 proxy URL.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy %q needs an http, https or socks5 scheme", u.Redacted())
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", u.Redacted())
+	}
+	return u, nil
+}
+
+// hostPort joins a configured host and port into a dial address, accepting
+// IPv6 literals with or without brackets.
+func hostPort(host string, port int) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strconv.Itoa(port))
+}
+
+// resolver looks up host names, including mDNS .local names, which the
+// pure Go resolver of CGO_ENABLED=0 builds does not handle, and caches the
+// results for a while.
+type resolver struct {
+	refresh time.Duration
+	lookup  func(ctx context.Context, host string) ([]string, error)
+
+	mutex sync.Mutex
+	cache map[string]resolved
+}
+
+type resolved struct {
+	addrs []string
+	at    time.Time
+}
+
+func newResolver(refresh time.Duration) *resolver {
+	return &resolver{refresh: refresh, lookup: lookupHost, cache: make(map[string]resolved)}
+}
+
+// lookupHost resolves host, using mDNS for .local names.
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	if strings.HasSuffix(strings.TrimSuffix(host, "."), ".local") {
+		return mdnsLookup(ctx, host)
+	}
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+// resolve returns the addresses of host. A failed lookup falls back to the
+// previous result, so a DNS outage does not take the proxy down with it.
+func (r *resolver) resolve(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	r.mutex.Lock()
+	cached, ok := r.cache[host]
+	r.mutex.Unlock()
+	if ok && time.Since(cached.at) < r.refresh {
+		return cached.addrs, nil
+	}
+
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		if ok {
+			return cached.addrs, nil
+		}
+		return nil, err
+	}
+	r.mutex.Lock()
+	r.cache[host] = resolved{addrs: addrs, at: time.Now()}
+	r.mutex.Unlock()
+	return addrs, nil
+}
+
+// dial connects to addr, trying each resolved address of its host in turn.
+func (r *resolver) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.dialWith(ctx, &net.Dialer{}, network, addr)
+}
+
+// dialWith is dial with the given dialer.
+func (r *resolver) dialWith(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := r.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, ip := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// mdnsLookup resolves a .local name with a one-shot multicast DNS query
+// (RFC 6762 section 5.1), to which responders answer by unicast.
+func mdnsLookup(ctx context.Context, host string) ([]string, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			{Name: name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+		},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > mdnsTimeout {
+		deadline = time.Now().Add(mdnsTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.WriteToUDP(packet, mdnsAddr); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, fmt.Errorf("mdns: no answer for %s", host)
+			}
+			return nil, err
+		}
+		var reply dnsmessage.Message
+		if err := reply.Unpack(buf[:n]); err != nil || !reply.Response {
+			continue
+		}
+		var addrs []string
+		for _, answer := range reply.Answers {
+			if !strings.EqualFold(answer.Header.Name.String(), name.String()) {
+				continue
+			}
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(body.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(body.AAAA[:]).String())
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestHostPort(t *testing.T) {
+	for _, test := range []struct {
+		host string
+		want string
+	}{
+		{"192.168.1.10", "192.168.1.10:8123"},
+		{"homeassistant.local", "homeassistant.local:8123"},
+		{"fd00::10", "[fd00::10]:8123"},
+		{"[fd00::10]", "[fd00::10]:8123"},
+	} {
+		if got := hostPort(test.host, 8123); got != test.want {
+			t.Errorf("hostPort(%q) = %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestResolverRefresh(t *testing.T) {
+	r := newResolver(time.Hour)
+	addr, lookups := "10.0.0.1", 0
+	var fail error
+	r.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{addr}, fail
+	}
+	resolve := func() string {
+		t.Helper()
+		addrs, err := r.resolve(context.Background(), "gateway.lan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addrs[0]
+	}
+
+	resolve()
+	addr = "10.0.0.2"
+	if got := resolve(); got != "10.0.0.1" || lookups != 1 {
+		t.Errorf("within the refresh interval: got %s after %d lookups, want the cached address", got, lookups)
+	}
+
+	// Once the entry is stale, address changes are picked up.
+	r.refresh = 0
+	if got := resolve(); got != "10.0.0.2" {
+		t.Errorf("after refresh: got %s, want 10.0.0.2", got)
+	}
+
+	// A failed lookup keeps using the last known address.
+	fail = errors.New("no DNS")
+	addr = ""
+	if got := resolve(); got != "10.0.0.2" {
+		t.Errorf("during a DNS outage: got %s, want 10.0.0.2", got)
+	}
+
+	if addrs, _ := r.resolve(context.Background(), "fd00::1"); len(addrs) != 1 || addrs[0] != "fd00::1" {
+		t.Errorf("IP literal resolved to %v", addrs)
+	}
+}
+
+func TestTCPTransportIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Write([]byte("hello$"))
+			conn.Close()
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	transport := newTCPTransport([]string{hostPort("::1", port)}, newResolver(time.Minute), TCPConfig{})
+	if err := transport.Dial(context.Background()); err != nil {
+		t.Fatalf("dialling [::1]:%d: %v", port, err)
+	}
+	defer transport.Close()
+	if frame, err := transport.Receive(); err != nil || string(frame) != "hello$" {
+		t.Errorf("Receive() = %q, %v", frame, err)
+	}
+}
+
+func TestMDNSLookup(t *testing.T) {
+	// Stand in for the multicast group with a local responder.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	saved := mdnsAddr
+	mdnsAddr = conn.LocalAddr().(*net.UDPAddr)
+	defer func() { mdnsAddr = saved }()
+
+	go func() {
+		buf := make([]byte, 1500)
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if query.Unpack(buf[:n]) != nil || len(query.Questions) == 0 {
+			return
+		}
+		name := query.Questions[0].Name
+		reply := dnsmessage.Message{
+			Header: dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 168, 1, 20}},
+			}},
+		}
+		packet, _ := reply.Pack()
+		conn.WriteToUDP(packet, from)
+	}()
+
+	addrs, err := lookupHost(context.Background(), "konke-gateway.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "192.168.1.20" {
+		t.Errorf("lookupHost() = %v, want [192.168.1.20]", addrs)
+	}
+}
+
+func TestHAProxy(t *testing.T) {
+	var mutex sync.Mutex
+	var requested []string
+	forward := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requested = append(requested, r.Method+" "+r.URL.String())
+		mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer forward.Close()
+
+	var config Config
+	config.HomeAssistant.Host = "ha.invalid"
+	config.HomeAssistant.Port = 8123
+	config.HomeAssistant.Proxy = forward.URL
+	proxy := NewProxy(&config)
+	proxy.updateHomeAssistant("switch.light_one", "on", nil)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if want := "POST http://ha.invalid:8123/api/states/switch.light_one"; len(requested) != 1 || requested[0] != want {
+		t.Errorf("proxy saw %v, want %q", requested, want)
+	}
+
+	for _, bad := range []string{"proxy.lan:3128", "ftp://proxy.lan", "http://"} {
+		config.HomeAssistant.Proxy = bad
+		found := false
+		for _, err := range config.validate() {
+			found = found || strings.Join(err.path, ".") == "home_assistant.proxy"
+		}
+		if !found {
+			t.Errorf("proxy %q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conditions of alert rules.
+const (
+	conditionEntityStale = "entity_stale"
+	conditionReconnects  = "reconnects"
+	conditionHAFailures  = "ha_failures"
+)
+
+var ruleConditions = []string{conditionEntityStale, conditionReconnects, conditionHAFailures}
+
+// ruleCheckInterval is how often the alert rules are evaluated.
+var ruleCheckInterval = 30 * time.Second
+
+// defaultRuleWindow is the window of counting conditions without one.
+const defaultRuleWindow = time.Hour
+
+// AlertRule raises an alert while a condition holds and reports when it
+// clears.
+type AlertRule struct {
+	Name string `yaml:"name"`
+	// Condition is one of
+	//   entity_stale: a device sent nothing for threshold seconds
+	//   reconnects:   more than threshold reconnects within window seconds
+	//   ha_failures:  more than threshold failed HA updates within window seconds
+	Condition string `yaml:"condition"`
+	Threshold int    `yaml:"threshold"`
+	Window    int    `yaml:"window"`
+	// Devices (keyed like the device mapping) and Tags select the devices
+	// entity_stale watches; it watches all mapped devices when both are
+	// empty.
+	Devices []string `yaml:"devices"`
+	Tags    []string `yaml:"tags"`
+	// Sinks are the notification sinks to alert (telegram, ntfy, email);
+	// all configured sinks when empty.
+	Sinks []string `yaml:"sinks"`
+	// Macro, if set, names a macro run when the condition starts to hold.
+	Macro string `yaml:"macro"`
+}
+
+// window returns the counting window of the rule.
+func (r AlertRule) window() time.Duration {
+	if r.Window > 0 {
+		return time.Duration(r.Window) * time.Second
+	}
+	return defaultRuleWindow
+}
+
+// validateAlertRules checks the alerts section.
+func (c *Config) validateAlertRules(add func(message string, path ...string)) {
+	if len(c.Alerts) > 0 && len(c.notificationSinks(nil)) == 0 {
+		add("alert rules need a sink configured in notifications", "alerts")
+	}
+	names := make(map[string]bool)
+	for i, rule := range c.Alerts {
+		at := []string{"alerts", strconv.Itoa(i)}
+		if rule.Name == "" || names[rule.Name] {
+			add("every alert rule needs a unique name", at...)
+		}
+		names[rule.Name] = true
+		if !contains(ruleConditions, rule.Condition) {
+			add(fmt.Sprintf("unknown condition %q; use one of entity_stale, reconnects, ha_failures", rule.Condition), append(at, "condition")...)
+		}
+		if rule.Threshold <= 0 {
+			add("threshold must be positive", append(at, "threshold")...)
+		}
+		if _, ok := c.Macros[rule.Macro]; rule.Macro != "" && !ok {
+			add(fmt.Sprintf("unknown macro %q", rule.Macro), append(at, "macro")...)
+		}
+		for j, sink := range rule.Sinks {
+			if sink != "telegram" && sink != "ntfy" && sink != "email" {
+				add(fmt.Sprintf("unknown sink %q; use telegram, ntfy or email", sink), append(at, "sinks", strconv.Itoa(j))...)
+			}
+		}
+	}
+}
+
+// ruleState is what the alert rules are evaluated on.
+type ruleState struct {
+	mutex      sync.Mutex
+	started    time.Time
+	seen       map[string]time.Time // last message by node key
+	reconnects []time.Time
+	haFailures []time.Time
+	// keep is how long reconnects and failures are kept, by condition:
+	// the longest window of the rules counting them. Those no rule
+	// counts are not recorded.
+	keep   map[string]time.Duration
+	firing map[string]bool // by rule name, or rule name and node key
+}
+
+// start resets the state when the proxy starts with the alert rules:
+// devices that never report count as silent from then on.
+func (s *ruleState) start(now time.Time, rules []AlertRule) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.started = now
+	s.keep = make(map[string]time.Duration)
+	for _, rule := range rules {
+		if w := rule.window(); w > s.keep[rule.Condition] {
+			s.keep[rule.Condition] = w
+		}
+	}
+}
+
+// nodeSeen records a message from the node at key.
+func (s *ruleState) nodeSeen(key string, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.seen == nil {
+		s.seen = make(map[string]time.Time)
+	}
+	s.seen[key] = now
+}
+
+// countReconnect records a reconnection to the gateway.
+func (s *ruleState) countReconnect(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reconnects = record(s.reconnects, now, s.keep[conditionReconnects])
+}
+
+// countHAFailure records a failed request to Home Assistant.
+func (s *ruleState) countHAFailure(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.haFailures = record(s.haFailures, now, s.keep[conditionHAFailures])
+}
+
+// record appends now to times, dropping the times more than keep before
+// it. With keep 0 nothing is recorded.
+func record(times []time.Time, now time.Time, keep time.Duration) []time.Time {
+	if keep <= 0 {
+		return nil
+	}
+	return append(recent(times, now.Add(-keep)), now)
+}
+
+// recent drops the times before since from times and returns the rest.
+func recent(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+	return times[i:]
+}
+
+// ruleFinding is a condition that holds, with the alert key it fires
+// under.
+type ruleFinding struct {
+	key     string
+	message string
+}
+
+// watchedDevices returns the mapped devices rule selects, sorted by node
+// key.
+func (p *Proxy) watchedDevices(rule AlertRule) []device {
+	p.stateMu.RLock()
+	var devs []device
+	for _, dev := range p.inventory {
+		if dev.EntityID != "" && p.selects(rule.Devices, rule.Tags, dev) {
+			devs = append(devs, *dev)
+		}
+	}
+	p.stateMu.RUnlock()
+	sort.Slice(devs, func(i, j int) bool { return devs[i].Ref.key() < devs[j].Ref.key() })
+	return devs
+}
+
+// evaluate returns the findings of rule at now.
+func (p *Proxy) evaluate(rule AlertRule, now time.Time) []ruleFinding {
+	var devs []device
+	if rule.Condition == conditionEntityStale {
+		devs = p.watchedDevices(rule)
+	}
+
+	s := &p.rules
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch rule.Condition {
+	case conditionEntityStale:
+		limit := time.Duration(rule.Threshold) * time.Second
+		var findings []ruleFinding
+		for _, dev := range devs {
+			last, ok := s.seen[dev.Ref.key()]
+			if !ok {
+				last = s.started
+			}
+			if now.Sub(last) > limit {
+				findings = append(findings, ruleFinding{
+					key:     rule.Name + "/" + dev.Ref.key(),
+					message: fmt.Sprintf("%s (node %s) has sent nothing for %s.", dev.EntityID, dev.Ref.key(), now.Sub(last).Round(time.Second)),
+				})
+			}
+		}
+		return findings
+	case conditionReconnects:
+		s.reconnects = recent(s.reconnects, now.Add(-s.keep[rule.Condition]))
+		if n := len(recent(s.reconnects, now.Add(-rule.window()))); n > rule.Threshold {
+			return []ruleFinding{{key: rule.Name, message: fmt.Sprintf("The proxy reconnected to the gateway %d times within %s.", n, rule.window())}}
+		}
+	case conditionHAFailures:
+		s.haFailures = recent(s.haFailures, now.Add(-s.keep[rule.Condition]))
+		if n := len(recent(s.haFailures, now.Add(-rule.window()))); n > rule.Threshold {
+			return []ruleFinding{{key: rule.Name, message: fmt.Sprintf("%d requests to Home Assistant failed within %s.", n, rule.window())}}
+		}
+	}
+	return nil
+}
+
+// checkAlertRules evaluates the alert rules and alerts for conditions that
+// began or cleared since the last check.
+func (p *Proxy) checkAlertRules(now time.Time) {
+	for _, rule := range p.config.Alerts {
+		holding := make(map[string]bool)
+		for _, f := range p.evaluate(rule, now) {
+			holding[f.key] = true
+			if p.setFiring(f.key, true) {
+				p.deliver(alert{Kind: rule.Condition, Title: "Konke alert: " + rule.Name, Message: f.message, Time: now}, rule.Sinks)
+				p.runRuleMacro(rule)
+			}
+		}
+		for _, key := range p.firingKeys(rule.Name) {
+			if !holding[key] && p.setFiring(key, false) {
+				message := "The condition no longer holds."
+				if node, ok := strings.CutPrefix(key, rule.Name+"/"); ok {
+					message = fmt.Sprintf("Node %s is reporting again.", node)
+				}
+				p.deliver(alert{Kind: rule.Condition, Title: "Konke alert resolved: " + rule.Name, Message: message, Time: now}, rule.Sinks)
+			}
+		}
+	}
+}
+
+// runRuleMacro runs the macro of rule, if any, as its condition starts to
+// hold.
+func (p *Proxy) runRuleMacro(rule AlertRule) {
+	if rule.Macro == "" {
+		return
+	}
+	source := commandSource{Identity: "alert:" + rule.Name, Via: viaAlert}
+	if err := p.startSequence("Macro "+rule.Macro, p.config.Macros[rule.Macro], source); err != nil {
+		log.Printf("Alert rule %s: macro %s not run: %v", rule.Name, rule.Macro, err)
+	}
+}
+
+// setFiring records whether the alert key is firing and reports whether
+// that changed.
+func (p *Proxy) setFiring(key string, firing bool) bool {
+	s := &p.rules
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.firing == nil {
+		s.firing = make(map[string]bool)
+	}
+	if s.firing[key] == firing {
+		return false
+	}
+	if firing {
+		s.firing[key] = true
+	} else {
+		delete(s.firing, key)
+	}
+	return true
+}
+
+// firingKeys returns the firing alert keys of the rule called name.
+func (p *Proxy) firingKeys(name string) []string {
+	s := &p.rules
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var keys []string
+	for key := range s.firing {
+		if key == name || strings.HasPrefix(key, name+"/") {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// watchAlertRules evaluates the alert rules periodically until ctx is
+// cancelled.
+func (p *Proxy) watchAlertRules(ctx context.Context) {
+	ticker := time.NewTicker(ruleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.checkAlertRules(now)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertRules(t *testing.T) {
+	proxy := eventProxy()
+	proxy.config.Alerts = []AlertRule{
+		{Name: "silent light", Condition: conditionEntityStale, Threshold: 3600, Devices: []string{"1"}},
+		{Name: "flapping", Condition: conditionReconnects, Threshold: 2, Window: 3600},
+		{Name: "ha down", Condition: conditionHAFailures, Threshold: 1, Window: 60},
+	}
+	sink := &recordingSink{}
+	proxy.sinks = []notificationSink{sink}
+
+	start := time.Now()
+	proxy.rules.start(start, proxy.config.Alerts)
+	proxy.rules.nodeSeen("2", start.Add(-2*time.Hour)) // not watched by the rule
+	for i := 0; i < 3; i++ {
+		proxy.rules.countReconnect(start.Add(time.Duration(i) * time.Minute))
+	}
+	proxy.rules.countHAFailure(start)
+	proxy.rules.countHAFailure(start.Add(10 * time.Second))
+
+	check := func(at time.Duration, want ...string) {
+		t.Helper()
+		before := len(sink.kinds())
+		proxy.checkAlertRules(start.Add(at))
+		waitFor(t, 3*time.Second, func() bool { return len(sink.kinds()) >= before+len(want) })
+		time.Sleep(20 * time.Millisecond)
+
+		sink.mutex.Lock()
+		got := sink.alerts[before:]
+		sink.mutex.Unlock()
+		if len(got) != len(want) {
+			t.Fatalf("at %s got %+v, want %v", at, got, want)
+		}
+		for _, w := range want {
+			found := false
+			for _, a := range got {
+				found = found || a.Title == w
+			}
+			if !found {
+				t.Errorf("at %s no alert %q in %+v", at, w, got)
+			}
+		}
+	}
+
+	check(30*time.Second, "Konke alert: flapping", "Konke alert: ha down")
+	check(time.Minute) // still holding: nothing new
+	check(2*time.Minute, "Konke alert resolved: ha down")
+	// The first reconnect leaves the window as the light becomes stale.
+	check(61*time.Minute+time.Second, "Konke alert: silent light", "Konke alert resolved: flapping")
+
+	proxy.rules.nodeSeen("1", start.Add(62*time.Minute))
+	check(63*time.Minute, "Konke alert resolved: silent light")
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	for _, a := range sink.alerts {
+		if a.Title == "Konke alert: silent light" && !strings.Contains(a.Message, "light_one") {
+			t.Errorf("stale alert does not name the entity: %q", a.Message)
+		}
+	}
+}
+
+func TestRuleCountersBounded(t *testing.T) {
+	var s ruleState
+	start := time.Now()
+	s.start(start, []AlertRule{{Name: "flapping", Condition: conditionReconnects, Threshold: 2, Window: 60}})
+	for i := 0; i < 100; i++ {
+		at := start.Add(time.Duration(i) * 10 * time.Second)
+		s.countReconnect(at)
+		s.countHAFailure(at)
+	}
+	// Only the last minute of reconnects is kept, and failures no rule
+	// counts are not kept at all.
+	if len(s.reconnects) != 7 || len(s.haFailures) != 0 {
+		t.Errorf("kept %d reconnects and %d failures, want 7 and 0", len(s.reconnects), len(s.haFailures))
+	}
+}
+
+func TestValidateAlertRules(t *testing.T) {
+	var config Config
+	config.Alerts = []AlertRule{
+		{Name: "a", Condition: "battery_low", Threshold: 1},
+		{Name: "a", Condition: conditionReconnects, Sinks: []string{"sms"}},
+	}
+	var paths []string
+	config.validateAlertRules(func(message string, path ...string) {
+		paths = append(paths, strings.Join(path, "."))
+	})
+	want := "alerts alerts.0.condition alerts.1 alerts.1.threshold alerts.1.sinks.0"
+	if strings.Join(paths, " ") != want {
+		t.Errorf("errors at %v, want %s", paths, want)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxScenes is how many snapshots are kept; older ones are dropped.
+const maxScenes = 20
+
+var errUnknownScene = errors.New("unknown snapshot")
+
+// sceneState is the state of one device when a snapshot was taken.
+type sceneState struct {
+	ZKID     string `json:"zkid"`
+	NodeID   string `json:"node_id"`
+	EntityID string `json:"entity_id"`
+	State    string `json:"state"` // as reported by the gateway
+}
+
+// scene is a snapshot of the states of a set of devices.
+type scene struct {
+	ID      string       `json:"id"`
+	Created time.Time    `json:"created"`
+	States  []sceneState `json:"states"`
+}
+
+// sceneResult tells what restoring a snapshot did to one device.
+type sceneResult struct {
+	EntityID string `json:"entity_id"`
+	State    string `json:"state"`
+	// Result is restored, unchanged, skipped (for states that cannot be
+	// sent as a command, such as a stopped curtain) or failed.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// sceneStore keeps the last maxScenes snapshots in memory.
+type sceneStore struct {
+	mutex  sync.Mutex
+	seq    int
+	scenes []*scene // oldest first
+}
+
+func (s *sceneStore) add(snap *scene) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seq++
+	snap.ID = strconv.Itoa(s.seq)
+	s.scenes = append(s.scenes, snap)
+	if len(s.scenes) > maxScenes {
+		s.scenes = s.scenes[len(s.scenes)-maxScenes:]
+	}
+}
+
+func (s *sceneStore) get(id string) (*scene, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, snap := range s.scenes {
+		if snap.ID == id {
+			return snap, true
+		}
+	}
+	return nil, false
+}
+
+// takeScene captures the last reported states of the mapped devices
+// among devices (keyed like the device mapping) or carrying one of tags,
+// or of all mapped devices when both are empty.
+func (p *Proxy) takeScene(devices, tags []string) *scene {
+	snap := &scene{Created: time.Now(), States: []sceneState{}}
+	p.stateMu.RLock()
+	for key, dev := range p.inventory {
+		state, ok := p.devices[key]
+		if dev.EntityID == "" || !ok || !p.selects(devices, tags, dev) {
+			continue
+		}
+		snap.States = append(snap.States, sceneState{
+			ZKID:     zkidOrPrimary(p, dev.Ref.ZKID),
+			NodeID:   dev.Ref.NodeID,
+			EntityID: dev.EntityID,
+			State:    state,
+		})
+	}
+	p.stateMu.RUnlock()
+	sort.Slice(snap.States, func(i, j int) bool {
+		a, b := snap.States[i], snap.States[j]
+		if a.ZKID != b.ZKID {
+			return a.ZKID < b.ZKID
+		}
+		return lessNodeID(a.NodeID, b.NodeID)
+	})
+	p.scenes.add(snap)
+	return snap
+}
+
+// replayable reports whether state can be sent to dev as a command.
+func replayable(dev *device, state string) bool {
+	switch state {
+	case "ON", "OFF", "OPEN", "CLOSE":
+		return true
+	}
+	_, ok := dimmerLevel(state)
+	return ok && dev.Config.Dimmer
+}
+
+// restoreScene sends the states of a snapshot to the devices that are
+// no longer in them.
+func (p *Proxy) restoreScene(ctx context.Context, id string) ([]sceneResult, error) {
+	snap, ok := p.scenes.get(id)
+	if !ok {
+		return nil, errUnknownScene
+	}
+	results := make([]sceneResult, 0, len(snap.States))
+	for _, saved := range snap.States {
+		result := sceneResult{EntityID: saved.EntityID, State: saved.State}
+		ref, _ := p.resolveNode(saved.ZKID, saved.NodeID)
+		dev, _ := p.lookupDevice(ref.key())
+		switch {
+		case p.deviceState(ref.key()) == saved.State:
+			result.Result = "unchanged"
+		case !replayable(&dev, saved.State):
+			result.Result = "skipped"
+		default:
+			p.scheduled.cancel(ref.key())
+			if err := p.sendSwitch(ctx, ref, saved.State); err != nil {
+				result.Result = "failed"
+				result.Error = err.Error()
+			} else {
+				result.Result = "restored"
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
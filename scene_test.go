@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSceneSnapshotAndRestore(t *testing.T) {
+	gw := startFakeGateway(t, 3, nil)
+	config := testConfig(t, gw, 3)
+	config.Devices.Lights = map[string]DeviceConfig{
+		"1": {Entity: "lamp", Tags: []string{"living"}},
+		"2": {Entity: "spots", Tags: []string{"living"}},
+		"3": {Entity: "hall"},
+	}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+
+	proxy.setDeviceState("1", "ON")
+	proxy.setDeviceState("2", "OFF")
+	rec := post("/snapshot", `{"tags": ["living"]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("snapshot: status %d", rec.Code)
+	}
+	var snap scene
+	if err := json.Unmarshal(rec.Body.Bytes(), &snap); err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.States) != 2 || snap.States[0].EntityID != "lamp" || snap.States[1].State != "OFF" {
+		t.Fatalf("snapshot states = %+v", snap.States)
+	}
+
+	// Movie mode.
+	if rec := post("/switch/1", `{"arg": "OFF"}`); rec.Code != http.StatusOK {
+		t.Fatalf("switch: status %d", rec.Code)
+	}
+
+	rec = post("/snapshot/"+snap.ID+"/restore", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore: status %d", rec.Code)
+	}
+	var restored struct {
+		Devices []sceneResult `json:"devices"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &restored); err != nil {
+		t.Fatal(err)
+	}
+	results := map[string]string{}
+	for _, r := range restored.Devices {
+		results[r.EntityID] = r.Result
+	}
+	if results["lamp"] != "restored" || results["spots"] != "unchanged" || len(results) != 2 {
+		t.Errorf("results = %v", results)
+	}
+	waitFor(t, time.Second, func() bool { return gw.State("1") == "ON" })
+
+	if rec := post("/snapshot/99/restore", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown snapshot: status %d, want 404", rec.Code)
+	}
+}
+
+func TestSnapshotRestoreRefusesLimitedTokens(t *testing.T) {
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.Auth.ProtectDevices = true
+	config.Auth.Tokens = []authToken{
+		{Name: "phone", Token: "phone-token", Scopes: []string{scopeDevices}},
+		{Name: "unit-a", Token: "a-token", Tenant: "unit-a"},
+	}
+	config.Devices.Lights = map[string]DeviceConfig{
+		"1": {Entity: "lamp", Tenant: "unit-a"},
+		"2": {Entity: "hall"},
+	}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+	proxy.setDeviceState("2", "ON")
+	snap := proxy.takeScene(nil, nil)
+	_, guest, err := proxy.guests.mint("visitor", []string{"1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Snapshot "1" would switch node 2 too, which neither the guest nor
+	// the tenant may control.
+	if snap.ID != "1" {
+		t.Fatalf("snapshot id = %s, want 1", snap.ID)
+	}
+	for token, want := range map[string]int{guest: 403, "a-token": 403, "phone-token": 200} {
+		req := httptest.NewRequest(http.MethodPost, "/snapshot/1/restore", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("restore with %s: status %d, want %d", token, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// transitionStep is the interval between the level commands of a dimming
+// transition.
+var transitionStep = 500 * time.Millisecond
+
+// maxTransitionSteps is the most level commands a transition sends: one
+// per level of a dimmer from 0 to 100.
+const maxTransitionSteps = 100
+
+// maxScheduleMS is the longest delay_ms and transition_ms, a day.
+const maxScheduleMS = int64(24 * time.Hour / time.Millisecond)
+
+var (
+	errNegativeDelay = errors.New("delay_ms and transition_ms must not be negative")
+	errLongDelay     = errors.New("delay_ms and transition_ms must be at most a day")
+	errNotDimmer     = errors.New("transition_ms needs a dimmer and a level from 0 to 100")
+)
+
+// scheduledStep is a command sent after the previous one of its job.
+type scheduledStep struct {
+	after time.Duration
+	arg   string
+}
+
+// commandJob is the delayed command or transition pending for a node.
+type commandJob struct {
+	timer *time.Timer
+}
+
+// commandScheduler sends delayed commands and dimming transitions, as the
+// gateway has no support for either, and runs delayed macros. Each node
+// and each macro has at most one job; a new command to the node, or a new
+// run of the macro, replaces it.
+type commandScheduler struct {
+	mutex   sync.Mutex
+	jobs    map[string]*commandJob // by node key
+	stopped bool
+}
+
+// start replaces the job of the node key with steps, sent one after the
+// other through run until it fails.
+func (s *commandScheduler) start(key string, steps []scheduledStep, run func(arg string) error) *commandJob {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped || len(steps) == 0 {
+		return nil
+	}
+	s.cancelLocked(key)
+	if s.jobs == nil {
+		s.jobs = make(map[string]*commandJob)
+	}
+	job := &commandJob{}
+	s.jobs[key] = job
+	s.schedule(key, job, steps, run)
+	return job
+}
+
+// schedule arms the timer of job for the first of steps. The mutex must
+// be held.
+func (s *commandScheduler) schedule(key string, job *commandJob, steps []scheduledStep, run func(arg string) error) {
+	step := steps[0]
+	job.timer = time.AfterFunc(step.after, func() {
+		if !s.current(key, job) {
+			return
+		}
+		err := run(step.arg)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.stopped || s.jobs[key] != job {
+			return
+		}
+		if err != nil || len(steps) == 1 {
+			delete(s.jobs, key)
+			return
+		}
+		s.schedule(key, job, steps[1:], run)
+	})
+}
+
+func (s *commandScheduler) current(key string, job *commandJob) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.stopped && s.jobs[key] == job
+}
+
+// cancel drops the job of the node key.
+func (s *commandScheduler) cancel(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cancelLocked(key)
+}
+
+// cancelJob drops job if it is still the job of the node key.
+func (s *commandScheduler) cancelJob(key string, job *commandJob) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if job != nil && s.jobs[key] == job {
+		s.cancelLocked(key)
+	}
+}
+
+func (s *commandScheduler) cancelLocked(key string) {
+	if job := s.jobs[key]; job != nil {
+		job.timer.Stop()
+		delete(s.jobs, key)
+	}
+}
+
+// stop drops all jobs.
+func (s *commandScheduler) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	for key := range s.jobs {
+		s.cancelLocked(key)
+	}
+}
+
+// macroJobKey returns the key the job of a delayed macro is held under,
+// which cannot be a node key.
+func macroJobKey(name string) string {
+	return "macro:" + name
+}
+
+// dimmerLevel returns arg as a dimmer level from 0 to 100.
+func dimmerLevel(arg string) (float64, bool) {
+	level, err := strconv.ParseFloat(arg, 64)
+	return level, err == nil && level >= 0 && level <= 100
+}
+
+// currentLevel returns the last reported level of a dimmer: its level
+// attribute, a numeric state, or 100 when on and 0 otherwise.
+func (p *Proxy) currentLevel(ref nodeRef) float64 {
+	if level, ok := p.extraAttributes(ref.key())["level"].(float64); ok {
+		return level
+	}
+	state := p.deviceState(ref.key())
+	if level, ok := dimmerLevel(state); ok {
+		return level
+	}
+	if state == "ON" {
+		return 100
+	}
+	return 0
+}
+
+// transitionSteps spreads the way from one level to another over d in
+// steps of transitionStep, or longer ones for long transitions, after
+// delay, the last reaching the target when d has passed.
+func transitionSteps(from, to float64, delay, d time.Duration) []scheduledStep {
+	n := int(d / transitionStep)
+	if n < 1 {
+		n = 1
+	}
+	if n > maxTransitionSteps {
+		n = maxTransitionSteps
+	}
+	interval := d / time.Duration(n)
+	steps := make([]scheduledStep, 0, n)
+	last, prev := math.Round(from), time.Duration(0)
+	for i := 1; i <= n; i++ {
+		level := math.Round(from + (to-from)*float64(i)/float64(n))
+		if level == last {
+			continue
+		}
+		at := delay + time.Duration(i)*interval
+		steps = append(steps, scheduledStep{after: at - prev, arg: strconv.FormatFloat(level, 'f', -1, 64)})
+		last, prev = level, at
+	}
+	if len(steps) == 0 {
+		steps = append(steps, scheduledStep{after: delay + d, arg: strconv.FormatFloat(math.Round(to), 'f', -1, 64)})
+	}
+	return steps
+}
+
+// scheduleSwitch sends arg to the node after delay, or for dimmers ramps
+// to the level arg over transition. It returns when the last step is due.
+func (p *Proxy) scheduleSwitch(ctx context.Context, ref nodeRef, arg string, delay, transition time.Duration) (time.Time, error) {
+	if delay < 0 || transition < 0 {
+		return time.Time{}, errNegativeDelay
+	}
+	if max := time.Duration(maxScheduleMS) * time.Millisecond; delay > max || transition > max {
+		return time.Time{}, errLongDelay
+	}
+	dev, _ := p.lookupDevice(ref.key())
+	if err := p.checkArg(&dev, arg); err != nil {
+		return time.Time{}, err
+	}
+	steps := []scheduledStep{{after: delay, arg: arg}}
+	if transition > 0 {
+		target, ok := dimmerLevel(arg)
+		if !dev.Config.Dimmer || !ok {
+			return time.Time{}, errNotDimmer
+		}
+		steps = transitionSteps(p.currentLevel(ref), target, delay, transition)
+	}
+
+	source := sourceOf(ctx)
+	source.Via = viaSchedule
+	p.scheduled.start(ref.key(), steps, func(arg string) error {
+		err := p.sendSwitch(withSource(context.Background(), source), ref, arg)
+		if err != nil {
+			log.Printf("Scheduled %s for node %s failed: %v", arg, ref.key(), err)
+		}
+		return err
+	})
+	return time.Now().Add(delay + transition), nil
+}
+
+// scheduleMacro runs the macro called name after delay. It returns when
+// the macro starts.
+func (p *Proxy) scheduleMacro(ctx context.Context, name string, delay time.Duration) (time.Time, error) {
+	if delay < 0 {
+		return time.Time{}, errNegativeDelay
+	}
+	if delay > time.Duration(maxScheduleMS)*time.Millisecond {
+		return time.Time{}, errLongDelay
+	}
+	source := sourceOf(ctx)
+	source.Via = viaSchedule
+	p.scheduled.start(macroJobKey(name), []scheduledStep{{after: delay}}, func(string) error {
+		err := p.startSequence("Macro "+name, p.config.Macros[name], source)
+		if err != nil {
+			log.Printf("Scheduled macro %s failed: %v", name, err)
+		}
+		return err
+	})
+	return time.Now().Add(delay), nil
+}
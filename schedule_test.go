@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+func TestTransitionSteps(t *testing.T) {
+	steps := transitionSteps(0, 100, time.Second, 2*time.Second)
+	var args []string
+	var at time.Duration
+	for _, step := range steps {
+		args = append(args, step.arg)
+		at += step.after
+	}
+	if want := []string{"25", "50", "75", "100"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("levels = %v, want %v", args, want)
+	}
+	if at != 3*time.Second {
+		t.Errorf("last step after %s, want 3s", at)
+	}
+
+	// Steps that would not change the level are left out.
+	steps = transitionSteps(50, 51, 0, 2*time.Second)
+	if len(steps) != 1 || steps[0].arg != "51" || steps[0].after != time.Second {
+		t.Errorf("steps = %+v, want one to 51 after 1s", steps)
+	}
+
+	// Long transitions take longer steps rather than more of them.
+	steps = transitionSteps(0, 100, 0, 24*time.Hour)
+	if len(steps) != maxTransitionSteps || steps[0].after != 24*time.Hour/maxTransitionSteps {
+		t.Errorf("day-long transition: %d steps, the first after %s", len(steps), steps[0].after)
+	}
+}
+
+func TestScheduledCommands(t *testing.T) {
+	defer func(step time.Duration) { transitionStep = step }(transitionStep)
+	transitionStep = 20 * time.Millisecond
+
+	var mutex sync.Mutex
+	var args []string
+	gw := startFakeGateway(t, 2, func(msg *fakegw.Message) {
+		if msg.Opcode == "SWITCH" {
+			mutex.Lock()
+			args = append(args, msg.Arg.(string))
+			mutex.Unlock()
+		}
+	})
+	received := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), args...)
+	}
+	config := testConfig(t, gw, 2)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "lamp", Dimmer: true}, "2": {Entity: "fan"}}
+	proxy := startProxy(t, config)
+	router := newRouter(proxy)
+
+	command := func(node, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/switch/"+node, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := command("2", `{"arg": "ON", "delay_ms": 50}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("delayed command: status %d", rec.Code)
+	}
+	if got := received(); len(got) != 0 {
+		t.Errorf("delayed command sent at once: %v", got)
+	}
+	waitFor(t, time.Second, func() bool { return len(received()) == 1 })
+
+	// A command sent now replaces the scheduled one.
+	command("2", `{"arg": "OFF", "delay_ms": 50}`)
+	command("2", `{"arg": "ON"}`)
+	time.Sleep(100 * time.Millisecond)
+	if got := received(); !reflect.DeepEqual(got, []string{"ON", "ON"}) {
+		t.Errorf("commands = %v, want the scheduled OFF dropped", got)
+	}
+
+	// So does one sent by a macro.
+	command("2", `{"arg": "OFF", "delay_ms": 50}`)
+	proxy.runSequence(context.Background(), "test", []CommandStep{{Device: "2", Arg: "ON"}}, commandSource{Via: "macro"})
+	time.Sleep(100 * time.Millisecond)
+	if got := received(); !reflect.DeepEqual(got, []string{"ON", "ON", "ON"}) {
+		t.Errorf("commands = %v, want the scheduled OFF dropped", got)
+	}
+
+	for _, body := range []string{`{"arg": "80", "transition_ms": 100000000000}`, `{"arg": "ON", "delay_ms": 9223372036854775807}`} {
+		if rec := command("1", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+	if rec := command("2", `{"arg": "50", "transition_ms": 100}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("transition on a plain switch: status %d, want 400", rec.Code)
+	}
+	proxy.setDeviceState("1", "OFF")
+	if rec := command("1", `{"arg": "80", "transition_ms": 80}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("transition: status %d", rec.Code)
+	}
+	waitFor(t, time.Second, func() bool { return len(received()) == 7 })
+	if got := received()[3:]; !reflect.DeepEqual(got, []string{"20", "40", "60", "80"}) {
+		t.Errorf("transition levels = %v", got)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+)
+
+// schemaEnums lists the allowed values of string settings, by dotted path.
+var schemaEnums = map[string][]string{
+	"gateway.transport":             {"tcp", "serial", "websocket"},
+	"gateway.cover_conflict":        {conflictForward, conflictCancel, conflictStop, conflictReject},
+	"logging.level":                 {"debug", "info", "warn", "error"},
+	"home_assistant.curtain_domain": {"switch", "cover"},
+	"notifications.ntfy.priority":   {"min", "low", "default", "high", "urgent"},
+	"logging.sampling[].event":      logEvents,
+}
+
+// configSchema returns a JSON Schema describing config.yaml, derived from
+// the Config struct so it cannot drift from what the proxy accepts.
+func configSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(Config{}), "")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "konke-ha-proxy configuration"
+	return schema
+}
+
+// typeSchema returns the schema of a Go type decoded from YAML at path.
+func typeSchema(t reflect.Type, path string) map[string]interface{} {
+	if t == reflect.TypeOf(DeviceConfig{}) {
+		// Either the bare entity ID or the long form.
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{"type": "string"},
+				structSchema(t, path),
+			},
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), path)
+	case reflect.Struct:
+		return structSchema(t, path)
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem(), path+".*"),
+		}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem(), path+"[]"),
+		}
+	case reflect.String:
+		schema := map[string]interface{}{"type": "string"}
+		if enum, ok := schemaEnums[path]; ok {
+			schema["enum"] = enum
+		}
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema returns the schema of a struct, using its yaml tags as
+// property names.
+func structSchema(t reflect.Type, path string) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := yamlName(field)
+		if name == "" {
+			continue
+		}
+		properties[name] = typeSchema(field.Type, joinPath(path, name))
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// yamlName returns the YAML key of a struct field, or "" if it is not
+// decoded from YAML.
+func yamlName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if tag == "-" {
+		return ""
+	}
+	if tag == "" {
+		return strings.ToLower(field.Name)
+	}
+	return tag
+}
+
+// joinPath appends a key to a dotted settings path.
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRouter builds the HTTP API used by Home Assistant's REST platforms.
+func newRouter(proxy *Proxy) *gin.Engine {
+	router := newEngine()
+	router.Use(gzipResponses())
+	auth := newAuthenticator(proxy.config, &proxy.guests)
+
+	// Devices on the primary zk controller are addressed by node ID alone;
+	// the same endpoints are available per controller under /zk/:zkid.
+	registerDeviceRoutes(router, proxy, auth)
+	registerDeviceRoutes(router.Group("/zk/:zkid"), proxy, auth)
+
+	registerExtensionRoutes(router, proxy, auth)
+
+	view := auth.requireView(proxy)
+	router.GET("/devices", view, func(c *gin.Context) {
+		q, err := parseListQuery(c, deviceSortFields...)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		version := proxy.stateTag.load()
+		devices, total := filterDevices(viewOf(c).devices(proxy.listDevices()), q)
+		setTotal(c, total)
+		if notModified(c, proxy.devicesETag(version, listFormat(c), devices)) {
+			return
+		}
+		renderList(c, 200, devices)
+	})
+	router.GET("/history", view, func(c *gin.Context) {
+		q, err := parseListQuery(c, historySortFields...)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if q.Limit == 0 {
+			q.Limit = defaultListLimit
+		}
+		var since int64
+		if s := c.Query("since"); s != "" {
+			if since, err = strconv.ParseInt(s, 10, 64); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid since"})
+				return
+			}
+		}
+		all, _, _ := proxy.events.since(since)
+		events, total := filterHistory(viewOf(c).events(all), q, c.Query("entity_id"))
+		setTotal(c, total)
+		renderList(c, 200, events)
+	})
+	router.GET("/stats/usage", view, func(c *gin.Context) {
+		report, err := proxy.usageStats(c.DefaultQuery("period", "day"), proxy.localNow(), viewOf(c))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, report)
+	})
+	router.GET("/api/discovery", view, func(c *gin.Context) {
+		c.JSON(200, proxy.discover(requestBaseURL(c), viewOf(c)))
+	})
+	router.GET("/events", view, eventsHandler(proxy))
+	router.GET("/ws", wsHandler(proxy, auth))
+	router.GET("/poll", view, pollHandler(proxy))
+	router.GET("/states", view, func(c *gin.Context) {
+		c.JSON(200, proxy.statesSnapshot(viewOf(c)))
+	})
+	registerGraphQL(router, proxy, auth)
+	registerActions(router, proxy, auth)
+	router.POST("/hooks/:name", hookHandler(proxy))
+	// Macros span several devices, so guest tokens cannot run them.
+	router.POST("/macro/:name", auth.requireDevice(proxy), macroHandler(proxy))
+	router.GET("/version", func(c *gin.Context) {
+		c.JSON(200, currentBuild())
+	})
+	router.GET("/mode", view, func(c *gin.Context) {
+		c.JSON(200, proxy.visibleModes(proxy.modeStatus(), viewOf(c)))
+	})
+	router.POST("/mode", auth.require(scopeAdmin), func(c *gin.Context) {
+		var data struct {
+			Mode string `json:"mode"`
+		}
+		if err := c.ShouldBindJSON(&data); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		if err := proxy.setMode(data.Mode); errors.Is(err, errUnknownMode) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			log.Printf("Failed to store mode: %v", err)
+		}
+		c.JSON(200, proxy.modeStatus())
+	})
+	// POST /mode/:name switches the mode on, or off again if it is on.
+	router.POST("/mode/:name", auth.require(scopeAdmin), func(c *gin.Context) {
+		name := c.Param("name")
+		if proxy.modeStatus().Mode == name {
+			name = ""
+		}
+		if err := proxy.setMode(name); errors.Is(err, errUnknownMode) {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			log.Printf("Failed to store mode: %v", err)
+		}
+		c.JSON(200, proxy.modeStatus())
+	})
+	router.GET("/anomalies", view, func(c *gin.Context) {
+		view := viewOf(c)
+		anomalies := []rateAnomaly{}
+		for _, a := range proxy.rates.flagged() {
+			if view.allowsKey(a.Node) {
+				anomalies = append(anomalies, a)
+			}
+		}
+		c.JSON(200, anomalies)
+	})
+	// Samples of unhandled messages may come from any device.
+	router.GET("/debug/unhandled", auth.require(scopeAdmin), func(c *gin.Context) {
+		c.JSON(200, proxy.unhandled.list())
+	})
+
+	// Snapshots span several devices, so guest and tenant tokens cannot
+	// use them. The snapshot is not addressed as :id, which requireDevice
+	// would take for a node ID.
+	router.POST("/snapshot", auth.requireDevice(proxy), func(c *gin.Context) {
+		var data struct {
+			Devices []string `json:"devices"`
+			Tags    []string `json:"tags"`
+		}
+		if err := c.ShouldBindJSON(&data); err != nil && err != io.EOF {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		c.JSON(201, proxy.takeScene(data.Devices, data.Tags))
+	})
+	router.POST("/snapshot/:name/restore", auth.requireDevice(proxy), func(c *gin.Context) {
+		ctx := withSource(c.Request.Context(), requestSource(c, "snapshot"))
+		results, err := proxy.restoreScene(ctx, c.Param("name"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"id": c.Param("name"), "devices": results})
+	})
+
+	if !proxy.config.splitAdmin() {
+		registerAdminRoutes(router, proxy, auth)
+	}
+	return router
+}
+
+// newAdminRouter builds the router of the http_server.admin listener.
+func newAdminRouter(proxy *Proxy) *gin.Engine {
+	router := newEngine()
+	router.Use(gzipResponses())
+	registerAdminRoutes(router, proxy, newAuthenticator(proxy.config, &proxy.guests))
+	return router
+}
+
+// newEngine returns an engine like gin.Default, whose access log leaves
+// out the token a WebSocket client may send as ?access_token=.
+func newEngine() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.LoggerWithFormatter(accessLogLine), gin.Recovery())
+	return router
+}
+
+// accessLogLine formats a request like gin's default logger, with the
+// access_token query parameter and the token of an action URL masked.
+func accessLogLine(param gin.LogFormatterParams) string {
+	if rest, ok := strings.CutPrefix(param.Path, "/action/"); ok {
+		_, query, _ := strings.Cut(rest, "?")
+		param.Path = "/action/***"
+		if query != "" {
+			param.Path += "?" + query
+		}
+	}
+	if path, query, ok := strings.Cut(param.Path, "?"); ok {
+		if values, err := url.ParseQuery(query); err == nil && values.Has("access_token") {
+			values.Set("access_token", "***")
+			param.Path = path + "?" + values.Encode()
+		}
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		param.Path,
+		param.ErrorMessage,
+	)
+}
+
+// registerAdminRoutes adds the operational endpoints: health, metrics,
+// diagnostics and logs, and the administration of the proxy and the
+// gateway. They move to a listener of their own with http_server.admin.
+func registerAdminRoutes(routes gin.IRouter, proxy *Proxy, auth *authenticator) {
+	routes.GET("/diagnostics", auth.require(scopeAdmin), diagnosticsHandler(proxy))
+	routes.GET("/healthz", healthzHandler(proxy))
+	routes.GET("/logs", auth.require(scopeAdmin), logsHandler(recentLogs))
+	routes.GET("/metrics", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(c.Writer)
+		proxy.writeMetrics(c.Writer)
+	})
+	routes.GET("/debug/tap", auth.require(scopeAdmin), tapHandler(proxy))
+	routes.POST("/debug/tap", auth.require(scopeAdmin), func(c *gin.Context) {
+		var data struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := c.BindJSON(&data); err != nil || data.Enabled == nil {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		proxy.tap.setEnabled(*data.Enabled)
+		if *data.Enabled {
+			log.Println("Debug tap enabled")
+		} else {
+			log.Println("Debug tap disabled")
+		}
+		c.JSON(200, gin.H{"enabled": *data.Enabled})
+	})
+
+	routes.GET("/archive", auth.require(scopeAdmin), func(c *gin.Context) {
+		if proxy.archive == nil {
+			c.JSON(404, gin.H{"error": "Message archive is disabled"})
+			return
+		}
+		q := archiveQuery{
+			Opcode:    c.Query("opcode"),
+			NodeID:    c.Query("node"),
+			ZKID:      c.Query("zkid"),
+			Direction: c.Query("direction"),
+			State:     c.Query("state"),
+		}
+		// The archive only has node IDs, so the device filters pick the
+		// nodes of the matching devices.
+		if filter := (listQuery{Type: c.Query("type"), Q: strings.ToLower(c.Query("q"))}); filter.Type != "" || filter.Q != "" {
+			q.Nodes = proxy.archiveNodes(filter)
+		}
+		var err error
+		if s := c.Query("since"); s != "" {
+			if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid since"})
+				return
+			}
+		}
+		if s := c.Query("until"); s != "" {
+			if q.Until, err = time.Parse(time.RFC3339, s); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid until"})
+				return
+			}
+		}
+		if s := c.Query("limit"); s != "" {
+			if q.Limit, err = strconv.Atoi(s); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid limit"})
+				return
+			}
+		}
+		if s := c.Query("offset"); s != "" {
+			if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+				c.JSON(400, gin.H{"error": "Invalid offset"})
+				return
+			}
+		}
+		switch c.Query("sort") {
+		case "", "-time", "-id":
+		case "time", "id":
+			q.Ascending = true
+		default:
+			c.JSON(400, gin.H{"error": "Invalid sort; use time or -time"})
+			return
+		}
+
+		records, total, err := proxy.archive.query(q)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		setTotal(c, total)
+		renderList(c, 200, records)
+	})
+
+	routes.GET("/backup", auth.require(scopeAdmin), func(c *gin.Context) {
+		name := fmt.Sprintf("konke-ha-proxy-%s.tar.gz", time.Now().Format("20060102-150405"))
+		c.Header("Content-Type", "application/gzip")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		if err := proxy.writeBackup(c.Writer); err != nil {
+			log.Printf("Failed to write backup: %v", err)
+			c.AbortWithStatus(500)
+		}
+	})
+	routes.POST("/restore", auth.require(scopeAdmin), func(c *gin.Context) {
+		errs, err := proxy.restoreBackup(c.Request.Body)
+		if errors.Is(err, errInvalidBackup) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if len(errs) > 0 {
+			c.JSON(400, gin.H{"error": "Invalid configuration", "errors": errs})
+			return
+		}
+		changes := []string{}
+		if restored, err := loadConfig(proxy.configPath, proxy.config.Profile); err == nil && proxy.configPath != "" {
+			changes = diffConfig(proxy.config, restored)
+		}
+		for _, change := range changes {
+			log.Printf("Restored configuration: %s", change)
+		}
+		c.JSON(200, gin.H{"status": "restored", "restart_required": true, "changes": changes})
+	})
+
+	tokens := routes.Group("/admin/tokens", auth.require(scopeAdmin))
+	tokens.GET("", func(c *gin.Context) {
+		c.JSON(200, proxy.guests.list())
+	})
+	tokens.POST("", func(c *gin.Context) {
+		var data struct {
+			Name    string   `json:"name"`
+			Devices []string `json:"devices"`
+			TTL     int      `json:"ttl"` // seconds
+		}
+		if err := c.ShouldBindJSON(&data); err != nil || data.Name == "" || len(data.Devices) == 0 || data.TTL <= 0 {
+			c.JSON(400, gin.H{"error": "name, devices and ttl are required"})
+			return
+		}
+		ttl := time.Duration(data.TTL) * time.Second
+		if ttl > maxGuestTTL {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("ttl is limited to %d seconds", int(maxGuestTTL.Seconds()))})
+			return
+		}
+		for _, key := range data.Devices {
+			parsed := parseNodeKey(key)
+			if ref, ok := proxy.resolveNode(parsed.ZKID, parsed.NodeID); !ok || !proxy.isMapped(ref) {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("unknown device %q", key)})
+				return
+			}
+		}
+
+		token, secret, err := proxy.guests.mint(data.Name, data.Devices, ttl)
+		if errors.Is(err, errGuestExists) {
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Guest token %q for %v minted by %s, valid until %s", token.Name, token.Devices, c.GetString(identityKey), token.Expires)
+		c.JSON(201, gin.H{"name": token.Name, "token": secret, "devices": token.Devices, "expires": token.Expires})
+	})
+	tokens.DELETE("/:name", func(c *gin.Context) {
+		if err := proxy.guests.revoke(c.Param("name")); errors.Is(err, errGuestUnknown) {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(204)
+	})
+
+	subsystems := routes.Group("/admin/subsystems", auth.require(scopeAdmin))
+	subsystems.GET("", func(c *gin.Context) {
+		c.JSON(200, proxy.subsystems.status())
+	})
+	subsystems.POST("/:name", func(c *gin.Context) {
+		var data struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := c.ShouldBindJSON(&data); err != nil || data.Enabled == nil {
+			c.JSON(400, gin.H{"error": "enabled is required"})
+			return
+		}
+		name := c.Param("name")
+		var err error
+		disabled := []string{}
+		if *data.Enabled {
+			err = proxy.subsystems.enable(name)
+		} else {
+			disabled, err = proxy.subsystems.disable(name)
+		}
+		switch {
+		case errors.Is(err, errUnknownSubsystem):
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, errDependencyOff):
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.JSON(503, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Subsystem %s set to enabled=%t by %s", name, *data.Enabled, c.GetString(identityKey))
+		c.JSON(200, gin.H{"disabled": disabled, "subsystems": proxy.subsystems.status()})
+	})
+
+	admin := routes.Group("/gateway", auth.require(scopeAdmin))
+	admin.POST("/sync-time", requireReady(proxy), func(c *gin.Context) {
+		now, err := proxy.syncTime()
+		if err != nil {
+			c.JSON(503, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"time": now.Format(time.RFC3339)})
+	})
+	admin.GET("/firmware", func(c *gin.Context) {
+		zkid := c.Query("zkid")
+		reply, err := proxy.queryFirmware(c.Request.Context(), zkid)
+		if err != nil {
+			gatewayError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"zkid": zkidOrPrimary(proxy, zkid), "firmware": reply.Arg, "status": reply.Status})
+	})
+	admin.POST("/upgrade", requireReady(proxy), func(c *gin.Context) {
+		var data struct {
+			ZKID string      `json:"zkid"`
+			Arg  interface{} `json:"arg"`
+		}
+		if err := c.ShouldBindJSON(&data); err != nil && err != io.EOF {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		reply, err := proxy.triggerUpgrade(c.Request.Context(), data.ZKID, data.Arg)
+		if err != nil {
+			gatewayError(c, err)
+			return
+		}
+		status := 200
+		if reply.Status != "" && reply.Status != "success" {
+			status = 502
+		}
+		c.JSON(status, gin.H{"zkid": zkidOrPrimary(proxy, data.ZKID), "status": reply.Status, "result": reply.Arg})
+	})
+	admin.POST("/reboot", requireReady(proxy), func(c *gin.Context) {
+		var data struct {
+			ZKID string `json:"zkid"`
+		}
+		if err := c.ShouldBindJSON(&data); err != nil && err != io.EOF {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		if err := proxy.reboot(c.Request.Context(), data.ZKID); err != nil {
+			gatewayError(c, err)
+			return
+		}
+		c.JSON(202, gin.H{"zkid": zkidOrPrimary(proxy, data.ZKID), "status": "rebooting"})
+	})
+}
+
+func registerDeviceRoutes(routes gin.IRoutes, proxy *Proxy, auth *authenticator) {
+	device := auth.requireDevice(proxy)
+
+	// Switch endpoints
+	routes.POST("/switch/:id", device, commandHandler(proxy, "is_active", "ON"))
+	routes.GET("/switch/:id", device, stateHandler(proxy, "is_active", "ON"))
+
+	// Curtain endpoints
+	routes.POST("/curtain/:id", device, commandHandler(proxy, "is_open", "OPEN"))
+	routes.GET("/curtain/:id", device, stateHandler(proxy, "is_open", "OPEN"))
+	routes.POST("/curtain/:id/calibrate", auth.require(scopeAdmin), func(c *gin.Context) {
+		ref, ok := nodeParam(c, proxy)
+		if !ok {
+			return
+		}
+		result, err := proxy.calibrate(c.Request.Context(), ref)
+		if err != nil {
+			gatewayError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"open_time": result.Open, "close_time": result.Close})
+	})
+}
+
+// gatewayError answers a request whose gateway round trip failed.
+func gatewayError(c *gin.Context, err error) {
+	var notReady *notReadyError
+	var limit *actuationLimitError
+	switch {
+	case errors.As(err, &notReady):
+		c.Header("Retry-After", strconv.Itoa(notReady.retryAfter))
+		c.JSON(503, gin.H{"error": err.Error(), "retry_after": notReady.retryAfter})
+		return
+	case errors.As(err, &limit):
+		c.Header("Retry-After", strconv.Itoa(limit.retryAfter))
+	}
+	c.JSON(gatewayStatus(err), gin.H{"error": err.Error()})
+}
+
+// gatewayStatus returns the HTTP status for an error sending a command or
+// request to the gateway.
+func gatewayStatus(err error) int {
+	var notReady *notReadyError
+	switch {
+	case errors.As(err, &notReady):
+		return 503
+	case errors.Is(err, errUnknownZKID), errors.Is(err, errNotCurtain), errors.Is(err, errUnknownNode):
+		return 404
+	case errors.Is(err, errRequestTimeout):
+		return 504
+	case errors.Is(err, errStateMismatch):
+		return 502
+	case errors.Is(err, errArgNotAllowed):
+		return 400
+	case errors.Is(err, errCommandConflict), errors.Is(err, errCommandSuperseded), errors.Is(err, errInterlock), errors.Is(err, errSyncLoop):
+		return 409
+	case errors.Is(err, errModeBlocked):
+		return 423
+	case errors.Is(err, errActuationLimit):
+		return 429
+	}
+	return 503
+}
+
+// nodeParam resolves the node addressed by the request path.
+func nodeParam(c *gin.Context, proxy *Proxy) (nodeRef, bool) {
+	ref, ok := proxy.resolveNode(c.Param("zkid"), c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "Unknown zkid"})
+	}
+	return ref, ok
+}
+
+// commandHandler forwards {"arg": ...} to the gateway as a SWITCH command
+// and answers with field set to whether arg equals activeArg. With
+// delay_ms or transition_ms the command is scheduled and answered with 202.
+// Unknown nodes are refused unless the request has ?force=1.
+func commandHandler(proxy *Proxy, field, activeArg string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ref, ok := nodeParam(c, proxy)
+		if !ok {
+			return
+		}
+		if err := proxy.checkNode(ref, c.Query("force") == "1"); err != nil {
+			gatewayError(c, err)
+			return
+		}
+		var data struct {
+			Arg          string `json:"arg"`
+			DelayMS      int64  `json:"delay_ms"`
+			TransitionMS int64  `json:"transition_ms"`
+		}
+		if err := c.BindJSON(&data); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		ctx := withSource(c.Request.Context(), requestSource(c, "rest"))
+		if data.DelayMS != 0 || data.TransitionMS != 0 {
+			// Checked before the conversion to a duration, which overflows.
+			if data.DelayMS > maxScheduleMS || data.TransitionMS > maxScheduleMS {
+				c.JSON(400, gin.H{"error": errLongDelay.Error()})
+				return
+			}
+			at, err := proxy.scheduleSwitch(ctx, ref, data.Arg, time.Duration(data.DelayMS)*time.Millisecond, time.Duration(data.TransitionMS)*time.Millisecond)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(202, gin.H{field: data.Arg == activeArg, "scheduled": true, "at": at})
+			return
+		}
+		// A command sent now replaces one that was scheduled.
+		proxy.scheduled.cancel(ref.key())
+		var trace *commandTrace
+		if c.Query("trace") == "1" {
+			var entityID string
+			if dev, ok := proxy.lookupDevice(ref.key()); ok && dev.EntityID != "" {
+				entityID = proxy.haEntityID(&dev)
+			}
+			trace = proxy.traces.start(entityID)
+			defer proxy.traces.finish(trace)
+			ctx = withTrace(ctx, trace)
+		}
+		if err := proxy.sendSwitch(ctx, ref, data.Arg); err != nil {
+			gatewayError(c, err)
+			return
+		}
+		if trace != nil {
+			c.JSON(200, gin.H{field: data.Arg == activeArg, "trace": trace.timing(c.Request.Context())})
+			return
+		}
+		c.JSON(200, gin.H{field: data.Arg == activeArg})
+	}
+}
+
+// stateHandler answers with field set to whether the node's last known
+// state equals activeArg or is mapped to on or open in a state_map.
+func stateHandler(proxy *Proxy, field, activeArg string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ref, ok := nodeParam(c, proxy)
+		if !ok {
+			return
+		}
+		version := proxy.stateTag.load()
+		state := proxy.deviceState(ref.key())
+		fresh := proxy.freshness(ref.key(), time.Now())
+		// Repeated reports of the same state change the ETag with
+		// last_updated, and so does a state turning stale. age_seconds
+		// only tells last_updated from now and is left out.
+		stale, updated := 0, 0
+		if fresh.Stale {
+			stale = 1
+		}
+		if fresh.LastUpdated != nil {
+			updated = int(fresh.LastUpdated.UnixNano())
+		}
+		if notModified(c, proxy.stateTag.etag(version, stale, updated)) {
+			return
+		}
+		if fresh.LastUpdated != nil {
+			c.Header("Last-Modified", fresh.LastUpdated.UTC().Format(http.TimeFormat))
+		}
+		active := state == activeArg
+		// Unusual arguments count as active if they map to on or open.
+		if dev, ok := proxy.lookupDevice(ref.key()); ok {
+			if mapped, ok := proxy.mappedState(&dev, state); ok {
+				active = mapped == "on" || mapped == "open"
+			}
+		}
+		c.JSON(200, gin.H{field: active, "last_updated": fresh.LastUpdated, "age_seconds": fresh.AgeSeconds, "stale": fresh.Stale})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// processesNumbers reports whether numeric attributes of the device are
+// rounded or smoothed before they are sent to Home Assistant.
+func (d DeviceConfig) processesNumbers() bool {
+	return d.Precision != nil || d.Smoothing > 1
+}
+
+// sensorSamples keeps the recent values of the numeric attributes of
+// smoothed devices.
+type sensorSamples struct {
+	mutex   sync.Mutex
+	samples map[string]map[string][]float64 // by node key and attribute
+}
+
+// observe records the numeric attributes of a report and reports whether
+// their moving averages over window samples changed.
+func (s *sensorSamples) observe(key string, window int, extra map[string]interface{}) bool {
+	if window <= 1 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.samples == nil {
+		s.samples = make(map[string]map[string][]float64)
+	}
+	node := s.samples[key]
+	if node == nil {
+		node = make(map[string][]float64)
+		s.samples[key] = node
+	}
+
+	changed := false
+	for name, v := range extra {
+		x, ok := v.(float64)
+		if !ok {
+			continue
+		}
+		values := node[name]
+		before := mean(values)
+		values = append(values, x)
+		if len(values) > window {
+			values = values[len(values)-window:]
+		}
+		node[name] = values
+		if len(values) == 1 || mean(values) != before {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// value returns the attribute as sent to Home Assistant: the moving
+// average of its recent values if the device is smoothed, rounded to the
+// device's precision.
+func (s *sensorSamples) value(key, name string, raw float64, config DeviceConfig) float64 {
+	v := raw
+	if config.Smoothing > 1 {
+		s.mutex.Lock()
+		if values := s.samples[key][name]; len(values) > 0 {
+			v = mean(values)
+		}
+		s.mutex.Unlock()
+	}
+	if config.Precision != nil {
+		scale := math.Pow(10, float64(*config.Precision))
+		v = math.Round(v*scale) / scale
+	}
+	return v
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestNumericSmoothing(t *testing.T) {
+	precision := 1
+	var config Config
+	config.HomeAssistant.Port = 1 // nothing listens there
+	config.Devices.Lights = map[string]DeviceConfig{
+		"1": {Entity: "meter", Precision: &precision, Smoothing: 3},
+		"2": {Entity: "plain"},
+	}
+	proxy := NewProxy(&config)
+
+	var sent []map[string]interface{}
+	proxy.bus.subscribe("+/switch.meter", func(ev busEvent) { sent = append(sent, ev.Attributes) })
+	report := func(node string, power float64) {
+		proxy.handleMessage(&Message{NodeID: node, Opcode: "SWITCH", Arg: map[string]interface{}{"state": "ON", "power": power, "mode": "eco"}})
+	}
+
+	// The moving average of the last three reports, rounded.
+	for _, power := range []float64{10.04, 11.0, 12.0, 13.5} {
+		report("1", power)
+	}
+	want := []float64{10, 10.5, 11, 12.2}
+	if len(sent) != len(want) {
+		t.Fatalf("sent %d updates, want %d: %v", len(sent), len(want), sent)
+	}
+	for i, w := range want {
+		if got := sent[i]["power"]; got != w {
+			t.Errorf("update %d: power = %v, want %v", i, got, w)
+		}
+		if sent[i]["mode"] != "eco" {
+			t.Errorf("update %d: non-numeric attribute changed to %v", i, sent[i]["mode"])
+		}
+	}
+
+	// The API keeps the raw value.
+	if got := proxy.extraAttributes("1")["power"]; got != 13.5 {
+		t.Errorf("raw power = %v, want 13.5", got)
+	}
+
+	// Devices without the options are sent as reported.
+	report("2", 10.04)
+	dev, _ := proxy.lookupDevice("2")
+	if got := proxy.haAttributes(&dev)["power"]; got != 10.04 {
+		t.Errorf("unprocessed power = %v, want 10.04", got)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "time"
+
+// defaultStaleAfter is how old the last report of a device may be before
+// GET /switch/:id and GET /curtain/:id call its state stale by default.
+const defaultStaleAfter = time.Hour
+
+// staleAfter returns the age from which a reported state counts as stale.
+func (c *Config) staleAfter() time.Duration {
+	if c.HTTPServer.StaleAfter > 0 {
+		return time.Duration(c.HTTPServer.StaleAfter) * time.Second
+	}
+	return defaultStaleAfter
+}
+
+// stateFreshness tells clients of the device endpoints how old a state is.
+type stateFreshness struct {
+	// LastUpdated is when the gateway last reported the state, or a
+	// command set it; missing while the state is not known or was only
+	// seeded from Home Assistant.
+	LastUpdated *time.Time `json:"last_updated"`
+	AgeSeconds  *int64     `json:"age_seconds"`
+	Stale       bool       `json:"stale"`
+}
+
+// freshness returns the freshness of the state of the node key at now.
+func (p *Proxy) freshness(key string, now time.Time) stateFreshness {
+	p.stateMu.RLock()
+	updated, ok := p.updated[key]
+	p.stateMu.RUnlock()
+	if !ok {
+		return stateFreshness{Stale: true}
+	}
+	age := int64(now.Sub(updated) / time.Second)
+	return stateFreshness{
+		LastUpdated: &updated,
+		AgeSeconds:  &age,
+		Stale:       now.Sub(updated) >= p.config.staleAfter(),
+	}
+}
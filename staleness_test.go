@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStateFreshness(t *testing.T) {
+	proxy := eventProxy()
+	proxy.config.HTTPServer.StaleAfter = 60
+	router := newRouter(proxy)
+	get := func(path string) (map[string]interface{}, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("GET %s: %v: %s", path, err, rec.Body)
+		}
+		return body, rec.Header().Get("ETag")
+	}
+
+	// A device that never reported has no age and is stale.
+	if body, _ := get("/curtain/2"); body["last_updated"] != nil || body["age_seconds"] != nil || body["stale"] != true {
+		t.Errorf("unreported curtain = %v", body)
+	}
+
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+	body, fresh := get("/switch/1")
+	if body["last_updated"] == nil || body["age_seconds"] != 0.0 || body["stale"] != false {
+		t.Errorf("fresh switch = %v", body)
+	}
+
+	// Turning stale changes the ETag.
+	proxy.stateMu.Lock()
+	proxy.updated["1"] = proxy.updated["1"].Add(-2 * time.Minute)
+	proxy.stateMu.Unlock()
+	body, stale := get("/switch/1")
+	if age, _ := body["age_seconds"].(float64); age < 120 || body["stale"] != true || body["is_active"] != true {
+		t.Errorf("old switch = %v, want active and stale", body)
+	}
+	if stale == fresh {
+		t.Error("the ETag did not change when the state turned stale")
+	}
+
+	// The age of a state restored after a restart counts from the report.
+	restarted := eventProxy()
+	restarted.config.HTTPServer.StaleAfter = 60
+	restarted.restoreSnapshot(proxy.snapshot())
+	if got := restarted.freshness("1", time.Now()); got.AgeSeconds == nil || *got.AgeSeconds < 120 || !got.Stale {
+		t.Errorf("restored freshness = %+v", got)
+	}
+}
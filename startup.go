@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Strategies for the queries at the start of a gateway session, set by
+// gateway.startup_query.strategy.
+const (
+	// queryRange queries nodes 1 to device_count on every zk controller.
+	queryRange = "range"
+	// queryMapped queries the nodes mapped in devices:.
+	queryMapped = "mapped"
+	// querySync waits for the SYNC_INFO inventory and queries the nodes it
+	// reported along with the mapped ones.
+	querySync = "sync"
+)
+
+// StartupQueryConfig sets which nodes are queried for their state when a
+// gateway session starts, and how fast.
+type StartupQueryConfig struct {
+	Strategy string `yaml:"strategy"`
+	// Concurrency is how many queries are sent back to back before
+	// pausing for Delay milliseconds; 0 sends them all at once.
+	Concurrency int `yaml:"concurrency"`
+	Delay       int `yaml:"delay"`
+}
+
+// strategy returns the configured strategy, range by default.
+func (q StartupQueryConfig) strategy() string {
+	if q.Strategy == "" {
+		return queryRange
+	}
+	return q.Strategy
+}
+
+// validateStartupQuery checks the startup query settings.
+func (c *Config) validateStartupQuery(add func(message string, path ...string)) {
+	q := c.Gateway.StartupQuery
+	switch q.strategy() {
+	case queryRange, queryMapped, querySync:
+	default:
+		add(fmt.Sprintf("unknown strategy %q; use range, mapped or sync", q.Strategy), "gateway", "startup_query", "strategy")
+	}
+	if q.Concurrency < 0 {
+		add("concurrency must not be negative", "gateway", "startup_query", "concurrency")
+	}
+	if q.Delay < 0 {
+		add("delay must not be negative", "gateway", "startup_query", "delay")
+	}
+}
+
+// startupNodes returns the nodes to query at the start of a session, by
+// zkid and node ID.
+func (p *Proxy) startupNodes() []nodeRef {
+	var refs []nodeRef
+	if p.config.Gateway.StartupQuery.strategy() == queryRange {
+		for _, zkid := range p.config.zkids() {
+			for i := 1; i <= p.config.Gateway.DeviceCount; i++ {
+				if ref, _ := p.resolveNode(zkid, strconv.Itoa(i)); !p.ignoreNodes[ref.key()] {
+					refs = append(refs, ref)
+				}
+			}
+		}
+		return refs
+	}
+
+	mappedOnly := p.config.Gateway.StartupQuery.strategy() == queryMapped
+	p.stateMu.RLock()
+	for _, dev := range p.inventory {
+		if (dev.EntityID != "" || !mappedOnly) && !p.ignoreNodes[dev.Ref.key()] {
+			refs = append(refs, dev.Ref)
+		}
+	}
+	p.stateMu.RUnlock()
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].ZKID != refs[j].ZKID {
+			return refs[i].ZKID < refs[j].ZKID
+		}
+		return lessNodeID(refs[i].NodeID, refs[j].NodeID)
+	})
+	return refs
+}
+
+// queryStartup queries the state of the nodes chosen by the startup query
+// strategy, pacing the queries as configured, until ctx is cancelled.
+func (p *Proxy) queryStartup(ctx context.Context) {
+	q := p.config.Gateway.StartupQuery
+	if q.strategy() == querySync {
+		select {
+		case <-p.readiness.syncWait():
+		case <-ctx.Done():
+			return
+		}
+	}
+	for i, ref := range p.startupNodes() {
+		if i > 0 && q.Concurrency > 0 && i%q.Concurrency == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(q.Delay) * time.Millisecond):
+			}
+		}
+		p.queryNode(ref)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+func TestStartupNodes(t *testing.T) {
+	var config Config
+	config.Gateway.ZKIDs = []string{"266590", "266591"}
+	config.Gateway.DeviceCount = 2
+	config.Gateway.IgnoreNodes = []string{"266591/2", "40"}
+	config.Devices.Lights = map[string]DeviceConfig{"10": {Entity: "hall"}, "266591/3": {Entity: "porch"}}
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "study"}}
+	proxy := NewProxy(&config)
+	proxy.handleMessage(&Message{NodeID: "*", Opcode: "SYNC_INFO", Arg: []interface{}{
+		map[string]interface{}{"nodeid": "150", "name": "Attic"},
+		map[string]interface{}{"nodeid": "40", "name": "Neighbour repeater"},
+	}})
+
+	for _, tc := range []struct {
+		strategy string
+		want     string
+	}{
+		{"", "[1 2 266591/1]"},
+		{queryMapped, "[2 10 266591/3]"},
+		{querySync, "[2 10 150 266591/3]"},
+	} {
+		config.Gateway.StartupQuery.Strategy = tc.strategy
+		var keys []string
+		for _, ref := range proxy.startupNodes() {
+			keys = append(keys, ref.key())
+		}
+		if got := fmt.Sprint(keys); got != tc.want {
+			t.Errorf("strategy %q queries %s, want %s", tc.strategy, got, tc.want)
+		}
+	}
+
+	config.Gateway.StartupQuery = StartupQueryConfig{Strategy: "all", Concurrency: -1}
+	if errs := config.validate(); len(errs) == 0 {
+		t.Error("unknown strategy and negative concurrency accepted")
+	}
+}
+
+func TestStartupQueryPacing(t *testing.T) {
+	gw := fakegw.New(3)
+	t.Cleanup(func() { gw.Close() })
+	gw.Report("2", "ON")
+	gw.Report("3", "ON")
+
+	// Only the mapped nodes are queried, one at a time.
+	var config Config
+	config.Gateway.StartupQuery = StartupQueryConfig{Strategy: queryMapped, Concurrency: 1, Delay: 200}
+	config.Devices.Lights = map[string]DeviceConfig{"2": {Entity: "two"}, "3": {Entity: "three"}}
+	config.DataDir = t.TempDir()
+	proxy := NewProxyWithTransport(&config, newPipeTransport(gw))
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("start proxy: %v", err)
+	}
+	t.Cleanup(proxy.Stop)
+
+	waitFor(t, time.Second, func() bool { return proxy.deviceState("2") == "ON" })
+	if got := proxy.deviceState("3"); got != "" {
+		t.Errorf("node 3 was queried along with node 2 (state %q)", got)
+	}
+	waitFor(t, time.Second, func() bool { return proxy.deviceState("3") == "ON" })
+	if got := proxy.deviceState("1"); got != "" {
+		t.Errorf("unmapped node 1 was queried (state %q)", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// supervisorService is the discovery service the proxy registers as; the
+// Home Assistant integration listens for it.
+const supervisorService = "konke_ha_proxy"
+
+// supervisorURL is the Supervisor API as seen from an add-on; tests
+// replace it.
+var supervisorURL = "http://supervisor"
+
+// supervisorRetry is how long to wait before retrying a failed
+// registration; the Supervisor may still be starting.
+var supervisorRetry = 30 * time.Second
+
+// supervisorAttempts bounds the registration attempts.
+const supervisorAttempts = 10
+
+// discoveryToken returns the API token offered to the integration: the
+// first one with the devices scope and no tenant, or "" when the API is
+// open. It reports false when tokens are configured but none of them may be
+// handed out; admin and tenant tokens never are.
+func (c *Config) discoveryToken() (string, bool) {
+	if len(c.Auth.Tokens) == 0 {
+		return "", true
+	}
+	for _, t := range c.Auth.Tokens {
+		if t.hasScope(scopeDevices) && t.Tenant == "" {
+			return t.Token, true
+		}
+	}
+	return "", false
+}
+
+// supervisorDiscovery is the configuration Home Assistant offers to the
+// integration.
+func supervisorDiscovery(host string, port int, token string) map[string]interface{} {
+	return map[string]interface{}{
+		"service": supervisorService,
+		"config": map[string]interface{}{
+			"host":    host,
+			"port":    port,
+			"token":   token,
+			"version": version,
+			"api":     discoverySchema,
+		},
+	}
+}
+
+// registerWithSupervisor announces the proxy through the Supervisor
+// discovery API when it runs as a Home Assistant add-on, so the
+// integration is offered in Home Assistant with the proxy's address and
+// token filled in. Like the mDNS advertisement it is not withdrawn on
+// exit; the Supervisor drops it when the add-on stops.
+func registerWithSupervisor(ctx context.Context, config *Config, port int) {
+	token := os.Getenv("SUPERVISOR_TOKEN")
+	if token == "" {
+		return
+	}
+	apiToken, ok := config.discoveryToken()
+	if !ok {
+		log.Printf("Supervisor discovery disabled: no token with the %s scope and no tenant", scopeDevices)
+		return
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		log.Printf("Supervisor discovery disabled: %v", err)
+		return
+	}
+	body, _ := json.Marshal(supervisorDiscovery(host, port, apiToken))
+
+	for attempt := 1; ; attempt++ {
+		uuid, err := postSupervisorDiscovery(ctx, token, body)
+		if err == nil {
+			log.Printf("Registered with the Supervisor for discovery (%s)", uuid)
+			return
+		}
+		if attempt == supervisorAttempts {
+			log.Printf("Giving up registering with the Supervisor: %v", err)
+			return
+		}
+		log.Printf("Failed to register with the Supervisor, retrying: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(supervisorRetry):
+		}
+	}
+}
+
+// postSupervisorDiscovery posts a discovery message and returns its UUID.
+func postSupervisorDiscovery(ctx context.Context, token string, body []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", supervisorURL+"/discovery", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Result  string `json:"result"`
+		Message string `json:"message"`
+		Data    struct {
+			UUID string `json:"uuid"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || reply.Result != "ok" {
+		return "", fmt.Errorf("status %d: %s", resp.StatusCode, reply.Message)
+	}
+	return reply.Data.UUID, nil
+}
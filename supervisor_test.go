@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegisterWithSupervisor(t *testing.T) {
+	var calls atomic.Int32
+	var got map[string]interface{}
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/discovery" {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(502)
+			json.NewEncoder(w).Encode(map[string]string{"result": "error", "message": "starting"})
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": "ok", "data": map[string]string{"uuid": "abc"}})
+	}))
+	defer server.Close()
+	defer func(url string, retry time.Duration) { supervisorURL, supervisorRetry = url, retry }(supervisorURL, supervisorRetry)
+	supervisorURL, supervisorRetry = server.URL, time.Millisecond
+	t.Setenv("SUPERVISOR_TOKEN", "sv-token")
+
+	var config Config
+	config.Auth.Tokens = []authToken{
+		{Name: "admin", Token: "admin-secret", Scopes: []string{scopeAdmin}},
+		{Name: "ha", Token: "ha-secret", Scopes: []string{scopeDevices}},
+	}
+	registerWithSupervisor(context.Background(), &config, 8500)
+
+	if calls.Load() != 2 {
+		t.Fatalf("got %d calls, want a retry after the failure", calls.Load())
+	}
+	if auth != "Bearer sv-token" || got["service"] != supervisorService {
+		t.Errorf("registered %v with %q", got, auth)
+	}
+	cfg, _ := got["config"].(map[string]interface{})
+	if cfg["port"] != 8500.0 || cfg["token"] != "ha-secret" || cfg["host"] == "" {
+		t.Errorf("discovery config = %v, want port 8500 and the devices token", cfg)
+	}
+}
+
+func TestRegisterWithSupervisorOutsideAddon(t *testing.T) {
+	defer func(url string) { supervisorURL = url }(supervisorURL)
+	supervisorURL = "http://127.0.0.1:1"
+	t.Setenv("SUPERVISOR_TOKEN", "")
+	// Returns at once without contacting anything.
+	registerWithSupervisor(context.Background(), &Config{}, 8500)
+}
+
+func TestRegisterWithSupervisorWithoutDevicesToken(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": "ok", "data": map[string]string{"uuid": "abc"}})
+	}))
+	defer server.Close()
+	defer func(url string) { supervisorURL = url }(supervisorURL)
+	supervisorURL = server.URL
+	t.Setenv("SUPERVISOR_TOKEN", "sv-token")
+
+	// Neither an admin token nor a tenant's token is handed out.
+	var config Config
+	config.Auth.Tokens = []authToken{
+		{Name: "admin", Token: "admin-secret", Scopes: []string{scopeAdmin}},
+		{Name: "flat", Token: "flat-secret", Scopes: []string{scopeDevices}, Tenant: "flat"},
+	}
+	registerWithSupervisor(context.Background(), &config, 8500)
+
+	if calls.Load() != 0 {
+		t.Errorf("got %d discovery calls, want none", calls.Load())
+	}
+}
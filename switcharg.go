@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// switchStateKeys are the fields holding the state in structured SWITCH
+// arguments, in order of preference.
+var switchStateKeys = []string{"state", "status", "switch", "value"}
+
+// switchArg extracts the state from a SWITCH argument. Most firmwares send
+// a string such as "ON"; others send numbers, booleans or objects like
+// {"state": "ON", "level": 80}, whose remaining fields are returned as
+// extra attributes. Numbers become their decimal string, so that codes
+// can be mapped with state_map.
+func switchArg(arg interface{}) (state string, extra map[string]interface{}, ok bool) {
+	switch v := arg.(type) {
+	case string:
+		return v, nil, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil, true
+	case bool:
+		if v {
+			return "ON", nil, true
+		}
+		return "OFF", nil, true
+	case map[string]interface{}:
+		for _, key := range switchStateKeys {
+			raw, found := v[key]
+			if !found {
+				continue
+			}
+			if state, _, ok = switchArg(raw); !ok {
+				continue
+			}
+			for k, x := range v {
+				if k == key {
+					continue
+				}
+				if extra == nil {
+					extra = make(map[string]interface{})
+				}
+				extra[strings.ToLower(k)] = x
+			}
+			return state, extra, true
+		}
+	}
+	return "", nil, false
+}
+
+// setExtraAttributes records the extra fields last reported for a node
+// and reports whether they changed.
+func (p *Proxy) setExtraAttributes(key string, extra map[string]interface{}) bool {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	if reflect.DeepEqual(p.extra[key], extra) {
+		return false
+	}
+	if extra == nil {
+		delete(p.extra, key)
+	} else {
+		p.extra[key] = extra
+	}
+	p.stateTag.bump()
+	return true
+}
+
+// extraAttributes returns the extra fields last reported for a node.
+func (p *Proxy) extraAttributes(key string) map[string]interface{} {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	return p.extra[key]
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSwitchArg(t *testing.T) {
+	for _, tc := range []struct {
+		arg   string // JSON
+		state string
+		extra map[string]interface{}
+		ok    bool
+	}{
+		{`"ON"`, "ON", nil, true},
+		{`1`, "1", nil, true},
+		{`2.5`, "2.5", nil, true},
+		{`true`, "ON", nil, true},
+		{`{"state": "ON", "level": 80}`, "ON", map[string]interface{}{"level": 80.0}, true},
+		{`{"Status": 0}`, "", nil, false},
+		{`{"status": 0, "Power": 3.5}`, "0", map[string]interface{}{"power": 3.5}, true},
+		{`{"level": 80}`, "", nil, false},
+		{`null`, "", nil, false},
+		{`["ON"]`, "", nil, false},
+	} {
+		var arg interface{}
+		if err := json.Unmarshal([]byte(tc.arg), &arg); err != nil {
+			t.Fatal(err)
+		}
+		state, extra, ok := switchArg(arg)
+		if state != tc.state || ok != tc.ok || !reflect.DeepEqual(extra, tc.extra) {
+			t.Errorf("switchArg(%s) = %q, %v, %v; want %q, %v, %v", tc.arg, state, extra, ok, tc.state, tc.extra, tc.ok)
+		}
+	}
+}
+
+func TestStructuredSwitchArg(t *testing.T) {
+	proxy := eventProxy()
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: map[string]interface{}{"state": "ON", "level": 80.0}})
+
+	if state := proxy.deviceState("1"); state != "ON" {
+		t.Errorf("state = %q, want ON", state)
+	}
+	dev, _ := proxy.lookupDevice("1")
+	if level := proxy.haAttributes(&dev)["level"]; level != 80.0 {
+		t.Errorf("level attribute = %v, want 80", level)
+	}
+	for _, d := range proxy.listDevices() {
+		if d.NodeID == "1" && d.Attributes["level"] != 80.0 {
+			t.Errorf("listed attributes = %v, want the level", d.Attributes)
+		}
+	}
+
+	// A string argument drops the extra fields again.
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "OFF"})
+	if extra := proxy.extraAttributes("1"); extra != nil {
+		t.Errorf("extra attributes after a plain argument = %v", extra)
+	}
+}
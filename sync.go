@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// syncNode is one node entry of a SYNC_INFO response.
+type syncNode struct {
+	NodeID string
+	Name   string
+	Room   string
+	Model  string
+}
+
+// requestSyncInfo asks every zk controller for its device inventory.
+func (p *Proxy) requestSyncInfo() {
+	for _, zkid := range p.config.zkids() {
+		ref, _ := p.resolveNode(zkid, "*")
+		p.sendMessage(&Message{
+			NodeID:    "*",
+			Opcode:    "SYNC_INFO",
+			Arg:       "*",
+			Requester: "HJ_Server",
+			ReqID:     p.nextReqID(),
+			ZKID:      p.outgoingZKID(ref),
+		})
+	}
+}
+
+// handleSync merges the names and rooms from a SYNC_INFO response into the
+// inventory. Nodes missing from the configuration are added as discovered
+// devices; mapped entities whose metadata changed are pushed to HA again.
+func (p *Proxy) handleSync(msg *Message) {
+	p.readiness.syncDone()
+	nodes := parseSyncInfo(msg.Arg)
+	if len(nodes) == 0 {
+		log.Printf("Received sync response without nodes: %v", msg)
+		return
+	}
+
+	var changedDevices []device
+	p.stateMu.Lock()
+	for _, node := range nodes {
+		ref, ok := p.resolveNode(msg.ZKID, node.NodeID)
+		if !ok || p.ignoreNodes[ref.key()] {
+			continue
+		}
+		dev, ok := p.inventory[ref.key()]
+		if !ok {
+			dev = &device{Ref: ref}
+			p.inventory[ref.key()] = dev
+			p.stateTag.bump()
+		}
+		if dev.GatewayName == node.Name && dev.Room == node.Room {
+			continue
+		}
+		p.stateTag.bump()
+
+		before := *dev
+		dev.GatewayName = node.Name
+		dev.Room = node.Room
+		changed := dev.displayName() != before.displayName() || dev.Room != before.Room
+		if changed && dev.EntityID != "" && p.entity[dev.EntityID] != "" && !p.updatesSuppressed(dev) {
+			changedDevices = append(changedDevices, *dev)
+		}
+	}
+	p.stateMu.Unlock()
+	log.Printf("Synced %d nodes from gateway inventory", len(nodes))
+
+	for i := range changedDevices {
+		dev := &changedDevices[i]
+		p.stateMu.RLock()
+		state := p.entity[dev.EntityID]
+		p.stateMu.RUnlock()
+		p.entityChanged(topicAttributes, dev, state)
+	}
+}
+
+// parseSyncInfo extracts the node list from a SYNC_INFO argument. Firmware
+// versions differ in the layout: a plain list of nodes, an object wrapping
+// that list, or an object keyed by node ID.
+func parseSyncInfo(arg interface{}) []syncNode {
+	switch v := arg.(type) {
+	case []interface{}:
+		var nodes []syncNode
+		for _, item := range v {
+			if fields, ok := item.(map[string]interface{}); ok {
+				if node, ok := parseSyncNode("", fields); ok {
+					nodes = append(nodes, node)
+				}
+			}
+		}
+		return nodes
+	case map[string]interface{}:
+		for _, key := range []string{"nodes", "devices", "list"} {
+			if list, ok := v[key].([]interface{}); ok {
+				return parseSyncInfo(list)
+			}
+		}
+		var nodes []syncNode
+		for id, item := range v {
+			if fields, ok := item.(map[string]interface{}); ok {
+				if node, ok := parseSyncNode(id, fields); ok {
+					nodes = append(nodes, node)
+				}
+			}
+		}
+		return nodes
+	}
+	return nil
+}
+
+func parseSyncNode(id string, fields map[string]interface{}) (syncNode, bool) {
+	node := syncNode{
+		NodeID: firstField(fields, "nodeid", "nodeId", "id"),
+		Name:   firstField(fields, "name", "nickname", "alias"),
+		Room:   firstField(fields, "room", "roomName", "zone", "area"),
+		Model:  firstField(fields, "model", "type", "devType"),
+	}
+	if node.NodeID == "" {
+		node.NodeID = id
+	}
+	return node, node.NodeID != ""
+}
+
+// firstField returns the first of keys present in fields as a string.
+func firstField(fields map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		switch v := fields[key].(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case float64:
+			return fmt.Sprintf("%.0f", v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseSyncInfoLayouts(t *testing.T) {
+	want := []syncNode{
+		{NodeID: "6", Name: "客厅灯带", Room: "客厅"},
+		{NodeID: "100", Name: "主卧窗帘", Room: "主卧"},
+	}
+	layouts := map[string]string{
+		"list":    `[{"nodeid":"6","name":"客厅灯带","room":"客厅"},{"nodeid":100,"nickname":"主卧窗帘","zone":"主卧"}]`,
+		"wrapped": `{"nodes":[{"nodeid":"6","name":"客厅灯带","room":"客厅"},{"id":"100","name":"主卧窗帘","roomName":"主卧"}]}`,
+		"keyed":   `{"6":{"name":"客厅灯带","room":"客厅"},"100":{"alias":"主卧窗帘","area":"主卧"}}`,
+	}
+
+	for name, data := range layouts {
+		var arg interface{}
+		if err := json.Unmarshal([]byte(data), &arg); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := parseSyncInfo(arg)
+		sort.Slice(got, func(i, j int) bool { return lessNodeID(got[i].NodeID, got[j].NodeID) })
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+}
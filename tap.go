@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tapBuffer is how many frames a slow tap client may lag behind before
+// frames are dropped for it.
+const tapBuffer = 256
+
+// tapFrame is a raw chunk of bytes sent to or received from the gateway.
+// Received chunks are what the transport returned and may hold several
+// frames or part of one.
+type tapFrame struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Data      string    `json:"data"`
+}
+
+// frameTap hands raw gateway traffic to debug clients while it is
+// enabled. Disabled, it costs one atomic load per frame.
+type frameTap struct {
+	enabled atomic.Bool
+	mutex   sync.Mutex
+	seq     int64 // gaps in a client's sequence numbers are dropped frames
+	clients map[chan tapFrame]struct{}
+}
+
+// setEnabled turns the tap on or off. Turning it off ends the streams of
+// all clients.
+func (t *frameTap) setEnabled(enabled bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.enabled.Store(enabled)
+	if !enabled {
+		for ch := range t.clients {
+			close(ch)
+		}
+		t.clients = nil
+	}
+}
+
+// record passes data to the clients if the tap is enabled.
+func (t *frameTap) record(direction string, data []byte) {
+	if !t.enabled.Load() {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.seq++
+	frame := tapFrame{Seq: t.seq, Time: time.Now(), Direction: direction, Data: string(data)}
+	for ch := range t.clients {
+		select {
+		case ch <- frame:
+		default:
+		}
+	}
+}
+
+// subscribe registers a client. It reports false while the tap is off.
+func (t *frameTap) subscribe() (<-chan tapFrame, func(), bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.enabled.Load() {
+		return nil, nil, false
+	}
+	if t.clients == nil {
+		t.clients = make(map[chan tapFrame]struct{})
+	}
+	ch := make(chan tapFrame, tapBuffer)
+	t.clients[ch] = struct{}{}
+	return ch, func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if _, ok := t.clients[ch]; ok {
+			delete(t.clients, ch)
+			close(ch)
+		}
+	}, true
+}
+
+// tapData returns what the tap shows of the frame sent for msg: LOGIN
+// frames are encoded again without the gateway password.
+func tapData(msg *Message, frame []byte) []byte {
+	if msg.Opcode != "LOGIN" {
+		return frame
+	}
+	redacted := *msg
+	redacted.Arg = redactArg(msg.Opcode, msg.Arg)
+	data, err := encodeFrame(&redacted)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// tapHandler streams the tapped frames: as server-sent events with a JSON
+// body each, or with ?format=hex as a plain text hexdump for curl.
+func tapHandler(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format := c.DefaultQuery("format", "json")
+		if format != "json" && format != "hex" {
+			c.JSON(400, gin.H{"error": "Invalid format"})
+			return
+		}
+		frames, unsubscribe, ok := proxy.tap.subscribe()
+		if !ok {
+			c.JSON(409, gin.H{"error": "The tap is disabled; enable it with POST /debug/tap"})
+			return
+		}
+		defer unsubscribe()
+
+		if format == "hex" {
+			c.Header("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			c.Header("Content-Type", "text/event-stream")
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(200)
+		c.Writer.Flush()
+
+		ctx := c.Request.Context()
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case frame, ok := <-frames:
+				if !ok {
+					return
+				}
+				if format == "hex" {
+					fmt.Fprintf(c.Writer, "#%d %s %s %d bytes\n%s\n", frame.Seq, frame.Time.Format(time.RFC3339Nano), frame.Direction, len(frame.Data), hex.Dump([]byte(frame.Data)))
+				} else {
+					data, _ := json.Marshal(frame)
+					fmt.Fprintf(c.Writer, "id: %d\nevent: frame\ndata: %s\n\n", frame.Seq, data)
+				}
+			case <-keepalive.C:
+				if format == "json" {
+					fmt.Fprint(c.Writer, ": keepalive\n\n")
+				}
+			}
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugTap(t *testing.T) {
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.Auth.Tokens = []authToken{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}}}
+	proxy := startProxy(t, config)
+	server := httptest.NewServer(newRouter(proxy))
+	defer server.Close()
+
+	do := func(method, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+"/debug/tap", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodGet, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("GET /debug/tap while disabled: status %d, want 409", resp.StatusCode)
+	}
+	do(http.MethodPost, `{"enabled": true}`).Body.Close()
+
+	stream := do(http.MethodGet, "")
+	defer stream.Body.Close()
+	if ct := stream.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	proxy.queryNode(nodeRef{NodeID: "2"})
+
+	// The query goes out and the gateway's answer comes back in.
+	r := bufio.NewReader(stream.Body)
+	var seen []string
+	for len(seen) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading tap stream: %v", err)
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var frame tapFrame
+		if err := json.Unmarshal([]byte(data), &frame); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(frame.Data, `"nodeid":"2"`) {
+			seen = append(seen, frame.Direction)
+		}
+	}
+	if seen[0] != directionOut || seen[1] != directionIn {
+		t.Errorf("tapped directions %v, want out then in", seen)
+	}
+
+	// Disabling the tap ends the stream.
+	do(http.MethodPost, `{"enabled": false}`).Body.Close()
+	if _, err := io.ReadAll(r); err != nil {
+		t.Errorf("stream did not end cleanly: %v", err)
+	}
+}
+
+func TestTapHidesPassword(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.Gateway.Password = "gateway-secret"
+	proxy := startProxy(t, config)
+	proxy.tap.setEnabled(true)
+	frames, unsubscribe, _ := proxy.tap.subscribe()
+	defer unsubscribe()
+
+	if err := proxy.login(); err != nil {
+		t.Fatal(err)
+	}
+	frame := <-frames
+	if !strings.Contains(frame.Data, `"LOGIN"`) || !strings.Contains(frame.Data, `"password":"***"`) ||
+		strings.Contains(frame.Data, config.Gateway.Password) {
+		t.Errorf("tapped LOGIN frame %s, want the password hidden", frame.Data)
+	}
+}
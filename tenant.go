@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// viewKey is the gin context key holding the deviceFilter of a request to
+// the read endpoints.
+const viewKey = "auth.view"
+
+// deviceFilter reports whether a request may see the device with a zkid
+// and node ID. A nil filter lets every device through.
+type deviceFilter func(zkid, nodeID string) bool
+
+func (f deviceFilter) allows(zkid, nodeID string) bool {
+	return f == nil || f(zkid, nodeID)
+}
+
+// allowsKey is allows for a node key.
+func (f deviceFilter) allowsKey(key string) bool {
+	ref := parseNodeKey(key)
+	return f.allows(ref.ZKID, ref.NodeID)
+}
+
+func (f deviceFilter) devices(list []deviceInfo) []deviceInfo {
+	if f == nil {
+		return list
+	}
+	visible := []deviceInfo{}
+	for _, d := range list {
+		if f(d.ZKID, d.NodeID) {
+			visible = append(visible, d)
+		}
+	}
+	return visible
+}
+
+func (f deviceFilter) events(list []stateEvent) []stateEvent {
+	if f == nil {
+		return list
+	}
+	var visible []stateEvent
+	for _, ev := range list {
+		if f(ev.ZKID, ev.NodeID) {
+			visible = append(visible, ev)
+		}
+	}
+	return visible
+}
+
+// viewOf returns the deviceFilter set by requireView.
+func viewOf(c *gin.Context) deviceFilter {
+	f, _ := c.Value(viewKey).(deviceFilter)
+	return f
+}
+
+// tenantsEnabled reports whether any token is limited to a tenant.
+func (c *Config) tenantsEnabled() bool {
+	for _, t := range c.Auth.Tokens {
+		if t.Tenant != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceTenants returns the tenant of each mapped device assigned to one,
+// by node key.
+func (c *Config) deviceTenants() map[string]string {
+	tenants := make(map[string]string)
+	for key, dev := range buildInventory(c) {
+		if dev.Config.Tenant != "" {
+			tenants[key] = dev.Config.Tenant
+		}
+	}
+	return tenants
+}
+
+// validateTenants checks the tenants of the tokens and devices.
+func (c *Config) validateTenants(add func(message string, path ...string)) {
+	if !c.tenantsEnabled() {
+		return
+	}
+	if !c.Auth.ProtectDevices {
+		add("tenant tokens need protect_devices, or every client controls every device", "auth", "protect_devices")
+	}
+	used := make(map[string]bool)
+	for _, tenant := range c.deviceTenants() {
+		used[tenant] = true
+	}
+	for i, t := range c.Auth.Tokens {
+		if t.Tenant == "" {
+			continue
+		}
+		at := []string{"auth", "tokens", strconv.Itoa(i), "tenant"}
+		if t.hasScope(scopeAdmin) {
+			add(fmt.Sprintf("token %q has the admin scope, which reaches every tenant", t.Name), at...)
+		}
+		if !used[t.Tenant] {
+			add(fmt.Sprintf("no device is assigned to tenant %q", t.Tenant), at...)
+		}
+	}
+}
+
+// viewFilter returns the devices a token may see in the read endpoints
+// once tenants are configured: all of them for tokens with the admin or
+// devices scope, those of its tenant for a tenant token and those of a
+// guest token. Otherwise it returns the status and message to refuse the
+// token with.
+func (a *authenticator) viewFilter(proxy *Proxy, secret string) (deviceFilter, int, string) {
+	if !a.tenanted {
+		return nil, 0, ""
+	}
+	if secret == "" {
+		return nil, 401, "Missing bearer token"
+	}
+	if token := a.lookup(secret); token != nil {
+		switch {
+		case token.Tenant != "":
+			tenant := token.Tenant
+			return func(zkid, nodeID string) bool {
+				ref, ok := proxy.resolveNode(zkid, nodeID)
+				return ok && a.tenants[ref.key()] == tenant
+			}, 0, ""
+		case token.hasScope(scopeAdmin), token.hasScope(scopeDevices):
+			return nil, 0, ""
+		}
+		return nil, 403, "Token lacks the " + scopeDevices + " scope"
+	}
+	if guest, ok := a.guests.lookup(secret); ok {
+		return func(zkid, nodeID string) bool {
+			ref, ok := proxy.resolveNode(zkid, nodeID)
+			return ok && guest.allows(ref.key(), a.primary)
+		}, 0, ""
+	}
+	return nil, 401, "Invalid token"
+}
+
+// requireView returns middleware for the endpoints listing devices and
+// state changes. Once tenants are configured they need a token, and the
+// handlers only show the devices it may see.
+func (a *authenticator) requireView(proxy *Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.tenanted {
+			c.Next()
+			return
+		}
+		secret, ok := bearerToken(c)
+		if !ok {
+			return
+		}
+		filter, status, message := a.viewFilter(proxy, secret)
+		if status != 0 {
+			c.AbortWithStatusJSON(status, gin.H{"error": message})
+			return
+		}
+		c.Set(viewKey, filter)
+		c.Next()
+	}
+}
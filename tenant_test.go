@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTenants(t *testing.T) {
+	var config Config
+	config.Gateway.ZKID = "266590"
+	config.Auth.ProtectDevices = true
+	config.Auth.Tokens = []authToken{
+		{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}},
+		{Name: "unit-a", Token: "a-token", Tenant: "unit-a"},
+		{Name: "unit-b", Token: "b-token", Tenant: "unit-b"},
+	}
+	config.Devices.Lights = map[string]DeviceConfig{
+		"1": {Entity: "light_a", Tenant: "unit-a"},
+		"3": {Entity: "light_b", Tenant: "unit-b"},
+		"5": {Entity: "light_shared"},
+	}
+	config.Modes = map[string]ModeConfig{
+		"away_a": {Devices: []string{"1"}},
+		"away_b": {Devices: []string{"3"}},
+	}
+	proxy := NewProxy(&config)
+	router := newRouter(proxy)
+	for _, node := range []string{"1", "3", "5"} {
+		proxy.handleMessage(&Message{NodeID: node, Opcode: "SWITCH", Arg: "ON"})
+	}
+
+	request := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(`{"arg": "OFF"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	entities := func(target, token string) []string {
+		t.Helper()
+		rec := request(http.MethodGet, target, token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d, body %s", target, rec.Code, rec.Body)
+		}
+		var list []struct {
+			EntityID string `json:"entity_id"`
+		}
+		body := rec.Body.Bytes()
+		if target == "/states" {
+			var snapshot struct {
+				States json.RawMessage `json:"states"`
+			}
+			json.Unmarshal(body, &snapshot)
+			body = snapshot.States
+		}
+		if err := json.Unmarshal(body, &list); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range list {
+			ids = append(ids, e.EntityID)
+		}
+		return ids
+	}
+
+	for _, target := range []string{"/devices", "/history", "/states"} {
+		if ids := entities(target, "a-token"); len(ids) != 1 || ids[0] != "light_a" {
+			t.Errorf("GET %s as unit-a = %v, want light_a only", target, ids)
+		}
+		if ids := entities(target, "admin-token"); len(ids) != 3 {
+			t.Errorf("GET %s as admin = %v, want all three", target, ids)
+		}
+		if rec := request(http.MethodGet, target, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a token: status %d", target, rec.Code)
+		}
+	}
+
+	// Commands to another tenant's device or to no one's are refused; the
+	// own device gets past authentication and waits for the gateway.
+	for node, want := range map[string]int{"1": http.StatusServiceUnavailable, "3": http.StatusForbidden, "5": http.StatusForbidden} {
+		if rec := request(http.MethodPost, "/switch/"+node, "a-token"); rec.Code != want {
+			t.Errorf("POST /switch/%s as unit-a: status %d, want %d", node, rec.Code, want)
+		}
+	}
+	if rec := request(http.MethodPost, "/macro/all_off", "a-token"); rec.Code != http.StatusForbidden {
+		t.Errorf("macro as unit-a: status %d, want 403", rec.Code)
+	}
+
+	// Nor do the other endpoints tell a tenant about the other's devices.
+	proxy.rates.observe("3", time.Now(), 0, time.Minute)
+	if rec := request(http.MethodGet, "/anomalies", "a-token"); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("GET /anomalies as unit-a: status %d, body %s; want none", rec.Code, rec.Body)
+	}
+	if rec := request(http.MethodGet, "/anomalies", "b-token"); !strings.Contains(rec.Body.String(), `"node":"3"`) {
+		t.Errorf("GET /anomalies as unit-b: %s, want node 3", rec.Body)
+	}
+	if rec := request(http.MethodGet, "/mode", "a-token"); !strings.Contains(rec.Body.String(), `"modes":["away_a"]`) {
+		t.Errorf("GET /mode as unit-a: %s, want away_a only", rec.Body)
+	}
+	if rec := request(http.MethodGet, "/debug/unhandled", "a-token"); rec.Code != http.StatusForbidden {
+		t.Errorf("GET /debug/unhandled as unit-a: status %d, want 403", rec.Code)
+	}
+	for _, target := range []string{"/anomalies", "/mode", "/debug/unhandled"} {
+		if rec := request(http.MethodGet, target, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a token: status %d", target, rec.Code)
+		}
+	}
+}
+
+func TestValidateTenants(t *testing.T) {
+	var config Config
+	config.Auth.Tokens = []authToken{
+		{Name: "root", Token: "x", Scopes: []string{scopeAdmin}, Tenant: "unit-a"},
+		{Name: "ghost", Token: "y", Tenant: "unit-z"},
+	}
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_a", Tenant: "unit-a"}}
+	var problems []string
+	config.validateTenants(func(message string, path ...string) { problems = append(problems, message) })
+	if len(problems) != 3 {
+		t.Errorf("problems = %q, want protect_devices, admin scope and unknown tenant", problems)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// throttled reports whether updates of the device to Home Assistant are
+// thinned out by min_report_interval or min_change.
+func (d DeviceConfig) throttled() bool {
+	return d.MinReportInterval > 0 || d.MinChange > 0
+}
+
+// reportedEntity is what was last sent to Home Assistant for a throttled
+// entity, and the update held back until its interval has passed.
+type reportedEntity struct {
+	sent       bool
+	at         time.Time
+	state      string
+	attributes map[string]interface{}
+	held       *busEvent
+	timer      *time.Timer
+}
+
+// reportThrottle keeps throttled devices from changing their Home
+// Assistant state more often than their recorder should see.
+type reportThrottle struct {
+	mutex    sync.Mutex
+	entities map[string]*reportedEntity
+	stopped  bool
+}
+
+// reportToHomeAssistant sends ev to Home Assistant, subject to the
+// device's min_report_interval and min_change.
+func (p *Proxy) reportToHomeAssistant(ev busEvent) {
+	if ev.Device == nil || !ev.Device.Config.throttled() {
+		p.updateHomeAssistant(ev.EntityID, ev.State, ev.Attributes)
+		return
+	}
+	if p.reports.offer(ev, time.Now(), p.reportHeld) {
+		p.updateHomeAssistant(ev.EntityID, ev.State, ev.Attributes)
+	}
+}
+
+// reportHeld sends an update that was held back, unless it has become
+// insignificant.
+func (p *Proxy) reportHeld(entityID string) {
+	if ev, ok := p.reports.release(entityID, time.Now()); ok {
+		p.updateHomeAssistant(ev.EntityID, ev.State, ev.Attributes)
+	}
+}
+
+// offer reports whether ev is to be sent now. Updates within the device's
+// min_report_interval of the last one are held, replacing any held
+// before, and flush is called with the entity ID once the interval has
+// passed.
+func (t *reportThrottle) offer(ev busEvent, now time.Time, flush func(entityID string)) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopped {
+		return false
+	}
+	if t.entities == nil {
+		t.entities = make(map[string]*reportedEntity)
+	}
+	r := t.entities[ev.EntityID]
+	if r == nil {
+		r = &reportedEntity{}
+		t.entities[ev.EntityID] = r
+	}
+
+	config := ev.Device.Config
+	if r.sent && !significant(r, ev, config.MinChange) {
+		// A change back within min_change drops what was held.
+		r.held = nil
+		return false
+	}
+	interval := time.Duration(config.MinReportInterval * float64(time.Second))
+	if wait := r.at.Add(interval).Sub(now); r.sent && wait > 0 {
+		r.held = &ev
+		if r.timer == nil {
+			entityID := ev.EntityID
+			r.timer = time.AfterFunc(wait, func() { flush(entityID) })
+		}
+		return false
+	}
+	r.record(ev, now)
+	return true
+}
+
+// release returns the update held for entityID once its interval has
+// passed, if it is still significant.
+func (t *reportThrottle) release(entityID string, now time.Time) (busEvent, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	r := t.entities[entityID]
+	if r == nil || t.stopped {
+		return busEvent{}, false
+	}
+	r.timer = nil
+	ev := r.held
+	r.held = nil
+	if ev == nil || !significant(r, *ev, ev.Device.Config.MinChange) {
+		return busEvent{}, false
+	}
+	r.record(*ev, now)
+	return *ev, true
+}
+
+// stop drops the held updates.
+func (t *reportThrottle) stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stopped = true
+	for _, r := range t.entities {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+	}
+}
+
+func (r *reportedEntity) record(ev busEvent, now time.Time) {
+	r.sent = true
+	r.at = now
+	r.state = ev.State
+	r.attributes = ev.Attributes
+}
+
+// significant reports whether ev differs from what was last sent by more
+// than minChange: numbers, in the state and in the attributes, must move
+// by at least minChange; anything else must differ.
+func significant(r *reportedEntity, ev busEvent, minChange float64) bool {
+	if !similar(r.state, ev.State, minChange) || len(r.attributes) != len(ev.Attributes) {
+		return true
+	}
+	for k, v := range ev.Attributes {
+		last, ok := r.attributes[k]
+		if !ok || !similar(last, v, minChange) {
+			return true
+		}
+	}
+	return false
+}
+
+// similar reports whether a and b are equal, or numbers less than
+// minChange apart.
+func similar(a, b interface{}, minChange float64) bool {
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			return math.Abs(x-y) < minChange || x == y
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// number returns v as a float if it is numeric or a numeric string.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportThrottleMinChange(t *testing.T) {
+	dev := &device{EntityID: "sensor", Config: DeviceConfig{MinChange: 1}}
+	event := func(state string, level float64) busEvent {
+		return busEvent{EntityID: "switch.sensor", Device: dev, State: state, Attributes: map[string]interface{}{"level": level}}
+	}
+
+	var r reportThrottle
+	now := time.Now()
+	for i, test := range []struct {
+		ev   busEvent
+		want bool
+	}{
+		{event("on", 20), true},
+		{event("on", 20.5), false},
+		{event("on", 19.2), false},
+		{event("on", 21.2), true}, // compared to the 20 sent, not the last seen
+		{event("off", 21.2), true},
+		{event("21", 21.2), true},
+		{event("21.4", 21.2), false},
+	} {
+		if got := r.offer(test.ev, now, nil); got != test.want {
+			t.Errorf("update %d (%s, %v): sent = %v, want %v", i, test.ev.State, test.ev.Attributes["level"], got, test.want)
+		}
+	}
+}
+
+func TestReportThrottleInterval(t *testing.T) {
+	dev := &device{EntityID: "sensor", Config: DeviceConfig{MinReportInterval: 0.05}}
+	event := func(state string) busEvent {
+		return busEvent{EntityID: "switch.sensor", Device: dev, State: state}
+	}
+	flushed := make(chan string, 1)
+	flush := func(entityID string) { flushed <- entityID }
+
+	var r reportThrottle
+	if !r.offer(event("on"), time.Now(), flush) {
+		t.Fatal("first update was held")
+	}
+	// Updates within the interval are held; the latest is sent when it
+	// has passed.
+	if r.offer(event("off"), time.Now(), flush) || r.offer(event("unknown"), time.Now(), flush) {
+		t.Fatal("update within the interval was sent")
+	}
+	select {
+	case id := <-flushed:
+		ev, ok := r.release(id, time.Now())
+		if !ok || ev.State != "unknown" {
+			t.Errorf("released %+v, %v; want the latest update", ev, ok)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("held update was not flushed")
+	}
+
+	// An update that returns to the state sent drops the held one.
+	time.Sleep(60 * time.Millisecond)
+	if !r.offer(event("on"), time.Now(), flush) {
+		t.Fatal("update after the interval was held")
+	}
+	r.offer(event("off"), time.Now(), flush)
+	r.offer(event("on"), time.Now(), flush)
+	if _, ok := r.release(<-flushed, time.Now()); ok {
+		t.Error("a held update was sent although the state is back to the one sent")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	// Containers often ship without a zoneinfo database.
+	_ "time/tzdata"
+)
+
+// locations caches the loaded time zones by name.
+var locations sync.Map
+
+// location returns the time zone that quiet hours, presence simulation,
+// daily limits, history timestamps and the gateway clock follow: the
+// configured timezone, or the host's when it is empty or unknown. An
+// unknown zone is logged once.
+func (c *Config) location() *time.Location {
+	if c.Timezone == "" {
+		return time.Local
+	}
+	if loc, ok := locations.Load(c.Timezone); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		loc = time.Local
+	}
+	if cached, loaded := locations.LoadOrStore(c.Timezone, loc); loaded {
+		return cached.(*time.Location)
+	}
+	if err != nil {
+		log.Printf("Unknown timezone %q, using the host's: %v", c.Timezone, err)
+	}
+	return loc
+}
+
+// validateTimezone checks that timezone names a known time zone.
+func (c *Config) validateTimezone(add func(message string, path ...string)) {
+	if c.Timezone == "" {
+		return
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		add(fmt.Sprintf("unknown time zone %q; use a name like Asia/Shanghai", c.Timezone), "timezone")
+	}
+}
+
+// localNow returns the current time in the configured time zone.
+func (p *Proxy) localNow() time.Time {
+	return time.Now().In(p.config.location())
+}
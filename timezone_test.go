@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimezone(t *testing.T) {
+	var config Config
+	if config.location() != time.Local {
+		t.Error("no timezone does not use the host's")
+	}
+	config.Timezone = "Asia/Shanghai"
+	if got := config.location().String(); got != "Asia/Shanghai" {
+		t.Errorf("location = %s", got)
+	}
+	timezoneErrors := func() int {
+		n := 0
+		for _, err := range config.validate() {
+			if len(err.path) == 1 && err.path[0] == "timezone" {
+				n++
+			}
+		}
+		return n
+	}
+	if timezoneErrors() != 0 {
+		t.Error("valid timezone rejected")
+	}
+	config.Timezone = "Mars/Olympus_Mons"
+	if timezoneErrors() != 1 {
+		t.Error("unknown timezone accepted")
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(io.Discard)
+	config.location()
+	if config.location() != time.Local {
+		t.Error("unknown timezone does not fall back to the host's")
+	}
+	if n := strings.Count(buf.String(), "Unknown timezone"); n != 1 {
+		t.Errorf("unknown timezone logged %d times, want once", n)
+	}
+}
+
+func TestQuietHoursInTimezone(t *testing.T) {
+	proxy := eventProxy()
+	proxy.config.Timezone = "Asia/Shanghai"
+	local := time.Now().In(proxy.config.location())
+	// Quiet hours around the current time in Shanghai, which is far from
+	// the current time in New York.
+	window := fmt.Sprintf("%s-%s", local.Add(-time.Hour).Format("15:04"), local.Add(time.Hour).Format("15:04"))
+	proxy.config.Modes = map[string]ModeConfig{"night": {QuietHours: window}}
+
+	if got := proxy.activeModes(proxy.localNow()); len(got) != 1 {
+		t.Errorf("modes active in Shanghai = %v, want night", got)
+	}
+	proxy.config.Timezone = "America/New_York"
+	if got := proxy.activeModes(proxy.localNow()); len(got) != 0 {
+		t.Errorf("modes active in New York = %v, want none", got)
+	}
+}
+
+func TestPresenceReplaysLocalTime(t *testing.T) {
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	// Recorded at 19:00 in Shanghai and replayed the next day, planned
+	// from a time given in UTC.
+	start := time.Date(2024, 5, 1, 19, 0, 0, 0, shanghai)
+	periods := map[string][]onPeriod{"1": {{start: start.UTC(), duration: time.Hour}}}
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, shanghai)
+
+	var steps []scheduledStep
+	// Not every period is replayed; try seeds until this one is.
+	for seed := int64(1); len(steps) == 0 && seed < 100; seed++ {
+		steps = planPresence(periods, now, rand.New(rand.NewSource(seed)))["1"]
+	}
+	if len(steps) == 0 {
+		t.Fatal("nothing planned")
+	}
+	on := now.Add(steps[0].after)
+	if d := on.Sub(start.AddDate(0, 0, 1)); d < -presenceJitter || d > presenceJitter {
+		t.Errorf("replayed at %s, want about 19:00 in Shanghai", on.In(shanghai))
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// traceHAWait bounds how long a traced command waits for the state it
+// caused to be pushed to Home Assistant.
+var traceHAWait = 2 * time.Second
+
+// commandTiming is the timing breakdown of a command, returned with
+// ?trace=1.
+type commandTiming struct {
+	// QueueMS is how long the frames waited for the gateway connection,
+	// which sends one frame at a time.
+	QueueMS float64 `json:"queue_ms"`
+	// GatewayRTTMS is the time from sending the command to the gateway's
+	// confirmation; missing for devices without timeout/retries, whose
+	// commands are not confirmed.
+	GatewayRTTMS *float64 `json:"gateway_rtt_ms,omitempty"`
+	Attempts     int      `json:"attempts"`
+	// HAPushMS is how long the state update to Home Assistant took; missing
+	// if none was pushed within traceHAWait, as when the state did not
+	// change.
+	HAPushMS *float64 `json:"ha_push_ms,omitempty"`
+	TotalMS  float64  `json:"total_ms"`
+}
+
+// commandTrace collects the timing of one command.
+type commandTrace struct {
+	start    time.Time
+	entityID string
+
+	mutex    sync.Mutex
+	queue    time.Duration
+	sent     time.Time
+	rtt      time.Duration
+	replied  bool
+	attempts int
+	haPush   time.Duration
+	pushed   chan struct{} // closed once the HA push is timed
+}
+
+type traceKey struct{}
+
+// withTrace returns ctx carrying t.
+func withTrace(ctx context.Context, t *commandTrace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// traceOf returns the trace carried by ctx, or nil.
+func traceOf(ctx context.Context) *commandTrace {
+	t, _ := ctx.Value(traceKey{}).(*commandTrace)
+	return t
+}
+
+// sending records a frame that waited from queued to locked for the
+// connection.
+func (t *commandTrace) sending(queued, locked time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.queue += locked.Sub(queued)
+	t.sent = time.Now()
+	t.attempts++
+}
+
+func (t *commandTrace) wasSent() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.attempts > 0
+}
+
+// confirmed records the gateway's confirmation.
+func (t *commandTrace) confirmed(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rtt, t.replied = now.Sub(t.sent), true
+}
+
+// pushedToHA records the duration of the HA push of the entity.
+func (t *commandTrace) pushedToHA(d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	select {
+	case <-t.pushed:
+	default:
+		t.haPush = d
+		close(t.pushed)
+	}
+}
+
+// timing waits up to traceHAWait for the HA push and returns the
+// breakdown.
+func (t *commandTrace) timing(ctx context.Context) commandTiming {
+	select {
+	case <-t.pushed:
+	case <-time.After(traceHAWait):
+	case <-ctx.Done():
+	}
+	total := time.Since(t.start)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	timing := commandTiming{QueueMS: milliseconds(t.queue), Attempts: t.attempts, TotalMS: milliseconds(total)}
+	if t.replied {
+		rtt := milliseconds(t.rtt)
+		timing.GatewayRTTMS = &rtt
+	}
+	select {
+	case <-t.pushed:
+		push := milliseconds(t.haPush)
+		timing.HAPushMS = &push
+	default:
+	}
+	return timing
+}
+
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*10) / 10
+}
+
+// commandTraces are the traced commands waiting for their HA push, by
+// entity ID.
+type commandTraces struct {
+	mutex   sync.Mutex
+	waiting map[string][]*commandTrace
+}
+
+// start begins a trace of a command to the entity.
+func (c *commandTraces) start(entityID string) *commandTrace {
+	t := &commandTrace{start: time.Now(), entityID: entityID, pushed: make(chan struct{})}
+	if entityID == "" {
+		return t
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.waiting == nil {
+		c.waiting = make(map[string][]*commandTrace)
+	}
+	c.waiting[entityID] = append(c.waiting[entityID], t)
+	return t
+}
+
+// finish stops waiting for the HA push of t.
+func (c *commandTraces) finish(t *commandTrace) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	list := c.waiting[t.entityID]
+	for i, w := range list {
+		if w == t {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(c.waiting, t.entityID)
+	} else {
+		c.waiting[t.entityID] = list
+	}
+}
+
+// pushed hands the duration of an HA push of the entity to the traces
+// waiting for it whose command has been sent.
+func (c *commandTraces) pushed(entityID string, d time.Duration) {
+	c.mutex.Lock()
+	var done, rest []*commandTrace
+	for _, t := range c.waiting[entityID] {
+		if t.wasSent() {
+			done = append(done, t)
+		} else {
+			rest = append(rest, t)
+		}
+	}
+	if len(rest) == 0 {
+		delete(c.waiting, entityID)
+	} else {
+		c.waiting[entityID] = rest
+	}
+	c.mutex.Unlock()
+	for _, t := range done {
+		t.pushedToHA(d)
+	}
+}
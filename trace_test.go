@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCommandTrace(t *testing.T) {
+	env := newIntegrationEnv(t)
+
+	// Node 1 is not confirmed: no gateway round trip, but the HA push of
+	// the reported state.
+	trace, ok := env.post(t, "/switch/1?trace=1", `{"arg": "OFF"}`)["trace"].(map[string]interface{})
+	if !ok {
+		t.Fatal("no trace in the response")
+	}
+	if _, ok := trace["gateway_rtt_ms"]; ok {
+		t.Errorf("unconfirmed command has a gateway round trip: %v", trace)
+	}
+	if trace["attempts"] != 1.0 || trace["ha_push_ms"] == nil || trace["total_ms"] == nil {
+		t.Errorf("trace = %v, want one attempt and the HA push", trace)
+	}
+
+	trace, _ = env.post(t, "/curtain/2?trace=1", `{"arg": "OPEN"}`)["trace"].(map[string]interface{})
+	if rtt, ok := trace["gateway_rtt_ms"].(float64); !ok || rtt < 0 {
+		t.Errorf("confirmed command trace = %v, want the gateway round trip", trace)
+	}
+
+	if _, ok := env.post(t, "/switch/1", `{"arg": "ON"}`)["trace"]; ok {
+		t.Error("trace without ?trace=1")
+	}
+	env.proxy.traces.mutex.Lock()
+	defer env.proxy.traces.mutex.Unlock()
+	if len(env.proxy.traces.waiting) != 0 {
+		t.Errorf("traces left waiting: %v", env.proxy.traces.waiting)
+	}
+}
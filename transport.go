@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GatewayTransport carries framed messages between the proxy and the
+// gateway. A transport may be dialled again after it has been closed; the
+// proxy does so when it reconnects.
+type GatewayTransport interface {
+	// Dial opens the underlying connection.
+	Dial(ctx context.Context) error
+	// Send writes one encoded frame. Calls are serialized by the caller.
+	Send(frame []byte) error
+	// Receive blocks until the next complete frame arrives.
+	Receive() ([]byte, error)
+	// Close shuts the connection down and unblocks a pending Receive.
+	Close() error
+}
+
+// errTransportClosed is returned by Send and Receive on a transport that
+// is not dialled.
+var errTransportClosed = errors.New("transport closed")
+
+// newTransport returns the transport selected by the gateway configuration.
+func newTransport(config *Config) (GatewayTransport, error) {
+	switch config.Gateway.Transport {
+	case "", "tcp":
+		return newTCPTransport(config.gatewayAddrs(), newResolver(config.dnsRefresh()), config.Gateway.TCP), nil
+	case "serial":
+		if config.Gateway.Serial.Port == "" {
+			return nil, errors.New("gateway.serial.port is required for the serial transport")
+		}
+		return newSerialTransport(config.Gateway.Serial.Port, config.Gateway.Serial.Baud), nil
+	case "websocket":
+		ws := config.Gateway.WebSocket
+		if ws.URL == "" {
+			return nil, errors.New("gateway.websocket.url is required for the websocket transport")
+		}
+		return newWSTransport(ws.URL, ws.Headers, ws.InsecureSkipVerify, newResolver(config.dnsRefresh())), nil
+	default:
+		return nil, fmt.Errorf("unknown gateway transport %q", config.Gateway.Transport)
+	}
+}
+
+// streamTransport frames messages over any byte stream, splitting incoming
+// data on the '$' frame terminator.
+type streamTransport struct {
+	name string
+	open func(ctx context.Context) (io.ReadWriteCloser, error)
+
+	mutex  sync.Mutex
+	conn   io.ReadWriteCloser
+	reader *bufio.Reader
+}
+
+// TCPConfig tunes the TCP connection to the gateway.
+type TCPConfig struct {
+	// KeepAlive is the idle time in seconds before the first keepalive
+	// probe and between probes; 0 keeps Go's default of 15 seconds and a
+	// negative value turns keepalives off.
+	KeepAlive int `yaml:"keepalive"`
+	// NoDelay sends frames without waiting to coalesce them (Nagle's
+	// algorithm off); the default.
+	NoDelay *bool `yaml:"no_delay"`
+	// DialTimeout bounds a connection attempt to one address in seconds;
+	// 0 leaves it to the operating system.
+	DialTimeout int `yaml:"dial_timeout"`
+}
+
+// dialer returns the dialer for the gateway connection.
+func (c TCPConfig) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: time.Duration(c.DialTimeout) * time.Second}
+	switch {
+	case c.KeepAlive < 0:
+		d.KeepAlive = -1
+	case c.KeepAlive > 0:
+		interval := time.Duration(c.KeepAlive) * time.Second
+		d.KeepAliveConfig = net.KeepAliveConfig{Enable: true, Idle: interval, Interval: interval}
+	}
+	return d
+}
+
+func (c TCPConfig) noDelay() bool {
+	return c.NoDelay == nil || *c.NoDelay
+}
+
+// validateTCP checks gateway.tcp and gateway.fallback_hosts.
+func (c *Config) validateTCP(add func(message string, path ...string)) {
+	if c.Gateway.TCP.DialTimeout < 0 {
+		add("dial_timeout must not be negative", "gateway", "tcp", "dial_timeout")
+	}
+	for i, host := range c.Gateway.FallbackHosts {
+		if strings.TrimSpace(host) == "" {
+			add("fallback host must not be empty", "gateway", "fallback_hosts", strconv.Itoa(i))
+		}
+	}
+}
+
+// gatewayAddrs returns the addresses of the gateway for the tcp transport:
+// gateway.host, then gateway.fallback_hosts, which default to
+// gateway.port.
+func (c *Config) gatewayAddrs() []string {
+	addrs := []string{hostPort(c.Gateway.Host, c.Gateway.Port)}
+	for _, host := range c.Gateway.FallbackHosts {
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			addrs = append(addrs, host)
+		} else {
+			addrs = append(addrs, hostPort(host, c.Gateway.Port))
+		}
+	}
+	return addrs
+}
+
+// newTCPTransport returns the default transport, a plain TCP connection to
+// the gateway's local port. The addresses are tried in turn on every dial,
+// so that the first one is used again as soon as it can be reached; the
+// hosts are resolved each time.
+func newTCPTransport(addrs []string, r *resolver, config TCPConfig) *streamTransport {
+	t := &streamTransport{name: addrs[0]}
+	t.open = func(ctx context.Context) (io.ReadWriteCloser, error) {
+		var firstErr error
+		for i, addr := range addrs {
+			conn, err := r.dialWith(ctx, config.dialer(), "tcp", addr)
+			if err != nil {
+				if i+1 < len(addrs) && ctx.Err() == nil {
+					log.Printf("Failed to connect to gateway at %s: %v; trying %s", addr, err, addrs[i+1])
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetNoDelay(config.noDelay())
+			}
+			t.mutex.Lock()
+			t.name = addr
+			t.mutex.Unlock()
+			return conn, nil
+		}
+		return nil, firstErr
+	}
+	return t
+}
+
+func (t *streamTransport) String() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.name
+}
+
+func (t *streamTransport) Dial(ctx context.Context) error {
+	conn, err := t.open(ctx)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.conn = conn
+	t.reader = bufio.NewReader(conn)
+	return nil
+}
+
+func (t *streamTransport) Send(frame []byte) error {
+	t.mutex.Lock()
+	conn := t.conn
+	t.mutex.Unlock()
+	if conn == nil {
+		return errTransportClosed
+	}
+
+	_, err := conn.Write(frame)
+	return err
+}
+
+func (t *streamTransport) Receive() ([]byte, error) {
+	t.mutex.Lock()
+	reader := t.reader
+	t.mutex.Unlock()
+	if reader == nil {
+		return nil, errTransportClosed
+	}
+
+	return reader.ReadBytes('$')
+}
+
+func (t *streamTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	t.reader = nil
+	return err
+}
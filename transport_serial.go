@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"go.bug.st/serial"
+)
+
+// defaultSerialBaud is used when gateway.serial.baud is not set.
+const defaultSerialBaud = 115200
+
+// newSerialTransport returns a transport for control units attached over a
+// serial or RS485 adapter. They speak the same framed protocol as the TCP
+// port, so only the way the byte stream is opened differs.
+func newSerialTransport(port string, baud int) *streamTransport {
+	if baud <= 0 {
+		baud = defaultSerialBaud
+	}
+	mode := &serial.Mode{
+		BaudRate: baud,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+
+	return &streamTransport{
+		name: port,
+		open: func(context.Context) (io.ReadWriteCloser, error) {
+			return serial.Open(port, mode)
+		},
+	}
+}
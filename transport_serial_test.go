@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+// openPTY opens a pseudo terminal and returns its master side and the
+// path of its slave side, which the proxy opens like a serial adapter.
+func openPTY(t *testing.T) (*os.File, string) {
+	t.Helper()
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pseudo terminals: %v", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	var unlock, n int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Fatalf("unlock pty: %v", errno)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		t.Fatalf("pty number: %v", errno)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestSerialTransport(t *testing.T) {
+	gw := fakegw.New(2)
+	t.Cleanup(func() { gw.Close() })
+	gw.Report("2", "ON")
+
+	// The fake gateway serves the master side of the terminal.
+	master, port := openPTY(t)
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	gw.ServeConn(server)
+	go io.Copy(master, client)
+	go io.Copy(client, master)
+
+	var config Config
+	config.Gateway.DeviceCount = 2
+	config.Gateway.Transport = "serial"
+	config.Gateway.Serial.Port = port
+	config.Gateway.Serial.Baud = 9600
+	proxy := startProxy(t, &config)
+
+	if gw.Logins() != 1 {
+		t.Errorf("gateway saw %d logins, want 1", gw.Logins())
+	}
+	waitFor(t, time.Second, func() bool { return proxy.deviceState("2") == "ON" })
+	if err := proxy.sendMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON", Requester: "HJ_Server"}); err != nil {
+		t.Fatalf("sendMessage: %v", err)
+	}
+	waitFor(t, time.Second, func() bool { return gw.State("1") == "ON" })
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+// startFakeRelay serves a WebSocket endpoint that forwards frames to and
+// from a fake gateway, like the vendor's cloud relay.
+func startFakeRelay(t *testing.T, gw *fakegw.Gateway) string {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Relay-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		client, server := net.Pipe()
+		defer client.Close()
+		gw.ServeConn(server)
+
+		go func() {
+			reader := bufio.NewReader(client)
+			for {
+				frame, err := reader.ReadBytes('$')
+				if err != nil {
+					return
+				}
+				if err := ws.WriteMessage(websocket.TextMessage, frame); err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, err := client.Write(data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(relay.Close)
+	return "ws" + strings.TrimPrefix(relay.URL, "http")
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	gw := fakegw.New(2)
+	t.Cleanup(func() { gw.Close() })
+	gw.Report("2", "ON")
+
+	var config Config
+	config.Gateway.DeviceCount = 2
+	config.Gateway.Transport = "websocket"
+	config.Gateway.WebSocket.URL = startFakeRelay(t, gw)
+	config.Gateway.WebSocket.Headers = map[string]string{"X-Relay-Token": "secret"}
+	proxy := startProxy(t, &config)
+
+	waitFor(t, time.Second, func() bool { return proxy.deviceState("2") == "ON" })
+	if err := proxy.sendMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON", Requester: "HJ_Server"}); err != nil {
+		t.Fatalf("sendMessage: %v", err)
+	}
+	waitFor(t, time.Second, func() bool { return gw.State("1") == "ON" })
+}
+
+func TestNewTransportValidation(t *testing.T) {
+	for _, transport := range []string{"serial", "websocket", "carrier-pigeon"} {
+		var config Config
+		config.Gateway.Transport = transport
+		if _, err := newTransport(&config); err == nil {
+			t.Errorf("newTransport(%q) with empty settings succeeded", transport)
+		}
+	}
+}
+
+func TestTCPConfig(t *testing.T) {
+	if d := (TCPConfig{}).dialer(); d.KeepAlive != 0 || d.KeepAliveConfig.Enable || d.Timeout != 0 {
+		t.Errorf("default dialer = %+v, want Go's defaults", d)
+	}
+	if d := (TCPConfig{KeepAlive: -1}).dialer(); d.KeepAlive >= 0 {
+		t.Errorf("keepalive -1: KeepAlive = %s, want off", d.KeepAlive)
+	}
+	d := (TCPConfig{KeepAlive: 30, DialTimeout: 3}).dialer()
+	if c := d.KeepAliveConfig; !c.Enable || c.Idle != 30*time.Second || c.Interval != 30*time.Second || d.Timeout != 3*time.Second {
+		t.Errorf("tuned dialer = %+v", d)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Write([]byte("hello$"))
+			conn.Close()
+		}
+	}()
+	noDelay := false
+	port := listener.Addr().(*net.TCPAddr).Port
+	transport := newTCPTransport([]string{hostPort("127.0.0.1", port)}, newResolver(time.Minute), TCPConfig{KeepAlive: 30, NoDelay: &noDelay, DialTimeout: 3})
+	if err := transport.Dial(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	if frame, err := transport.Receive(); err != nil || string(frame) != "hello$" {
+		t.Errorf("Receive() = %q, %v", frame, err)
+	}
+
+	var config Config
+	config.Gateway.TCP.DialTimeout = -1
+	var problems []string
+	config.validateTCP(func(message string, path ...string) { problems = append(problems, message) })
+	if len(problems) != 1 {
+		t.Errorf("dial_timeout -1: problems = %q", problems)
+	}
+}
+
+func TestTCPFailover(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := closed.Addr().String()
+	closed.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello$"))
+			conn.Close()
+		}
+	}()
+
+	var config Config
+	config.Gateway.Host = "127.0.0.1"
+	config.Gateway.Port = closed.Addr().(*net.TCPAddr).Port
+	config.Gateway.FallbackHosts = []string{listener.Addr().String()}
+	if addrs := config.gatewayAddrs(); len(addrs) != 2 || addrs[0] != dead || addrs[1] != listener.Addr().String() {
+		t.Fatalf("gatewayAddrs() = %q", addrs)
+	}
+	config.Gateway.FallbackHosts = []string{"localhost"}
+	if addrs := config.gatewayAddrs(); addrs[1] != hostPort("localhost", config.Gateway.Port) {
+		t.Errorf("fallback without port = %q, want gateway.port", addrs[1])
+	}
+
+	transport := newTCPTransport([]string{dead, listener.Addr().String()}, newResolver(time.Minute), TCPConfig{})
+	if err := transport.Dial(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	if transport.String() != listener.Addr().String() {
+		t.Errorf("connected to %s, want the fallback %s", transport, listener.Addr())
+	}
+	if frame, err := transport.Receive(); err != nil || string(frame) != "hello$" {
+		t.Errorf("Receive() = %q, %v", frame, err)
+	}
+
+	transport = newTCPTransport([]string{dead}, newResolver(time.Minute), TCPConfig{})
+	if err := transport.Dial(context.Background()); err == nil {
+		t.Error("dialling only a dead address succeeded")
+	}
+}
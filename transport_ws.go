@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsTransport talks to the gateway through Konke's cloud relay, which
+// forwards the same "!{json}$" frames as WebSocket text messages. A single
+// message may carry several frames; the shared codec splits them.
+type wsTransport struct {
+	url     string
+	headers http.Header
+	dialer  *websocket.Dialer
+
+	mutex sync.Mutex
+	conn  *websocket.Conn
+}
+
+func newWSTransport(url string, headers map[string]string, insecureSkipVerify bool, r *resolver) *wsTransport {
+	header := make(http.Header)
+	for key, value := range headers {
+		header.Set(key, value)
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.NetDialContext = r.dial
+	if insecureSkipVerify {
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &wsTransport{
+		url:     url,
+		headers: header,
+		dialer:  &dialer,
+	}
+}
+
+func (t *wsTransport) String() string {
+	return t.url
+}
+
+func (t *wsTransport) Dial(ctx context.Context) error {
+	conn, _, err := t.dialer.DialContext(ctx, t.url, t.headers)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.conn = conn
+	return nil
+}
+
+func (t *wsTransport) Send(frame []byte) error {
+	t.mutex.Lock()
+	conn := t.conn
+	t.mutex.Unlock()
+	if conn == nil {
+		return errTransportClosed
+	}
+
+	return conn.WriteMessage(websocket.TextMessage, frame)
+}
+
+func (t *wsTransport) Receive() ([]byte, error) {
+	t.mutex.Lock()
+	conn := t.conn
+	t.mutex.Unlock()
+	if conn == nil {
+		return nil, errTransportClosed
+	}
+
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if kind == websocket.TextMessage || kind == websocket.BinaryMessage {
+			return data, nil
+		}
+	}
+}
+
+func (t *wsTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// unhandledOpcode aggregates the messages received for one opcode the
+// proxy has no handler for.
+type unhandledOpcode struct {
+	Opcode    string    `json:"opcode"`
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Sample is the first message received with the opcode.
+	Sample Message `json:"sample"`
+}
+
+// unhandledOpcodes collects unhandled opcodes so users can report missing
+// device types precisely instead of pasting raw logs.
+type unhandledOpcodes struct {
+	mutex   sync.Mutex
+	opcodes map[string]*unhandledOpcode
+}
+
+func (u *unhandledOpcodes) record(msg *Message) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.opcodes == nil {
+		u.opcodes = make(map[string]*unhandledOpcode)
+	}
+	now := time.Now()
+	entry := u.opcodes[msg.Opcode]
+	if entry == nil {
+		entry = &unhandledOpcode{Opcode: msg.Opcode, FirstSeen: now, Sample: *msg}
+		u.opcodes[msg.Opcode] = entry
+	}
+	entry.Count++
+	entry.LastSeen = now
+}
+
+// list returns the unhandled opcodes, most frequent first.
+func (u *unhandledOpcodes) list() []unhandledOpcode {
+	u.mutex.Lock()
+	list := make([]unhandledOpcode, 0, len(u.opcodes))
+	for _, entry := range u.opcodes {
+		list = append(list, *entry)
+	}
+	u.mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Opcode < list[j].Opcode
+	})
+	return list
+}
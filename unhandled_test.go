@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestUnhandledOpcodes(t *testing.T) {
+	var config Config
+	proxy := NewProxy(&config)
+
+	proxy.handleMessage(&Message{NodeID: "5", Opcode: "SENSOR", Arg: map[string]interface{}{"temp": 21.5}})
+	proxy.handleMessage(&Message{NodeID: "6", Opcode: "SENSOR", Arg: map[string]interface{}{"temp": 22}})
+	proxy.handleMessage(&Message{NodeID: "7", Opcode: "IR_LEARN", Arg: "*"})
+	proxy.handleMessage(&Message{NodeID: "1", Opcode: "SWITCH", Arg: "ON"})
+
+	list := proxy.unhandled.list()
+	if len(list) != 2 {
+		t.Fatalf("got %d unhandled opcodes, want 2: %+v", len(list), list)
+	}
+	if list[0].Opcode != "SENSOR" || list[0].Count != 2 || list[0].Sample.NodeID != "5" {
+		t.Errorf("first entry = %+v, want SENSOR seen twice with the node 5 sample", list[0])
+	}
+	if list[1].Opcode != "IR_LEARN" || list[1].Count != 1 {
+		t.Errorf("second entry = %+v, want IR_LEARN seen once", list[1])
+	}
+}
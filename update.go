@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Release locations used by the update command.
+var (
+	updateAPI  = "https://api.github.com"
+	updateRepo = "Artorius-P/konke-ha-proxy"
+)
+
+// updateKey is the base64 Ed25519 public key that signs release checksums,
+// set at build time with -ldflags "-X main.updateKey=...". Without it,
+// releases are only installed with -insecure.
+var updateKey = ""
+
+// errNoUpdateKey is returned for downloads by builds without an update key.
+var errNoUpdateKey = errors.New("this build has no update key to verify releases with; use -insecure to install without")
+
+// Release files besides the binaries.
+const (
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig"
+)
+
+// maxUpdateSize bounds the size of a downloaded release file.
+const maxUpdateSize = 128 << 20
+
+// release is the part of the GitHub releases API the updater uses.
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+func (r *release) asset(name string) *releaseAsset {
+	for i := range r.Assets {
+		if r.Assets[i].Name == name {
+			return &r.Assets[i]
+		}
+	}
+	return nil
+}
+
+// assetName returns the name of the release binary for this platform, e.g.
+// konke-ha-proxy_linux_armv7.
+func assetName() string {
+	arch := runtime.GOARCH
+	if arch == "arm" {
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range bi.Settings {
+				if setting.Key == "GOARM" {
+					arch += "v" + strings.TrimSuffix(setting.Value, ",softfloat")
+				}
+			}
+		}
+	}
+	name := "konke-ha-proxy_" + runtime.GOOS + "_" + arch
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// newerVersion reports whether release version a is newer than b. Versions
+// that are not of the form v1.2.3, such as development builds, are older
+// than any release.
+func newerVersion(a, b string) bool {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	if !okA {
+		return false
+	}
+	if !okB {
+		return true
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			return pa[i] > pb[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+	fields := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if len(fields) != 3 {
+		return parts, false
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// updater downloads and installs releases.
+type updater struct {
+	client *http.Client
+	out    io.Writer
+	// insecure allows downloads without an update key, checked against
+	// the checksums alone.
+	insecure bool
+}
+
+// fetch downloads url into memory.
+func (u *updater) fetch(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "konke-ha-proxy/"+version)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUpdateSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxUpdateSize {
+		return nil, fmt.Errorf("GET %s: response too large", url)
+	}
+	return data, nil
+}
+
+// release returns the latest release, or the one tagged tag.
+func (u *updater) release(ctx context.Context, tag string) (*release, error) {
+	url := fmt.Sprintf("%s/repos/%s/releases/latest", updateAPI, updateRepo)
+	if tag != "" {
+		url = fmt.Sprintf("%s/repos/%s/releases/tags/%s", updateAPI, updateRepo, tag)
+	}
+	data, err := u.fetch(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	var r release
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// download fetches the binary for this platform from r and verifies it
+// against the release checksums and their signature, which only insecure
+// updaters skip when updateKey is not set.
+func (u *updater) download(ctx context.Context, r *release) ([]byte, error) {
+	name := assetName()
+	binary := r.asset(name)
+	if binary == nil {
+		return nil, fmt.Errorf("release %s has no %s", r.TagName, name)
+	}
+	if updateKey == "" && !u.insecure {
+		return nil, errNoUpdateKey
+	}
+	sums := r.asset(checksumsAsset)
+	if sums == nil {
+		return nil, fmt.Errorf("release %s has no %s", r.TagName, checksumsAsset)
+	}
+
+	checksums, err := u.fetch(ctx, sums.URL)
+	if err != nil {
+		return nil, err
+	}
+	if updateKey != "" {
+		sig := r.asset(signatureAsset)
+		if sig == nil {
+			return nil, fmt.Errorf("release %s is not signed", r.TagName)
+		}
+		signature, err := u.fetch(ctx, sig.URL)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifySignature(checksums, signature); err != nil {
+			return nil, err
+		}
+	} else {
+		fmt.Fprintln(u.out, "Warning: -insecure: not verifying the release signature, only its checksums")
+	}
+
+	want, err := findChecksum(checksums, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := u.fetch(ctx, binary.URL)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != want {
+		return nil, fmt.Errorf("checksum mismatch for %s", name)
+	}
+	return data, nil
+}
+
+// verifySignature checks the base64 Ed25519 signature of the checksums.
+func verifySignature(checksums, signature []byte) error {
+	key, err := base64.StdEncoding.DecodeString(updateKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid update key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), checksums, sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// findChecksum returns the SHA-256 of name from a sha256sum style list.
+func findChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("%s lists no checksum for %s", checksumsAsset, name)
+}
+
+// install replaces the binary at path with data. The new file is written
+// next to it and renamed into place, so a failure leaves the old binary
+// intact.
+func install(path string, data []byte) error {
+	mode := os.FileMode(0755)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// runUpdateCommand implements the "update" subcommand and returns the
+// process exit code.
+func runUpdateCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("update", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	check := flags.Bool("check", false, "only report whether an update is available")
+	tag := flags.String("version", "", "install this release instead of the latest")
+	insecure := flags.Bool("insecure", false, "install releases without verifying their signature in builds without an update key")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	u := &updater{client: http.DefaultClient, out: stdout, insecure: *insecure}
+
+	r, err := u.release(ctx, *tag)
+	if err != nil {
+		fmt.Fprintf(stderr, "Checking for updates: %v\n", err)
+		return 1
+	}
+	if *tag == "" && !newerVersion(r.TagName, version) {
+		fmt.Fprintf(stdout, "konke-ha-proxy %s is up to date\n", version)
+		return 0
+	}
+	if *check {
+		fmt.Fprintf(stdout, "konke-ha-proxy %s is available (running %s)\n", r.TagName, version)
+		return 0
+	}
+
+	data, err := u.download(ctx, r)
+	if err != nil {
+		fmt.Fprintf(stderr, "Downloading %s: %v\n", r.TagName, err)
+		return 1
+	}
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err == nil {
+		err = install(executable, data)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Installing %s: %v\n", r.TagName, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "Installed konke-ha-proxy %s to %s; send the running proxy SIGUSR2 or restart it to switch\n", r.TagName, executable)
+	return 0
+}
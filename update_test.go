@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startReleaseServer serves a release v9.9.9 with a binary for this
+// platform, its checksum and a signature made with key.
+func startReleaseServer(t *testing.T, binary []byte, key ed25519.PrivateKey) {
+	t.Helper()
+
+	sum := sha256.Sum256(binary)
+	checksums := []byte(fmt.Sprintf("%s  %s\n%s  konke-ha-proxy_plan9_mips\n",
+		hex.EncodeToString(sum[:]), assetName(), strings.Repeat("0", 64)))
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, checksums))
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/" + updateRepo + "/releases/latest", "/repos/" + updateRepo + "/releases/tags/v9.9.9":
+			json.NewEncoder(w).Encode(release{TagName: "v9.9.9", Assets: []releaseAsset{
+				{Name: assetName(), URL: server.URL + "/download/binary"},
+				{Name: checksumsAsset, URL: server.URL + "/download/checksums"},
+				{Name: signatureAsset, URL: server.URL + "/download/signature"},
+			}})
+		case "/download/binary":
+			w.Write(binary)
+		case "/download/checksums":
+			w.Write(checksums)
+		case "/download/signature":
+			io.WriteString(w, signature)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	saved := updateAPI
+	updateAPI = server.URL
+	t.Cleanup(func() { updateAPI = saved })
+}
+
+func TestUpdateDownload(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	binary := []byte("new binary")
+	startReleaseServer(t, binary, private)
+
+	savedKey := updateKey
+	updateKey = base64.StdEncoding.EncodeToString(public)
+	defer func() { updateKey = savedKey }()
+
+	u := &updater{client: http.DefaultClient, out: io.Discard}
+	r, err := u.release(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := u.download(context.Background(), r)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if !bytes.Equal(data, binary) {
+		t.Errorf("downloaded %q, want %q", data, binary)
+	}
+
+	path := filepath.Join(t.TempDir(), "konke-ha-proxy")
+	os.WriteFile(path, []byte("old binary"), 0700)
+	if err := install(path, data); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, binary) {
+		t.Errorf("installed %q, want %q", got, binary)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0700 {
+		t.Errorf("installed with mode %v, want the old binary's", info.Mode().Perm())
+	}
+
+	// A signature from another key is rejected.
+	other, _, _ := ed25519.GenerateKey(nil)
+	updateKey = base64.StdEncoding.EncodeToString(other)
+	if _, err := u.download(context.Background(), r); err == nil {
+		t.Error("download with a foreign signature succeeded")
+	}
+}
+
+func TestUpdateChecksumMismatch(t *testing.T) {
+	_, private, _ := ed25519.GenerateKey(nil)
+	startReleaseServer(t, []byte("new binary"), private)
+
+	u := &updater{client: http.DefaultClient, out: io.Discard}
+	r, err := u.release(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without an update key only insecure updaters download.
+	if _, err := u.download(context.Background(), r); !errors.Is(err, errNoUpdateKey) {
+		t.Errorf("download without an update key: %v", err)
+	}
+	u.insecure = true
+	// Point the binary at the checksums file, which hashes differently.
+	r.asset(assetName()).URL = r.asset(checksumsAsset).URL
+	if _, err := u.download(context.Background(), r); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("err = %v, want a checksum mismatch", err)
+	}
+}
+
+func TestUpdateCheck(t *testing.T) {
+	_, private, _ := ed25519.GenerateKey(nil)
+	startReleaseServer(t, []byte("new binary"), private)
+
+	for _, test := range []struct {
+		running string
+		want    string
+	}{
+		{"v1.0.0", "v9.9.9 is available"},
+		{"dev", "v9.9.9 is available"},
+		{"v9.9.9", "is up to date"},
+		{"v10.0.0", "is up to date"},
+	} {
+		saved := version
+		version = test.running
+		var stdout, stderr bytes.Buffer
+		code := runUpdateCommand([]string{"-check"}, &stdout, &stderr)
+		version = saved
+		if code != 0 || !strings.Contains(stdout.String(), test.want) {
+			t.Errorf("running %s: exit %d, output %q %q, want %q", test.running, code, stdout.String(), stderr.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"time"
+)
+
+// envUpgrade marks a process started by a running proxy to take over from
+// it. The parent passes the HTTP listener, a pipe carrying its state and a
+// pipe on which the child reports that it is ready, as file descriptors
+// 3, 4 and 5. The variable holds the number of listeners; a second one,
+// that of http_server.admin, follows as descriptor 6.
+const envUpgrade = "KONKE_UPGRADE"
+
+// upgradeTimeout bounds how long the old process waits for the new one.
+var upgradeTimeout = 30 * time.Second
+
+// errUpgradeFailed is returned when the new process did not become ready.
+var errUpgradeFailed = errors.New("new process did not become ready")
+
+// proxySnapshot is the state handed to the new process so that it serves
+// the last known device states at once and does not push unchanged
+// states to Home Assistant again.
+type proxySnapshot struct {
+	Devices map[string]string `json:"devices"`
+	// Updated is when the gateway last reported each device state.
+	Updated map[string]time.Time `json:"updated,omitempty"`
+	Entity  map[string]string    `json:"entity"`
+	// Events are the recent state changes, so that event cursors stay
+	// valid.
+	Events []stateEvent `json:"events,omitempty"`
+}
+
+// snapshot returns the proxy's device and entity states.
+func (p *Proxy) snapshot() proxySnapshot {
+	events := p.events.recent()
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	s := proxySnapshot{
+		Devices: make(map[string]string, len(p.devices)),
+		Updated: make(map[string]time.Time, len(p.updated)),
+		Entity:  make(map[string]string, len(p.entity)),
+		Events:  events,
+	}
+	for k, v := range p.devices {
+		s.Devices[k] = v
+	}
+	for k, v := range p.updated {
+		s.Updated[k] = v
+	}
+	for k, v := range p.entity {
+		s.Entity[k] = v
+	}
+	return s
+}
+
+// restoreSnapshot loads state handed over by the previous process. It is
+// called before Start.
+func (p *Proxy) restoreSnapshot(s proxySnapshot) {
+	p.events.restore(s.Events)
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	for k, v := range s.Devices {
+		p.devices[k] = v
+	}
+	for k, v := range s.Updated {
+		p.updated[k] = v
+	}
+	for k, v := range s.Entity {
+		p.entity[k] = v
+	}
+}
+
+// handoff is what a process started for an upgrade inherits.
+type handoff struct {
+	listener net.Listener
+	admin    net.Listener // nil unless the old process had http_server.admin
+	snapshot proxySnapshot
+	ready    *os.File
+}
+
+// inheritHandoff returns the inherited listener and state, or nil if the
+// process was not started by an upgrade.
+func inheritHandoff() (*handoff, error) {
+	listeners := os.Getenv(envUpgrade)
+	if listeners == "" {
+		return nil, nil
+	}
+	os.Unsetenv(envUpgrade)
+
+	listener, err := inheritListener(3)
+	if err != nil {
+		return nil, err
+	}
+	h := &handoff{listener: listener, ready: os.NewFile(5, "ready")}
+	if listeners == "2" {
+		if h.admin, err = inheritListener(6); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	state := os.NewFile(4, "state")
+	defer state.Close()
+	if err := json.NewDecoder(state).Decode(&h.snapshot); err != nil {
+		h.close()
+		return nil, fmt.Errorf("reading handed over state: %v", err)
+	}
+	return h, nil
+}
+
+func inheritListener(fd uintptr) (net.Listener, error) {
+	file := os.NewFile(fd, "listener")
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("inheriting listener: %v", err)
+	}
+	return listener, nil
+}
+
+// close closes the inherited listeners.
+func (h *handoff) close() {
+	h.listener.Close()
+	if h.admin != nil {
+		h.admin.Close()
+	}
+}
+
+// signalReady tells the parent that this process has taken over.
+func (h *handoff) signalReady() {
+	h.ready.Write([]byte("ready\n"))
+	h.ready.Close()
+}
+
+// upgrade starts a new instance of the running binary, hands it the HTTP
+// listeners and the proxy's state and waits until it is serving. The new
+// binary is read from disk, so replacing the file and then triggering an
+// upgrade switches versions.
+func upgrade(listeners []net.Listener, proxy *Proxy) error {
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		tl, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("cannot hand over a %T", listener)
+		}
+		file, err := tl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stateR.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		stateW.Close()
+		return err
+	}
+	defer readyR.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		stateW.Close()
+		readyW.Close()
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envUpgrade+"="+strconv.Itoa(len(files)))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append([]*os.File{files[0], stateR, readyW}, files[1:]...)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		stateW.Close()
+		return err
+	}
+	log.Printf("Started new process %d, handing over", cmd.Process.Pid)
+
+	// The child's exit status only matters while the upgrade is in progress.
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	json.NewEncoder(stateW).Encode(proxy.snapshot())
+	stateW.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 6)
+		_, err := io.ReadFull(readyR, buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			return nil
+		}
+		cmd.Process.Kill()
+		return errUpgradeFailed
+	case err := <-exited:
+		return fmt.Errorf("%w: exited (%v)", errUpgradeFailed, err)
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("%w: timed out", errUpgradeFailed)
+	}
+}
+
+// serveUpgradable serves each server on its listener until an upgrade
+// signal hands them over to a new process, which then takes over the
+// listeners while this one finishes the requests in flight and exits.
+func serveUpgradable(servers []*http.Server, listeners []net.Listener, proxy *Proxy) error {
+	upgraded := make(chan struct{})
+	if len(upgradeSignals) > 0 {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, upgradeSignals...)
+		go func() {
+			for range signals {
+				log.Println("Upgrading...")
+				if err := upgrade(listeners, proxy); err != nil {
+					log.Printf("Upgrade failed: %v", err)
+					continue
+				}
+				signal.Stop(signals)
+
+				ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout)
+				for _, server := range servers {
+					server.Shutdown(ctx)
+				}
+				cancel()
+				proxy.Stop()
+				log.Println("Handed over to the new process")
+				close(upgraded)
+				return
+			}
+		}()
+	}
+
+	errs := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(server *http.Server, listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(server, listeners[i])
+	}
+	for range servers {
+		if err := <-errs; err != http.ErrServerClosed {
+			return err
+		}
+	}
+	<-upgraded
+	return nil
+}
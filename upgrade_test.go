@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestHelperUpgrade is not a real test: it is the new process started by
+// TestUpgrade. It serves the state it took over on the inherited listener
+// until asked to exit, or exits at once if KONKE_TEST_UPGRADE_FAIL is set.
+func TestHelperUpgrade(t *testing.T) {
+	inherited, err := inheritHandoff()
+	if inherited == nil {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if os.Getenv("KONKE_TEST_UPGRADE_FAIL") == "1" {
+		os.Exit(1)
+	}
+
+	done := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(inherited.snapshot)
+	})
+	mux.HandleFunc("/exit", func(w http.ResponseWriter, r *http.Request) {
+		close(done)
+	})
+	go http.Serve(inherited.listener, mux)
+	if inherited.admin != nil {
+		go http.Serve(inherited.admin, mux)
+	}
+	inherited.signalReady()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+	}
+	os.Exit(0)
+}
+
+func TestUpgrade(t *testing.T) {
+	if len(upgradeSignals) == 0 {
+		t.Skipf("upgrades are not supported on %s", runtime.GOOS)
+	}
+
+	gw := startFakeGateway(t, 2, nil)
+	proxy := startProxy(t, testConfig(t, gw, 2))
+	waitFor(t, time.Second, func() bool { return proxy.deviceState("2") != "" })
+	proxy.setEntityState("switch.test", "on")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestHelperUpgrade$"}
+	defer func() { os.Args = args }()
+
+	if err := upgrade([]net.Listener{listener, admin}, proxy); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	// The old process stops accepting; the new one keeps serving.
+	listener.Close()
+	admin.Close()
+	defer http.Get("http://" + addr + "/exit")
+
+	if resp, err := http.Get("http://" + admin.Addr().String() + "/state"); err != nil {
+		t.Errorf("new process is not serving the admin listener: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get("http://" + addr + "/state")
+	if err != nil {
+		t.Fatalf("new process is not serving: %v", err)
+	}
+	defer resp.Body.Close()
+	var state proxySnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Devices["2"] != proxy.deviceState("2") || state.Entity["switch.test"] != "on" {
+		t.Errorf("handed over state = %+v", state)
+	}
+}
+
+func TestUpgradeFailure(t *testing.T) {
+	if len(upgradeSignals) == 0 {
+		t.Skipf("upgrades are not supported on %s", runtime.GOOS)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// A process that exits without taking over leaves the old one running.
+	t.Setenv("KONKE_TEST_UPGRADE_FAIL", "1")
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestHelperUpgrade$"}
+	defer func() { os.Args = args }()
+
+	gw := startFakeGateway(t, 1, nil)
+	proxy := startProxy(t, testConfig(t, gw, 1))
+	if err := upgrade([]net.Listener{listener}, proxy); err == nil {
+		t.Fatal("upgrade to a process that never became ready succeeded")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// usagePeriods are the periods GET /stats/usage summarizes, ending now.
+var usagePeriods = map[string]time.Duration{
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+var errUnknownPeriod = errors.New("unknown period; use day or week")
+
+// switchUsage is how long a switch was on within the period.
+type switchUsage struct {
+	ZKID     string `json:"zkid"`
+	NodeID   string `json:"node_id"`
+	EntityID string `json:"entity_id"`
+	OnTime   int64  `json:"on_time"` // seconds
+	TurnedOn int    `json:"turned_on"`
+}
+
+// curtainUsage is how often a curtain moved within the period. A cycle is
+// a close following an open.
+type curtainUsage struct {
+	ZKID     string `json:"zkid"`
+	NodeID   string `json:"node_id"`
+	EntityID string `json:"entity_id"`
+	Opens    int    `json:"opens"`
+	Closes   int    `json:"closes"`
+	Cycles   int    `json:"cycles"`
+}
+
+// usageReport is the body of GET /stats/usage.
+type usageReport struct {
+	Period string    `json:"period"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	// Complete is false when the history does not reach back to From,
+	// as it only keeps the last eventHistory changes.
+	Complete bool           `json:"complete"`
+	Switches []switchUsage  `json:"switches"`
+	Curtains []curtainUsage `json:"curtains"`
+}
+
+// curtainPosition maps a curtain's pushed state to "open" or "closed",
+// or "" while it moves.
+func curtainPosition(state string) string {
+	switch state {
+	case "on", "open":
+		return "open"
+	case "off", "closed":
+		return "closed"
+	}
+	return ""
+}
+
+// usageStats summarizes the use of the mapped devices over the period
+// ending at now, from the state changes in the event feed. Devices whose
+// state at the start of the period is not in the history count from their
+// first change.
+func (p *Proxy) usageStats(period string, now time.Time, view deviceFilter) (usageReport, error) {
+	length, ok := usagePeriods[period]
+	if !ok {
+		return usageReport{}, errUnknownPeriod
+	}
+	from := now.Add(-length)
+	events, complete, _ := p.events.since(0)
+	if !complete && !events[0].Time.After(from) {
+		// Only changes before the period were discarded.
+		complete = true
+	}
+
+	byNode := make(map[string][]stateEvent)
+	for _, ev := range events {
+		key := ev.ZKID + "/" + ev.NodeID
+		byNode[key] = append(byNode[key], ev)
+	}
+
+	report := usageReport{Period: period, From: from, To: now, Complete: complete, Switches: []switchUsage{}, Curtains: []curtainUsage{}}
+	for _, dev := range view.devices(p.listDevices()) {
+		if dev.EntityID == "" {
+			continue
+		}
+		history := byNode[dev.ZKID+"/"+dev.NodeID]
+		if dev.Type == kindCurtain {
+			usage := curtainUsage{ZKID: dev.ZKID, NodeID: dev.NodeID, EntityID: dev.EntityID}
+			last := ""
+			for _, ev := range history {
+				position := curtainPosition(ev.State)
+				if position == "" || position == last {
+					continue
+				}
+				if !ev.Time.Before(from) {
+					if position == "open" {
+						usage.Opens++
+					} else {
+						usage.Closes++
+						if last == "open" {
+							usage.Cycles++
+						}
+					}
+				}
+				last = position
+			}
+			report.Curtains = append(report.Curtains, usage)
+			continue
+		}
+
+		usage := switchUsage{ZKID: dev.ZKID, NodeID: dev.NodeID, EntityID: dev.EntityID}
+		var onSince time.Time // zero while off
+		for _, ev := range history {
+			at := ev.Time
+			if at.Before(from) {
+				at = from
+			}
+			switch {
+			case ev.State == "on" && onSince.IsZero():
+				onSince = at
+				if !ev.Time.Before(from) {
+					usage.TurnedOn++
+				}
+			case ev.State != "on" && !onSince.IsZero():
+				usage.OnTime += int64(at.Sub(onSince).Seconds())
+				onSince = time.Time{}
+			}
+		}
+		if !onSince.IsZero() {
+			usage.OnTime += int64(now.Sub(onSince).Seconds())
+		}
+		report.Switches = append(report.Switches, usage)
+	}
+
+	sort.SliceStable(report.Switches, func(i, j int) bool { return report.Switches[i].OnTime > report.Switches[j].OnTime })
+	sort.SliceStable(report.Curtains, func(i, j int) bool { return report.Curtains[i].Cycles > report.Curtains[j].Cycles })
+	return report, nil
+}
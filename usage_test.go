@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUsageStats(t *testing.T) {
+	proxy := eventProxy()
+	now := time.Now()
+	at := func(ago time.Duration) time.Time { return now.Add(-ago) }
+	for _, ev := range []stateEvent{
+		{Time: at(30 * time.Hour), NodeID: "1", Type: kindSwitch, EntityID: "light_one", State: "on"},
+		{Time: at(23 * time.Hour), NodeID: "1", Type: kindSwitch, EntityID: "light_one", State: "off"},
+		{Time: at(2 * time.Hour), NodeID: "1", Type: kindSwitch, EntityID: "light_one", State: "on"},
+		{Time: at(90 * time.Minute), NodeID: "1", Type: kindSwitch, EntityID: "light_one", State: "off"},
+		{Time: at(10 * time.Minute), NodeID: "1", Type: kindSwitch, EntityID: "light_one", State: "on"},
+		{Time: at(26 * time.Hour), NodeID: "2", Type: kindCurtain, EntityID: "curtain_two", State: "open"},
+		{Time: at(5 * time.Hour), NodeID: "2", Type: kindCurtain, EntityID: "curtain_two", State: "closing"},
+		{Time: at(5 * time.Hour), NodeID: "2", Type: kindCurtain, EntityID: "curtain_two", State: "closed"},
+		{Time: at(4 * time.Hour), NodeID: "2", Type: kindCurtain, EntityID: "curtain_two", State: "open"},
+		{Time: at(3 * time.Hour), NodeID: "2", Type: kindCurtain, EntityID: "curtain_two", State: "closed"},
+	} {
+		proxy.events.publish(ev)
+	}
+
+	report, err := proxy.usageStats("day", now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Complete || len(report.Switches) != 1 || len(report.Curtains) != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	// On from the start of the day for an hour, then 30 and 10 minutes.
+	if got := report.Switches[0]; got.OnTime != int64((100*time.Minute).Seconds()) || got.TurnedOn != 2 {
+		t.Errorf("switch usage = %+v, want 6000s on, turned on twice", got)
+	}
+	if got := report.Curtains[0]; got.Opens != 1 || got.Closes != 2 || got.Cycles != 2 {
+		t.Errorf("curtain usage = %+v, want 1 open, 2 closes, 2 cycles", got)
+	}
+
+	week, _ := proxy.usageStats("week", now, nil)
+	if got := week.Switches[0]; got.OnTime != int64((7*time.Hour+40*time.Minute).Seconds()) || got.TurnedOn != 3 {
+		t.Errorf("weekly switch usage = %+v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	newRouter(proxy).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats/usage?period=month", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /stats/usage?period=month: status %d, want 400", rec.Code)
+	}
+}
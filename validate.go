@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// configError is a problem found in a configuration file.
+type configError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e configError) format() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+	}
+	b.WriteString(": ")
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// fieldError is a semantic problem with the setting at path.
+type fieldError struct {
+	path    []string
+	message string
+}
+
+func (e fieldError) format() string {
+	return strings.Join(e.path, ".") + ": " + e.message
+}
+
+// validate checks the settings that YAML decoding alone cannot.
+func (c *Config) validate() []fieldError {
+	var errs []fieldError
+	add := func(message string, path ...string) {
+		errs = append(errs, fieldError{path: path, message: message})
+	}
+
+	if _, err := newTransport(c); err != nil {
+		add(err.Error(), "gateway", "transport")
+	}
+	if (c.Gateway.Transport == "" || c.Gateway.Transport == "tcp") && c.Gateway.Host == "" {
+		add("gateway.host is required for the tcp transport", "gateway", "host")
+	}
+	if c.HomeAssistant.Proxy != "" {
+		if _, err := parseProxyURL(c.HomeAssistant.Proxy); err != nil {
+			add(err.Error(), "home_assistant", "proxy")
+		}
+	}
+	if err := c.validateCoverConflict(); err != nil {
+		add(err.Error(), "gateway", "cover_conflict")
+	}
+	switch c.HomeAssistant.CurtainDomain {
+	case "", "switch", "cover":
+	default:
+		add(fmt.Sprintf("unknown curtain domain %q", c.HomeAssistant.CurtainDomain), "home_assistant", "curtain_domain")
+	}
+
+	for domain := range c.HomeAssistant.StateMap {
+		if domain != "switch" && domain != "cover" {
+			add(fmt.Sprintf("unknown domain %q; use switch or cover", domain), "home_assistant", "state_map", domain)
+		}
+	}
+
+	zkids := make(map[string]bool)
+	for _, zkid := range c.zkids() {
+		zkids[zkid] = true
+	}
+	checkDevices := func(kind string, mapping map[string]DeviceConfig) {
+		for key, dc := range mapping {
+			if ref := parseNodeKey(key); ref.ZKID != "" && !zkids[ref.ZKID] {
+				add(fmt.Sprintf("zkid %s is not listed in gateway.zkids", ref.ZKID), "devices", kind, key)
+			}
+			if dc.Entity == "" {
+				add("entity is required", "devices", kind, key)
+			}
+			if dc.MinReportInterval < 0 {
+				add("min_report_interval must not be negative", "devices", kind, key, "min_report_interval")
+			}
+			if dc.MinChange < 0 {
+				add("min_change must not be negative", "devices", kind, key, "min_change")
+			}
+			if dc.Precision != nil && *dc.Precision < 0 {
+				add("precision must not be negative", "devices", kind, key, "precision")
+			}
+			if dc.Smoothing < 0 {
+				add("smoothing must not be negative", "devices", kind, key, "smoothing")
+			}
+			if dc.PowerInterval < 0 {
+				add("power_interval must not be negative", "devices", kind, key, "power_interval")
+			}
+			if dc.Dimmer && kind != "lights" {
+				add("only lights can be dimmers", "devices", kind, key, "dimmer")
+			}
+			if dc.MaxDailyActuations < 0 {
+				add("max_daily_actuations must not be negative", "devices", kind, key, "max_daily_actuations")
+			}
+			if dc.Repeat.Count < 0 {
+				add("count must not be negative", "devices", kind, key, "repeat", "count")
+			}
+			if dc.Repeat.Interval < 0 {
+				add("interval must not be negative", "devices", kind, key, "repeat", "interval")
+			}
+			for _, arg := range dc.AllowedArgs {
+				if arg == "" {
+					add("allowed_args must not contain an empty argument", "devices", kind, key, "allowed_args")
+				}
+			}
+		}
+	}
+	checkDevices("curtains", c.Devices.Curtains)
+	checkDevices("lights", c.Devices.Lights)
+
+	for name, mode := range c.Modes {
+		for _, key := range mode.Devices {
+			if ref := parseNodeKey(key); ref.ZKID != "" && !zkids[ref.ZKID] {
+				add(fmt.Sprintf("zkid %s is not listed in gateway.zkids", ref.ZKID), "modes", name, "devices")
+			}
+		}
+		if mode.QuietHours != "" {
+			if _, err := parseQuietHours(mode.QuietHours); err != nil {
+				add(err.Error(), "modes", name, "quiet_hours")
+			}
+		}
+	}
+
+	for name, interlock := range c.Interlocks {
+		if len(interlock.Devices) < 2 {
+			add("an interlock needs at least two devices", "interlocks", name, "devices")
+		}
+		for _, key := range interlock.Devices {
+			if ref := parseNodeKey(key); ref.ZKID != "" && !zkids[ref.ZKID] {
+				add(fmt.Sprintf("zkid %s is not listed in gateway.zkids", ref.ZKID), "interlocks", name, "devices")
+			}
+		}
+	}
+
+	for name, action := range c.Actions {
+		if action.Device == "" || action.Arg == "" {
+			add("actions need a device and an arg", "actions", name)
+		}
+		if ref := parseNodeKey(action.Device); ref.ZKID != "" && !zkids[ref.ZKID] {
+			add(fmt.Sprintf("zkid %s is not listed in gateway.zkids", ref.ZKID), "actions", name, "device")
+		}
+	}
+
+	for name, hook := range c.Hooks {
+		switch {
+		case hook.Macro != "" && len(hook.Commands) > 0:
+			add("hooks run either commands or a macro", "hooks", name)
+		case hook.Macro != "":
+			if _, ok := c.Macros[hook.Macro]; !ok {
+				add(fmt.Sprintf("unknown macro %q", hook.Macro), "hooks", name, "macro")
+			}
+		default:
+			c.validateSteps(add, hook.Commands, "hooks", name, "commands")
+		}
+	}
+	for name, steps := range c.Macros {
+		c.validateSteps(add, steps, "macros", name)
+	}
+
+	c.validateNotifications(add)
+	c.validateAlertRules(add)
+	c.validateLogSampling(add)
+	c.validateErrorBudget(add)
+	c.validateAdminListener(add)
+	c.validateHeartbeat(add)
+	c.validateTCP(add)
+	c.validateTenants(add)
+	c.validateStartupQuery(add)
+	c.validateLoopGuard(add)
+	c.validateTimezone(add)
+	c.validateExtensions(add)
+
+	switch c.Logging.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		add(fmt.Sprintf("unknown log level %q", c.Logging.Level), "logging", "level")
+	}
+	if c.Logging.Buffer < 0 {
+		add("buffer must not be negative", "logging", "buffer")
+	}
+	return errs
+}
+
+// yamlErrorLine matches the position prefix of YAML decoding errors.
+var yamlErrorLine = regexp.MustCompile(`line (\d+): (.*)`)
+
+// validateConfig checks a configuration file, reporting unknown keys, type
+// errors and invalid settings with their line numbers. Every document in
+// a multi-profile file is checked.
+func validateConfig(data []byte) []configError {
+	var configs []Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.SetStrict(true)
+	for {
+		var config Config
+		err := decoder.Decode(&config)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return decodeErrors(err)
+		}
+		configs = append(configs, config)
+	}
+
+	var errs []configError
+	profiles := make(map[string]bool)
+	nodes := yaml3.NewDecoder(bytes.NewReader(data))
+	for i := range configs {
+		var root yaml3.Node
+		nodes.Decode(&root)
+
+		if len(configs) > 1 {
+			name := configs[i].Profile
+			if name == "" || profiles[name] {
+				errs = append(errs, configError{
+					Line:    nodeLine(&root, []string{"profile"}),
+					Path:    "profile",
+					Message: "every document in a multi-profile file needs a unique profile name",
+				})
+			}
+			profiles[name] = true
+		}
+		for _, fe := range configs[i].validate() {
+			errs = append(errs, configError{
+				Line:    nodeLine(&root, fe.path),
+				Path:    strings.Join(fe.path, "."),
+				Message: fe.message,
+			})
+		}
+	}
+	return errs
+}
+
+// decodeErrors converts a YAML decoding error into configErrors.
+func decodeErrors(err error) []configError {
+	var messages []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+
+	errs := make([]configError, 0, len(messages))
+	for _, message := range messages {
+		if m := yamlErrorLine.FindStringSubmatch(message); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			errs = append(errs, configError{Line: line, Message: m[2]})
+		} else {
+			errs = append(errs, configError{Message: message})
+		}
+	}
+	return errs
+}
+
+// nodeLine returns the line of the setting at path, or of its closest
+// parent present in the file.
+func nodeLine(node *yaml3.Node, path []string) int {
+	if node.Kind == yaml3.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	for _, key := range path {
+		var next *yaml3.Node
+		switch node.Kind {
+		case yaml3.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml3.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i < len(node.Content) {
+				next = node.Content[i]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return line
+}
+
+// runConfigCommand implements the "config" subcommands and returns the
+// process exit code.
+func runConfigCommand(args []string, stdout, stderr io.Writer) int {
+	usage := func() int {
+		fmt.Fprintln(stderr, "usage: konke-ha-proxy config schema")
+		fmt.Fprintln(stderr, "       konke-ha-proxy config validate [-json] [file or directory]")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	switch args[0] {
+	case "schema":
+		data, _ := json.MarshalIndent(configSchema(), "", "  ")
+		fmt.Fprintln(stdout, string(data))
+		return 0
+
+	case "validate":
+		flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+		flags.SetOutput(stderr)
+		asJSON := flags.Bool("json", false, "print the errors as JSON")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		path := "config.yaml"
+		if flags.NArg() > 0 {
+			path = flags.Arg(0)
+		}
+		files, _, err := configFiles(path)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+
+		var errs []configError
+		var lines []string
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				return 1
+			}
+			for _, e := range validateConfig(data) {
+				e.File = file
+				errs = append(errs, e)
+				lines = append(lines, e.format())
+			}
+		}
+		if *asJSON {
+			if errs == nil {
+				errs = []configError{}
+			}
+			out, _ := json.MarshalIndent(errs, "", "  ")
+			fmt.Fprintln(stdout, string(out))
+		} else if len(errs) == 0 {
+			fmt.Fprintf(stdout, "%s: OK\n", path)
+		} else {
+			fmt.Fprintln(stdout, strings.Join(lines, "\n"))
+		}
+		if len(errs) > 0 {
+			return 1
+		}
+		return 0
+	}
+	return usage()
+}
+
+// validateSteps checks the command sequence of a macro or webhook at path.
+func (c *Config) validateSteps(add func(message string, path ...string), steps []CommandStep, path ...string) {
+	if len(steps) == 0 {
+		add("at least one command is required", path...)
+	}
+	zkids := c.zkids()
+	for i, step := range steps {
+		at := append(append([]string(nil), path...), strconv.Itoa(i))
+		if step.Device == "" || step.Arg == "" {
+			add("commands need a device and an arg", at...)
+		}
+		if ref := parseNodeKey(step.Device); ref.ZKID != "" && !contains(zkids, ref.ZKID) {
+			add(fmt.Sprintf("zkid %s is not listed in gateway.zkids", ref.ZKID), append(at, "device")...)
+		}
+		if step.DelayMS < 0 {
+			add("delay_ms must not be negative", append(at, "delay_ms")...)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	data := []byte(`gateway:
+  host: "192.168.1.10"
+  port: 5000
+  zkid: "266590"
+  transport: "udp"
+devices:
+  lights:
+    "6": "light_six"
+    "266599/3": "light_three"
+modes:
+  night:
+    quiet_hours: "22:00"
+`)
+	errs := validateConfig(data)
+	want := map[string]int{"gateway.transport": 5, "devices.lights.266599/3": 9, "modes.night.quiet_hours": 12}
+	if len(errs) != len(want) {
+		t.Fatalf("validateConfig = %+v, want %d errors", errs, len(want))
+	}
+	for _, e := range errs {
+		if line, ok := want[e.Path]; !ok || e.Line != line {
+			t.Errorf("unexpected error %+v", e)
+		}
+	}
+}
+
+func TestValidateConfigDecodeErrors(t *testing.T) {
+	data := []byte(`gateway:
+  host: "192.168.1.10"
+  port: "five thousand"
+  colour: "blue"
+`)
+	errs := validateConfig(data)
+	if len(errs) != 2 || errs[0].Line != 3 || errs[1].Line != 4 || !strings.Contains(errs[1].Message, "colour") {
+		t.Errorf("validateConfig = %+v, want a type error on line 3 and an unknown field on line 4", errs)
+	}
+}
+
+func TestValidateConfigProfiles(t *testing.T) {
+	data := []byte(`profile: home
+gateway:
+  host: "192.168.1.10"
+---
+profile: home
+gateway:
+  host: "10.0.0.5"
+  cover_conflict: "ignore"
+`)
+	errs := validateConfig(data)
+	if len(errs) != 2 || errs[0].Line != 5 || errs[1].Line != 8 {
+		t.Errorf("validateConfig = %+v, want a duplicate profile on line 5 and a bad policy on line 8", errs)
+	}
+}
+
+func TestValidateShippedConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := validateConfig(data); len(errs) != 0 {
+		t.Errorf("config.yaml is invalid: %+v", errs)
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runConfigCommand([]string{"schema"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("config schema exited with %d: %s", code, stderr.String())
+	}
+	var schema struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &schema); err != nil {
+		t.Fatalf("schema is not JSON: %v", err)
+	}
+	for _, key := range []string{"gateway", "devices", "home_assistant"} {
+		if _, ok := schema.Properties[key]; !ok {
+			t.Errorf("schema lacks %s", key)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	ioutil.WriteFile(file, []byte("gateway:\n  transport: \"udp\"\n"), 0644)
+	stdout.Reset()
+	if code := runConfigCommand([]string{"validate", "-json", file}, &stdout, &stderr); code != 1 {
+		t.Fatalf("config validate exited with %d, want 1", code)
+	}
+	var errs []configError
+	if err := json.Unmarshal(stdout.Bytes(), &errs); err != nil || len(errs) == 0 || errs[0].Line != 2 {
+		t.Errorf("config validate -json = %s", stdout.String())
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with
+//
+//	-ldflags "-X main.version=v1.2.3 -X main.commit=abc1234 -X main.date=2024-01-02T03:04:05Z"
+//
+// When they are not set, the commit and date recorded by the Go toolchain
+// are used.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// buildInfo describes the running binary.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// currentBuild returns the build information of the running binary.
+func currentBuild() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = setting.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+func (b buildInfo) String() string {
+	s := b.Version
+	if b.Commit != "" {
+		commit := b.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		s += " (" + commit
+		if b.Date != "" {
+			s += ", " + b.Date
+		}
+		s += ")"
+	}
+	return s + " " + b.GoVersion + " " + b.Platform
+}
+
+// writeMetrics writes the proxy's metrics in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	b := currentBuild()
+	fmt.Fprintln(w, "# HELP konke_build_info Build information of the running proxy.")
+	fmt.Fprintln(w, "# TYPE konke_build_info gauge")
+	fmt.Fprintf(w, "konke_build_info{version=%q,commit=%q,date=%q,goversion=%q} 1\n", b.Version, b.Commit, b.Date, b.GoVersion)
+}
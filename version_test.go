@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVersionEndpoints(t *testing.T) {
+	saved := [3]string{version, commit, date}
+	version, commit, date = "v1.2.3", "abc1234", "2024-01-02T03:04:05Z"
+	defer func() { version, commit, date = saved[0], saved[1], saved[2] }()
+
+	router := newRouter(NewProxy(&Config{}))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var info buildInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("GET /version: %v", err)
+	}
+	if info.Version != "v1.2.3" || info.Commit != "abc1234" || info.Date != "2024-01-02T03:04:05Z" {
+		t.Errorf("GET /version = %+v", info)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	want := `konke_build_info{version="v1.2.3",commit="abc1234",date="2024-01-02T03:04:05Z",`
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("GET /metrics = %q, want it to contain %q", rec.Body.String(), want)
+	}
+}
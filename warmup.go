@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// warmUpTimeout bounds the request for the Home Assistant states at
+// startup, so that an unreachable HA does not hold the proxy up.
+const warmUpTimeout = 5 * time.Second
+
+// haEntityState is an entry of Home Assistant's GET /api/states.
+type haEntityState struct {
+	EntityID string `json:"entity_id"`
+	State    string `json:"state"`
+}
+
+// fetchHAStates returns the current states of all Home Assistant
+// entities by entity ID.
+func (p *Proxy) fetchHAStates(ctx context.Context) (map[string]string, error) {
+	url := fmt.Sprintf("http://%s/api/states", hostPort(p.config.HomeAssistant.Host, p.config.HomeAssistant.Port))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer "+p.config.HomeAssistant.Token)
+	resp, err := p.haClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var list []haEntityState
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	states := make(map[string]string, len(list))
+	for _, s := range list {
+		states[s.EntityID] = s.State
+	}
+	return states, nil
+}
+
+// warmUp seeds the states of the mapped devices from Home Assistant before
+// the gateway reports them, so that unchanged states are not pushed again
+// and the read endpoints have values right after a restart. States that
+// are already known, from state.json or an upgrade, are kept.
+func (p *Proxy) warmUp(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, warmUpTimeout)
+	defer cancel()
+	states, err := p.fetchHAStates(ctx)
+	if err != nil {
+		log.Printf("Failed to fetch states from Home Assistant, starting without them: %v", err)
+		return
+	}
+
+	seeded := 0
+	p.stateMu.Lock()
+	for key, dev := range p.inventory {
+		if dev.EntityID == "" {
+			continue
+		}
+		state, ok := states[p.haEntityID(dev)]
+		if !ok || state == "unavailable" || state == "unknown" {
+			continue
+		}
+		if p.entity[dev.EntityID] == "" {
+			p.entity[dev.EntityID] = state
+			seeded++
+		}
+		if p.devices[key] == "" {
+			if arg, ok := p.gatewayArg(dev, state); ok {
+				p.devices[key] = arg
+			}
+		}
+	}
+	p.stateMu.Unlock()
+	log.Printf("Seeded %d entity states from Home Assistant", seeded)
+}
+
+// gatewayArg is the inverse of haState: the gateway argument of dev that
+// maps to the Home Assistant state.
+func (p *Proxy) gatewayArg(dev *device, state string) (string, bool) {
+	var candidates []string
+	for _, mapping := range []map[string]string{dev.Config.StateMap, p.config.HomeAssistant.StateMap[p.haDomain(dev.Kind)]} {
+		keys := make([]string, 0, len(mapping))
+		for arg := range mapping {
+			keys = append(keys, arg)
+		}
+		sort.Strings(keys)
+		candidates = append(candidates, keys...)
+	}
+	if dev.Kind == kindCurtain {
+		candidates = append(candidates, "OPEN", "CLOSE")
+	} else {
+		candidates = append(candidates, "ON", "OFF")
+	}
+	for _, arg := range candidates {
+		if s, ok := p.haState(dev, arg); ok && s == state {
+			return arg, true
+		}
+	}
+	return "", false
+}
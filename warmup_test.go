@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWarmUp(t *testing.T) {
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/api/states" || r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]haEntityState{
+			{EntityID: "switch.light_one", State: "on"},
+			{EntityID: "switch.light_three", State: "unavailable"},
+			{EntityID: "cover.curtain_two", State: "closed"},
+			{EntityID: "switch.light_five", State: "off"},
+			{EntityID: "sun.sun", State: "above_horizon"},
+		})
+	}))
+	defer ha.Close()
+
+	var config Config
+	config.Gateway.ZKID = "266590"
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(ha.URL, "http://"))
+	config.HomeAssistant.Host = host
+	config.HomeAssistant.Port, _ = strconv.Atoi(port)
+	config.HomeAssistant.Token = "test-token"
+	config.HomeAssistant.CurtainDomain = "cover"
+	config.Devices.Lights = map[string]DeviceConfig{
+		"1": {Entity: "light_one"},
+		"3": {Entity: "light_three"},
+		"5": {Entity: "light_five"},
+	}
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "curtain_two"}}
+	proxy := NewProxy(&config)
+	// Node 5 is known from state.json.
+	proxy.devices["5"] = "ON"
+
+	proxy.warmUp(context.Background())
+	for entity, want := range map[string]string{"light_one": "on", "light_three": "", "curtain_two": "closed", "light_five": "off"} {
+		if got := proxy.entityState(entity); got != want {
+			t.Errorf("entity %s = %q, want %q", entity, got, want)
+		}
+	}
+	for key, want := range map[string]string{"1": "ON", "3": "", "2": "CLOSE", "5": "ON"} {
+		if got := proxy.deviceState(key); got != want {
+			t.Errorf("device %s = %q, want %q", key, got, want)
+		}
+	}
+
+	// The seeded state is not pushed again.
+	dev, _ := proxy.lookupDevice("1")
+	if proxy.setEntityState(dev.EntityID, "on") {
+		t.Error("unchanged state after warm-up counted as a change")
+	}
+
+	config.HomeAssistant.Token = "wrong"
+	cold := NewProxy(&config)
+	cold.warmUp(context.Background())
+	if got := cold.entityState("light_one"); got != "" {
+		t.Errorf("after a failed warm-up light_one = %q", got)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stuckEvent is the Home Assistant event type fired for a stuck
+// transition.
+const stuckEvent = "konke_stuck_transition"
+
+// stuckGrace is how much longer than expected the watchdog waits for a
+// curtain to report its final state.
+var stuckGrace = 30 * time.Second
+
+// transitionWatch holds the watchdogs of curtains reported as opening or
+// closing, by node key.
+type transitionWatch struct {
+	mutex   sync.Mutex
+	pending map[string]*watchedTransition
+	stuck   atomic.Int64
+}
+
+type watchedTransition struct {
+	timer *time.Timer
+}
+
+// watchTransition starts the watchdog for a curtain sent arg: unless the
+// gateway reports the curtain within its travel time (or, without one, its
+// command timeout) plus stuckGrace, the transition counts as stuck.
+func (p *Proxy) watchTransition(dev *device, arg string) {
+	deadline := p.travelTime(dev, arg)
+	if deadline <= 0 {
+		deadline = dev.Config.timeout(p.config) * time.Duration(dev.Config.Retries+1)
+	}
+	deadline += stuckGrace
+
+	key := dev.Ref.key()
+	w := &watchedTransition{}
+	watched := *dev
+	p.watch.mutex.Lock()
+	defer p.watch.mutex.Unlock()
+	if p.watch.pending == nil {
+		p.watch.pending = make(map[string]*watchedTransition)
+	}
+	if old := p.watch.pending[key]; old != nil {
+		old.timer.Stop()
+	}
+	p.watch.pending[key] = w
+	w.timer = time.AfterFunc(deadline, func() {
+		p.watch.mutex.Lock()
+		current := p.watch.pending[key] == w
+		if current {
+			delete(p.watch.pending, key)
+		}
+		p.watch.mutex.Unlock()
+		if current {
+			p.transitionStuck(&watched, arg)
+		}
+	})
+}
+
+// settleTransition stops the watchdog for key once the gateway reports the
+// curtain. Any state will do: a curtain stopped part way, or sent back by
+// hand, is not stuck.
+func (p *Proxy) settleTransition(key string) {
+	p.watch.mutex.Lock()
+	defer p.watch.mutex.Unlock()
+	if w := p.watch.pending[key]; w != nil {
+		w.timer.Stop()
+		delete(p.watch.pending, key)
+	}
+}
+
+// stopWatch cancels the watchdog for key, if any.
+func (p *Proxy) stopWatch(key string) {
+	p.watch.mutex.Lock()
+	defer p.watch.mutex.Unlock()
+	if w := p.watch.pending[key]; w != nil {
+		w.timer.Stop()
+		delete(p.watch.pending, key)
+	}
+}
+
+// stopWatches cancels all watchdogs when the proxy stops.
+func (p *Proxy) stopWatches() {
+	p.watch.mutex.Lock()
+	defer p.watch.mutex.Unlock()
+	for key, w := range p.watch.pending {
+		w.timer.Stop()
+		delete(p.watch.pending, key)
+	}
+}
+
+// transitionStuck handles a device that never reached the state it was
+// sent: it is logged, reported to Home Assistant as a konke_stuck_transition
+// event and its entity is set to unknown until the gateway reports again.
+func (p *Proxy) transitionStuck(dev *device, arg string) {
+	p.stopWatch(dev.Ref.key())
+	p.watch.stuck.Add(1)
+	log.Printf("Warning: node %s never reached %s, reporting it as unknown", dev.Ref.key(), arg)
+	name := dev.displayName()
+	if name == "" {
+		name = "node " + dev.Ref.key()
+	}
+	p.alert(alertStuckTransition, "Konke: "+name+" is stuck",
+		"Node %s never reached %s after the command and is reported as unknown.", dev.Ref.key(), arg)
+	if dev.EntityID == "" {
+		return
+	}
+
+	event := map[string]interface{}{
+		"entity_id": p.haEntityID(dev),
+		"zkid":      zkidOrPrimary(p, dev.Ref.ZKID),
+		"node_id":   dev.Ref.NodeID,
+		"command":   arg,
+		"time":      p.localNow().Format(time.RFC3339),
+	}
+	if err := p.postHomeAssistant("/api/events/"+stuckEvent, event); err != nil {
+		log.Printf("Failed to fire %s for %s: %v", stuckEvent, dev.EntityID, err)
+	}
+	p.origins.set(dev.Ref.key(), stateOrigin{Source: originWatchdog})
+	p.pushState(dev, "unknown")
+}
+
+// writeMetrics writes the proxy's own metrics in the Prometheus text
+// format.
+func (p *Proxy) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP konke_stuck_transitions_total Commands whose device never reached the requested state.")
+	fmt.Fprintln(w, "# TYPE konke_stuck_transitions_total counter")
+	fmt.Fprintf(w, "konke_stuck_transitions_total %d\n", p.watch.stuck.Load())
+	writePanicMetrics(w)
+	p.delivery.writeMetrics(w, p.config.HomeAssistant.ErrorBudget)
+	p.broker.writeMetrics(w)
+	p.loops.writeMetrics(w)
+	p.rates.writeMetrics(w)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout bounds each write to a /ws client.
+const wsWriteTimeout = 10 * time.Second
+
+// wsReadLimit bounds the size of a frame from a /ws client; larger frames
+// close the connection.
+const wsReadLimit = 4096
+
+// wsMaxCommands bounds the commands of one /ws connection that run at the
+// same time; further commands are answered with 429 until one finishes.
+var wsMaxCommands = 16
+
+// wsUpgrader accepts /ws connections. Browsers are only let in from pages
+// served by the proxy itself.
+var wsUpgrader = websocket.Upgrader{}
+
+// wsRequest is a frame sent by a /ws client. ID is echoed in the response.
+type wsRequest struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"` // "command"
+	ZKID   string `json:"zkid"`
+	NodeID string `json:"node_id"`
+	Arg    string `json:"arg"`
+	Force  bool   `json:"force"` // send to a node the proxy does not know
+}
+
+// wsFrame is a frame sent to a /ws client: a state change, or the response
+// to a request.
+type wsFrame struct {
+	Type   string      `json:"type"` // "state", "reset" or "response"
+	ID     string      `json:"id,omitempty"`
+	Event  *stateEvent `json:"event,omitempty"`
+	Status int         `json:"status,omitempty"`
+	Result gin.H       `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	// Cursor is where the changes continue after a reset frame.
+	Cursor *int64 `json:"cursor,omitempty"`
+}
+
+// wsConn serializes the writes to a /ws client.
+type wsConn struct {
+	mutex sync.Mutex
+	conn  *websocket.Conn
+}
+
+func (w *wsConn) send(frame wsFrame) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return w.conn.WriteJSON(frame)
+}
+
+// wsHandler serves /ws: it streams state changes like /events and runs the
+// command frames it receives, answering each with a response frame that
+// carries the request's ID. Commands run concurrently, so responses may
+// come in a different order than the requests.
+func wsHandler(proxy *Proxy, auth *authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cursor := proxy.events.cursor()
+		reset := false
+		if s := c.Query("since"); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Invalid since"})
+				return
+			}
+			cursor, reset = proxy.events.resume(n)
+		}
+		// Browsers cannot set headers on WebSocket connections, so the
+		// token may also come as ?access_token=.
+		secret := c.Query("access_token")
+		if s, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			secret = s
+		}
+		noEchoes := skipEchoes(c)
+		source := commandSource{Addr: c.ClientIP(), Via: "websocket"}
+		view, status, message := auth.viewFilter(proxy, secret)
+		if status != 0 {
+			c.JSON(status, gin.H{"error": message})
+			return
+		}
+		gate := proxy.wsGate.context()
+		if gate == nil {
+			c.JSON(503, gin.H{"error": "WebSocket stream is disabled"})
+			return
+		}
+
+		conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return // the upgrader has answered
+		}
+		defer conn.Close()
+		ws := &wsConn{conn: conn}
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		stop := context.AfterFunc(gate, cancel)
+		defer stop()
+
+		conn.SetReadLimit(wsReadLimit)
+		running := make(chan struct{}, wsMaxCommands)
+		go func() {
+			defer cancel()
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				var req wsRequest
+				if err := json.Unmarshal(data, &req); err != nil {
+					ws.send(wsFrame{Type: "response", Status: 400, Error: "Invalid request"})
+					continue
+				}
+				select {
+				case running <- struct{}{}:
+				default:
+					ws.send(wsFrame{Type: "response", ID: req.ID, Status: 429, Error: "Too many commands in flight"})
+					continue
+				}
+				go proxy.protect("websocket command", func() error {
+					defer func() { <-running }()
+					return ws.send(proxy.wsCommand(ctx, auth, secret, source, req))
+				})
+			}
+		}()
+
+		if reset {
+			if err := ws.send(wsFrame{Type: "reset", Cursor: &cursor}); err != nil {
+				return
+			}
+		}
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+		for {
+			events, _, changed := proxy.events.since(cursor)
+			for i := range events {
+				cursor = events[i].Seq
+				if !view.allows(events[i].ZKID, events[i].NodeID) || (noEchoes && events[i].Echo) {
+					continue
+				}
+				if err := ws.send(wsFrame{Type: "state", Event: &events[i]}); err != nil {
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			case <-keepalive.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// wsCommand runs a request received on /ws, checking it like the device
+// endpoints would, and returns the response frame.
+func (p *Proxy) wsCommand(ctx context.Context, auth *authenticator, secret string, source commandSource, req wsRequest) wsFrame {
+	resp := wsFrame{Type: "response", ID: req.ID}
+	fail := func(status int, message string) wsFrame {
+		resp.Status = status
+		resp.Error = message
+		return resp
+	}
+	if req.Type != "command" {
+		return fail(400, "Unknown request type")
+	}
+	ref, ok := p.resolveNode(req.ZKID, req.NodeID)
+	if !ok {
+		return fail(404, "Unknown zkid")
+	}
+	if auth.protect {
+		if secret == "" {
+			return fail(401, "Missing bearer token")
+		}
+		identity, status, message := auth.deviceAccess(secret, func(has func(key string) bool) bool {
+			return has(ref.key())
+		})
+		if status != 0 {
+			return fail(status, message)
+		}
+		source.Identity = identity
+	}
+	if err := p.checkNode(ref, req.Force); err != nil {
+		return fail(gatewayStatus(err), err.Error())
+	}
+
+	p.scheduled.cancel(ref.key())
+	if err := p.sendSwitch(withSource(ctx, source), ref, req.Arg); err != nil {
+		return fail(gatewayStatus(err), err.Error())
+	}
+	resp.Status = 200
+	if dev, _ := p.lookupDevice(ref.key()); dev.Kind == kindCurtain {
+		resp.Result = gin.H{"is_open": req.Arg == "OPEN"}
+	} else {
+		resp.Result = gin.H{"is_active": req.Arg == "ON"}
+	}
+	return resp
+}
+
+// subsystemWebSocket is the subsystem of the /ws stream. Disabling it
+// closes the open connections and refuses new ones.
+const subsystemWebSocket = "websocket stream"
+
+// wsGate hands the context of the websocket subsystem to the /ws
+// connections, which close when it ends.
+type wsGate struct {
+	mutex sync.Mutex
+	ctx   context.Context // nil while the subsystem is not running
+}
+
+// serve opens the gate until ctx is cancelled.
+func (g *wsGate) serve(ctx context.Context) {
+	g.mutex.Lock()
+	g.ctx = ctx
+	g.mutex.Unlock()
+	<-ctx.Done()
+	g.mutex.Lock()
+	g.ctx = nil
+	g.mutex.Unlock()
+}
+
+// context returns the context of the running subsystem, or nil.
+func (g *wsGate) context() context.Context {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.ctx
+}
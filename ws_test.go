@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"konke-ha-proxy/internal/fakegw"
+)
+
+func TestWebSocketCommands(t *testing.T) {
+	gw := startFakeGateway(t, 2, nil)
+	config := testConfig(t, gw, 2)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}}
+	config.Devices.Curtains = map[string]DeviceConfig{"2": {Entity: "curtain_two"}}
+	proxy := startProxy(t, config)
+	server := httptest.NewServer(newRouter(proxy))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial /ws: %v", err)
+	}
+	defer conn.Close()
+
+	send := func(req wsRequest) {
+		if err := conn.WriteJSON(req); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	responses := make(map[string]wsFrame)
+	var states []string
+	read := func(done func() bool) {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for !done() {
+			var frame wsFrame
+			if err := conn.ReadJSON(&frame); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			switch frame.Type {
+			case "response":
+				responses[frame.ID] = frame
+			case "state":
+				states = append(states, frame.Event.EntityID+"="+frame.Event.State)
+			}
+		}
+	}
+
+	send(wsRequest{ID: "a", Type: "command", NodeID: "1", Arg: "ON"})
+	send(wsRequest{ID: "b", Type: "command", NodeID: "2", Arg: "OPEN"})
+	send(wsRequest{ID: "c", Type: "reboot"})
+	send(wsRequest{ID: "d", Type: "command", ZKID: "999", NodeID: "1", Arg: "ON"})
+	read(func() bool { return len(responses) == 4 && contains(states, "light_one=on") })
+
+	if r := responses["a"]; r.Status != 200 || r.Result["is_active"] != true {
+		t.Errorf("response a = %+v", r)
+	}
+	if r := responses["b"]; r.Status != 200 || r.Result["is_open"] != true {
+		t.Errorf("response b = %+v", r)
+	}
+	if r := responses["c"]; r.Status != 400 {
+		t.Errorf("unknown request type: status %d, want 400", r.Status)
+	}
+	if r := responses["d"]; r.Status != 404 {
+		t.Errorf("unknown zkid: status %d, want 404", r.Status)
+	}
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	// The fake gateway holds its replies until released, and light 1
+	// waits for its confirmation.
+	received, release := make(chan struct{}, 1), make(chan struct{})
+	gw := startFakeGateway(t, 2, func(msg *fakegw.Message) {
+		if msg.Opcode == "SWITCH" {
+			received <- struct{}{}
+			<-release
+		}
+	})
+	defer func(n int) { wsMaxCommands = n }(wsMaxCommands)
+	wsMaxCommands = 1
+	config := testConfig(t, gw, 2)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one", Timeout: 5}, "2": {Entity: "light_two"}}
+	proxy := startProxy(t, config)
+	server := httptest.NewServer(newRouter(proxy))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial /ws: %v", err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(wsRequest{ID: "a", Type: "command", NodeID: "1", Arg: "ON"})
+	<-received
+	conn.WriteJSON(wsRequest{ID: "b", Type: "command", NodeID: "2", Arg: "ON"})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var frame wsFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if frame.Type != "response" {
+			continue
+		}
+		if frame.ID != "b" || frame.Status != 429 {
+			t.Errorf("response = %+v, want 429 for b while a is in flight", frame)
+		}
+		break
+	}
+	close(release)
+
+	// An oversized frame closes the connection.
+	big, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial /ws: %v", err)
+	}
+	defer big.Close()
+	big.WriteJSON(wsRequest{ID: strings.Repeat("x", 2*wsReadLimit), Type: "command"})
+	big.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var frame wsFrame
+		err := big.ReadJSON(&frame)
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Errorf("read after an oversized frame: %v, want close 1009", err)
+		}
+		break
+	}
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	gw := startFakeGateway(t, 1, nil)
+	config := testConfig(t, gw, 1)
+	config.Devices.Lights = map[string]DeviceConfig{"1": {Entity: "light_one"}}
+	config.Auth.ProtectDevices = true
+	config.Auth.Tokens = []authToken{{Name: "phone", Token: "phone-token", Scopes: []string{scopeDevices}}}
+	proxy := startProxy(t, config)
+	server := httptest.NewServer(newRouter(proxy))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{{"", 401}, {"?access_token=wrong", 401}, {"?access_token=phone-token", 200}} {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws"+tc.query, nil)
+		if err != nil {
+			t.Fatalf("dial /ws%s: %v", tc.query, err)
+		}
+		conn.WriteJSON(wsRequest{ID: "1", Type: "command", NodeID: "1", Arg: "OFF"})
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var frame wsFrame
+		for frame.Type != "response" {
+			if err := conn.ReadJSON(&frame); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+		}
+		if frame.Status != tc.status {
+			t.Errorf("command with %q: status %d, want %d", tc.query, frame.Status, tc.status)
+		}
+		conn.Close()
+	}
+}
+
+func TestAccessLogHidesToken(t *testing.T) {
+	line := accessLogLine(gin.LogFormatterParams{Method: "GET", Path: "/ws?since=3&access_token=phone-token", StatusCode: 101})
+	if strings.Contains(line, "phone-token") || !strings.Contains(line, "since=3") {
+		t.Errorf("access log line = %q", line)
+	}
+	if line := accessLogLine(gin.LogFormatterParams{Method: "GET", Path: "/events?since=3"}); !strings.Contains(line, `"/events?since=3"`) {
+		t.Errorf("access log line = %q", line)
+	}
+	// The signed action URL is the credential itself.
+	if line := accessLogLine(gin.LogFormatterParams{Method: "GET", Path: "/action/c2lnbmVk.abc123"}); strings.Contains(line, "abc123") || !strings.Contains(line, `"/action/***"`) {
+		t.Errorf("access log line = %q", line)
+	}
+}